@@ -0,0 +1,442 @@
+package main
+
+import (
+	"authentication/data"
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// NOTE: Admin API
+/*
+	Every `/users` route but `/users/register` is for admins, who send their
+	session token:
+
+	curl -H "Authorization: Bearer $SESSION" "localhost:8081/users?page=1&per_page=20&sort=-created_at&active=1&q=example.com"
+
+	Each route needs a permission of the session's user: `users.read` to
+	look, `users.write` to change users, their sessions, API keys and OAuth2
+	clients, and `roles.assign` to give and take roles. Nobody can issue a
+	key or client with a scope they don't have themselves, and only those
+	with `roles.assign` can set the password or email of a user with a
+	permission they don't have, since that lets them log in as that user,
+	or disable, unlock or delete such a user.
+
+	ADMIN_API_TOKEN, if set, passes as a bearer token with every permission,
+	to give the first admin their role. No account, not even the seeded
+	admin@example.com, is an admin until then. The seeded account can't log
+	in either until it gets a password:
+
+	curl -X PUT -H "Authorization: Bearer $ADMIN_API_TOKEN" localhost:8081/users/$ID/password -d '{"password": "..."}'
+*/
+
+const maxPerPage = 100
+
+var (
+	errForbidden = withCode("forbidden", errors.New("you don't have the permission for this"))
+	errOutranked = withCode("forbidden", errors.New("you can't change a user with permissions you don't have"))
+)
+
+type callerKey struct{}
+
+// caller is who makes an admin request: the user of a session, or whoever
+// has the admin token.
+type caller struct {
+	UserID      int
+	Permissions []string
+	AdminToken  bool // * may do anything
+}
+
+func (c *caller) can(permission string) bool {
+	return c.AdminToken || slices.Contains(c.Permissions, permission)
+}
+
+// callerFrom returns the caller requirePermission let through.
+func callerFrom(r *http.Request) *caller {
+	if c, ok := r.Context().Value(callerKey{}).(*caller); ok {
+		return c
+	}
+
+	return &caller{}
+}
+
+// requirePermission lets through requests with the admin token, or the
+// session token of an active user with the permission.
+func (app *Config) requirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if app.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(app.AdminToken)) == 1 {
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), callerKey{}, &caller{AdminToken: true})))
+				return
+			}
+
+			session, ok := app.currentSession(w, r)
+			if !ok {
+				return
+			}
+
+			user, active, err := app.activeUser(r, session.UserID)
+			if err != nil {
+				app.errorJson(w, err)
+				return
+			}
+			if !active {
+				app.errorJson(w, errNoSession, http.StatusUnauthorized)
+				return
+			}
+
+			access, err := app.Models.Role.ForUser(r.Context(), user.ID)
+			if err != nil {
+				app.errorJson(w, err)
+				return
+			}
+
+			c := &caller{UserID: user.ID, Permissions: access.Permissions}
+			if !c.can(permission) {
+				app.errorJson(w, errForbidden, http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), callerKey{}, c)))
+		})
+	}
+}
+
+// checkGrantable refuses scopes the caller doesn't have, so a key or client
+// can't do more than whoever issued it.
+func checkGrantable(r *http.Request, scopes []string) error {
+	c := callerFrom(r)
+	for _, scope := range scopes {
+		if !c.can(scope) {
+			return withCode("forbidden", fmt.Errorf("you can't grant %q, you don't have it", scope))
+		}
+	}
+
+	return nil
+}
+
+// outranks reports whether the caller may change the credentials or the
+// status of the user: only if the user has no permission the caller doesn't,
+// or the caller could give it to themselves anyway. It answers the request
+// itself when not.
+func (app *Config) outranks(w http.ResponseWriter, r *http.Request, userID int) bool {
+	c := callerFrom(r)
+	if c.can("roles.assign") {
+		return true
+	}
+
+	access, err := app.Models.Role.ForUser(r.Context(), userID)
+	if err != nil {
+		app.errorJson(w, err)
+		return false
+	}
+
+	for _, permission := range access.Permissions {
+		if !c.can(permission) {
+			app.errorJson(w, errOutranked, http.StatusForbidden)
+			return false
+		}
+	}
+
+	return true
+}
+
+type userPage struct {
+	Users   []*data.User `json:"users"`
+	Page    int          `json:"page"`
+	PerPage int          `json:"per_page"`
+	Total   int          `json:"total"`
+}
+
+// ListUsers takes `page`, `per_page`, `sort` (a column, `-` prefixed for
+// descending order), `active` and `q` as query parameters.
+func (app *Config) ListUsers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	filter := data.UserFilter{
+		Page:    1,
+		PerPage: 20,
+		Search:  strings.TrimSpace(query.Get("q")),
+	}
+
+	if p := query.Get("page"); p != "" {
+		page, err := strconv.Atoi(p)
+		if err != nil || page < 1 {
+			app.errorJson(w, errors.New("page must be a positive number"), http.StatusBadRequest)
+			return
+		}
+		filter.Page = page
+	}
+
+	if p := query.Get("per_page"); p != "" {
+		perPage, err := strconv.Atoi(p)
+		if err != nil || perPage < 1 || perPage > maxPerPage {
+			app.errorJson(w, fmt.Errorf("per_page must be between 1 and %d", maxPerPage), http.StatusBadRequest)
+			return
+		}
+		filter.PerPage = perPage
+	}
+
+	if sort := query.Get("sort"); sort != "" {
+		filter.Sort, filter.Desc = strings.TrimPrefix(sort, "-"), strings.HasPrefix(sort, "-")
+		if !data.SortableColumn(filter.Sort) {
+			app.errorJson(w, fmt.Errorf("can't sort by %q", filter.Sort), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if a := query.Get("active"); a != "" {
+		active, err := strconv.Atoi(a)
+		if err != nil || (active != 0 && active != 1) {
+			app.errorJson(w, errors.New("active must be 0 or 1"), http.StatusBadRequest)
+			return
+		}
+		filter.Active = &active
+	}
+
+	users, total, err := app.Models.User.List(r.Context(), filter)
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("%d user(s)", len(users)),
+		Data: userPage{
+			Users:   users,
+			Page:    filter.Page,
+			PerPage: filter.PerPage,
+			Total:   total,
+		},
+	}
+
+	app.writeJson(w, http.StatusOK, payload)
+}
+
+func (app *Config) GetUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.userFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("User %d", user.ID),
+		Data:    user,
+	}
+
+	app.writeJson(w, http.StatusOK, payload)
+}
+
+// UpdateUserPayload only changes the fields that are present.
+type UpdateUserPayload struct {
+	Email     *string `json:"email"`
+	FirstName *string `json:"first_name"`
+	LastName  *string `json:"last_name"`
+	Active    *int    `json:"active"`
+}
+
+func (app *Config) UpdateUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.userFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	var requestPayload UpdateUserPayload
+	err := app.readJson(w, r, &requestPayload)
+	if err != nil {
+		app.errorJson(w, err, http.StatusBadRequest)
+		return
+	}
+
+	emailChanged := false
+	if requestPayload.Email != nil {
+		email := strings.TrimSpace(*requestPayload.Email)
+		if !validEmail(email) {
+			app.errorJson(w, errors.New("invalid email address"), http.StatusBadRequest)
+			return
+		}
+		// * emails are looked up without case, a new case is the same address
+		emailChanged = !strings.EqualFold(email, user.Email)
+		user.Email = email
+	}
+
+	if requestPayload.FirstName != nil {
+		user.FirstName = strings.TrimSpace(*requestPayload.FirstName)
+	}
+
+	if requestPayload.LastName != nil {
+		user.LastName = strings.TrimSpace(*requestPayload.LastName)
+	}
+
+	activeChanged := false
+	if requestPayload.Active != nil {
+		if *requestPayload.Active != 0 && *requestPayload.Active != 1 {
+			app.errorJson(w, errors.New("active must be 0 or 1"), http.StatusBadRequest)
+			return
+		}
+		activeChanged = *requestPayload.Active != user.Active
+		user.Active = *requestPayload.Active
+	}
+
+	if (emailChanged || activeChanged) && !app.outranks(w, r, user.ID) {
+		return
+	}
+
+	err = app.Models.User.Update(r.Context(), *user)
+	switch {
+	case errors.Is(err, data.ErrDuplicateEmail):
+		app.errorJson(w, err, http.StatusConflict)
+		return
+	case errors.Is(err, sql.ErrNoRows):
+		app.errorJson(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	case err != nil:
+		app.errorJson(w, err)
+		return
+	}
+
+	// * the new address is unverified, so the user can't log in until they follow the link
+	if emailChanged {
+		user.VerifiedAt = nil
+		go app.sendVerificationLink(*user)
+	}
+
+	app.GetUser(w, r)
+}
+
+func (app *Config) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := app.userID(w, r)
+	if !ok || !app.outranks(w, r, id) {
+		return
+	}
+
+	err := app.Models.User.DeleteByID(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJson(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Deleted user %d", id),
+	}
+
+	app.writeJson(w, http.StatusOK, payload)
+}
+
+type SetPasswordPayload struct {
+	Password string `json:"password"`
+}
+
+func (app *Config) SetPassword(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.userFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	var requestPayload SetPasswordPayload
+	err := app.readJson(w, r, &requestPayload)
+	if err != nil {
+		app.errorJson(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if err := app.PasswordPolicy.Validate(requestPayload.Password); err != nil {
+		app.errorJson(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if !app.outranks(w, r, user.ID) {
+		return
+	}
+
+	err = app.Models.User.ResetPassword(r.Context(), user.ID, requestPayload.Password)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJson(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	app.revokeSessions(r, user.ID)
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Changed the password of user %d", user.ID),
+	}
+
+	app.writeJson(w, http.StatusOK, payload)
+}
+
+// UnlockUser lifts a lockout after too many failed logins.
+func (app *Config) UnlockUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := app.userID(w, r)
+	if !ok || !app.outranks(w, r, id) {
+		return
+	}
+
+	err := app.Models.User.Unlock(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJson(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Unlocked user %d", id),
+	}
+
+	app.writeJson(w, http.StatusOK, payload)
+}
+
+func (app *Config) userID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil || id < 1 {
+		app.errorJson(w, errors.New("invalid user id"), http.StatusBadRequest)
+		return 0, false
+	}
+
+	return id, true
+}
+
+// userFromURL loads the user named by the `{id}` URL parameter, answering
+// the request itself when it can't.
+func (app *Config) userFromURL(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	id, ok := app.userID(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	user, err := app.Models.User.GetOne(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJson(w, errors.New("user not found"), http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		app.errorJson(w, err)
+		return nil, false
+	}
+
+	return user, true
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"authentication/data"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const testAdminToken = "test-admin-token"
+
+// testResponse is a jsonResponse with the data left to the test to decode.
+type testResponse struct {
+	Error   bool            `json:"error"`
+	Message string          `json:"message"`
+	Code    string          `json:"code"`
+	Data    json.RawMessage `json:"data"`
+}
+
+func newTestApp(t *testing.T) *Config {
+	t.Helper()
+
+	return &Config{
+		Models:          data.NewMemory(),
+		PasswordPolicy:  PasswordPolicy{MinLength: defaultPasswordMinLength},
+		AdminToken:      testAdminToken,
+		ResetByIP:       newRateLimiter(resetsPerIP, time.Hour),
+		ResetByEmail:    newRateLimiter(resetsPerEmail, time.Hour),
+		ResendByIP:      newRateLimiter(resendsPerIP, time.Hour),
+		ResendByEmail:   newRateLimiter(resendsPerEmail, time.Hour),
+		TokenSecret:     []byte("test secret, long enough to sign tokens"),
+		VerificationURL: "http://localhost/verify",
+
+		Lockout:              LockoutPolicy{Threshold: 2, Duration: time.Minute, IPThreshold: 100, IPWindow: time.Minute},
+		LoginFailuresByIP:    newRateLimiter(100, time.Minute),
+		UnknownEmailFailures: newFailureCounter(),
+
+		TOTPKey:    []byte("test key for TOTP secrets, 32 b!"),
+		TOTPIssuer: "test",
+	}
+}
+
+// addUser inserts a verified user with the roles, on top of the default one.
+func addUser(t *testing.T, app *Config, user data.User, roles ...string) *data.User {
+	t.Helper()
+
+	ctx := context.Background()
+
+	if user.Password == "" {
+		user.Password = "correct horse battery"
+	}
+
+	id, err := app.Models.User.Insert(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.Models.User.Verify(ctx, id, user.Email); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, role := range roles {
+		if err := app.Models.Role.Assign(ctx, id, role); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stored, err := app.Models.User.GetOne(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return stored
+}
+
+// login starts a session for the user and returns its token.
+func login(t *testing.T, app *Config, user *data.User) string {
+	t.Helper()
+
+	session, err := app.startSession(httptest.NewRequest(http.MethodPost, "/authenticate", nil), user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return session.Token
+}
+
+// call sends a request through the routes with the token as bearer token,
+// if there is one, and decodes the answer.
+func call(t *testing.T, app *Config, method, path, token string, body any) (int, testResponse) {
+	t.Helper()
+
+	var content bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&content).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := httptest.NewRequest(method, path, &content)
+	r.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	w := httptest.NewRecorder()
+	app.routes().ServeHTTP(w, r)
+
+	var response testResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("%s %s answered %d with %q: %v", method, path, w.Code, w.Body.String(), err)
+	}
+
+	return w.Code, response
+}
+
+func decode[T any](t *testing.T, response testResponse) T {
+	t.Helper()
+
+	var v T
+	if err := json.Unmarshal(response.Data, &v); err != nil {
+		t.Fatalf("decoding %s: %v", response.Data, err)
+	}
+
+	return v
+}
+
+func TestAdminRoutesNeedAPermission(t *testing.T) {
+	app := newTestApp(t)
+
+	admin := addUser(t, app, data.User{Email: "admin@example.com", Active: 1}, "admin")
+	user := addUser(t, app, data.User{Email: "user@example.com", Active: 1})
+	adminToken, userToken := login(t, app, admin), login(t, app, user)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		status int
+	}{
+		{"no token", http.MethodGet, "/users", "", http.StatusUnauthorized},
+		{"unknown token", http.MethodGet, "/users", "not-a-session", http.StatusUnauthorized},
+		{"user without users.read", http.MethodGet, "/users", userToken, http.StatusForbidden},
+		{"user without users.write", http.MethodDelete, "/users/1", userToken, http.StatusForbidden},
+		{"user without roles.assign", http.MethodPut, "/users/2/roles/admin", userToken, http.StatusForbidden},
+		{"admin session", http.MethodGet, "/users", adminToken, http.StatusOK},
+		{"admin token", http.MethodGet, "/users", testAdminToken, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, _ := call(t, app, tt.method, tt.path, tt.token, nil)
+			if status != tt.status {
+				t.Errorf("%s %s answered %d, want %d", tt.method, tt.path, status, tt.status)
+			}
+		})
+	}
+
+	t.Run("deactivated admin", func(t *testing.T) {
+		active := 0
+		if status, _ := call(t, app, http.MethodPatch, "/users/1", testAdminToken, UpdateUserPayload{Active: &active}); status != http.StatusOK {
+			t.Fatalf("deactivating answered %d", status)
+		}
+
+		if status, _ := call(t, app, http.MethodGet, "/users", adminToken, nil); status != http.StatusUnauthorized {
+			t.Errorf("session of a deactivated admin answered %d, want %d", status, http.StatusUnauthorized)
+		}
+	})
+}
+
+func TestListUsers(t *testing.T) {
+	app := newTestApp(t)
+
+	addUser(t, app, data.User{Email: "ann@example.com", FirstName: "Ann", LastName: "Smith", Active: 1})
+	addUser(t, app, data.User{Email: "bob@example.org", FirstName: "Bob", LastName: "Jones", Active: 0})
+	addUser(t, app, data.User{Email: "carol@example.com", FirstName: "Carol", LastName: "Brown", Active: 1})
+	addUser(t, app, data.User{Email: "dave@example.com", FirstName: "Dave", LastName: "Adams", Active: 1})
+
+	tests := []struct {
+		query  string
+		emails []string
+		total  int
+	}{
+		{"", []string{"ann@example.com", "bob@example.org", "carol@example.com", "dave@example.com"}, 4},
+		{"?page=2&per_page=3", []string{"dave@example.com"}, 4},
+		{"?page=3&per_page=3", []string{}, 4},
+		{"?sort=-email", []string{"dave@example.com", "carol@example.com", "bob@example.org", "ann@example.com"}, 4},
+		{"?sort=last_name&per_page=2", []string{"dave@example.com", "carol@example.com"}, 4},
+		{"?active=0", []string{"bob@example.org"}, 1},
+		{"?active=1&sort=-id", []string{"dave@example.com", "carol@example.com", "ann@example.com"}, 3},
+		{"?q=EXAMPLE.COM&per_page=2", []string{"ann@example.com", "carol@example.com"}, 3},
+		{"?q=jones", []string{"bob@example.org"}, 1},
+		{"?q=nobody", []string{}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			status, response := call(t, app, http.MethodGet, "/users"+tt.query, testAdminToken, nil)
+			if status != http.StatusOK {
+				t.Fatalf("answered %d: %s", status, response.Message)
+			}
+
+			page := decode[userPage](t, response)
+
+			emails := []string{}
+			for _, user := range page.Users {
+				emails = append(emails, user.Email)
+			}
+
+			if !slices.Equal(emails, tt.emails) || page.Total != tt.total {
+				t.Errorf("got %v of %d, want %v of %d", emails, page.Total, tt.emails, tt.total)
+			}
+		})
+	}
+
+	for _, query := range []string{"?page=0", "?per_page=101", "?sort=password", "?active=2"} {
+		t.Run(query, func(t *testing.T) {
+			if status, _ := call(t, app, http.MethodGet, "/users"+query, testAdminToken, nil); status != http.StatusBadRequest {
+				t.Errorf("answered %d, want %d", status, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestGetUser(t *testing.T) {
+	app := newTestApp(t)
+	ann := addUser(t, app, data.User{Email: "ann@example.com", FirstName: "Ann", Active: 1})
+
+	status, response := call(t, app, http.MethodGet, "/users/1", testAdminToken, nil)
+	if status != http.StatusOK {
+		t.Fatalf("answered %d: %s", status, response.Message)
+	}
+	if got := decode[data.User](t, response); got.ID != ann.ID || got.Email != ann.Email {
+		t.Errorf("got user %d %s, want %d %s", got.ID, got.Email, ann.ID, ann.Email)
+	}
+
+	if status, _ := call(t, app, http.MethodGet, "/users/99", testAdminToken, nil); status != http.StatusNotFound {
+		t.Errorf("unknown user answered %d, want %d", status, http.StatusNotFound)
+	}
+
+	if status, _ := call(t, app, http.MethodGet, "/users/ann", testAdminToken, nil); status != http.StatusBadRequest {
+		t.Errorf("invalid id answered %d, want %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	app := newTestApp(t)
+	addUser(t, app, data.User{Email: "ann@example.com", FirstName: "Ann", LastName: "Smith", Active: 1})
+	addUser(t, app, data.User{Email: "bob@example.com", Active: 1})
+
+	name := " Anne "
+	status, response := call(t, app, http.MethodPatch, "/users/1", testAdminToken, UpdateUserPayload{FirstName: &name})
+	if status != http.StatusOK {
+		t.Fatalf("answered %d: %s", status, response.Message)
+	}
+
+	got := decode[data.User](t, response)
+	if got.FirstName != "Anne" || got.LastName != "Smith" || got.Email != "ann@example.com" {
+		t.Errorf("got %q %q %s, want only the first name changed", got.FirstName, got.LastName, got.Email)
+	}
+	if !got.Verified() {
+		t.Error("changing the name unverified the email address")
+	}
+
+	recased := "Ann@Example.com"
+	status, response = call(t, app, http.MethodPatch, "/users/1", testAdminToken, UpdateUserPayload{Email: &recased})
+	if status != http.StatusOK {
+		t.Fatalf("answered %d: %s", status, response.Message)
+	}
+	if got := decode[data.User](t, response); got.Email != recased || !got.Verified() {
+		t.Errorf("got %s verified %v, want %s still verified", got.Email, got.Verified(), recased)
+	}
+
+	email := "anne@example.com"
+	status, response = call(t, app, http.MethodPatch, "/users/1", testAdminToken, UpdateUserPayload{Email: &email})
+	if status != http.StatusOK {
+		t.Fatalf("answered %d: %s", status, response.Message)
+	}
+
+	stored, err := app.Models.User.GetOne(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Email != email || stored.Verified() {
+		t.Errorf("stored %s verified %v, want %s unverified", stored.Email, stored.Verified(), email)
+	}
+	if answered := decode[data.User](t, response); answered.Verified() {
+		t.Error("the answer still has the old verification")
+	}
+
+	taken := "bob@example.com"
+	invalid := "bob"
+	active := 2
+
+	tests := []struct {
+		name    string
+		path    string
+		payload UpdateUserPayload
+		status  int
+	}{
+		{"email taken", "/users/1", UpdateUserPayload{Email: &taken}, http.StatusConflict},
+		{"invalid email", "/users/1", UpdateUserPayload{Email: &invalid}, http.StatusBadRequest},
+		{"invalid active flag", "/users/1", UpdateUserPayload{Active: &active}, http.StatusBadRequest},
+		{"unknown user", "/users/99", UpdateUserPayload{FirstName: &name}, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, _ := call(t, app, http.MethodPatch, tt.path, testAdminToken, tt.payload); status != tt.status {
+				t.Errorf("answered %d, want %d", status, tt.status)
+			}
+		})
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	app := newTestApp(t)
+	addUser(t, app, data.User{Email: "ann@example.com", Active: 1})
+
+	if status, response := call(t, app, http.MethodDelete, "/users/1", testAdminToken, nil); status != http.StatusOK {
+		t.Fatalf("answered %d: %s", status, response.Message)
+	}
+
+	if status, _ := call(t, app, http.MethodGet, "/users/1", testAdminToken, nil); status != http.StatusNotFound {
+		t.Errorf("deleted user answered %d, want %d", status, http.StatusNotFound)
+	}
+
+	if status, _ := call(t, app, http.MethodDelete, "/users/1", testAdminToken, nil); status != http.StatusNotFound {
+		t.Errorf("deleting twice answered %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestSetPassword(t *testing.T) {
+	app := newTestApp(t)
+	ann := addUser(t, app, data.User{Email: "ann@example.com", Active: 1})
+	session := login(t, app, ann)
+
+	if status, _ := call(t, app, http.MethodGet, "/sessions", session, nil); status != http.StatusOK {
+		t.Fatalf("session isn't valid to begin with, answered %d", status)
+	}
+
+	if status, _ := call(t, app, http.MethodPut, "/users/1/password", testAdminToken, SetPasswordPayload{Password: "short"}); status != http.StatusBadRequest {
+		t.Errorf("weak password answered %d, want %d", status, http.StatusBadRequest)
+	}
+
+	if status, _ := call(t, app, http.MethodPut, "/users/99/password", testAdminToken, SetPasswordPayload{Password: "a new long password"}); status != http.StatusNotFound {
+		t.Errorf("unknown user answered %d, want %d", status, http.StatusNotFound)
+	}
+
+	status, response := call(t, app, http.MethodPut, "/users/1/password", testAdminToken, SetPasswordPayload{Password: "a new long password"})
+	if status != http.StatusOK {
+		t.Fatalf("answered %d: %s", status, response.Message)
+	}
+
+	stored, err := app.Models.User.GetOne(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := stored.PasswordMatches("a new long password"); !ok {
+		t.Error("the new password doesn't match")
+	}
+
+	if status, _ := call(t, app, http.MethodGet, "/sessions", session, nil); status != http.StatusUnauthorized {
+		t.Errorf("session from before the change answered %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+// TestCredentialsOfHigherUsers has a caller with `users.write` but not
+// `roles.assign` change the credentials of users: only those without more
+// permissions than the caller.
+func TestChangesToHigherUsers(t *testing.T) {
+	app := newTestApp(t)
+	addUser(t, app, data.User{Email: "admin@example.com", Active: 1}, "admin")
+	addUser(t, app, data.User{Email: "user@example.com", Active: 1})
+
+	support := &caller{UserID: 99, Permissions: []string{"logs.write", "mail.send", "users.read", "users.write"}}
+	email := "taken-over@example.com"
+	name := "Renamed"
+	active, inactive := 1, 0
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		body    any
+		caller  *caller
+		user    string
+		status  int
+	}{
+		{"password of an admin", app.SetPassword, SetPasswordPayload{Password: "a new long password"}, support, "1", http.StatusForbidden},
+		{"email of an admin", app.UpdateUser, UpdateUserPayload{Email: &email}, support, "1", http.StatusForbidden},
+		{"password of a user", app.SetPassword, SetPasswordPayload{Password: "a new long password"}, support, "2", http.StatusOK},
+		{"email of a user", app.UpdateUser, UpdateUserPayload{Email: &email}, support, "2", http.StatusOK},
+		{"password of an admin by the admin token", app.SetPassword, SetPasswordPayload{Password: "a new long password"}, &caller{AdminToken: true}, "1", http.StatusOK},
+		{"disabling an admin", app.UpdateUser, UpdateUserPayload{Active: &inactive}, support, "1", http.StatusForbidden},
+		{"unlocking an admin", app.UnlockUser, nil, support, "1", http.StatusForbidden},
+		{"deleting an admin", app.DeleteUser, nil, support, "1", http.StatusForbidden},
+		{"name of an admin", app.UpdateUser, UpdateUserPayload{FirstName: &name}, support, "1", http.StatusOK},
+		{"active of an admin, unchanged", app.UpdateUser, UpdateUserPayload{Active: &active}, support, "1", http.StatusOK},
+		{"disabling a user", app.UpdateUser, UpdateUserPayload{Active: &inactive}, support, "2", http.StatusOK},
+		{"unlocking a user", app.UnlockUser, nil, support, "2", http.StatusOK},
+		{"deleting a user", app.DeleteUser, nil, support, "2", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var content bytes.Buffer
+			if err := json.NewEncoder(&content).Encode(tt.body); err != nil {
+				t.Fatal(err)
+			}
+
+			params := chi.NewRouteContext()
+			params.URLParams.Add("id", tt.user)
+
+			ctx := context.WithValue(context.Background(), chi.RouteCtxKey, params)
+			ctx = context.WithValue(ctx, callerKey{}, tt.caller)
+
+			w := httptest.NewRecorder()
+			tt.handler(w, httptest.NewRequest(http.MethodPut, "/users/"+tt.user, &content).WithContext(ctx))
+
+			if w.Code != tt.status {
+				t.Errorf("answered %d: %s, want %d", w.Code, w.Body.String(), tt.status)
+			}
+		})
+	}
+
+	admin, err := app.Models.User.GetOne(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if admin.Email != "admin@example.com" || admin.Active != 1 {
+		t.Errorf("admin changed to %s, active %d", admin.Email, admin.Active)
+	}
+}
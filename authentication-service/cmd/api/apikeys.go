@@ -0,0 +1,357 @@
+package main
+
+import (
+	"authentication/data"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// NOTE: API keys
+/*
+	For clients that can't log in, like batch jobs. Admins issue them, to a
+	user or to a service account, with scopes (permission names) and an
+	optional lifetime:
+
+	curl -X POST -H "Authorization: Bearer $ADMIN_API_TOKEN" localhost:8081/api-keys \
+		-d '{"name": "nightly report", "service": "reports", "scopes": ["logs.write"], "expires_in": "720h"}'
+
+	The answer has the key, the only time it's shown; only its hash is
+	stored. Keys look like `gmk_1a2b3c4d_...`, the part before the second
+	underscore being the prefix that lists show to tell keys apart.
+
+	GET /api-keys?user_id=2   lists keys, of one user or all of them
+	DELETE /api-keys/{id}     revokes a key
+
+	A user's key can't do more than the user: scopes are checked against the
+	user's permissions when the key is issued and again whenever it's used.
+	Other services check a key with
+
+	POST /api-keys/validate {"key": "..."}
+
+	which answers `{"active": false}` for a key that's no good, and who it
+	belongs to and its scopes otherwise.
+*/
+
+const apiKeyPrefix = "gmk_"
+
+var serviceName = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+
+// newAPIKey returns a random key, its prefix and the hash to store for it.
+func newAPIKey() (string, string, string, error) {
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return "", "", "", err
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", "", err
+	}
+
+	prefix := apiKeyPrefix + hex.EncodeToString(id)
+	key := prefix + "_" + base64.RawURLEncoding.EncodeToString(secret)
+
+	return key, prefix, hashToken(key), nil
+}
+
+type CreateAPIKeyPayload struct {
+	Name      string   `json:"name"`
+	UserID    int      `json:"user_id,omitempty"`
+	Service   string   `json:"service,omitempty"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn string   `json:"expires_in,omitempty"` // * a duration like `720h`, empty for a key that doesn't expire
+}
+
+type createdAPIKey struct {
+	*data.APIKey
+	Key string `json:"key"`
+}
+
+func (app *Config) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var requestPayload CreateAPIKeyPayload
+
+	err := app.readJson(w, r, &requestPayload)
+	if err != nil {
+		app.errorJson(w, err, http.StatusBadRequest)
+		return
+	}
+
+	key := data.APIKey{
+		Name:    strings.TrimSpace(requestPayload.Name),
+		Service: strings.TrimSpace(requestPayload.Service),
+	}
+
+	if len(key.Name) > 255 {
+		app.errorJson(w, errors.New("name must be at most 255 characters"), http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case (requestPayload.UserID != 0) == (key.Service != ""):
+		app.errorJson(w, errors.New("a key belongs to either a user_id or a service"), http.StatusBadRequest)
+		return
+	case requestPayload.UserID < 0:
+		app.errorJson(w, errors.New("invalid user id"), http.StatusBadRequest)
+		return
+	case requestPayload.UserID != 0:
+		key.UserID = &requestPayload.UserID
+	case !serviceName.MatchString(key.Service):
+		app.errorJson(w, errors.New("service must be lowercase letters, digits, dots, dashes and underscores"), http.StatusBadRequest)
+		return
+	}
+
+	if requestPayload.ExpiresIn != "" {
+		ttl, err := time.ParseDuration(requestPayload.ExpiresIn)
+		if err != nil || ttl <= 0 {
+			app.errorJson(w, errors.New("expires_in must be a positive duration, like 720h"), http.StatusBadRequest)
+			return
+		}
+
+		expiresAt := time.Now().Add(ttl).UTC().Truncate(time.Second)
+		key.ExpiresAt = &expiresAt
+	}
+
+	key.Scopes, err = app.checkScopes(r.Context(), key.UserID, requestPayload.Scopes)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJson(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.errorJson(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if err := checkGrantable(r, key.Scopes); err != nil {
+		app.errorJson(w, err, http.StatusForbidden)
+		return
+	}
+
+	secret, prefix, hash, err := newAPIKey()
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+	key.Prefix = prefix
+
+	key.ID, err = app.Models.APIKey.Create(r.Context(), key, hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJson(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+	key.CreatedAt = time.Now().UTC()
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Created API key %s, store it now, it isn't shown again", prefix),
+		Data:    createdAPIKey{APIKey: &key, Key: secret},
+	}
+
+	app.writeJson(w, http.StatusCreated, payload)
+}
+
+// checkScopes returns the scopes sorted and without duplicates, if they're
+// all permissions the key may have: any permission for a service account,
+// the user's own permissions for a user.
+func (app *Config) checkScopes(ctx context.Context, userID *int, scopes []string) ([]string, error) {
+	if len(scopes) == 0 {
+		return nil, errors.New("a key needs at least one scope")
+	}
+
+	var allowed []string
+	if userID != nil {
+		access, err := app.Models.Role.ForUser(ctx, *userID)
+		if err != nil {
+			return nil, err
+		}
+		allowed = access.Permissions
+	} else {
+		roles, err := app.Models.Role.List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, role := range roles {
+			allowed = append(allowed, role.Permissions...)
+		}
+	}
+
+	scopes = slices.Clone(scopes)
+	slices.Sort(scopes)
+	scopes = slices.Compact(scopes)
+
+	for _, scope := range scopes {
+		if !slices.Contains(allowed, scope) {
+			return nil, fmt.Errorf("scope %q isn't a permission the key may have", scope)
+		}
+	}
+
+	return scopes, nil
+}
+
+// ListAPIKeys takes an optional `user_id` query parameter.
+func (app *Config) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	userID := 0
+	if u := r.URL.Query().Get("user_id"); u != "" {
+		id, err := strconv.Atoi(u)
+		if err != nil || id < 1 {
+			app.errorJson(w, errors.New("invalid user id"), http.StatusBadRequest)
+			return
+		}
+		userID = id
+	}
+
+	keys, err := app.Models.APIKey.List(r.Context(), userID)
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("%d API key(s)", len(keys)),
+		Data:    keys,
+	}
+
+	app.writeJson(w, http.StatusOK, payload)
+}
+
+func (app *Config) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "key"), 10, 64)
+	if err != nil || id < 1 {
+		app.errorJson(w, errors.New("invalid API key id"), http.StatusBadRequest)
+		return
+	}
+
+	err = app.Models.APIKey.Revoke(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJson(w, errors.New("API key not found or revoked already"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Revoked API key %d", id),
+	}
+
+	app.writeJson(w, http.StatusOK, payload)
+}
+
+type ValidateAPIKeyPayload struct {
+	Key string `json:"key"`
+}
+
+// keyValidation leaves out everything but Active for a key that's no good.
+type keyValidation struct {
+	Active    bool       `json:"active"`
+	KeyID     int64      `json:"key_id,omitempty"`
+	Prefix    string     `json:"prefix,omitempty"`
+	UserID    int        `json:"user_id,omitempty"`
+	Email     string     `json:"email,omitempty"`
+	Service   string     `json:"service,omitempty"`
+	Scopes    []string   `json:"scopes,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// ValidateAPIKey tells whether a key is good, and what it may do.
+func (app *Config) ValidateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var requestPayload ValidateAPIKeyPayload
+
+	err := app.readJson(w, r, &requestPayload)
+	if err != nil {
+		app.errorJson(w, err, http.StatusBadRequest)
+		return
+	}
+
+	result, err := app.validateAPIKey(r.Context(), requestPayload.Key)
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	message := "API key is active"
+	if !result.Active {
+		message = "API key is not active"
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: message,
+		Data:    result,
+	}
+
+	app.writeJson(w, http.StatusOK, payload)
+}
+
+func (app *Config) validateAPIKey(ctx context.Context, secret string) (keyValidation, error) {
+	if !strings.HasPrefix(secret, apiKeyPrefix) {
+		return keyValidation{}, nil
+	}
+
+	key, err := app.Models.APIKey.Use(ctx, hashToken(secret))
+	if errors.Is(err, data.ErrInvalidToken) {
+		return keyValidation{}, nil
+	}
+	if err != nil {
+		return keyValidation{}, err
+	}
+
+	result := keyValidation{
+		Active:    true,
+		KeyID:     key.ID,
+		Prefix:    key.Prefix,
+		Service:   key.Service,
+		Scopes:    key.Scopes,
+		ExpiresAt: key.ExpiresAt,
+	}
+
+	if key.UserID == nil {
+		return result, nil
+	}
+
+	user, err := app.Models.User.GetOne(ctx, *key.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return keyValidation{}, nil
+	}
+	if err != nil {
+		return keyValidation{}, err
+	}
+
+	// * like a session, the key of a disabled account is no good until it's enabled again
+	if user.Active != 1 {
+		return keyValidation{}, nil
+	}
+
+	// * the user may have lost permissions since the key was issued
+	access, err := app.Models.Role.ForUser(ctx, user.ID)
+	if err != nil {
+		return keyValidation{}, err
+	}
+
+	result.UserID = user.ID
+	result.Email = user.Email
+	result.Scopes = slices.DeleteFunc(slices.Clone(key.Scopes), func(scope string) bool {
+		return !slices.Contains(access.Permissions, scope)
+	})
+
+	return result, nil
+}
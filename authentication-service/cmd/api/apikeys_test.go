@@ -0,0 +1,216 @@
+package main
+
+import (
+	"authentication/data"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"testing"
+	"time"
+)
+
+var apiKeyFormat = regexp.MustCompile(`^gmk_[0-9a-f]{8}_[A-Za-z0-9_-]{43}$`)
+
+// createKey issues a key with the admin token and returns it.
+func createKey(t *testing.T, app *Config, payload CreateAPIKeyPayload) createdAPIKey {
+	t.Helper()
+
+	status, response := call(t, app, http.MethodPost, "/api-keys", testAdminToken, payload)
+	if status != http.StatusCreated {
+		t.Fatalf("creating the key answered %d: %s", status, response.Message)
+	}
+
+	return decode[createdAPIKey](t, response)
+}
+
+// validated asks about the key the way other services do.
+func validated(t *testing.T, app *Config, key string) keyValidation {
+	t.Helper()
+
+	status, response := call(t, app, http.MethodPost, "/api-keys/validate", "", ValidateAPIKeyPayload{Key: key})
+	if status != http.StatusOK {
+		t.Fatalf("validating answered %d: %s", status, response.Message)
+	}
+
+	return decode[keyValidation](t, response)
+}
+
+func TestCreateAPIKey(t *testing.T) {
+	app := newTestApp(t)
+	user := addUser(t, app, data.User{Email: "ann@example.com", Active: 1})
+
+	tests := []struct {
+		name    string
+		payload CreateAPIKeyPayload
+		status  int
+		scopes  []string
+	}{
+		{"user key", CreateAPIKeyPayload{Name: "backup", UserID: user.ID, Scopes: []string{"mail.send", "logs.write", "mail.send"}}, http.StatusCreated, []string{"logs.write", "mail.send"}},
+		{"service key", CreateAPIKeyPayload{Service: "reports", Scopes: []string{"users.read"}, ExpiresIn: "720h"}, http.StatusCreated, []string{"users.read"}},
+		{"user and service", CreateAPIKeyPayload{UserID: user.ID, Service: "reports", Scopes: []string{"logs.write"}}, http.StatusBadRequest, nil},
+		{"no owner", CreateAPIKeyPayload{Scopes: []string{"logs.write"}}, http.StatusBadRequest, nil},
+		{"negative user id", CreateAPIKeyPayload{UserID: -1, Scopes: []string{"logs.write"}}, http.StatusBadRequest, nil},
+		{"unknown user", CreateAPIKeyPayload{UserID: 999, Scopes: []string{"logs.write"}}, http.StatusNotFound, nil},
+		{"invalid service name", CreateAPIKeyPayload{Service: "Reports!", Scopes: []string{"logs.write"}}, http.StatusBadRequest, nil},
+		{"no scopes", CreateAPIKeyPayload{Service: "reports"}, http.StatusBadRequest, nil},
+		{"scope the user doesn't have", CreateAPIKeyPayload{UserID: user.ID, Scopes: []string{"users.read"}}, http.StatusBadRequest, nil},
+		{"scope that doesn't exist", CreateAPIKeyPayload{Service: "reports", Scopes: []string{"everything"}}, http.StatusBadRequest, nil},
+		{"invalid lifetime", CreateAPIKeyPayload{Service: "reports", Scopes: []string{"logs.write"}, ExpiresIn: "a month"}, http.StatusBadRequest, nil},
+		{"negative lifetime", CreateAPIKeyPayload{Service: "reports", Scopes: []string{"logs.write"}, ExpiresIn: "-1h"}, http.StatusBadRequest, nil},
+	}
+
+	var secrets []string
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, response := call(t, app, http.MethodPost, "/api-keys", testAdminToken, tt.payload)
+			if status != tt.status {
+				t.Fatalf("answered %d: %s, want %d", status, response.Message, tt.status)
+			}
+			if status != http.StatusCreated {
+				return
+			}
+
+			key := decode[createdAPIKey](t, response)
+			secrets = append(secrets, key.Key)
+			if !apiKeyFormat.MatchString(key.Key) || key.Key[:len(key.Prefix)] != key.Prefix {
+				t.Errorf("key %q with prefix %q isn't a key", key.Key, key.Prefix)
+			}
+			if !slices.Equal(key.Scopes, tt.scopes) {
+				t.Errorf("scopes are %v, want %v", key.Scopes, tt.scopes)
+			}
+			if (tt.payload.ExpiresIn != "") != (key.ExpiresAt != nil) {
+				t.Errorf("expires at %v for a lifetime of %q", key.ExpiresAt, tt.payload.ExpiresIn)
+			}
+		})
+	}
+
+	status, response := call(t, app, http.MethodGet, "/api-keys", testAdminToken, nil)
+	if status != http.StatusOK {
+		t.Fatalf("listing answered %d: %s", status, response.Message)
+	}
+	for _, secret := range secrets {
+		if bytes.Contains(response.Data, []byte(secret)) {
+			t.Errorf("the list shows the key %s", secret)
+		}
+	}
+}
+
+// TestCreateAPIKeyGrantsOnlyCallersScopes issues a key as a caller without
+// every scope of the key.
+func TestCreateAPIKeyGrantsOnlyCallersScopes(t *testing.T) {
+	app := newTestApp(t)
+	c := &caller{UserID: 99, Permissions: []string{"logs.write", "users.write"}}
+
+	tests := []struct {
+		scopes []string
+		status int
+	}{
+		{[]string{"logs.write"}, http.StatusCreated},
+		{[]string{"logs.write", "mail.send"}, http.StatusForbidden},
+		{[]string{"roles.assign"}, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		body, err := json.Marshal(CreateAPIKeyPayload{Service: "reports", Scopes: tt.scopes})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := httptest.NewRequest(http.MethodPost, "/api-keys", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		app.CreateAPIKey(w, r.WithContext(context.WithValue(r.Context(), callerKey{}, c)))
+
+		if w.Code != tt.status {
+			t.Errorf("key with %v answered %d: %s, want %d", tt.scopes, w.Code, w.Body.String(), tt.status)
+		}
+	}
+}
+
+func TestValidateAPIKey(t *testing.T) {
+	app := newTestApp(t)
+	ann := addUser(t, app, data.User{Email: "ann@example.com", Active: 1})
+	bob := addUser(t, app, data.User{Email: "bob@example.com", Active: 1})
+
+	good := createKey(t, app, CreateAPIKeyPayload{UserID: ann.ID, Scopes: []string{"logs.write"}})
+	service := createKey(t, app, CreateAPIKeyPayload{Service: "reports", Scopes: []string{"users.read"}, ExpiresIn: "1h"})
+
+	revoked := createKey(t, app, CreateAPIKeyPayload{UserID: ann.ID, Scopes: []string{"logs.write"}})
+	if status, _ := call(t, app, http.MethodDelete, fmt.Sprintf("/api-keys/%d", revoked.ID), testAdminToken, nil); status != http.StatusOK {
+		t.Fatalf("revoking answered %d", status)
+	}
+
+	expired, prefix, hash, err := newAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Second)
+	if _, err := app.Models.APIKey.Create(context.Background(), data.APIKey{Prefix: prefix, Service: "reports", Scopes: []string{"logs.write"}, ExpiresAt: &past}, hash); err != nil {
+		t.Fatal(err)
+	}
+
+	disabled := createKey(t, app, CreateAPIKeyPayload{UserID: bob.ID, Scopes: []string{"logs.write"}})
+	bob.Active = 0
+	if err := app.Models.User.Update(context.Background(), *bob); err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := []byte(good.Key)
+	tampered[len(tampered)-1] ^= 1
+
+	tests := []struct {
+		name   string
+		key    string
+		active bool
+		owner  string
+	}{
+		{"user key", good.Key, true, ann.Email},
+		{"service key", service.Key, true, ""},
+		{"tampered", string(tampered), false, ""},
+		{"prefix only", good.Prefix, false, ""},
+		{"without the key prefix", good.Key[len(apiKeyPrefix):], false, ""},
+		{"session token", login(t, app, ann), false, ""},
+		{"revoked", revoked.Key, false, ""},
+		{"expired", expired, false, ""},
+		{"disabled user", disabled.Key, false, ""},
+		{"empty", "", false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := validated(t, app, tt.key)
+			if got.Active != tt.active {
+				t.Fatalf("active is %v, want %v", got.Active, tt.active)
+			}
+
+			if !tt.active && (got.KeyID != 0 || got.Scopes != nil || got.UserID != 0) {
+				t.Errorf("inactive key answered %+v, want nothing but active", got)
+			}
+			if tt.active && got.Email != tt.owner {
+				t.Errorf("key belongs to %q, want %q", got.Email, tt.owner)
+			}
+		})
+	}
+}
+
+// TestAPIKeyLosesScopesWithTheUser checks a key against the user's
+// permissions when it's used, not only when it's issued.
+func TestAPIKeyLosesScopesWithTheUser(t *testing.T) {
+	app := newTestApp(t)
+	user := addUser(t, app, data.User{Email: "ann@example.com", Active: 1}, "admin")
+
+	key := createKey(t, app, CreateAPIKeyPayload{UserID: user.ID, Scopes: []string{"logs.write", "users.read"}})
+
+	if err := app.Models.Role.Revoke(context.Background(), user.ID, "admin"); err != nil {
+		t.Fatal(err)
+	}
+
+	got := validated(t, app, key.Key)
+	if !got.Active || !slices.Equal(got.Scopes, []string{"logs.write"}) {
+		t.Errorf("key is active %v with %v, want active with only logs.write", got.Active, got.Scopes)
+	}
+}
@@ -1,11 +1,25 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"authentication/data"
+	"context"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"shared/envelope"
+	"strings"
+)
+
+// Authenticate answers failures with a code as well: `invalid_credentials`,
+// `too_many_attempts` and `account_locked`, or, for the right password,
+// `account_inactive` and `email_unverified`.
+var (
+	errInvalidCredentials = withCode("invalid_credentials", errors.New("invalid credentials"))
+	errTooManyAttempts    = withCode("too_many_attempts", errors.New("too many failed logins, try again later"))
+	errAccountLocked      = withCode("account_locked", errors.New("account is locked after too many failed logins, try again later"))
+	errAccountInactive    = withCode("account_inactive", errors.New("account is disabled"))
+	errEmailUnverified    = withCode("email_unverified", errors.New("email address is not verified"))
 )
 
 func (app *Config) Authenticate(w http.ResponseWriter, r *http.Request) {
@@ -20,59 +34,177 @@ func (app *Config) Authenticate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// validate the user against database
-	user, err := app.Models.User.GetByEmail(requestPayload.Email)
+	user, login, refused := app.checkCredentials(r, requestPayload.Email, requestPayload.Password)
+	if refused != nil {
+		app.refuseLogin(w, refused)
+		return
+	}
+
+	tf, err := app.Models.TwoFactor.Get(r.Context(), user.ID)
 	if err != nil {
-		app.errorJson(w, errors.New("invalid credentials"), http.StatusBadRequest)
+		app.errorJson(w, err)
+		return
+	}
+
+	// * with two-factor authentication the password only earns a challenge for the second step
+	if tf.Enabled {
+		app.challenge(w, user)
 		return
 	}
 
-	valid, err := user.PasswordMatches(requestPayload.Password)
+	app.clearFailures(r, user)
+	app.loginSucceeded(w, r, login, user)
+}
+
+// checkCredentials looks up the user with the email and checks the password,
+// counting failures and enforcing lockouts. Clearing the failures is left to
+// the caller, once the whole login succeeded: a right password followed by
+// wrong two-factor codes must still end in a lockout.
+func (app *Config) checkCredentials(r *http.Request, email, password string) (*data.User, envelope.LoginData, *loginError) {
+	login := envelope.LoginData{
+		Email: email,
+		IP:    app.clientIP(r),
+	}
+
+	if refused := app.addressBlocked(r, login); refused != nil {
+		return nil, login, refused
+	}
+
+	// validate the user against database
+	user, err := app.Models.User.GetByEmail(r.Context(), email)
+	if err != nil {
+		// * locked, delayed and compared like a real account, so none of it gives the email away
+		if refused := app.unknownEmailLocked(r, login); refused != nil {
+			return nil, login, refused
+		}
+
+		data.DummyPasswordCheck(password)
+		login.Reason = "unknown email"
+		return nil, login, app.loginFailed(r, login, app.countUnknownFailure(login), errInvalidCredentials)
+	}
+	login.UserID = user.ID
+
+	if refused := app.accountLocked(r, login, user); refused != nil {
+		return nil, login, refused
+	}
+
+	valid, err := user.PasswordMatches(password)
 	if err != nil || !valid {
-		app.errorJson(w, errors.New("invalid credentials"), http.StatusBadRequest)
+		login.Reason = "wrong password"
+		return nil, login, app.loginFailed(r, login, app.countFailure(r, user, login), errInvalidCredentials)
+	}
+
+	// * checked only once the password matched, so neither reveals an account to a guesser
+	if user.Active != 1 {
+		login.Reason = "inactive account"
+		app.recordEvent(r.Context(), "user.login.failed", login)
+		return nil, login, &loginError{err: errAccountInactive, status: http.StatusForbidden}
+	}
+
+	if !user.Verified() {
+		login.Reason = "unverified email"
+		app.recordEvent(r.Context(), "user.login.failed", login)
+		return nil, login, &loginError{err: errEmailUnverified, status: http.StatusForbidden}
+	}
+
+	return user, login, nil
+}
+
+// loginSucceeded starts a session and answers with the user, their roles and
+// permissions, and the session token.
+func (app *Config) loginSucceeded(w http.ResponseWriter, r *http.Request, login envelope.LoginData, user *data.User) {
+	access, err := app.Models.Role.ForUser(r.Context(), user.ID)
+	if err != nil {
+		app.errorJson(w, err)
 		return
 	}
+	user.Access = access
 
-	// log authentication
-	err = app.logRequest("authentication", fmt.Sprintf("%s logged in", user.Email))
+	session, err := app.startSession(r, user)
 	if err != nil {
 		app.errorJson(w, err)
 		return
 	}
 
+	// whoever is interested in logins, e.g. the logger, picks this up from RabbitMQ
+	app.recordEvent(r.Context(), "user.login.succeeded", login)
+
 	payload := jsonResponse{
 		Error:   false,
 		Message: fmt.Sprintf("Logged in user %s", user.Email),
-		Data:    user,
+		Data:    loginResponse{User: user, Session: session},
 	}
 	app.writeJson(w, http.StatusOK, payload)
 }
 
-func (app *Config) logRequest(name, data string) error {
-	entry := struct {
-		Name string `json:"name"`
-		Data string `json:"data"`
-	}{
-		name,
-		data,
+// recordEvent adds an event to the outbox. Failing to record it is logged but
+// doesn't fail the request.
+func (app *Config) recordEvent(ctx context.Context, eventType string, data any) {
+	// * the event outlives the request, even if the client hangs up
+	if err := app.Models.Outbox.Add(context.WithoutCancel(ctx), eventType, data); err != nil {
+		log.Printf("Recording %s event failed: %v\r\n", eventType, err)
 	}
+}
+
+type RegisterPayload struct {
+	Email     string `json:"email"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Password  string `json:"password"`
+}
+
+func (app *Config) Register(w http.ResponseWriter, r *http.Request) {
+	var requestPayload RegisterPayload
 
-	jsonData, err := json.Marshal(&entry)
+	err := app.readJson(w, r, &requestPayload)
 	if err != nil {
-		return err
+		app.errorJson(w, err, http.StatusBadRequest)
+		return
+	}
+
+	email := strings.TrimSpace(requestPayload.Email)
+	if !validEmail(email) {
+		app.errorJson(w, errors.New("invalid email address"), http.StatusBadRequest)
+		return
+	}
+
+	if err := app.PasswordPolicy.Validate(requestPayload.Password); err != nil {
+		app.errorJson(w, err, http.StatusBadRequest)
+		return
 	}
 
-	logServiceURL := "http://logger-service/log"
-	request, err := http.NewRequest(http.MethodPost, logServiceURL, bytes.NewBuffer(jsonData))
+	// * Insert hashes the password and records the `user.created` event, the
+	// * user starts out unverified
+	_, err = app.Models.User.Insert(r.Context(), data.User{
+		Email:     email,
+		FirstName: strings.TrimSpace(requestPayload.FirstName),
+		LastName:  strings.TrimSpace(requestPayload.LastName),
+		Password:  requestPayload.Password,
+		Active:    1,
+	})
+	if errors.Is(err, data.ErrDuplicateEmail) {
+		app.errorJson(w, err, http.StatusConflict)
+		return
+	}
 	if err != nil {
-		return err
+		app.errorJson(w, err)
+		return
 	}
 
-	client := &http.Client{}
-	_, err = client.Do(request)
+	user, err := app.Models.User.GetByEmail(r.Context(), email)
 	if err != nil {
-		return err
+		app.errorJson(w, err)
+		return
+	}
+
+	// * the account can't log in until the link in this mail is followed
+	go app.sendVerificationLink(*user)
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Registered user %s, check your inbox to verify the email address", user.Email),
+		Data:    user,
 	}
 
-	return nil
+	app.writeJson(w, http.StatusCreated, payload)
 }
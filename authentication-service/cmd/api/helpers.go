@@ -5,14 +5,31 @@ import (
 	"errors"
 	"io"
 	"net/http"
+	"net/mail"
+	"strings"
 )
 
 type jsonResponse struct {
 	Error   bool   `json:"error"`
 	Message string `json:"message" `
+	Code    string `json:"code,omitempty"`
 	Data    any    `json:"data,omitempty"`
 }
 
+// codedError is an error clients can tell apart by its code rather than by
+// parsing the message.
+type codedError struct {
+	code string
+	err  error
+}
+
+func (e *codedError) Error() string { return e.err.Error() }
+func (e *codedError) Unwrap() error { return e.err }
+
+func withCode(code string, err error) error {
+	return &codedError{code: code, err: err}
+}
+
 // data should be a variable pointed to
 func (app *Config) readJson(w http.ResponseWriter, r *http.Request, data any) error {
 	maxBytes := 1048576 // 1 MB
@@ -67,5 +84,21 @@ func (app *Config) errorJson(w http.ResponseWriter, err error, status ...int) er
 		Message: err.Error(),
 	}
 
+	var coded *codedError
+	if errors.As(err, &coded) {
+		payload.Code = coded.code
+	}
+
 	return app.writeJson(w, statusCode, payload)
 }
+
+// validEmail accepts a bare address like `jane@example.com`, without a
+// display name or angle brackets.
+func validEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	if err != nil {
+		return false
+	}
+
+	return addr.Address == email && strings.Contains(email[strings.LastIndex(email, "@"):], ".")
+}
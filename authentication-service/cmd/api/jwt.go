@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// NOTE: JWTs
+/*
+	OAuth2 access tokens are JWTs signed with RS256 (RFC 7515 and 7519), so
+	other services can check them without asking: the public key is at
+	/.well-known/jwks.json, under the `kid` in the token's header.
+
+	OAUTH_SIGNING_KEY is the RSA private key, PEM encoded, PKCS #1 or #8.
+	Without one a key is made up at start, and tokens die with the process.
+*/
+
+const signingKeyBits = 2048
+
+var errInvalidJWT = errors.New("invalid or expired token")
+
+// signingKey returns the key from OAUTH_SIGNING_KEY, or a new one without it.
+func signingKey() *rsa.PrivateKey {
+	value := os.Getenv("OAUTH_SIGNING_KEY")
+	if value == "" {
+		// * still works, but tokens can't be checked after a restart and differ between replicas
+		log.Println("OAUTH_SIGNING_KEY is not set, using a random one")
+		key, err := rsa.GenerateKey(rand.Reader, signingKeyBits)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		return key
+	}
+
+	block, _ := pem.Decode([]byte(value))
+	if block == nil {
+		log.Panic("OAUTH_SIGNING_KEY must be a PEM encoded RSA private key")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	key, ok := parsed.(*rsa.PrivateKey)
+	if err != nil || !ok {
+		log.Panic("OAUTH_SIGNING_KEY must be a PEM encoded RSA private key")
+	}
+
+	return key
+}
+
+// keyID names the key in the JWKS, a hash of the public key so a new key
+// gets a new id.
+func keyID(key *rsa.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	sum := sha256.Sum256(der)
+
+	return base64.RawURLEncoding.EncodeToString(sum[:12])
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ,omitempty"`
+	KeyID     string `json:"kid,omitempty"`
+}
+
+// accessClaims are the claims of an access token, after RFC 9068. Subject
+// is the user id for tokens of a user, the client id for tokens of a client.
+type accessClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	ClientID  string `json:"client_id"`
+	Scope     string `json:"scope,omitempty"`
+	Email     string `json:"email,omitempty"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	ID        string `json:"jti"`
+}
+
+func (c *accessClaims) forUser() bool {
+	return c.Subject != c.ClientID
+}
+
+// signJWT returns the claims as a JWT signed with the OAuth2 key.
+func (app *Config) signJWT(claims any) (string, error) {
+	header, err := json.Marshal(jwtHeader{Algorithm: "RS256", Type: "at+jwt", KeyID: app.OAuthKeyID})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	sum := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, app.OAuthKey, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// parseJWT checks the signature, issuer and expiry of an access token and
+// returns its claims. It returns errInvalidJWT for any token that isn't
+// good, without telling why.
+func (app *Config) parseJWT(token string) (*accessClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidJWT
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errInvalidJWT
+	}
+
+	// * only the one algorithm is accepted, never what the token asks for
+	if header.Algorithm != "RS256" || header.KeyID != app.OAuthKeyID {
+		return nil, errInvalidJWT
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidJWT
+	}
+
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&app.OAuthKey.PublicKey, crypto.SHA256, sum[:], signature); err != nil {
+		return nil, errInvalidJWT
+	}
+
+	var claims accessClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errInvalidJWT
+	}
+
+	if claims.Issuer != app.OAuthIssuer || time.Now().Unix() >= claims.ExpiresAt || claims.ID == "" {
+		return nil, errInvalidJWT
+	}
+
+	return &claims, nil
+}
+
+func decodeSegment(segment string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+type jwk struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Modulus   string `json:"n"`
+	Exponent  string `json:"e"`
+}
+
+// JWKS publishes the public key access tokens are signed with (RFC 7517).
+// Like the other OAuth2 endpoints it answers in the standard format, not in
+// a jsonResponse.
+func (app *Config) JWKS(w http.ResponseWriter, r *http.Request) {
+	key := &app.OAuthKey.PublicKey
+
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{
+		Keys: []jwk{{
+			KeyType:   "RSA",
+			Use:       "sig",
+			Algorithm: "RS256",
+			KeyID:     app.OAuthKeyID,
+			Modulus:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			Exponent:  base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	app.writeJson(w, http.StatusOK, set)
+}
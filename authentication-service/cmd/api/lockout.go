@@ -0,0 +1,279 @@
+package main
+
+import (
+	"authentication/data"
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"shared/envelope"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NOTE: Brute-force protection
+/*
+	Failed logins are counted per account, in the users table, and per client
+	address, in memory.
+
+	- every failure after the first makes the answer slower, doubling up to
+	  maxLoginDelay
+	- LOCKOUT_THRESHOLD failures in a row lock the account for
+	  LOCKOUT_DURATION, and while the failures continue every further one
+	  locks it again. A successful login or an admin
+	  (POST /users/{id}/unlock) resets the count.
+	- LOCKOUT_IP_THRESHOLD failures from one address within LOCKOUT_IP_WINDOW
+	  block the address for the rest of the window
+	- emails without an account are counted and locked the same way, in
+	  memory, so the answers don't tell them apart from real accounts
+
+	Locked accounts and blocked addresses get 429 with a Retry-After header.
+*/
+
+const (
+	baseLoginDelay = 250 * time.Millisecond
+	maxLoginDelay  = 5 * time.Second
+)
+
+// LockoutPolicy is read from the LOCKOUT_* environment variables.
+type LockoutPolicy struct {
+	Threshold   int
+	Duration    time.Duration
+	IPThreshold int
+	IPWindow    time.Duration
+}
+
+func lockoutPolicy() LockoutPolicy {
+	policy := LockoutPolicy{
+		Threshold:   5,
+		Duration:    15 * time.Minute,
+		IPThreshold: 20,
+		IPWindow:    15 * time.Minute,
+	}
+
+	if n, err := strconv.Atoi(os.Getenv("LOCKOUT_THRESHOLD")); err == nil && n > 0 {
+		policy.Threshold = n
+	}
+
+	if d, err := time.ParseDuration(os.Getenv("LOCKOUT_DURATION")); err == nil && d > 0 {
+		policy.Duration = d
+	}
+
+	if n, err := strconv.Atoi(os.Getenv("LOCKOUT_IP_THRESHOLD")); err == nil && n > 0 {
+		policy.IPThreshold = n
+	}
+
+	if d, err := time.ParseDuration(os.Getenv("LOCKOUT_IP_WINDOW")); err == nil && d > 0 {
+		policy.IPWindow = d
+	}
+
+	return policy
+}
+
+// loginDelay is how long to hold back the answer to the n-th failure in a row.
+func loginDelay(failures int) time.Duration {
+	if failures <= 1 {
+		return 0
+	}
+
+	delay := baseLoginDelay
+	for i := 2; i < failures && delay < maxLoginDelay; i++ {
+		delay *= 2
+	}
+
+	return min(delay, maxLoginDelay)
+}
+
+// sleep waits for d, or less if the client goes away.
+func sleep(ctx context.Context, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
+
+// setRetryAfter sets the Retry-After header to d, in whole seconds.
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	seconds := int((d + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+}
+
+// loginError is why a login was refused, with the status to answer with and,
+// for 429s, how long to wait before trying again. Each endpoint answers it
+// in its own format.
+type loginError struct {
+	err        error
+	status     int
+	retryAfter time.Duration
+}
+
+// refuseLogin answers with the error.
+func (app *Config) refuseLogin(w http.ResponseWriter, err *loginError) {
+	if err.retryAfter > 0 {
+		setRetryAfter(w, err.retryAfter)
+	}
+
+	app.errorJson(w, err.err, err.status)
+}
+
+// addressBlocked refuses with 429 if the client's address failed too often.
+// A blocked address doesn't get to try at all, not even the right password.
+func (app *Config) addressBlocked(r *http.Request, login envelope.LoginData) *loginError {
+	failures, wait := app.LoginFailuresByIP.Hits(login.IP)
+	if failures < app.Lockout.IPThreshold {
+		return nil
+	}
+
+	login.Reason = "address blocked"
+	app.recordEvent(r.Context(), "user.login.failed", login)
+
+	return &loginError{err: errTooManyAttempts, status: http.StatusTooManyRequests, retryAfter: wait}
+}
+
+// accountLocked refuses with 429 if the user is locked out.
+func (app *Config) accountLocked(r *http.Request, login envelope.LoginData, user *data.User) *loginError {
+	now := time.Now()
+	if !user.Locked(now) {
+		return nil
+	}
+
+	login.Reason = "account locked"
+	app.recordEvent(r.Context(), "user.login.failed", login)
+
+	return &loginError{err: errAccountLocked, status: http.StatusTooManyRequests, retryAfter: user.LockedUntil.Sub(now)}
+}
+
+// countFailure counts a failed login against the user and returns the
+// failures in a row.
+func (app *Config) countFailure(r *http.Request, user *data.User, login envelope.LoginData) int {
+	// * counted even if the client hangs up, or hanging up would dodge the lockout
+	failures, err := app.Models.User.RecordLoginFailure(context.WithoutCancel(r.Context()),
+		user.ID, login.IP, app.Lockout.Threshold, app.Lockout.Duration)
+	if err != nil {
+		log.Printf("Counting failed login of user %d failed: %v\r\n", user.ID, err)
+	}
+
+	return failures
+}
+
+// unknownEmailLocked refuses with 429 if an email without an account failed
+// as often as locks a real account.
+func (app *Config) unknownEmailLocked(r *http.Request, login envelope.LoginData) *loginError {
+	wait := app.UnknownEmailFailures.LockedFor(strings.ToLower(login.Email), time.Now())
+	if wait <= 0 {
+		return nil
+	}
+
+	login.Reason = "unknown email locked"
+	app.recordEvent(r.Context(), "user.login.failed", login)
+
+	return &loginError{err: errAccountLocked, status: http.StatusTooManyRequests, retryAfter: wait}
+}
+
+// countUnknownFailure counts a failed login against an email without an
+// account and returns the failures in a row.
+func (app *Config) countUnknownFailure(login envelope.LoginData) int {
+	return app.UnknownEmailFailures.Fail(strings.ToLower(login.Email), time.Now(), app.Lockout.Threshold, app.Lockout.Duration)
+}
+
+// clearFailures forgets the user's failed logins after a successful one.
+func (app *Config) clearFailures(r *http.Request, user *data.User) {
+	if user.FailedLogins == 0 && user.LockedUntil == nil {
+		return
+	}
+
+	if err := app.Models.User.ClearLoginFailures(r.Context(), user.ID); err != nil {
+		log.Printf("Clearing failed logins of user %d failed: %v\r\n", user.ID, err)
+	}
+}
+
+// loginFailed records a failed login, counts it against the client address
+// and refuses with err, after the delay the failures in a row earned.
+func (app *Config) loginFailed(r *http.Request, login envelope.LoginData, accountFailures int, err error) *loginError {
+	app.recordEvent(r.Context(), "user.login.failed", login)
+
+	ipFailures := app.LoginFailuresByIP.Hit(login.IP)
+	if ipFailures == app.Lockout.IPThreshold {
+		login.Reason = "address blocked after too many failed logins"
+		app.recordEvent(r.Context(), "user.login.blocked", login)
+	}
+
+	sleep(r.Context(), loginDelay(max(accountFailures, ipFailures)))
+
+	return &loginError{err: err, status: http.StatusBadRequest}
+}
+
+// unknownFailureRetention is how long an email without an account keeps its
+// failures after the last one. Real accounts keep them until a login
+// succeeds, which an unknown email never does.
+const unknownFailureRetention = 24 * time.Hour
+
+// failureCounter counts failed logins in a row per key and locks the key the
+// way RecordLoginFailure locks an account. It lives in memory, like
+// rateLimiter.
+type failureCounter struct {
+	mu      sync.Mutex
+	entries map[string]*failureEntry
+}
+
+type failureEntry struct {
+	failures    int
+	lockedUntil time.Time
+	last        time.Time
+}
+
+func newFailureCounter() *failureCounter {
+	return &failureCounter{entries: make(map[string]*failureEntry)}
+}
+
+// Fail counts a failure for key and returns the failures in a row. From the
+// threshold on, every failure locks the key for lockFor.
+func (c *failureCounter) Fail(key string, now time.Time, threshold int, lockFor time.Duration) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// * drop forgotten keys now and then, so the map doesn't only grow
+	if len(c.entries) > 10_000 {
+		for k, e := range c.entries {
+			if now.Sub(e.last) >= unknownFailureRetention && !now.Before(e.lockedUntil) {
+				delete(c.entries, k)
+			}
+		}
+	}
+
+	e, ok := c.entries[key]
+	if !ok || (now.Sub(e.last) >= unknownFailureRetention && !now.Before(e.lockedUntil)) {
+		e = &failureEntry{}
+		c.entries[key] = e
+	}
+
+	e.failures++
+	e.last = now
+	if e.failures >= threshold {
+		e.lockedUntil = now.Add(lockFor)
+	}
+
+	return e.failures
+}
+
+// LockedFor returns how long key stays locked, or 0 if it isn't.
+func (c *failureCounter) LockedFor(key string, now time.Time) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok || !now.Before(e.lockedUntil) {
+		return 0
+	}
+
+	return e.lockedUntil.Sub(now)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"authentication/data"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLoginDelay(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{1, 0},
+		{2, baseLoginDelay},
+		{3, 2 * baseLoginDelay},
+		{4, 4 * baseLoginDelay},
+		{100, maxLoginDelay},
+	}
+
+	for _, tt := range tests {
+		if got := loginDelay(tt.failures); got != tt.want {
+			t.Errorf("loginDelay(%d) = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestFailureCounter(t *testing.T) {
+	c := newFailureCounter()
+	now := time.Now()
+
+	for i := 1; i <= 3; i++ {
+		if got := c.Fail("a@example.com", now, 3, time.Minute); got != i {
+			t.Fatalf("failure %d counted as %d", i, got)
+		}
+
+		locked := c.LockedFor("a@example.com", now)
+		if i < 3 && locked != 0 {
+			t.Fatalf("locked for %s after %d failures, want unlocked below the threshold", locked, i)
+		}
+		if i == 3 && locked != time.Minute {
+			t.Fatalf("locked for %s at the threshold, want a minute", locked)
+		}
+	}
+
+	if locked := c.LockedFor("a@example.com", now.Add(time.Minute)); locked != 0 {
+		t.Errorf("still locked for %s once the lock ran out", locked)
+	}
+
+	// * like an account, the next failure after the lock locks again
+	if got := c.Fail("a@example.com", now.Add(time.Minute), 3, time.Minute); got != 4 {
+		t.Errorf("failure after the lock counted as %d, want 4", got)
+	}
+	if locked := c.LockedFor("a@example.com", now.Add(time.Minute)); locked != time.Minute {
+		t.Errorf("locked for %s after the next failure, want a minute", locked)
+	}
+
+	if got := c.Fail("a@example.com", now.Add(time.Minute+unknownFailureRetention), 3, time.Minute); got != 1 {
+		t.Errorf("failure after the retention counted as %d, want a fresh count", got)
+	}
+
+	if locked := c.LockedFor("b@example.com", now); locked != 0 {
+		t.Errorf("unrelated key locked for %s", locked)
+	}
+}
+
+// TestUnknownEmailLocksLikeAnAccount sends the same wrong logins for an
+// account and for an email without one: the answers must not differ.
+func TestUnknownEmailLocksLikeAnAccount(t *testing.T) {
+	app := newTestApp(t)
+	addUser(t, app, data.User{Email: "known@example.com", Active: 1})
+
+	answers := func(email string) []string {
+		var got []string
+		for i := 0; i <= app.Lockout.Threshold; i++ {
+			status, response := call(t, app, http.MethodPost, "/authenticate", "", map[string]string{
+				"email":    email,
+				"password": "wrong password",
+			})
+			got = append(got, http.StatusText(status)+" "+response.Code)
+		}
+		return got
+	}
+
+	known := answers("known@example.com")
+	unknown := answers("unknown@example.com")
+
+	for i := range known {
+		if known[i] != unknown[i] {
+			t.Errorf("attempt %d: account answered %q, unknown email %q", i+1, known[i], unknown[i])
+		}
+	}
+
+	if last := unknown[len(unknown)-1]; last != "Too Many Requests account_locked" {
+		t.Errorf("unknown email answered %q after the threshold, want a lockout", last)
+	}
+}
+
+// authenticate logs in from the address, keeping the whole answer for its
+// headers.
+func authenticate(t *testing.T, app *Config, addr, email, password string) (*httptest.ResponseRecorder, testResponse) {
+	t.Helper()
+
+	body, err := json.Marshal(map[string]string{"email": email, "password": password})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/authenticate", bytes.NewReader(body))
+	r.RemoteAddr = addr + ":1234"
+
+	w := httptest.NewRecorder()
+	app.routes().ServeHTTP(w, r)
+
+	var response testResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("login answered %d with %q: %v", w.Code, w.Body.String(), err)
+	}
+
+	return w, response
+}
+
+// retryAfter returns the Retry-After header in seconds, 0 without one.
+func retryAfter(t *testing.T, w *httptest.ResponseRecorder) int {
+	t.Helper()
+
+	header := w.Header().Get("Retry-After")
+	if header == "" {
+		return 0
+	}
+
+	seconds, err := strconv.Atoi(header)
+	if err != nil {
+		t.Fatalf("Retry-After is %q", header)
+	}
+
+	return seconds
+}
+
+func TestAccountLockout(t *testing.T) {
+	app := newTestApp(t)
+	app.Lockout.Threshold = 3
+
+	admin := addUser(t, app, data.User{Email: "admin@example.com", Active: 1}, "admin")
+	user := addUser(t, app, data.User{Email: "ann@example.com", Active: 1})
+
+	tests := []struct {
+		name     string
+		password string
+		status   int
+		code     string
+	}{
+		{"wrong password", "wrong password", http.StatusBadRequest, "invalid_credentials"},
+		{"right password clears the failures", "correct horse battery", http.StatusOK, ""},
+		{"wrong password after the login", "wrong password", http.StatusBadRequest, "invalid_credentials"},
+		{"wrong password again", "wrong password", http.StatusBadRequest, "invalid_credentials"},
+		{"wrong password at the threshold", "wrong password", http.StatusBadRequest, "invalid_credentials"},
+		{"right password while locked", "correct horse battery", http.StatusTooManyRequests, "account_locked"},
+	}
+
+	for _, tt := range tests {
+		w, response := authenticate(t, app, "192.0.2.1", user.Email, tt.password)
+		if w.Code != tt.status || response.Code != tt.code {
+			t.Fatalf("%s: answered %d %q, want %d %q", tt.name, w.Code, response.Code, tt.status, tt.code)
+		}
+
+		seconds := retryAfter(t, w)
+		if tt.status == http.StatusTooManyRequests && (seconds < 1 || seconds > int(app.Lockout.Duration/time.Second)) {
+			t.Errorf("%s: Retry-After is %d seconds, want up to the lockout duration", tt.name, seconds)
+		}
+		if tt.status != http.StatusTooManyRequests && seconds != 0 {
+			t.Errorf("%s: Retry-After is %d seconds on a %d", tt.name, seconds, w.Code)
+		}
+	}
+
+	// * the lock is on the account, not the address
+	if w, response := authenticate(t, app, "198.51.100.1", user.Email, "correct horse battery"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("login from another address answered %d %q, want %d", w.Code, response.Code, http.StatusTooManyRequests)
+	}
+
+	if status, response := call(t, app, http.MethodPost, "/users/"+strconv.Itoa(user.ID)+"/unlock", login(t, app, admin), nil); status != http.StatusOK {
+		t.Fatalf("unlocking answered %d: %s", status, response.Message)
+	}
+
+	if w, response := authenticate(t, app, "192.0.2.1", user.Email, "correct horse battery"); w.Code != http.StatusOK {
+		t.Errorf("login after unlocking answered %d %q", w.Code, response.Code)
+	}
+}
+
+func TestAddressBlocked(t *testing.T) {
+	app := newTestApp(t)
+	app.Lockout.IPThreshold = 3
+	app.Lockout.Threshold = 100
+
+	user := addUser(t, app, data.User{Email: "ann@example.com", Active: 1})
+
+	// * each guess at another email, so no account locks before the address does
+	for _, email := range []string{"a@example.com", "b@example.com", user.Email} {
+		if w, response := authenticate(t, app, "192.0.2.1", email, "wrong password"); w.Code != http.StatusBadRequest {
+			t.Fatalf("guessing %s answered %d %q, want %d", email, w.Code, response.Code, http.StatusBadRequest)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		addr   string
+		status int
+		code   string
+	}{
+		{"right password from the blocked address", "192.0.2.1", http.StatusTooManyRequests, "too_many_attempts"},
+		{"right password from another address", "198.51.100.1", http.StatusOK, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, response := authenticate(t, app, tt.addr, user.Email, "correct horse battery")
+			if w.Code != tt.status || response.Code != tt.code {
+				t.Fatalf("answered %d %q, want %d %q", w.Code, response.Code, tt.status, tt.code)
+			}
+
+			seconds := retryAfter(t, w)
+			if tt.status == http.StatusTooManyRequests && (seconds < 1 || seconds > int(app.Lockout.IPWindow/time.Second)) {
+				t.Errorf("Retry-After is %d seconds, want up to the window", seconds)
+			}
+		})
+	}
+}
+
+// TestSecondFactorFailuresLock checks that the right password doesn't clear
+// the failures of wrong two-factor codes, so guessing codes ends in a lockout.
+func TestSecondFactorFailuresLock(t *testing.T) {
+	app := newTestApp(t)
+	app.Lockout.Threshold = 3
+	user := addUser(t, app, data.User{Email: "ann@example.com", Active: 1})
+
+	credentials := TwoFactorPayload{Email: "ann@example.com", Password: "correct horse battery"}
+	secret, _ := enableTwoFactor(t, app, credentials)
+
+	// * enabling counted its wrong confirmation code
+	if err := app.Models.User.ClearLoginFailures(context.Background(), user.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	var challenge string
+	for i := 1; i <= app.Lockout.Threshold; i++ {
+		w, response := authenticate(t, app, "192.0.2.1", credentials.Email, credentials.Password)
+		if w.Code != http.StatusOK || response.Code != "two_factor_required" {
+			t.Fatalf("password %d answered %d %q, want a challenge", i, w.Code, response.Code)
+		}
+		challenge = decode[challengeResponse](t, response).Challenge
+
+		status, response := call(t, app, http.MethodPost, "/authenticate/2fa", "", TwoFactorLoginPayload{Challenge: challenge, Code: "000000"})
+		if status != http.StatusBadRequest || response.Code != "invalid_code" {
+			t.Fatalf("wrong code %d answered %d %q, want %d invalid_code", i, status, response.Code, http.StatusBadRequest)
+		}
+	}
+
+	if w, response := authenticate(t, app, "192.0.2.1", credentials.Email, credentials.Password); w.Code != http.StatusTooManyRequests || response.Code != "account_locked" {
+		t.Errorf("password after the wrong codes answered %d %q, want %d account_locked", w.Code, response.Code, http.StatusTooManyRequests)
+	}
+
+	// * an outstanding challenge doesn't get around the lock either
+	code := totpCode(secret, totpStep(time.Now())+1)
+	if status, response := call(t, app, http.MethodPost, "/authenticate/2fa", "", TwoFactorLoginPayload{Challenge: challenge, Code: code}); status != http.StatusTooManyRequests {
+		t.Errorf("right code while locked answered %d %q, want %d", status, response.Code, http.StatusTooManyRequests)
+	}
+}
+
+func TestConfirmFailuresLock(t *testing.T) {
+	app := newTestApp(t)
+	app.Lockout.Threshold = 3
+	addUser(t, app, data.User{Email: "ann@example.com", Active: 1})
+
+	credentials := TwoFactorPayload{Email: "ann@example.com", Password: "correct horse battery"}
+	if status, response := call(t, app, http.MethodPost, "/2fa/enroll", "", credentials); status != http.StatusOK {
+		t.Fatalf("enrolling answered %d: %s", status, response.Message)
+	}
+
+	confirm := credentials
+	confirm.Code = "000000"
+	for i := 1; i <= app.Lockout.Threshold; i++ {
+		status, response := call(t, app, http.MethodPost, "/2fa/confirm", "", confirm)
+		if status != http.StatusBadRequest || response.Code != "invalid_code" {
+			t.Fatalf("wrong code %d answered %d %q, want %d invalid_code", i, status, response.Code, http.StatusBadRequest)
+		}
+	}
+
+	if w, response := authenticate(t, app, "192.0.2.1", credentials.Email, credentials.Password); w.Code != http.StatusTooManyRequests || response.Code != "account_locked" {
+		t.Errorf("password after the wrong codes answered %d %q, want %d account_locked", w.Code, response.Code, http.StatusTooManyRequests)
+	}
+	if status, response := call(t, app, http.MethodPost, "/2fa/confirm", "", confirm); status != http.StatusTooManyRequests {
+		t.Errorf("confirming while locked answered %d %q, want %d", status, response.Code, http.StatusTooManyRequests)
+	}
+}
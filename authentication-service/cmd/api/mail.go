@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"shared/envelope"
+	"shared/topology"
+	"time"
+)
+
+// sendMail publishes a `mail.send` event for mail-service and waits for the
+// broker to confirm it.
+//
+// NOTE: mails don't go through the outbox on purpose: they can carry secrets
+// like reset links, and outbox rows are kept after publishing.
+func (app *Config) sendMail(ctx context.Context, mail envelope.MailData) error {
+	if app.Rabbit == nil {
+		return errors.New("no rabbitmq connection to send mail with")
+	}
+
+	event, err := envelope.Encode("mail.send", "1", "authentication-service", mail)
+	if err != nil {
+		return err
+	}
+
+	publishing, err := event.Publishing()
+	if err != nil {
+		return err
+	}
+
+	ch, err := app.Rabbit.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	if err := ch.Confirm(false); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	confirmation, err := ch.PublishWithDeferredConfirmWithContext(ctx, topology.EventsExchange, event.Type, false, false, publishing)
+	if err != nil {
+		return err
+	}
+
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return fmt.Errorf("broker nacked mail %s", event.ID)
+	}
+
+	return nil
+}
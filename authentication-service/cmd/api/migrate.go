@@ -0,0 +1,93 @@
+package main
+
+import (
+	"authentication/data"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// NOTE: Migration commands
+/*
+	authApp migrate up          # applies every pending migration, also done on startup
+	authApp migrate down [n]    # reverts the last n migrations, 1 by default
+	authApp migrate status
+
+	Set MIGRATE_ON_START=false to leave migrating to the command.
+*/
+
+func migrateOnStart(conn *sql.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	applied, err := data.MigrateUp(ctx, conn)
+	for _, m := range applied {
+		log.Printf("Applied migration %d_%s\r\n", m.Version, m.Name)
+	}
+
+	return err
+}
+
+func runMigrate(conn *sql.DB, args []string) error {
+	if len(args) < 2 || args[0] != "migrate" {
+		return errors.New("usage: authApp migrate up|down [n]|status")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	switch args[1] {
+	case "up":
+		applied, err := data.MigrateUp(ctx, conn)
+		for _, m := range applied {
+			fmt.Printf("Applied %d_%s\r\n", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Println("Nothing to apply")
+		}
+
+	case "down":
+		steps := 1
+		if len(args) > 2 {
+			n, err := strconv.Atoi(args[2])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid number of migrations %q", args[2])
+			}
+			steps = n
+		}
+
+		reverted, err := data.MigrateDown(ctx, conn, steps)
+		for _, m := range reverted {
+			fmt.Printf("Reverted %d_%s\r\n", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+
+	case "status":
+		statuses, err := data.MigrationStatuses(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d\t%s\t%s\r\n", s.Version, s.Name, applied)
+		}
+
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[1])
+	}
+
+	return nil
+}
@@ -0,0 +1,697 @@
+package main
+
+import (
+	"authentication/data"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// NOTE: OAuth2
+/*
+	A small authorization server (RFC 6749). Admins register clients, which
+	get a client id and a secret, the only time it's shown:
+
+	curl -X POST -H "Authorization: Bearer $ADMIN_API_TOKEN" localhost:8081/oauth/clients \
+		-d '{"name": "reports", "grant_types": ["client_credentials"], "scopes": ["logs.write"]}'
+
+	POST /oauth/token takes a form, with the client's credentials as HTTP
+	Basic auth or as client_id and client_secret fields, and these grants:
+
+	grant_type=password&username=...&password=...&scope=...
+		a user's token, with a refresh token if the client may refresh.
+		Users with two-factor authentication log in through /authenticate.
+	grant_type=client_credentials&scope=...
+		a token of the client itself.
+	grant_type=refresh_token&refresh_token=...&scope=...
+		a new access token and a new refresh token, the old one is used up.
+
+	Scopes are permission names. A token gets the ones asked for, or all it
+	may have without `scope`: what the client may have, and what the user
+	may do for a user's token. Access tokens are JWTs (see jwt.go) that
+	last OAUTH_ACCESS_TOKEN_TTL, refresh tokens OAUTH_REFRESH_TOKEN_TTL.
+
+	POST /oauth/revoke {token}      revokes a token of the client (RFC 7009)
+	POST /oauth/introspect {token}  tells any client about a token (RFC 7662)
+
+	These endpoints answer errors as `{"error": "...", "error_description": "..."}`.
+*/
+
+const (
+	grantPassword          = "password"
+	grantClientCredentials = "client_credentials"
+	grantRefreshToken      = "refresh_token"
+
+	oauthClientPrefix = "gmc_"
+
+	defaultAccessTokenTTL  = 15 * time.Minute
+	defaultRefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+var grantTypes = []string{grantPassword, grantClientCredentials, grantRefreshToken}
+
+func oauthIssuer() string {
+	if issuer := os.Getenv("OAUTH_ISSUER"); issuer != "" {
+		return issuer
+	}
+
+	return "http://authentication-service"
+}
+
+func accessTokenTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("OAUTH_ACCESS_TOKEN_TTL")); err == nil && d > 0 {
+		return d
+	}
+
+	return defaultAccessTokenTTL
+}
+
+func refreshTokenTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("OAUTH_REFRESH_TOKEN_TTL")); err == nil && d > 0 {
+		return d
+	}
+
+	return defaultRefreshTokenTTL
+}
+
+// oauthError is an error response of RFC 6749, section 5.2.
+type oauthError struct {
+	status      int
+	retryAfter  time.Duration
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func newOAuthError(status int, code, description string) *oauthError {
+	return &oauthError{status: status, Code: code, Description: description}
+}
+
+func (app *Config) writeOAuthError(w http.ResponseWriter, err *oauthError) {
+	if err.retryAfter > 0 {
+		setRetryAfter(w, err.retryAfter)
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	app.writeJson(w, err.status, err)
+}
+
+// readForm parses the form of a request to an OAuth2 endpoint.
+func readForm(w http.ResponseWriter, r *http.Request) *oauthError {
+	r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+
+	if err := r.ParseForm(); err != nil {
+		return newOAuthError(http.StatusBadRequest, "invalid_request", "the body must be a form")
+	}
+
+	return nil
+}
+
+// authenticateClient checks the client's credentials, from HTTP Basic auth
+// or the form.
+func (app *Config) authenticateClient(w http.ResponseWriter, r *http.Request) (*data.OAuthClient, *oauthError) {
+	clientID, secret, basic := r.BasicAuth()
+	if !basic {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	invalid := newOAuthError(http.StatusUnauthorized, "invalid_client", "unknown client or wrong secret")
+	if basic {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+
+	if clientID == "" || secret == "" {
+		return nil, invalid
+	}
+
+	client, err := app.Models.OAuth.Client(r.Context(), clientID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, invalid
+	}
+	if err != nil {
+		return nil, newOAuthError(http.StatusInternalServerError, "server_error", "")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(client.SecretHash)) != 1 {
+		return nil, invalid
+	}
+
+	return client, nil
+}
+
+// grantScopes returns the scopes asked for, space separated, if they're all
+// allowed, or all that are allowed if none are asked for.
+func grantScopes(requested string, allowed []string) ([]string, *oauthError) {
+	if requested == "" {
+		scopes := slices.Clone(allowed)
+		slices.Sort(scopes)
+		return slices.Compact(scopes), nil
+	}
+
+	scopes := strings.Fields(requested)
+	slices.Sort(scopes)
+	scopes = slices.Compact(scopes)
+
+	for _, scope := range scopes {
+		if !slices.Contains(allowed, scope) {
+			return nil, newOAuthError(http.StatusBadRequest, "invalid_scope", fmt.Sprintf("scope %q can't be granted", scope))
+		}
+	}
+
+	return scopes, nil
+}
+
+// intersect returns the scopes that are also in allowed.
+func intersect(scopes, allowed []string) []string {
+	return slices.DeleteFunc(slices.Clone(scopes), func(scope string) bool {
+		return !slices.Contains(allowed, scope)
+	})
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+// Token is the token endpoint.
+func (app *Config) Token(w http.ResponseWriter, r *http.Request) {
+	if err := readForm(w, r); err != nil {
+		app.writeOAuthError(w, err)
+		return
+	}
+
+	client, oerr := app.authenticateClient(w, r)
+	if oerr != nil {
+		app.writeOAuthError(w, oerr)
+		return
+	}
+
+	grantType := r.PostForm.Get("grant_type")
+	if !slices.Contains(grantTypes, grantType) {
+		app.writeOAuthError(w, newOAuthError(http.StatusBadRequest, "unsupported_grant_type", ""))
+		return
+	}
+
+	if !client.Allows(grantType) {
+		app.writeOAuthError(w, newOAuthError(http.StatusBadRequest, "unauthorized_client", fmt.Sprintf("the client may not use the %s grant", grantType)))
+		return
+	}
+
+	var response *tokenResponse
+	switch grantType {
+	case grantPassword:
+		response, oerr = app.passwordGrant(r, client)
+	case grantClientCredentials:
+		response, oerr = app.clientCredentialsGrant(r, client)
+	case grantRefreshToken:
+		response, oerr = app.refreshTokenGrant(r, client)
+	}
+	if oerr != nil {
+		app.writeOAuthError(w, oerr)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	app.writeJson(w, http.StatusOK, response)
+}
+
+func (app *Config) passwordGrant(r *http.Request, client *data.OAuthClient) (*tokenResponse, *oauthError) {
+	username, password := r.PostForm.Get("username"), r.PostForm.Get("password")
+	if username == "" || password == "" {
+		return nil, newOAuthError(http.StatusBadRequest, "invalid_request", "username and password are required")
+	}
+
+	// * the same checks, lockouts and events as /authenticate
+	user, login, refused := app.checkCredentials(r, username, password)
+	if refused != nil {
+		oerr := newOAuthError(http.StatusBadRequest, "invalid_grant", refused.err.Error())
+		if refused.status == http.StatusTooManyRequests {
+			oerr.status, oerr.retryAfter = refused.status, refused.retryAfter
+		}
+		return nil, oerr
+	}
+
+	tf, err := app.Models.TwoFactor.Get(r.Context(), user.ID)
+	if err != nil {
+		return nil, newOAuthError(http.StatusInternalServerError, "server_error", "")
+	}
+
+	if tf.Enabled {
+		return nil, newOAuthError(http.StatusBadRequest, "invalid_grant", "the user has two-factor authentication, log in through /authenticate")
+	}
+
+	app.clearFailures(r, user)
+
+	access, err := app.Models.Role.ForUser(r.Context(), user.ID)
+	if err != nil {
+		return nil, newOAuthError(http.StatusInternalServerError, "server_error", "")
+	}
+
+	scopes, oerr := grantScopes(r.PostForm.Get("scope"), intersect(client.Scopes, access.Permissions))
+	if oerr != nil {
+		return nil, oerr
+	}
+
+	app.recordEvent(r.Context(), "user.login.succeeded", login)
+
+	response, err := app.issueAccessToken(client, strconv.Itoa(user.ID), user.Email, scopes)
+	if err != nil {
+		return nil, newOAuthError(http.StatusInternalServerError, "server_error", "")
+	}
+
+	if client.Allows(grantRefreshToken) {
+		token, hash, err := newToken()
+		if err != nil {
+			return nil, newOAuthError(http.StatusInternalServerError, "server_error", "")
+		}
+
+		err = app.Models.OAuth.CreateRefreshToken(r.Context(), data.RefreshToken{
+			ClientID:  client.ID,
+			UserID:    user.ID,
+			Scopes:    scopes,
+			ExpiresAt: time.Now().Add(app.RefreshTokenTTL),
+		}, hash)
+		if err != nil {
+			return nil, newOAuthError(http.StatusInternalServerError, "server_error", "")
+		}
+
+		response.RefreshToken = token
+	}
+
+	return response, nil
+}
+
+func (app *Config) clientCredentialsGrant(r *http.Request, client *data.OAuthClient) (*tokenResponse, *oauthError) {
+	scopes, oerr := grantScopes(r.PostForm.Get("scope"), client.Scopes)
+	if oerr != nil {
+		return nil, oerr
+	}
+
+	// * no refresh token, the client can simply ask again
+	response, err := app.issueAccessToken(client, client.ClientID, "", scopes)
+	if err != nil {
+		return nil, newOAuthError(http.StatusInternalServerError, "server_error", "")
+	}
+
+	return response, nil
+}
+
+func (app *Config) refreshTokenGrant(r *http.Request, client *data.OAuthClient) (*tokenResponse, *oauthError) {
+	refreshToken := r.PostForm.Get("refresh_token")
+	if refreshToken == "" {
+		return nil, newOAuthError(http.StatusBadRequest, "invalid_request", "refresh_token is required")
+	}
+
+	invalid := newOAuthError(http.StatusBadRequest, "invalid_grant", data.ErrInvalidToken.Error())
+
+	token, hash, err := newToken()
+	if err != nil {
+		return nil, newOAuthError(http.StatusInternalServerError, "server_error", "")
+	}
+
+	old, err := app.Models.OAuth.RotateRefreshToken(r.Context(), client.ID, hashToken(refreshToken), hash, time.Now().Add(app.RefreshTokenTTL))
+	if errors.Is(err, data.ErrInvalidToken) {
+		return nil, invalid
+	}
+	if err != nil {
+		return nil, newOAuthError(http.StatusInternalServerError, "server_error", "")
+	}
+
+	user, err := app.Models.User.GetOne(r.Context(), old.UserID)
+	if err != nil || user.Active != 1 {
+		// * the new token was already stored, it can't be left usable
+		if err := app.Models.OAuth.RevokeRefreshToken(r.Context(), client.ID, hash); err != nil {
+			log.Println("Revoking the rotated refresh token failed:", err)
+			return nil, newOAuthError(http.StatusInternalServerError, "server_error", "")
+		}
+		return nil, invalid
+	}
+
+	access, err := app.Models.Role.ForUser(r.Context(), user.ID)
+	if err != nil {
+		return nil, newOAuthError(http.StatusInternalServerError, "server_error", "")
+	}
+
+	// * the user may have lost permissions since the token was issued
+	scopes, oerr := grantScopes(r.PostForm.Get("scope"), intersect(old.Scopes, access.Permissions))
+	if oerr != nil {
+		return nil, oerr
+	}
+
+	response, err := app.issueAccessToken(client, strconv.Itoa(user.ID), user.Email, scopes)
+	if err != nil {
+		return nil, newOAuthError(http.StatusInternalServerError, "server_error", "")
+	}
+	response.RefreshToken = token
+
+	return response, nil
+}
+
+// issueAccessToken signs an access token for the subject.
+func (app *Config) issueAccessToken(client *data.OAuthClient, subject, email string, scopes []string) (*tokenResponse, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	claims := accessClaims{
+		Issuer:    app.OAuthIssuer,
+		Subject:   subject,
+		ClientID:  client.ClientID,
+		Scope:     strings.Join(scopes, " "),
+		Email:     email,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(app.AccessTokenTTL).Unix(),
+		ID:        hex.EncodeToString(jti),
+	}
+
+	token, err := app.signJWT(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(app.AccessTokenTTL / time.Second),
+		Scope:       claims.Scope,
+	}, nil
+}
+
+// RevokeToken revokes an access or refresh token of the client. Unknown
+// tokens and tokens of other clients are ignored, the answer is the same.
+func (app *Config) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	if err := readForm(w, r); err != nil {
+		app.writeOAuthError(w, err)
+		return
+	}
+
+	client, oerr := app.authenticateClient(w, r)
+	if oerr != nil {
+		app.writeOAuthError(w, oerr)
+		return
+	}
+
+	token := r.PostForm.Get("token")
+	if token == "" {
+		app.writeOAuthError(w, newOAuthError(http.StatusBadRequest, "invalid_request", "token is required"))
+		return
+	}
+
+	// * token_type_hint isn't needed, access tokens are JWTs and refresh tokens aren't
+	var err error
+	if claims, jwtErr := app.parseJWT(token); jwtErr == nil {
+		if claims.ClientID == client.ClientID {
+			err = app.Models.OAuth.RevokeAccessToken(r.Context(), claims.ID, time.Unix(claims.ExpiresAt, 0))
+		}
+	} else {
+		err = app.Models.OAuth.RevokeRefreshToken(r.Context(), client.ID, hashToken(token))
+	}
+	if err != nil {
+		app.writeOAuthError(w, newOAuthError(http.StatusServiceUnavailable, "temporarily_unavailable", ""))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// tokenIntrospection leaves out everything but Active for a token that's no
+// good.
+type tokenIntrospection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	Issuer    string `json:"iss,omitempty"`
+	ID        string `json:"jti,omitempty"`
+}
+
+// IntrospectToken tells an authenticated client whether a token is good.
+func (app *Config) IntrospectToken(w http.ResponseWriter, r *http.Request) {
+	if err := readForm(w, r); err != nil {
+		app.writeOAuthError(w, err)
+		return
+	}
+
+	if _, oerr := app.authenticateClient(w, r); oerr != nil {
+		app.writeOAuthError(w, oerr)
+		return
+	}
+
+	result, err := app.introspectToken(r, r.PostForm.Get("token"))
+	if err != nil {
+		app.writeOAuthError(w, newOAuthError(http.StatusServiceUnavailable, "temporarily_unavailable", ""))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	app.writeJson(w, http.StatusOK, result)
+}
+
+func (app *Config) introspectToken(r *http.Request, token string) (tokenIntrospection, error) {
+	if token == "" {
+		return tokenIntrospection{}, nil
+	}
+
+	if claims, err := app.parseJWT(token); err == nil {
+		return app.introspectAccessToken(r, claims)
+	}
+
+	refresh, err := app.Models.OAuth.RefreshToken(r.Context(), hashToken(token))
+	if errors.Is(err, data.ErrInvalidToken) {
+		return tokenIntrospection{}, nil
+	}
+	if err != nil {
+		return tokenIntrospection{}, err
+	}
+
+	user, active, err := app.activeUser(r, refresh.UserID)
+	if err != nil || !active {
+		return tokenIntrospection{}, err
+	}
+
+	if _, err := app.Models.OAuth.Client(r.Context(), refresh.Client); err != nil {
+		return tokenIntrospection{}, ignoreNoRows(err)
+	}
+
+	return tokenIntrospection{
+		Active:    true,
+		Scope:     strings.Join(refresh.Scopes, " "),
+		ClientID:  refresh.Client,
+		Username:  user.Email,
+		TokenType: "refresh_token",
+		ExpiresAt: refresh.ExpiresAt.Unix(),
+		Subject:   strconv.Itoa(user.ID),
+		Issuer:    app.OAuthIssuer,
+	}, nil
+}
+
+func (app *Config) introspectAccessToken(r *http.Request, claims *accessClaims) (tokenIntrospection, error) {
+	revoked, err := app.Models.OAuth.AccessTokenRevoked(r.Context(), claims.ID)
+	if err != nil || revoked {
+		return tokenIntrospection{}, err
+	}
+
+	// * a revoked client's tokens are no good either
+	if _, err := app.Models.OAuth.Client(r.Context(), claims.ClientID); err != nil {
+		return tokenIntrospection{}, ignoreNoRows(err)
+	}
+
+	result := tokenIntrospection{
+		Active:    true,
+		Scope:     claims.Scope,
+		ClientID:  claims.ClientID,
+		TokenType: "Bearer",
+		ExpiresAt: claims.ExpiresAt,
+		IssuedAt:  claims.IssuedAt,
+		Subject:   claims.Subject,
+		Issuer:    claims.Issuer,
+		ID:        claims.ID,
+	}
+
+	if claims.forUser() {
+		id, err := strconv.Atoi(claims.Subject)
+		if err != nil {
+			return tokenIntrospection{}, nil
+		}
+
+		user, active, err := app.activeUser(r, id)
+		if err != nil || !active {
+			return tokenIntrospection{}, err
+		}
+		result.Username = user.Email
+	}
+
+	return result, nil
+}
+
+// activeUser returns the user, if they still exist and are active.
+func (app *Config) activeUser(r *http.Request, id int) (*data.User, bool, error) {
+	user, err := app.Models.User.GetOne(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	return user, user.Active == 1, nil
+}
+
+func ignoreNoRows(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+
+	return err
+}
+
+type CreateOAuthClientPayload struct {
+	Name       string   `json:"name"`
+	GrantTypes []string `json:"grant_types"`
+	Scopes     []string `json:"scopes"`
+}
+
+type createdOAuthClient struct {
+	*data.OAuthClient
+	ClientSecret string `json:"client_secret"`
+}
+
+func (app *Config) CreateOAuthClient(w http.ResponseWriter, r *http.Request) {
+	var requestPayload CreateOAuthClientPayload
+
+	err := app.readJson(w, r, &requestPayload)
+	if err != nil {
+		app.errorJson(w, err, http.StatusBadRequest)
+		return
+	}
+
+	client := data.OAuthClient{
+		Name:       strings.TrimSpace(requestPayload.Name),
+		GrantTypes: slices.Compact(slices.Sorted(slices.Values(requestPayload.GrantTypes))),
+	}
+
+	if len(client.Name) > 255 {
+		app.errorJson(w, errors.New("name must be at most 255 characters"), http.StatusBadRequest)
+		return
+	}
+
+	if len(client.GrantTypes) == 0 {
+		app.errorJson(w, errors.New("a client needs at least one grant type"), http.StatusBadRequest)
+		return
+	}
+
+	for _, grantType := range client.GrantTypes {
+		if !slices.Contains(grantTypes, grantType) {
+			app.errorJson(w, fmt.Errorf("unsupported grant type %q", grantType), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if client.Allows(grantRefreshToken) && !client.Allows(grantPassword) {
+		app.errorJson(w, errors.New("refresh tokens only come with the password grant"), http.StatusBadRequest)
+		return
+	}
+
+	client.Scopes, err = app.checkScopes(r.Context(), nil, requestPayload.Scopes)
+	if err != nil {
+		app.errorJson(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if err := checkGrantable(r, client.Scopes); err != nil {
+		app.errorJson(w, err, http.StatusForbidden)
+		return
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		app.errorJson(w, err)
+		return
+	}
+	client.ClientID = oauthClientPrefix + hex.EncodeToString(id)
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		app.errorJson(w, err)
+		return
+	}
+	clientSecret := base64.RawURLEncoding.EncodeToString(secret)
+
+	client.ID, err = app.Models.OAuth.CreateClient(r.Context(), client, hashToken(clientSecret))
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+	client.CreatedAt = time.Now().UTC()
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Registered client %s, store the secret now, it isn't shown again", client.ClientID),
+		Data:    createdOAuthClient{OAuthClient: &client, ClientSecret: clientSecret},
+	}
+
+	app.writeJson(w, http.StatusCreated, payload)
+}
+
+func (app *Config) ListOAuthClients(w http.ResponseWriter, r *http.Request) {
+	clients, err := app.Models.OAuth.ListClients(r.Context())
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("%d client(s)", len(clients)),
+		Data:    clients,
+	}
+
+	app.writeJson(w, http.StatusOK, payload)
+}
+
+// RevokeOAuthClient revokes the client and its refresh tokens. Its access
+// tokens stop passing introspection, but stay good for offline checks until
+// they expire.
+func (app *Config) RevokeOAuthClient(w http.ResponseWriter, r *http.Request) {
+	clientID := chi.URLParam(r, "client")
+
+	err := app.Models.OAuth.RevokeClient(r.Context(), clientID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJson(w, errors.New("client not found or revoked already"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Revoked client %s", clientID),
+	}
+
+	app.writeJson(w, http.StatusOK, payload)
+}
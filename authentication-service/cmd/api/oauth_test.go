@@ -0,0 +1,334 @@
+package main
+
+import (
+	"authentication/data"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	testKeysOnce sync.Once
+	testKeys     [2]*rsa.PrivateKey // * the signing key and another one
+)
+
+// withOAuth sets up the app to issue tokens. The keys are shared by every
+// test, generating them is slow.
+func withOAuth(t *testing.T, app *Config) {
+	t.Helper()
+
+	testKeysOnce.Do(func() {
+		for i := range testKeys {
+			key, err := rsa.GenerateKey(rand.Reader, signingKeyBits)
+			if err != nil {
+				panic(err)
+			}
+			testKeys[i] = key
+		}
+	})
+
+	app.OAuthKey = testKeys[0]
+	app.OAuthKeyID = keyID(&testKeys[0].PublicKey)
+	app.OAuthIssuer = "http://test"
+	app.AccessTokenTTL = time.Minute
+	app.RefreshTokenTTL = time.Hour
+}
+
+// signTestJWT signs the claims with key under any header, unlike signJWT.
+func signTestJWT(t *testing.T, key *rsa.PrivateKey, header jwtHeader, claims accessClaims) string {
+	t.Helper()
+
+	h, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+
+	sum := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestParseJWT(t *testing.T) {
+	app := newTestApp(t)
+	withOAuth(t, app)
+
+	now := time.Now()
+	good := accessClaims{
+		Issuer:    app.OAuthIssuer,
+		Subject:   "gmc_client",
+		ClientID:  "gmc_client",
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(time.Minute).Unix(),
+		ID:        "jti",
+	}
+	header := jwtHeader{Algorithm: "RS256", Type: "at+jwt", KeyID: app.OAuthKeyID}
+
+	expired, otherIssuer, noID := good, good, good
+	expired.ExpiresAt = now.Add(-time.Second).Unix()
+	otherIssuer.Issuer = "http://elsewhere"
+	noID.ID = ""
+
+	signed, err := app.signJWT(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(signed, ".")
+
+	tampered := good
+	tampered.Subject = "1"
+	tamperedPayload, _ := json.Marshal(tampered)
+
+	noneHeader, _ := json.Marshal(jwtHeader{Algorithm: "none", KeyID: app.OAuthKeyID})
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"signed by signJWT", signed, true},
+		{"signed by the test helper", signTestJWT(t, testKeys[0], header, good), true},
+		{"wrong alg", signTestJWT(t, testKeys[0], jwtHeader{Algorithm: "HS256", KeyID: app.OAuthKeyID}, good), false},
+		{"alg none", base64.RawURLEncoding.EncodeToString(noneHeader) + "." + parts[1] + ".", false},
+		{"wrong kid", signTestJWT(t, testKeys[0], jwtHeader{Algorithm: "RS256", KeyID: "other"}, good), false},
+		{"other key", signTestJWT(t, testKeys[1], header, good), false},
+		{"other key under its own kid", signTestJWT(t, testKeys[1], jwtHeader{Algorithm: "RS256", KeyID: keyID(&testKeys[1].PublicKey)}, good), false},
+		{"tampered payload", parts[0] + "." + base64.RawURLEncoding.EncodeToString(tamperedPayload) + "." + parts[2], false},
+		{"expired", signTestJWT(t, testKeys[0], header, expired), false},
+		{"other issuer", signTestJWT(t, testKeys[0], header, otherIssuer), false},
+		{"no jti", signTestJWT(t, testKeys[0], header, noID), false},
+		{"not a JWT", "not-a-jwt", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := app.parseJWT(tt.token)
+			if tt.valid && (err != nil || claims.Subject != good.Subject) {
+				t.Errorf("got %v, %v, want the claims", claims, err)
+			}
+			if !tt.valid && err != errInvalidJWT {
+				t.Errorf("got %v, %v, want %v", claims, err, errInvalidJWT)
+			}
+		})
+	}
+}
+
+// createClient registers a client through the admin API and returns its id
+// and secret.
+func createClient(t *testing.T, app *Config, grantTypes, scopes []string) (string, string) {
+	t.Helper()
+
+	status, response := call(t, app, http.MethodPost, "/oauth/clients", testAdminToken, CreateOAuthClientPayload{
+		Name:       "test",
+		GrantTypes: grantTypes,
+		Scopes:     scopes,
+	})
+	if status != http.StatusCreated {
+		t.Fatalf("creating a client answered %d: %s", status, response.Message)
+	}
+
+	created := decode[struct {
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+	}](t, response)
+
+	return created.ClientID, created.ClientSecret
+}
+
+// postForm posts the form to an OAuth2 endpoint as the client and decodes
+// the answer, if there is one, into a T.
+func postForm[T any](t *testing.T, app *Config, path, clientID, secret string, form url.Values) (int, T) {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth(clientID, secret)
+
+	w := httptest.NewRecorder()
+	app.routes().ServeHTTP(w, r)
+
+	var v T
+	if w.Body.Len() == 0 {
+		return w.Code, v
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+		t.Fatalf("%s answered %d with %q: %v", path, w.Code, w.Body.String(), err)
+	}
+
+	return w.Code, v
+}
+
+type testTokenResponse struct {
+	tokenResponse
+	Error string `json:"error"`
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	app := newTestApp(t)
+	withOAuth(t, app)
+	addUser(t, app, data.User{Email: "ann@example.com", Active: 1})
+
+	clientID, secret := createClient(t, app, []string{grantPassword, grantRefreshToken}, []string{"logs.write"})
+
+	status, first := postForm[testTokenResponse](t, app, "/oauth/token", clientID, secret, url.Values{
+		"grant_type": {grantPassword},
+		"username":   {"ann@example.com"},
+		"password":   {"correct horse battery"},
+	})
+	if status != http.StatusOK || first.RefreshToken == "" {
+		t.Fatalf("password grant answered %d %q without a refresh token", status, first.Error)
+	}
+
+	refresh := func(token string) (int, testTokenResponse) {
+		return postForm[testTokenResponse](t, app, "/oauth/token", clientID, secret, url.Values{
+			"grant_type":    {grantRefreshToken},
+			"refresh_token": {token},
+		})
+	}
+
+	status, second := refresh(first.RefreshToken)
+	if status != http.StatusOK || second.RefreshToken == "" || second.RefreshToken == first.RefreshToken {
+		t.Fatalf("refreshing answered %d %q, want a new refresh token", status, second.Error)
+	}
+
+	otherID, otherSecret := createClient(t, app, []string{grantPassword, grantRefreshToken}, []string{"logs.write"})
+	status, other := postForm[testTokenResponse](t, app, "/oauth/token", otherID, otherSecret, url.Values{
+		"grant_type":    {grantRefreshToken},
+		"refresh_token": {second.RefreshToken},
+	})
+	if status != http.StatusBadRequest {
+		t.Errorf("refresh token of another client answered %d %q, want %d", status, other.Error, http.StatusBadRequest)
+	}
+
+	if status, response := refresh(first.RefreshToken); status != http.StatusBadRequest || response.Error != "invalid_grant" {
+		t.Errorf("reusing a rotated refresh token answered %d %q, want %d invalid_grant", status, response.Error, http.StatusBadRequest)
+	}
+
+	// * a reused token means it leaked, so the tokens rotated from it are revoked too
+	if status, response := refresh(second.RefreshToken); status != http.StatusBadRequest {
+		t.Errorf("refresh token after a reuse answered %d %q, want %d", status, response.Error, http.StatusBadRequest)
+	}
+}
+
+func TestRefreshNarrowsScopes(t *testing.T) {
+	app := newTestApp(t)
+	withOAuth(t, app)
+	ann := addUser(t, app, data.User{Email: "ann@example.com", Active: 1}, "admin")
+
+	clientID, secret := createClient(t, app, []string{grantPassword, grantRefreshToken}, []string{"logs.write", "users.read"})
+
+	status, first := postForm[testTokenResponse](t, app, "/oauth/token", clientID, secret, url.Values{
+		"grant_type": {grantPassword},
+		"username":   {"ann@example.com"},
+		"password":   {"correct horse battery"},
+	})
+	if status != http.StatusOK || first.Scope != "logs.write users.read" {
+		t.Fatalf("password grant answered %d with scope %q, want logs.write users.read", status, first.Scope)
+	}
+
+	if err := app.Models.Role.Revoke(context.Background(), ann.ID, "admin"); err != nil {
+		t.Fatal(err)
+	}
+
+	status, second := postForm[testTokenResponse](t, app, "/oauth/token", clientID, secret, url.Values{
+		"grant_type":    {grantRefreshToken},
+		"refresh_token": {first.RefreshToken},
+	})
+	if status != http.StatusOK || second.Scope != "logs.write" {
+		t.Fatalf("refreshing answered %d with scope %q, want logs.write only", status, second.Scope)
+	}
+
+	claims, err := app.parseJWT(second.AccessToken)
+	if err != nil || claims.Scope != "logs.write" {
+		t.Errorf("access token has scope %v, %v, want logs.write only", claims, err)
+	}
+
+	status, asked := postForm[testTokenResponse](t, app, "/oauth/token", clientID, secret, url.Values{
+		"grant_type":    {grantRefreshToken},
+		"refresh_token": {second.RefreshToken},
+		"scope":         {"users.read"},
+	})
+	if status != http.StatusBadRequest || asked.Error != "invalid_scope" {
+		t.Errorf("asking for a lost scope answered %d %q, want %d invalid_scope", status, asked.Error, http.StatusBadRequest)
+	}
+}
+
+func TestIntrospectToken(t *testing.T) {
+	app := newTestApp(t)
+	withOAuth(t, app)
+
+	clientID, secret := createClient(t, app, []string{grantClientCredentials}, []string{"logs.write"})
+	otherID, otherSecret := createClient(t, app, []string{grantClientCredentials}, []string{"logs.write"})
+
+	issue := func() string {
+		status, response := postForm[testTokenResponse](t, app, "/oauth/token", clientID, secret, url.Values{
+			"grant_type": {grantClientCredentials},
+		})
+		if status != http.StatusOK {
+			t.Fatalf("client credentials grant answered %d %q", status, response.Error)
+		}
+		return response.AccessToken
+	}
+
+	introspect := func(token string) tokenIntrospection {
+		status, result := postForm[tokenIntrospection](t, app, "/oauth/introspect", otherID, otherSecret, url.Values{"token": {token}})
+		if status != http.StatusOK {
+			t.Fatalf("introspecting answered %d", status)
+		}
+		return result
+	}
+
+	token := issue()
+	if result := introspect(token); !result.Active || result.ClientID != clientID || result.Scope != "logs.write" {
+		t.Errorf("fresh token introspects as %+v, want active for %s", result, clientID)
+	}
+
+	if result := introspect("not-a-token"); result.Active {
+		t.Error("unknown token introspects as active")
+	}
+
+	revoked := issue()
+	if status, _ := postForm[testTokenResponse](t, app, "/oauth/revoke", clientID, secret, url.Values{"token": {revoked}}); status != http.StatusOK {
+		t.Fatalf("revoking answered %d", status)
+	}
+	if result := introspect(revoked); result.Active {
+		t.Error("revoked token introspects as active")
+	}
+
+	app.AccessTokenTTL = -time.Second
+	if result := introspect(issue()); result.Active {
+		t.Error("expired token introspects as active")
+	}
+
+	if status, response := call(t, app, http.MethodDelete, "/oauth/clients/"+clientID, testAdminToken, nil); status != http.StatusOK {
+		t.Fatalf("revoking the client answered %d: %s", status, response.Message)
+	}
+	if result := introspect(token); result.Active {
+		t.Error("token of a revoked client introspects as active")
+	}
+
+	if status, _ := postForm[testTokenResponse](t, app, "/oauth/introspect", clientID, secret, url.Values{"token": {token}}); status != http.StatusUnauthorized {
+		t.Errorf("revoked client introspecting answered %d, want %d", status, http.StatusUnauthorized)
+	}
+}
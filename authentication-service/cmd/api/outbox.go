@@ -0,0 +1,108 @@
+package main
+
+import (
+	"authentication/data"
+	"context"
+	"fmt"
+	"log"
+	"shared/topology"
+	"time"
+)
+
+const (
+	outboxExchange  = topology.EventsExchange
+	outboxInterval  = time.Second
+	outboxBatchSize = 100
+
+	// published events are kept this long, for looking into what was sent
+	outboxRetention     = 7 * 24 * time.Hour
+	outboxPruneInterval = time.Hour
+)
+
+// relayOutbox publishes recorded events to RabbitMQ until the connection
+// closes. Events are marked as published only once the broker confirmed them,
+// so a crash can publish an event twice but never lose one.
+func (app *Config) relayOutbox() {
+	ch, err := app.Rabbit.Channel()
+	if err != nil {
+		log.Panicln(err)
+	}
+	defer ch.Close()
+
+	_, err = topology.Declare(ch)
+	if err != nil {
+		log.Panicln(err)
+	}
+
+	// * publisher confirms, so we know the broker has the event
+	err = ch.Confirm(false)
+	if err != nil {
+		log.Panicln(err)
+	}
+
+	publish := func(event data.OutboxEvent) error {
+		publishing, err := event.Envelope.Publishing()
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		confirmation, err := ch.PublishWithDeferredConfirmWithContext(ctx, outboxExchange, event.RoutingKey, false, false, publishing)
+		if err != nil {
+			return err
+		}
+
+		acked, err := confirmation.WaitContext(ctx)
+		if err != nil {
+			return err
+		}
+		if !acked {
+			return fmt.Errorf("broker nacked event %s", event.Envelope.ID)
+		}
+
+		return nil
+	}
+
+	ticker := time.NewTicker(outboxInterval)
+	defer ticker.Stop()
+
+	var pruned time.Time
+	for range ticker.C {
+		if ch.IsClosed() {
+			log.Panicln("outbox channel closed")
+		}
+
+		// keep going while there is a backlog
+		for {
+			published, err := app.Models.Outbox.Relay(context.Background(), outboxBatchSize, publish)
+			if err != nil {
+				log.Println("Relaying outbox failed:", err)
+				break
+			}
+
+			if published < outboxBatchSize {
+				break
+			}
+		}
+
+		if time.Since(pruned) >= outboxPruneInterval {
+			pruned = time.Now()
+			app.pruneOutbox()
+		}
+	}
+}
+
+// pruneOutbox deletes the events published longer than outboxRetention ago.
+func (app *Config) pruneOutbox() {
+	count, err := app.Models.Outbox.Prune(context.Background(), time.Now().Add(-outboxRetention))
+	if err != nil {
+		log.Println("Pruning outbox failed:", err)
+		return
+	}
+
+	if count > 0 {
+		log.Printf("Pruned %d published events from the outbox", count)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	defaultPasswordMinLength = 8
+	maxPasswordLength        = 72 // * bcrypt ignores everything after 72 bytes
+)
+
+// PasswordPolicy is what a new password has to look like. It's read from the
+// PASSWORD_* environment variables.
+type PasswordPolicy struct {
+	MinLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+}
+
+func passwordPolicy() PasswordPolicy {
+	policy := PasswordPolicy{
+		MinLength:     defaultPasswordMinLength,
+		RequireUpper:  os.Getenv("PASSWORD_REQUIRE_UPPER") == "true",
+		RequireLower:  os.Getenv("PASSWORD_REQUIRE_LOWER") == "true",
+		RequireDigit:  os.Getenv("PASSWORD_REQUIRE_DIGIT") == "true",
+		RequireSymbol: os.Getenv("PASSWORD_REQUIRE_SYMBOL") == "true",
+	}
+
+	if n, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH")); err == nil && n > 0 {
+		policy.MinLength = n
+	}
+
+	return policy
+}
+
+// Validate returns an error naming every rule the password breaks.
+func (p PasswordPolicy) Validate(password string) error {
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			symbol = true
+		}
+	}
+
+	var problems []string
+
+	if len([]rune(password)) < p.MinLength {
+		problems = append(problems, fmt.Sprintf("be at least %d characters long", p.MinLength))
+	}
+
+	if len(password) > maxPasswordLength {
+		problems = append(problems, fmt.Sprintf("be at most %d bytes long", maxPasswordLength))
+	}
+
+	if p.RequireUpper && !upper {
+		problems = append(problems, "contain an upper case letter")
+	}
+
+	if p.RequireLower && !lower {
+		problems = append(problems, "contain a lower case letter")
+	}
+
+	if p.RequireDigit && !digit {
+		problems = append(problems, "contain a digit")
+	}
+
+	if p.RequireSymbol && !symbol {
+		problems = append(problems, "contain a symbol")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("password must %s", strings.Join(problems, ", "))
+	}
+
+	return nil
+}
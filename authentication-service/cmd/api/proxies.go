@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NOTE: Trusted proxies
+/*
+	Lockouts and rate limits count per client address. Behind the broker that
+	is the address it puts in X-Forwarded-For, but anyone else could send the
+	header too, with a new address on every request. So it's only believed
+	from TRUSTED_PROXIES, a comma separated list of addresses, CIDRs and host
+	names:
+
+	TRUSTED_PROXIES=broker-service,10.0.0.0/8
+
+	Host names are looked up again every minute, containers get a new address
+	when they restart. Without TRUSTED_PROXIES the header is ignored.
+*/
+
+const proxyLookupInterval = time.Minute
+
+type trustedProxies struct {
+	nets  []*net.IPNet
+	hosts []string
+
+	mu       sync.Mutex
+	resolved []net.IP
+	expires  time.Time
+}
+
+func proxiesFromEnv() *trustedProxies {
+	return parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+}
+
+func parseTrustedProxies(value string) *trustedProxies {
+	proxies := &trustedProxies{}
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+
+		if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+			proxies.nets = append(proxies.nets, ipNet)
+			continue
+		}
+
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 8 * net.IPv6len
+			}
+			proxies.nets = append(proxies.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		if entry != "" {
+			proxies.hosts = append(proxies.hosts, entry)
+		}
+	}
+
+	return proxies
+}
+
+// trusts tells whether the address belongs to a trusted proxy.
+func (p *trustedProxies) trusts(ip net.IP) bool {
+	if p == nil || ip == nil {
+		return false
+	}
+
+	for _, ipNet := range p.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	for _, resolved := range p.lookup() {
+		if resolved.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// lookup returns the addresses of the trusted host names, keeping the last
+// ones if looking them up fails.
+func (p *trustedProxies) lookup() []net.IP {
+	if len(p.hosts) == 0 {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if time.Now().Before(p.expires) {
+		return p.resolved
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var resolved []net.IP
+	for _, host := range p.hosts {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			log.Printf("Looking up trusted proxy %s failed: %v\r\n", host, err)
+			continue
+		}
+
+		for _, addr := range addrs {
+			resolved = append(resolved, addr.IP)
+		}
+	}
+
+	if len(resolved) > 0 {
+		p.resolved = resolved
+	}
+	p.expires = time.Now().Add(proxyLookupInterval)
+
+	return p.resolved
+}
+
+// clientIP is the address of the connection, or, when that is a trusted
+// proxy, the last address in X-Forwarded-For that isn't one.
+func (app *Config) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if !app.TrustedProxies.trusts(net.ParseIP(host)) {
+		return host
+	}
+
+	// * the header is read from the right, entries left of the proxies are the client's to make up
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			break
+		}
+
+		host = addr
+		if !app.TrustedProxies.trusts(ip) {
+			break
+		}
+	}
+
+	return host
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter allows limit hits per key in fixed windows. It lives in memory,
+// so every replica counts on its own and a restart forgets everything.
+type rateLimiter struct {
+	limit  int
+	window time.Duration
+
+	mu   sync.Mutex
+	hits map[string]*rateWindow
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:  limit,
+		window: window,
+		hits:   make(map[string]*rateWindow),
+	}
+}
+
+// Allow counts a hit for key and reports whether it's within the limit.
+func (l *rateLimiter) Allow(key string) bool {
+	return l.Hit(key) <= l.limit
+}
+
+// Hit counts a hit for key and returns the hits in the current window.
+func (l *rateLimiter) Hit(key string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+
+	// * drop finished windows now and then, so the map doesn't only grow
+	if len(l.hits) > 10_000 {
+		for k, w := range l.hits {
+			if now.Sub(w.start) >= l.window {
+				delete(l.hits, k)
+			}
+		}
+	}
+
+	w, ok := l.hits[key]
+	if !ok || now.Sub(w.start) >= l.window {
+		w = &rateWindow{start: now}
+		l.hits[key] = w
+	}
+
+	w.count++
+
+	return w.count
+}
+
+// Hits returns the hits for key in the current window, without counting one,
+// and how long until the window ends.
+func (l *rateLimiter) Hits(key string) (int, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	w, ok := l.hits[key]
+	if !ok {
+		return 0, 0
+	}
+
+	left := l.window - time.Since(w.start)
+	if left <= 0 {
+		return 0, 0
+	}
+
+	return w.count, left
+}
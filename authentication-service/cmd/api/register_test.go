@@ -0,0 +1,88 @@
+package main
+
+import (
+	"authentication/data"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRegister(t *testing.T) {
+	app := newTestApp(t)
+	addUser(t, app, data.User{Email: "taken@example.com", Active: 1})
+
+	tests := []struct {
+		name    string
+		payload RegisterPayload
+		status  int
+	}{
+		{"good", RegisterPayload{Email: "ann@example.com", FirstName: " Ann ", Password: "correct horse battery"}, http.StatusCreated},
+		{"email with spaces around", RegisterPayload{Email: " bob@example.com ", Password: "correct horse battery"}, http.StatusCreated},
+		{"email taken", RegisterPayload{Email: "taken@example.com", Password: "correct horse battery"}, http.StatusConflict},
+		{"email taken in another case", RegisterPayload{Email: "Taken@Example.com", Password: "correct horse battery"}, http.StatusConflict},
+		{"no email", RegisterPayload{Password: "correct horse battery"}, http.StatusBadRequest},
+		{"email with a name", RegisterPayload{Email: "Carl <carl@example.com>", Password: "correct horse battery"}, http.StatusBadRequest},
+		{"email without a domain", RegisterPayload{Email: "carl@localhost", Password: "correct horse battery"}, http.StatusBadRequest},
+		{"short password", RegisterPayload{Email: "carl@example.com", Password: "short"}, http.StatusBadRequest},
+		{"password too long", RegisterPayload{Email: "carl@example.com", Password: strings.Repeat("a", maxPasswordLength+1)}, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, response := call(t, app, http.MethodPost, "/users/register", "", tt.payload)
+			if status != tt.status {
+				t.Fatalf("answered %d: %s, want %d", status, response.Message, tt.status)
+			}
+			if status != http.StatusCreated {
+				return
+			}
+
+			if strings.Contains(string(response.Data), tt.payload.Password) {
+				t.Error("the answer contains the password")
+			}
+
+			user := decode[data.User](t, response)
+			if user.Email != strings.TrimSpace(tt.payload.Email) || user.FirstName != strings.TrimSpace(tt.payload.FirstName) {
+				t.Errorf("registered %q %q, want the payload trimmed", user.Email, user.FirstName)
+			}
+			if user.Verified() || user.Active != 1 {
+				t.Errorf("registered user is verified %v, active %d, want an active unverified user", user.Verified(), user.Active)
+			}
+
+			access, err := app.Models.Role.ForUser(context.Background(), user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(access.Roles) != 1 || access.Roles[0] != data.DefaultRole {
+				t.Errorf("registered user has roles %v, want only %s", access.Roles, data.DefaultRole)
+			}
+		})
+	}
+}
+
+// TestRegisteredUserLogsInOnceVerified goes from registering to the first login.
+func TestRegisteredUserLogsInOnceVerified(t *testing.T) {
+	app := newTestApp(t)
+
+	credentials := map[string]string{"email": "ann@example.com", "password": "correct horse battery"}
+
+	status, response := call(t, app, http.MethodPost, "/users/register", "", RegisterPayload{Email: credentials["email"], Password: credentials["password"]})
+	if status != http.StatusCreated {
+		t.Fatalf("registering answered %d: %s", status, response.Message)
+	}
+	user := decode[data.User](t, response)
+
+	if status, response := call(t, app, http.MethodPost, "/authenticate", "", credentials); status != http.StatusForbidden || response.Code != "email_unverified" {
+		t.Fatalf("login before verifying answered %d %q, want %d email_unverified", status, response.Code, http.StatusForbidden)
+	}
+
+	token := verificationToken(t, app, user.ID, user.Email, verificationTTL())
+	if status, response := call(t, app, http.MethodGet, "/verify?token="+token, "", nil); status != http.StatusOK {
+		t.Fatalf("verifying answered %d: %s", status, response.Message)
+	}
+
+	if status, response := call(t, app, http.MethodPost, "/authenticate", "", credentials); status != http.StatusOK {
+		t.Errorf("login after verifying answered %d: %s", status, response.Message)
+	}
+}
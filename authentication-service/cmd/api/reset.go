@@ -0,0 +1,207 @@
+package main
+
+import (
+	"authentication/data"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"shared/envelope"
+	"strings"
+	"time"
+)
+
+// NOTE: Password reset
+/*
+	POST /password/forgot {"email": "..."}
+		always answers 202, and mails a reset link if the email belongs to an
+		active user. The link is PASSWORD_RESET_URL with `?token=` appended.
+		Limited per email and per client address, like verification resends,
+		answering 429 beyond that whether or not the email is registered.
+
+	POST /password/reset {"token": "...", "password": "..."}
+		sets the password, the token can't be used again.
+*/
+
+const (
+	defaultResetTTL = time.Hour
+
+	// * reset requests per email and per client address in an hour
+	resetsPerEmail = 3
+	resetsPerIP    = 10
+)
+
+// newToken returns a random URL-safe token and the hash to store for it.
+func newToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	return token, hashToken(token), nil
+}
+
+// hashToken is what gets stored and looked up. Tokens have 256 random bits,
+// so a fast hash is enough: there is nothing to brute force.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func resetURL() string {
+	if u := os.Getenv("PASSWORD_RESET_URL"); u != "" {
+		return u
+	}
+
+	return "http://localhost/reset-password"
+}
+
+func resetTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("PASSWORD_RESET_TTL")); err == nil && d > 0 {
+		return d
+	}
+
+	return defaultResetTTL
+}
+
+type ForgotPasswordPayload struct {
+	Email string `json:"email"`
+}
+
+func (app *Config) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var requestPayload ForgotPasswordPayload
+
+	err := app.readJson(w, r, &requestPayload)
+	if err != nil {
+		app.errorJson(w, err, http.StatusBadRequest)
+		return
+	}
+
+	email := strings.TrimSpace(requestPayload.Email)
+	if !validEmail(email) {
+		app.errorJson(w, errors.New("invalid email address"), http.StatusBadRequest)
+		return
+	}
+
+	if !app.ResetByIP.Allow(app.clientIP(r)) || !app.ResetByEmail.Allow(strings.ToLower(email)) {
+		app.errorJson(w, errRateLimited, http.StatusTooManyRequests)
+		return
+	}
+
+	// * everything happens after answering, so neither the answer nor its
+	// * timing tells whether the email is registered
+	go app.sendResetLink(email)
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "If the email is registered, a reset link is on its way",
+	}
+
+	app.writeJson(w, http.StatusAccepted, payload)
+}
+
+func (app *Config) sendResetLink(email string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	user, err := app.Models.User.GetByEmail(ctx, email)
+	if err != nil || user.Active != 1 {
+		return
+	}
+
+	token, hash, err := newToken()
+	if err != nil {
+		log.Println("Creating reset token failed:", err)
+		return
+	}
+
+	ttl := app.ResetTTL
+	if ttl <= 0 {
+		ttl = defaultResetTTL
+	}
+	if err := app.Models.PasswordReset.Create(ctx, user.ID, hash, time.Now().Add(ttl)); err != nil {
+		log.Println("Storing reset token failed:", err)
+		return
+	}
+
+	link, err := url.Parse(app.ResetURL)
+	if err != nil {
+		log.Println("Invalid PASSWORD_RESET_URL:", err)
+		return
+	}
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+
+	name := user.FirstName
+	if name == "" {
+		name = user.Email
+	}
+
+	err = app.sendMail(ctx, envelope.MailData{
+		To:       user.Email,
+		Subject:  "Reset your password",
+		Template: "password-reset",
+		Fields: map[string]string{
+			"name":    name,
+			"link":    link.String(),
+			"expires": ttl.String(),
+		},
+	})
+	if err != nil {
+		log.Printf("Sending reset link to user %d failed: %v\r\n", user.ID, err)
+	}
+}
+
+type ResetPasswordPayload struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+func (app *Config) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var requestPayload ResetPasswordPayload
+
+	err := app.readJson(w, r, &requestPayload)
+	if err != nil {
+		app.errorJson(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if requestPayload.Token == "" {
+		app.errorJson(w, data.ErrInvalidToken, http.StatusBadRequest)
+		return
+	}
+
+	if err := app.PasswordPolicy.Validate(requestPayload.Password); err != nil {
+		app.errorJson(w, err, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := app.Models.PasswordReset.Consume(r.Context(), hashToken(requestPayload.Token), requestPayload.Password)
+	if errors.Is(err, data.ErrInvalidToken) {
+		app.errorJson(w, err, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	// * whoever knew the old password is logged out
+	app.revokeSessions(r, userID)
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Password changed",
+	}
+
+	app.writeJson(w, http.StatusOK, payload)
+}
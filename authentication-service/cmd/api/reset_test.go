@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestForgotPasswordIsRateLimited(t *testing.T) {
+	tests := []struct {
+		name    string
+		emails  func(i int) string
+		allowed int
+	}{
+		{"same email", func(i int) string { return "someone@example.com" }, resetsPerEmail},
+		{"same address", func(i int) string { return fmt.Sprintf("user%d@example.com", i) }, resetsPerIP},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+
+			for i := 0; i < tt.allowed; i++ {
+				status, _ := call(t, app, http.MethodPost, "/password/forgot", "", ForgotPasswordPayload{Email: tt.emails(i)})
+				if status != http.StatusAccepted {
+					t.Fatalf("request %d answered %d, want %d", i+1, status, http.StatusAccepted)
+				}
+			}
+
+			status, response := call(t, app, http.MethodPost, "/password/forgot", "", ForgotPasswordPayload{Email: tt.emails(tt.allowed)})
+			if status != http.StatusTooManyRequests || response.Code != "rate_limited" {
+				t.Errorf("request over the limit answered %d %q, want %d rate_limited", status, response.Code, http.StatusTooManyRequests)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"authentication/data"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// NOTE: Roles
+/*
+	Users have roles, roles grant permissions, e.g. `users.read` or
+	`mail.send`. The roles and what they grant are set up by migrations,
+	only who has which role changes at runtime:
+
+	curl -X PUT -H "Authorization: Bearer $ADMIN_API_TOKEN" localhost:8081/users/2/roles/admin
+
+	A login returns the user's roles and permissions, for the broker and
+	other services to authorize what the user does. The admin routes here
+	check them too, see admin.go.
+*/
+
+func (app *Config) ListRoles(w http.ResponseWriter, r *http.Request) {
+	roles, err := app.Models.Role.List(r.Context())
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("%d role(s)", len(roles)),
+		Data:    roles,
+	}
+
+	app.writeJson(w, http.StatusOK, payload)
+}
+
+func (app *Config) GetUserRoles(w http.ResponseWriter, r *http.Request) {
+	id, ok := app.userID(w, r)
+	if !ok {
+		return
+	}
+
+	access, err := app.Models.Role.ForUser(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJson(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Roles of user %d", id),
+		Data:    access,
+	}
+
+	app.writeJson(w, http.StatusOK, payload)
+}
+
+func (app *Config) AssignRole(w http.ResponseWriter, r *http.Request) {
+	app.changeRole(w, r, app.Models.Role.Assign)
+}
+
+func (app *Config) RevokeRole(w http.ResponseWriter, r *http.Request) {
+	app.changeRole(w, r, app.Models.Role.Revoke)
+}
+
+// changeRole applies change to the `{id}` user and the `{role}` role, and
+// answers with the roles the user ends up with.
+func (app *Config) changeRole(w http.ResponseWriter, r *http.Request, change func(ctx context.Context, userID int, role string) error) {
+	id, ok := app.userID(w, r)
+	if !ok {
+		return
+	}
+
+	err := change(r.Context(), id, chi.URLParam(r, "role"))
+	switch {
+	case errors.Is(err, data.ErrUnknownRole):
+		app.errorJson(w, err, http.StatusNotFound)
+		return
+	case errors.Is(err, sql.ErrNoRows):
+		app.errorJson(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	case err != nil:
+		app.errorJson(w, err)
+		return
+	}
+
+	app.GetUserRoles(w, r)
+}
@@ -14,7 +14,7 @@ func (app *Config) routes() http.Handler {
 	// specify who is allowed to connect
 	mux.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"https://*", "http://*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
 		ExposedHeaders:   []string{"Link"},
 		AllowCredentials: true,
@@ -24,6 +24,61 @@ func (app *Config) routes() http.Handler {
 	mux.Use(middleware.Heartbeat("/ping"))
 
 	mux.Post("/authenticate", app.Authenticate)
+	mux.Post("/authenticate/2fa", app.AuthenticateTwoFactor)
+	mux.Post("/users/register", app.Register)
+	mux.Post("/password/forgot", app.ForgotPassword)
+	mux.Post("/password/reset", app.ResetPassword)
+	mux.Get("/verify", app.VerifyEmail)
+	mux.Post("/verify/resend", app.ResendVerification)
+	mux.Post("/2fa/enroll", app.EnrollTwoFactor)
+	mux.Post("/2fa/confirm", app.ConfirmTwoFactor)
+	mux.Post("/2fa/disable", app.DisableTwoFactor)
+
+	mux.Post("/logout", app.Logout)
+	mux.Get("/sessions", app.ListSessions)
+	mux.Delete("/sessions/{session}", app.RevokeSession)
+	mux.Post("/sessions/introspect", app.IntrospectSession)
+	mux.Post("/api-keys/validate", app.ValidateAPIKey)
+
+	mux.Post("/oauth/token", app.Token)
+	mux.Post("/oauth/revoke", app.RevokeToken)
+	mux.Post("/oauth/introspect", app.IntrospectToken)
+	mux.Get("/.well-known/jwks.json", app.JWKS)
+
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.requirePermission("users.read"))
+
+		mux.Get("/users", app.ListUsers)
+		mux.Get("/users/{id}", app.GetUser)
+		mux.Get("/roles", app.ListRoles)
+		mux.Get("/users/{id}/roles", app.GetUserRoles)
+		mux.Get("/users/{id}/sessions", app.GetUserSessions)
+		mux.Get("/api-keys", app.ListAPIKeys)
+		mux.Get("/oauth/clients", app.ListOAuthClients)
+	})
+
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.requirePermission("users.write"))
+
+		mux.Patch("/users/{id}", app.UpdateUser)
+		mux.Delete("/users/{id}", app.DeleteUser)
+		mux.Put("/users/{id}/password", app.SetPassword)
+		mux.Post("/users/{id}/unlock", app.UnlockUser)
+		mux.Delete("/users/{id}/sessions", app.RevokeUserSessions)
+
+		mux.Post("/api-keys", app.CreateAPIKey)
+		mux.Delete("/api-keys/{key}", app.RevokeAPIKey)
+
+		mux.Post("/oauth/clients", app.CreateOAuthClient)
+		mux.Delete("/oauth/clients/{client}", app.RevokeOAuthClient)
+	})
+
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.requirePermission("roles.assign"))
+
+		mux.Put("/users/{id}/roles/{role}", app.AssignRole)
+		mux.Delete("/users/{id}/roles/{role}", app.RevokeRole)
+	})
 
 	return mux
 }
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"authentication/data"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// NOTE: Sessions
+/*
+	Every login starts a session, and the login answer carries its token
+	under `session`. The token goes with later requests as a bearer token:
+
+	curl -H "Authorization: Bearer $SESSION" localhost:8081/sessions
+
+	GET /sessions          the user's sessions, the one making the request marked `current`
+	DELETE /sessions/{id}  ends one of them, e.g. a lost phone
+	POST /logout           ends the session making the request
+
+	Sessions last SESSION_TTL (24h by default) and end early when the user
+	logs out, ends them, or the password changes. Admins can list and end
+	them as well, at /users/{id}/sessions.
+
+	Other services check a token with
+
+	POST /sessions/introspect {"token": "..."}
+
+	which answers `{"active": false}` for a token that's no good, and the
+	user with their permissions otherwise.
+*/
+
+const defaultSessionTTL = 24 * time.Hour
+
+var errNoSession = withCode("invalid_session", errors.New("not logged in or the session has ended"))
+
+func sessionTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("SESSION_TTL")); err == nil && d > 0 {
+		return d
+	}
+
+	return defaultSessionTTL
+}
+
+type sessionToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// loginResponse is the user with the session the login started.
+type loginResponse struct {
+	*data.User
+	Session sessionToken `json:"session"`
+}
+
+// startSession creates a session for the user and returns its token.
+func (app *Config) startSession(r *http.Request, user *data.User) (sessionToken, error) {
+	token, hash, err := newToken()
+	if err != nil {
+		return sessionToken{}, err
+	}
+
+	ttl := app.SessionTTL
+	if ttl <= 0 {
+		ttl = defaultSessionTTL
+	}
+
+	session := data.Session{
+		UserID:    user.ID,
+		Device:    truncate(r.UserAgent(), 255),
+		IP:        app.clientIP(r),
+		ExpiresAt: time.Now().Add(ttl).UTC().Truncate(time.Second),
+	}
+
+	if _, err := app.Models.Session.Create(r.Context(), session, hash); err != nil {
+		return sessionToken{}, err
+	}
+
+	return sessionToken{Token: token, ExpiresAt: session.ExpiresAt}, nil
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	return s[:n]
+}
+
+// currentSession returns the session of the request's bearer token,
+// answering the request itself when there is none.
+func (app *Config) currentSession(w http.ResponseWriter, r *http.Request) (*data.Session, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		app.errorJson(w, errNoSession, http.StatusUnauthorized)
+		return nil, false
+	}
+
+	session, err := app.Models.Session.Touch(r.Context(), hashToken(token))
+	if errors.Is(err, data.ErrInvalidToken) {
+		app.errorJson(w, errNoSession, http.StatusUnauthorized)
+		return nil, false
+	}
+	if err != nil {
+		app.errorJson(w, err)
+		return nil, false
+	}
+
+	return session, true
+}
+
+// revokeSessions ends every session, and revokes every OAuth2 refresh token,
+// of a user whose password changed. Failing is logged but doesn't fail the
+// request, the password is changed already.
+func (app *Config) revokeSessions(r *http.Request, userID int) {
+	if _, err := app.Models.Session.RevokeAll(r.Context(), userID); err != nil {
+		log.Printf("Ending the sessions of user %d failed: %v\r\n", userID, err)
+	}
+
+	if err := app.Models.OAuth.RevokeUserTokens(r.Context(), userID); err != nil {
+		log.Printf("Revoking the refresh tokens of user %d failed: %v\r\n", userID, err)
+	}
+}
+
+func (app *Config) Logout(w http.ResponseWriter, r *http.Request) {
+	session, ok := app.currentSession(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.Models.Session.Revoke(r.Context(), session.UserID, session.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.errorJson(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Logged out",
+	}
+
+	app.writeJson(w, http.StatusOK, payload)
+}
+
+type sessionEntry struct {
+	*data.Session
+	Current bool `json:"current"`
+}
+
+func (app *Config) ListSessions(w http.ResponseWriter, r *http.Request) {
+	current, ok := app.currentSession(w, r)
+	if !ok {
+		return
+	}
+
+	sessions, err := app.Models.Session.ListForUser(r.Context(), current.UserID)
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	entries := make([]sessionEntry, 0, len(sessions))
+	for _, session := range sessions {
+		entries = append(entries, sessionEntry{Session: session, Current: session.ID == current.ID})
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("%d session(s)", len(entries)),
+		Data:    entries,
+	}
+
+	app.writeJson(w, http.StatusOK, payload)
+}
+
+// RevokeSession ends one of the sessions of the user making the request.
+func (app *Config) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	current, ok := app.currentSession(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "session"), 10, 64)
+	if err != nil || id < 1 {
+		app.errorJson(w, errors.New("invalid session id"), http.StatusBadRequest)
+		return
+	}
+
+	err = app.Models.Session.Revoke(r.Context(), current.UserID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJson(w, errors.New("session not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Ended session %d", id),
+	}
+
+	app.writeJson(w, http.StatusOK, payload)
+}
+
+func (app *Config) GetUserSessions(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.userFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	sessions, err := app.Models.Session.ListForUser(r.Context(), user.ID)
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("%d session(s) of user %d", len(sessions), user.ID),
+		Data:    sessions,
+	}
+
+	app.writeJson(w, http.StatusOK, payload)
+}
+
+func (app *Config) RevokeUserSessions(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.userFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	n, err := app.Models.Session.RevokeAll(r.Context(), user.ID)
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Ended %d session(s) of user %d", n, user.ID),
+	}
+
+	app.writeJson(w, http.StatusOK, payload)
+}
+
+type IntrospectPayload struct {
+	Token string `json:"token"`
+}
+
+// introspection leaves out everything but Active for a token that's no good.
+type introspection struct {
+	Active      bool       `json:"active"`
+	SessionID   int64      `json:"session_id,omitempty"`
+	UserID      int        `json:"user_id,omitempty"`
+	Email       string     `json:"email,omitempty"`
+	Roles       []string   `json:"roles,omitempty"`
+	Permissions []string   `json:"permissions,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+// IntrospectSession tells whether a session token is still good, and whose
+// it is.
+func (app *Config) IntrospectSession(w http.ResponseWriter, r *http.Request) {
+	var requestPayload IntrospectPayload
+
+	err := app.readJson(w, r, &requestPayload)
+	if err != nil {
+		app.errorJson(w, err, http.StatusBadRequest)
+		return
+	}
+
+	result, err := app.introspect(r, requestPayload.Token)
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	message := "Session is active"
+	if !result.Active {
+		message = "Session is not active"
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: message,
+		Data:    result,
+	}
+
+	app.writeJson(w, http.StatusOK, payload)
+}
+
+func (app *Config) introspect(r *http.Request, token string) (introspection, error) {
+	if token == "" {
+		return introspection{}, nil
+	}
+
+	session, err := app.Models.Session.Touch(r.Context(), hashToken(token))
+	if errors.Is(err, data.ErrInvalidToken) {
+		return introspection{}, nil
+	}
+	if err != nil {
+		return introspection{}, err
+	}
+
+	// * a disabled account keeps its sessions, but they're no good until it's enabled again
+	user, err := app.Models.User.GetOne(r.Context(), session.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return introspection{}, nil
+	}
+	if err != nil {
+		return introspection{}, err
+	}
+
+	if user.Active != 1 {
+		return introspection{}, nil
+	}
+
+	access, err := app.Models.Role.ForUser(r.Context(), user.ID)
+	if err != nil {
+		return introspection{}, err
+	}
+
+	return introspection{
+		Active:      true,
+		SessionID:   session.ID,
+		UserID:      user.ID,
+		Email:       user.Email,
+		Roles:       access.Roles,
+		Permissions: access.Permissions,
+		ExpiresAt:   &session.ExpiresAt,
+	}, nil
+}
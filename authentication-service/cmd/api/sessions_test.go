@@ -0,0 +1,167 @@
+package main
+
+import (
+	"authentication/data"
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// introspected asks about the token the way other services do.
+func introspected(t *testing.T, app *Config, token string) introspection {
+	t.Helper()
+
+	status, response := call(t, app, http.MethodPost, "/sessions/introspect", "", IntrospectPayload{Token: token})
+	if status != http.StatusOK {
+		t.Fatalf("introspecting answered %d: %s", status, response.Message)
+	}
+
+	return decode[introspection](t, response)
+}
+
+func TestIntrospectSession(t *testing.T) {
+	app := newTestApp(t)
+	ann := addUser(t, app, data.User{Email: "ann@example.com", Active: 1})
+	bob := addUser(t, app, data.User{Email: "bob@example.com", Active: 1})
+
+	expired, hash, err := newToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = app.Models.Session.Create(context.Background(), data.Session{UserID: ann.ID, ExpiresAt: time.Now().Add(-time.Second)}, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	good := login(t, app, ann)
+	loggedOut := login(t, app, ann)
+	if status, _ := call(t, app, http.MethodPost, "/logout", loggedOut, nil); status != http.StatusOK {
+		t.Fatalf("logging out answered %d", status)
+	}
+
+	disabled := login(t, app, bob)
+	bob.Active = 0
+	if err := app.Models.User.Update(context.Background(), *bob); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		active bool
+	}{
+		{"good", good, true},
+		{"no token", "", false},
+		{"made up", "not-a-session", false},
+		{"expired", expired, false},
+		{"logged out", loggedOut, false},
+		{"disabled user", disabled, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := introspected(t, app, tt.token)
+			if got.Active != tt.active {
+				t.Fatalf("active is %v, want %v", got.Active, tt.active)
+			}
+
+			if !tt.active && (got.UserID != 0 || got.Email != "" || got.Permissions != nil) {
+				t.Errorf("inactive token answered %+v, want nothing but active", got)
+			}
+			if tt.active && (got.UserID != ann.ID || len(got.Permissions) == 0) {
+				t.Errorf("answered user %d with %v, want user %d with permissions", got.UserID, got.Permissions, ann.ID)
+			}
+		})
+	}
+}
+
+func TestRevokeSession(t *testing.T) {
+	app := newTestApp(t)
+	ann := addUser(t, app, data.User{Email: "ann@example.com", Active: 1})
+	bob := addUser(t, app, data.User{Email: "bob@example.com", Active: 1})
+
+	laptop, phone := login(t, app, ann), login(t, app, ann)
+	bobs := login(t, app, bob)
+
+	status, response := call(t, app, http.MethodGet, "/sessions", laptop, nil)
+	if status != http.StatusOK {
+		t.Fatalf("listing answered %d: %s", status, response.Message)
+	}
+
+	sessions := decode[[]sessionEntry](t, response)
+	if len(sessions) != 2 {
+		t.Fatalf("listed %d sessions, want 2", len(sessions))
+	}
+
+	var laptopID, phoneID int64
+	for _, s := range sessions {
+		if s.Current {
+			laptopID = s.ID
+		} else {
+			phoneID = s.ID
+		}
+	}
+	if laptopID == 0 || phoneID == 0 {
+		t.Fatalf("listed %+v, want one current session", sessions)
+	}
+
+	bobsID := introspected(t, app, bobs).SessionID
+
+	tests := []struct {
+		name    string
+		token   string
+		session string
+		status  int
+	}{
+		{"without a session", "", fmt.Sprint(phoneID), http.StatusUnauthorized},
+		{"with a made up session", "not-a-session", fmt.Sprint(phoneID), http.StatusUnauthorized},
+		{"invalid id", laptop, "phone", http.StatusBadRequest},
+		{"someone else's", laptop, fmt.Sprint(bobsID), http.StatusNotFound},
+		{"own other session", laptop, fmt.Sprint(phoneID), http.StatusOK},
+		{"own other session again", laptop, fmt.Sprint(phoneID), http.StatusNotFound},
+		{"from the ended session", phone, fmt.Sprint(laptopID), http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, response := call(t, app, http.MethodDelete, "/sessions/"+tt.session, tt.token, nil)
+			if status != tt.status {
+				t.Errorf("answered %d: %s, want %d", status, response.Message, tt.status)
+			}
+			if status == http.StatusUnauthorized && response.Code != "invalid_session" {
+				t.Errorf("answered code %q, want invalid_session", response.Code)
+			}
+		})
+	}
+
+	if !introspected(t, app, bobs).Active {
+		t.Error("bob's session ended")
+	}
+	if !introspected(t, app, laptop).Active {
+		t.Error("the session ending the other one ended as well")
+	}
+}
+
+func TestPasswordChangeEndsSessions(t *testing.T) {
+	app := newTestApp(t)
+	admin := addUser(t, app, data.User{Email: "admin@example.com", Active: 1}, "admin")
+	ann := addUser(t, app, data.User{Email: "ann@example.com", Active: 1})
+
+	sessions := []string{login(t, app, ann), login(t, app, ann)}
+
+	status, response := call(t, app, http.MethodPut, fmt.Sprintf("/users/%d/password", ann.ID), login(t, app, admin), SetPasswordPayload{Password: "another horse battery"})
+	if status != http.StatusOK {
+		t.Fatalf("setting the password answered %d: %s", status, response.Message)
+	}
+
+	for i, token := range sessions {
+		if introspected(t, app, token).Active {
+			t.Errorf("session %d is still active", i+1)
+		}
+		if status, _ := call(t, app, http.MethodGet, "/sessions", token, nil); status != http.StatusUnauthorized {
+			t.Errorf("session %d listed sessions with %d, want %d", i+1, status, http.StatusUnauthorized)
+		}
+	}
+}
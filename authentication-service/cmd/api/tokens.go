@@ -0,0 +1,90 @@
+package main
+
+import (
+	"authentication/data"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// NOTE: Signed tokens
+/*
+	Short-lived tokens that don't need to be stored, like email verification
+	links and two-factor challenges, are `<claims>.<signature>`: the claims
+	as base64url JSON and an HMAC-SHA256 over the purpose and the claims,
+	keyed with TOKEN_SECRET. The purpose keeps a token of one kind from being
+	used as another.
+*/
+
+// tokenClaims is embedded by the claims of each kind of token.
+type tokenClaims struct {
+	Expires int64 `json:"exp"`
+}
+
+func (c tokenClaims) expired() bool {
+	return time.Now().Unix() >= c.Expires
+}
+
+func expiresIn(ttl time.Duration) tokenClaims {
+	return tokenClaims{Expires: time.Now().Add(ttl).Unix()}
+}
+
+func tokenSecret() []byte {
+	if secret := os.Getenv("TOKEN_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+
+	// * still works, but tokens die with the process and differ between replicas
+	log.Println("TOKEN_SECRET is not set, using a random one")
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Panic(err)
+	}
+
+	return secret
+}
+
+func (app *Config) signToken(purpose string, claims any) (string, error) {
+	b, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	body := base64.RawURLEncoding.EncodeToString(b)
+
+	return body + "." + app.tokenSignature(purpose, body), nil
+}
+
+func (app *Config) tokenSignature(purpose, body string) string {
+	mac := hmac.New(sha256.New, app.TokenSecret)
+	mac.Write([]byte(purpose + "."))
+	mac.Write([]byte(body))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseToken decodes the claims of a token signed for purpose. It returns
+// data.ErrInvalidToken for any token that isn't, or has expired.
+func (app *Config) parseToken(purpose, token string, claims interface{ expired() bool }) error {
+	body, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(app.tokenSignature(purpose, body))) {
+		return data.ErrInvalidToken
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		return data.ErrInvalidToken
+	}
+
+	if err := json.Unmarshal(b, claims); err != nil || claims.expired() {
+		return data.ErrInvalidToken
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"authentication/data"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseToken(t *testing.T) {
+	app := newTestApp(t)
+
+	sign := func(purpose string, ttl time.Duration) string {
+		token, err := app.signToken(purpose, verificationClaims{tokenClaims: expiresIn(ttl), UserID: 7, Email: "ann@example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	good := sign(verifyEmailToken, time.Hour)
+	body, signature, _ := strings.Cut(good, ".")
+
+	// * the same claims for user 8, still signed as user 7's
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"exp":9999999999,"uid":8,"email":"ann@example.com"}`))
+
+	other := newTestApp(t)
+	other.TokenSecret = []byte("another secret")
+	otherToken, err := other.signToken(verifyEmailToken, verificationClaims{tokenClaims: expiresIn(time.Hour), UserID: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"good", good, true},
+		{"other purpose", sign("two-factor", time.Hour), false},
+		{"expired", sign(verifyEmailToken, -time.Second), false},
+		{"tampered claims", forged + "." + signature, false},
+		{"tampered signature", body + "." + strings.ToUpper(signature), false},
+		{"no signature", body, false},
+		{"signed with another secret", otherToken, false},
+		{"claims not base64", "!!!." + app.tokenSignature(verifyEmailToken, "!!!"), false},
+		{"claims not json", "bm90IGpzb24." + app.tokenSignature(verifyEmailToken, "bm90IGpzb24"), false},
+		{"empty", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var claims verificationClaims
+			err := app.parseToken(verifyEmailToken, tt.token, &claims)
+
+			if tt.ok {
+				if err != nil {
+					t.Fatalf("parsing failed: %v", err)
+				}
+				if claims.UserID != 7 || claims.Email != "ann@example.com" {
+					t.Errorf("parsed %+v, want user 7 ann@example.com", claims)
+				}
+				return
+			}
+
+			if !errors.Is(err, data.ErrInvalidToken) {
+				t.Errorf("parsing returned %v, want %v", err, data.ErrInvalidToken)
+			}
+		})
+	}
+}
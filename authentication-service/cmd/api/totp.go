@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NOTE: TOTP
+/*
+	RFC 6238 with the parameters every authenticator app supports: HMAC-SHA1,
+	6 digits, 30 second steps, and a 160 bit secret. A code of the step
+	before or after the current one is accepted too, for clocks that are a
+	little off.
+
+	Secrets are sealed with AES-256-GCM under TOTP_ENCRYPTION_KEY (32 bytes,
+	hex or base64) before they are stored, with the user id as additional
+	data so a sealed secret can't be moved to another user.
+*/
+
+const (
+	totpDigits = 6
+	totpPeriod = 30 // * seconds
+	totpSkew   = 1  // * steps accepted on either side of the current one
+)
+
+var errTwoFactorUnavailable = errors.New("two-factor authentication is not configured")
+
+// totpKey returns the key from TOTP_ENCRYPTION_KEY, or nil without one, which
+// leaves two-factor authentication unavailable.
+func totpKey() []byte {
+	value := os.Getenv("TOTP_ENCRYPTION_KEY")
+	if value == "" {
+		return nil
+	}
+
+	for _, decode := range []func(string) ([]byte, error){hex.DecodeString, base64.StdEncoding.DecodeString} {
+		if key, err := decode(value); err == nil && len(key) == 32 {
+			return key
+		}
+	}
+
+	log.Panic("TOTP_ENCRYPTION_KEY must be 32 bytes, hex or base64 encoded")
+	return nil
+}
+
+func totpIssuer() string {
+	if issuer := os.Getenv("TOTP_ISSUER"); issuer != "" {
+		return issuer
+	}
+
+	return "go-micro"
+}
+
+func newTOTPSecret() ([]byte, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// totpCode is the code of a time step, RFC 4226's HOTP with the step as the
+// counter.
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	// * dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%1_000_000)
+}
+
+// checkTOTP returns the step of the code, if it's valid around now.
+func checkTOTP(secret []byte, code string, now time.Time) (int64, bool) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// totpURI is what authenticator apps scan, usually as a QR code.
+func totpURI(issuer, account string, secret []byte) string {
+	query := url.Values{}
+	query.Set("secret", base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret))
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", strconv.Itoa(totpDigits))
+	query.Set("period", strconv.Itoa(totpPeriod))
+
+	label := url.PathEscape(issuer + ":" + account)
+
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+func (app *Config) totpAEAD() (cipher.AEAD, error) {
+	if app.TOTPKey == nil {
+		return nil, errTwoFactorUnavailable
+	}
+
+	block, err := aes.NewCipher(app.TOTPKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// sealTOTPSecret returns the nonce followed by the encrypted secret.
+func (app *Config) sealTOTPSecret(userID int, secret []byte) ([]byte, error) {
+	aead, err := app.totpAEAD()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, secret, []byte(strconv.Itoa(userID))), nil
+}
+
+func (app *Config) openTOTPSecret(userID int, sealed []byte) ([]byte, error) {
+	aead, err := app.totpAEAD()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed TOTP secret is too short")
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+
+	return aead.Open(nil, nonce, ciphertext, []byte(strconv.Itoa(userID)))
+}
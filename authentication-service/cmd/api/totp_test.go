@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestTOTPCode checks the SHA1 test vectors of RFC 6238, appendix B. The RFC
+// has 8 digit codes, ours are their last 6.
+func TestTOTPCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		if got := totpCode(secret, totpStep(time.Unix(tt.unix, 0))); got != tt.code {
+			t.Errorf("code at %d is %s, want %s", tt.unix, got, tt.code)
+		}
+	}
+}
+
+func TestCheckTOTP(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1111111111, 0)
+	current := totpStep(now)
+	code := totpCode(secret, current)
+
+	tests := []struct {
+		name string
+		code string
+		ok   bool
+		step int64
+	}{
+		{"current step", code, true, current},
+		{"with spaces", code[:3] + " " + code[3:], true, current},
+		{"step before", totpCode(secret, current-1), true, current - 1},
+		{"step after", totpCode(secret, current+1), true, current + 1},
+		{"two steps before", totpCode(secret, current-2), false, 0},
+		{"two steps after", totpCode(secret, current+2), false, 0},
+		{"too short", code[:5], false, 0},
+		{"wrong code", "000000", false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := checkTOTP(secret, tt.code, now)
+			if ok != tt.ok || step != tt.step {
+				t.Errorf("checkTOTP(%q) = %d, %v, want %d, %v", tt.code, step, ok, tt.step, tt.ok)
+			}
+		})
+	}
+}
+
+func TestTOTPSecretIsSealedForTheUser(t *testing.T) {
+	app := newTestApp(t)
+	secret := []byte("12345678901234567890")
+
+	sealed, err := app.sealTOTPSecret(1, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(sealed, secret) {
+		t.Error("the sealed secret contains the secret")
+	}
+
+	opened, err := app.openTOTPSecret(1, sealed)
+	if err != nil || !bytes.Equal(opened, secret) {
+		t.Errorf("opening for the same user got %q, %v, want the secret", opened, err)
+	}
+
+	if _, err := app.openTOTPSecret(2, sealed); err == nil {
+		t.Error("opened the secret of user 1 as user 2's")
+	}
+
+	tampered := bytes.Clone(sealed)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := app.openTOTPSecret(1, tampered); err == nil {
+		t.Error("opened a tampered secret")
+	}
+
+	app.TOTPKey = nil
+	if _, err := app.sealTOTPSecret(1, secret); !errors.Is(err, errTwoFactorUnavailable) {
+		t.Errorf("sealing without a key returned %v, want %v", err, errTwoFactorUnavailable)
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"authentication/data"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"net/http"
+	"shared/envelope"
+	"strings"
+	"time"
+)
+
+// NOTE: Two-factor authentication
+/*
+	Enrolling takes the password, like every change to the second factor:
+
+	POST /2fa/enroll {"email": "...", "password": "..."}
+		returns a new secret and its `otpauth://` URI for the authenticator
+		app. It isn't used until it's confirmed.
+
+	POST /2fa/confirm {"email": "...", "password": "...", "code": "123456"}
+		turns two-factor authentication on and returns the recovery codes,
+		the only time they are shown.
+
+	POST /2fa/disable {"email": "...", "password": "...", "code": "..."}
+		turns it off again, the code can be a recovery code.
+
+	Once it's on, /authenticate answers the right password with a challenge
+	(code `two_factor_required`) instead of the user, and the login ends with
+
+	POST /authenticate/2fa {"challenge": "...", "code": "..."}
+
+	where the code is the authenticator's or a recovery code. Wrong codes
+	count towards the lockout like wrong passwords.
+*/
+
+const (
+	challengeTTL       = 5 * time.Minute
+	recoveryCodeCount  = 10
+	recoveryCodeLength = 10 // * characters, without the dash in the middle
+)
+
+// twoFactorChallenge is the purpose of challenge tokens.
+const twoFactorChallenge = "2fa-challenge"
+
+var errInvalidCode = withCode("invalid_code", errors.New("invalid two-factor code"))
+
+type challengeClaims struct {
+	tokenClaims
+	UserID int `json:"uid"`
+}
+
+type challengeResponse struct {
+	Challenge string    `json:"challenge"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// challenge answers a correct password of a user with two-factor
+// authentication.
+func (app *Config) challenge(w http.ResponseWriter, user *data.User) {
+	claims := challengeClaims{
+		tokenClaims: expiresIn(challengeTTL),
+		UserID:      user.ID,
+	}
+
+	token, err := app.signToken(twoFactorChallenge, claims)
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Two-factor authentication required",
+		Code:    "two_factor_required",
+		Data: challengeResponse{
+			Challenge: token,
+			ExpiresAt: time.Unix(claims.Expires, 0).UTC(),
+		},
+	}
+
+	app.writeJson(w, http.StatusOK, payload)
+}
+
+type TwoFactorLoginPayload struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+// AuthenticateTwoFactor is the second step of a login with two-factor
+// authentication.
+func (app *Config) AuthenticateTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var requestPayload TwoFactorLoginPayload
+
+	err := app.readJson(w, r, &requestPayload)
+	if err != nil {
+		app.errorJson(w, err, http.StatusBadRequest)
+		return
+	}
+
+	var claims challengeClaims
+	if err := app.parseToken(twoFactorChallenge, requestPayload.Challenge, &claims); err != nil {
+		app.errorJson(w, err, http.StatusBadRequest)
+		return
+	}
+
+	login := envelope.LoginData{
+		UserID: claims.UserID,
+		IP:     app.clientIP(r),
+	}
+
+	if refused := app.addressBlocked(r, login); refused != nil {
+		app.refuseLogin(w, refused)
+		return
+	}
+
+	user, err := app.Models.User.GetOne(r.Context(), claims.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJson(w, data.ErrInvalidToken, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+	login.Email = user.Email
+
+	if refused := app.accountLocked(r, login, user); refused != nil {
+		app.refuseLogin(w, refused)
+		return
+	}
+
+	// * the account may have changed since the password was checked
+	if user.Active != 1 {
+		login.Reason = "inactive account"
+		app.recordEvent(r.Context(), "user.login.failed", login)
+		app.errorJson(w, errAccountInactive, http.StatusForbidden)
+		return
+	}
+
+	tf, err := app.Models.TwoFactor.Get(r.Context(), user.ID)
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	if !tf.Enabled {
+		app.errorJson(w, data.ErrInvalidToken, http.StatusBadRequest)
+		return
+	}
+
+	valid, err := app.checkSecondFactor(r.Context(), user.ID, tf, requestPayload.Code)
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	if !valid {
+		login.Reason = "wrong two-factor code"
+		app.refuseLogin(w, app.loginFailed(r, login, app.countFailure(r, user, login), errInvalidCode))
+		return
+	}
+
+	app.clearFailures(r, user)
+	app.loginSucceeded(w, r, login, user)
+}
+
+// checkSecondFactor accepts a code from the authenticator or an unused
+// recovery code, using it up either way.
+func (app *Config) checkSecondFactor(ctx context.Context, userID int, tf *data.TwoFactor, code string) (bool, error) {
+	secret, err := app.openTOTPSecret(userID, tf.Secret)
+	if err != nil {
+		return false, err
+	}
+
+	if step, ok := checkTOTP(secret, code, time.Now()); ok {
+		return app.Models.TwoFactor.UseStep(ctx, userID, step)
+	}
+
+	code = normalizeRecoveryCode(code)
+	if len(code) != recoveryCodeLength {
+		return false, nil
+	}
+
+	return app.Models.TwoFactor.UseRecoveryCode(ctx, userID, hashToken(code))
+}
+
+// newRecoveryCodes returns the codes to show, like `ABCDE-FGHIJ`, and the
+// hashes to store.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+
+	for range recoveryCodeCount {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+
+		code := base32.StdEncoding.EncodeToString(b)[:recoveryCodeLength]
+		codes = append(codes, code[:recoveryCodeLength/2]+"-"+code[recoveryCodeLength/2:])
+		hashes = append(hashes, hashToken(code))
+	}
+
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToUpper(code)
+	code = strings.ReplaceAll(code, "-", "")
+	code = strings.ReplaceAll(code, " ", "")
+
+	return code
+}
+
+type TwoFactorPayload struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	Code     string `json:"code,omitempty"`
+}
+
+type enrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+func (app *Config) EnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var requestPayload TwoFactorPayload
+
+	err := app.readJson(w, r, &requestPayload)
+	if err != nil {
+		app.errorJson(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if app.TOTPKey == nil {
+		app.errorJson(w, errTwoFactorUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+
+	user, _, refused := app.checkCredentials(r, requestPayload.Email, requestPayload.Password)
+	if refused != nil {
+		app.refuseLogin(w, refused)
+		return
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	sealed, err := app.sealTOTPSecret(user.ID, secret)
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	err = app.Models.TwoFactor.Enroll(r.Context(), user.ID, sealed)
+	if errors.Is(err, data.ErrTwoFactorEnabled) {
+		app.errorJson(w, err, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Add the secret to your authenticator app, then confirm a code",
+		Data: enrollment{
+			Secret: base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret),
+			URI:    totpURI(app.TOTPIssuer, user.Email, secret),
+		},
+	}
+
+	app.writeJson(w, http.StatusOK, payload)
+}
+
+func (app *Config) ConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var requestPayload TwoFactorPayload
+
+	err := app.readJson(w, r, &requestPayload)
+	if err != nil {
+		app.errorJson(w, err, http.StatusBadRequest)
+		return
+	}
+
+	user, login, refused := app.checkCredentials(r, requestPayload.Email, requestPayload.Password)
+	if refused != nil {
+		app.refuseLogin(w, refused)
+		return
+	}
+
+	tf, err := app.Models.TwoFactor.Get(r.Context(), user.ID)
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	if tf.Enabled {
+		app.errorJson(w, data.ErrTwoFactorEnabled, http.StatusConflict)
+		return
+	}
+
+	if tf.Secret == nil {
+		app.errorJson(w, errors.New("enroll first"), http.StatusBadRequest)
+		return
+	}
+
+	secret, err := app.openTOTPSecret(user.ID, tf.Secret)
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	// * wrong codes count towards the lockout, like when disabling
+	step, ok := checkTOTP(secret, requestPayload.Code, time.Now())
+	if !ok {
+		login.Reason = "wrong two-factor code"
+		app.refuseLogin(w, app.loginFailed(r, login, app.countFailure(r, user, login), errInvalidCode))
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	if err := app.Models.TwoFactor.Enable(r.Context(), user.ID, step, hashes); err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Two-factor authentication enabled, keep the recovery codes somewhere safe",
+		Data: struct {
+			RecoveryCodes []string `json:"recovery_codes"`
+		}{codes},
+	}
+
+	app.writeJson(w, http.StatusOK, payload)
+}
+
+func (app *Config) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var requestPayload TwoFactorPayload
+
+	err := app.readJson(w, r, &requestPayload)
+	if err != nil {
+		app.errorJson(w, err, http.StatusBadRequest)
+		return
+	}
+
+	user, login, refused := app.checkCredentials(r, requestPayload.Email, requestPayload.Password)
+	if refused != nil {
+		app.refuseLogin(w, refused)
+		return
+	}
+
+	tf, err := app.Models.TwoFactor.Get(r.Context(), user.ID)
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	if !tf.Enabled {
+		app.errorJson(w, errors.New("two-factor authentication is not enabled"), http.StatusBadRequest)
+		return
+	}
+
+	valid, err := app.checkSecondFactor(r.Context(), user.ID, tf, requestPayload.Code)
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	if !valid {
+		login.Reason = "wrong two-factor code"
+		app.refuseLogin(w, app.loginFailed(r, login, app.countFailure(r, user, login), errInvalidCode))
+		return
+	}
+
+	if err := app.Models.TwoFactor.Disable(r.Context(), user.ID); err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Two-factor authentication disabled",
+	}
+
+	app.writeJson(w, http.StatusOK, payload)
+}
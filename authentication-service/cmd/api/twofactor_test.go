@@ -0,0 +1,157 @@
+package main
+
+import (
+	"authentication/data"
+	"encoding/base32"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// enableTwoFactor enrolls and confirms the user, returning the secret and
+// the recovery codes.
+func enableTwoFactor(t *testing.T, app *Config, credentials TwoFactorPayload) ([]byte, []string) {
+	t.Helper()
+
+	status, response := call(t, app, http.MethodPost, "/2fa/enroll", "", credentials)
+	if status != http.StatusOK {
+		t.Fatalf("enrolling answered %d: %s", status, response.Message)
+	}
+
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(decode[enrollment](t, response).Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	confirm := credentials
+	confirm.Code = "000000"
+	if status, response := call(t, app, http.MethodPost, "/2fa/confirm", "", confirm); status != http.StatusBadRequest || response.Code != "invalid_code" {
+		t.Errorf("confirming a wrong code answered %d %q, want %d invalid_code", status, response.Code, http.StatusBadRequest)
+	}
+
+	confirm.Code = totpCode(secret, totpStep(time.Now()))
+	status, response = call(t, app, http.MethodPost, "/2fa/confirm", "", confirm)
+	if status != http.StatusOK {
+		t.Fatalf("confirming answered %d: %s", status, response.Message)
+	}
+
+	codes := decode[struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}](t, response).RecoveryCodes
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("got %d recovery codes, want %d", len(codes), recoveryCodeCount)
+	}
+
+	if status, _ := call(t, app, http.MethodPost, "/2fa/confirm", "", confirm); status != http.StatusConflict {
+		t.Errorf("confirming twice answered %d, want %d", status, http.StatusConflict)
+	}
+
+	return secret, codes
+}
+
+// secondStep logs in with the password and answers the challenge with code.
+func secondStep(t *testing.T, app *Config, credentials TwoFactorPayload, code string) (int, testResponse) {
+	t.Helper()
+
+	status, response := call(t, app, http.MethodPost, "/authenticate", "", credentials)
+	if status != http.StatusOK || response.Code != "two_factor_required" {
+		t.Fatalf("password answered %d %q, want a challenge", status, response.Code)
+	}
+
+	challenge := decode[challengeResponse](t, response).Challenge
+
+	return call(t, app, http.MethodPost, "/authenticate/2fa", "", TwoFactorLoginPayload{Challenge: challenge, Code: code})
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	app := newTestApp(t)
+	app.Lockout.Threshold = 10
+	addUser(t, app, data.User{Email: "ann@example.com", Active: 1})
+
+	credentials := TwoFactorPayload{Email: "ann@example.com", Password: "correct horse battery"}
+	secret, codes := enableTwoFactor(t, app, credentials)
+
+	// * the step after the one used to confirm, so it hasn't been used yet
+	next := totpCode(secret, totpStep(time.Now())+1)
+	lowered := strings.ToLower(strings.ReplaceAll(codes[1], "-", ""))
+
+	tests := []struct {
+		name   string
+		code   string
+		status int
+	}{
+		{"authenticator code", next, http.StatusOK},
+		{"authenticator code again", next, http.StatusBadRequest},
+		{"recovery code", codes[0], http.StatusOK},
+		{"recovery code again", codes[0], http.StatusBadRequest},
+		{"recovery code without dash in lower case", lowered, http.StatusOK},
+		{"made up recovery code", "AAAAA-AAAAA", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, response := secondStep(t, app, credentials, tt.code)
+			if status != tt.status {
+				t.Fatalf("answered %d: %s, want %d", status, response.Message, tt.status)
+			}
+
+			if status == http.StatusBadRequest && response.Code != "invalid_code" {
+				t.Errorf("answered code %q, want invalid_code", response.Code)
+			}
+			if status == http.StatusOK && decode[loginResponse](t, response).Session.Token == "" {
+				t.Error("login has no session")
+			}
+		})
+	}
+
+	t.Run("tampered challenge", func(t *testing.T) {
+		status, _ := call(t, app, http.MethodPost, "/authenticate/2fa", "", TwoFactorLoginPayload{
+			Challenge: "not.a-challenge",
+			Code:      codes[2],
+		})
+		if status != http.StatusBadRequest {
+			t.Errorf("answered %d, want %d", status, http.StatusBadRequest)
+		}
+	})
+}
+
+func TestDisableTwoFactor(t *testing.T) {
+	app := newTestApp(t)
+	app.Lockout.Threshold = 10
+	addUser(t, app, data.User{Email: "ann@example.com", Active: 1})
+
+	credentials := TwoFactorPayload{Email: "ann@example.com", Password: "correct horse battery"}
+	_, codes := enableTwoFactor(t, app, credentials)
+
+	if status, _ := secondStep(t, app, credentials, codes[0]); status != http.StatusOK {
+		t.Fatalf("logging in with a recovery code answered %d", status)
+	}
+
+	disable := credentials
+	disable.Code = codes[0]
+	if status, response := call(t, app, http.MethodPost, "/2fa/disable", "", disable); status != http.StatusBadRequest || response.Code != "invalid_code" {
+		t.Errorf("disabling with a used recovery code answered %d %q, want %d invalid_code", status, response.Code, http.StatusBadRequest)
+	}
+
+	wrongPassword := disable
+	wrongPassword.Password = "wrong password"
+	wrongPassword.Code = codes[1]
+	if status, _ := call(t, app, http.MethodPost, "/2fa/disable", "", wrongPassword); status != http.StatusBadRequest {
+		t.Errorf("disabling with a wrong password answered %d, want %d", status, http.StatusBadRequest)
+	}
+
+	disable.Code = codes[1]
+	if status, response := call(t, app, http.MethodPost, "/2fa/disable", "", disable); status != http.StatusOK {
+		t.Fatalf("disabling answered %d: %s", status, response.Message)
+	}
+
+	status, response := call(t, app, http.MethodPost, "/authenticate", "", credentials)
+	if status != http.StatusOK || response.Code == "two_factor_required" {
+		t.Errorf("login after disabling answered %d %q, want no challenge", status, response.Code)
+	}
+
+	if status, _ := call(t, app, http.MethodPost, "/2fa/disable", "", disable); status != http.StatusBadRequest {
+		t.Errorf("disabling twice answered %d, want %d", status, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"authentication/data"
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"shared/envelope"
+	"strings"
+	"time"
+)
+
+// NOTE: Email verification
+/*
+	New accounts can't log in until their email address is verified.
+	Registering mails a link, VERIFICATION_URL with `?token=` appended.
+
+	GET /verify?token=...
+		verifies the address the token was issued for. The broker serves
+		it too and passes it on, links point there by default.
+
+	POST /verify/resend {"email": "..."}
+		mails a new link to an unverified account. It always answers 202,
+		unless the client or the email asked too often, then it's 429.
+
+	The token in the link is a signed token with the user id and the email,
+	so it stops working once the account is verified or its email changes.
+*/
+
+const (
+	defaultVerificationTTL = 24 * time.Hour
+
+	// * resends per email and per client address in an hour
+	resendsPerEmail = 3
+	resendsPerIP    = 10
+)
+
+var errRateLimited = withCode("rate_limited", errors.New("too many requests, try again later"))
+
+func verificationURL() string {
+	if u := os.Getenv("VERIFICATION_URL"); u != "" {
+		return u
+	}
+
+	return "http://localhost:8080/verify"
+}
+
+func verificationTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("VERIFICATION_TTL")); err == nil && d > 0 {
+		return d
+	}
+
+	return defaultVerificationTTL
+}
+
+// verifyEmailToken is the purpose of verification tokens.
+const verifyEmailToken = "verify-email"
+
+type verificationClaims struct {
+	tokenClaims
+	UserID int    `json:"uid"`
+	Email  string `json:"email"`
+}
+
+func (app *Config) sendVerificationLink(user data.User) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	ttl := app.VerificationTTL
+	if ttl <= 0 {
+		ttl = defaultVerificationTTL
+	}
+
+	token, err := app.signToken(verifyEmailToken, verificationClaims{
+		tokenClaims: expiresIn(ttl),
+		UserID:      user.ID,
+		Email:       user.Email,
+	})
+	if err != nil {
+		log.Println("Creating verification token failed:", err)
+		return
+	}
+
+	link, err := url.Parse(app.VerificationURL)
+	if err != nil {
+		log.Println("Invalid VERIFICATION_URL:", err)
+		return
+	}
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+
+	name := user.FirstName
+	if name == "" {
+		name = user.Email
+	}
+
+	err = app.sendMail(ctx, envelope.MailData{
+		To:       user.Email,
+		Subject:  "Verify your email address",
+		Template: "verify-email",
+		Fields: map[string]string{
+			"name":    name,
+			"link":    link.String(),
+			"expires": ttl.String(),
+		},
+	})
+	if err != nil {
+		log.Printf("Sending verification link to user %d failed: %v\r\n", user.ID, err)
+	}
+}
+
+func (app *Config) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var claims verificationClaims
+	err := app.parseToken(verifyEmailToken, r.URL.Query().Get("token"), &claims)
+	if err != nil {
+		app.errorJson(w, err, http.StatusBadRequest)
+		return
+	}
+
+	err = app.Models.User.Verify(r.Context(), claims.UserID, claims.Email)
+	if errors.Is(err, sql.ErrNoRows) {
+		// * the user is gone or has another email by now
+		app.errorJson(w, data.ErrInvalidToken, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Email address verified",
+	}
+
+	app.writeJson(w, http.StatusOK, payload)
+}
+
+type ResendVerificationPayload struct {
+	Email string `json:"email"`
+}
+
+func (app *Config) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	var requestPayload ResendVerificationPayload
+
+	err := app.readJson(w, r, &requestPayload)
+	if err != nil {
+		app.errorJson(w, err, http.StatusBadRequest)
+		return
+	}
+
+	email := strings.TrimSpace(requestPayload.Email)
+	if !validEmail(email) {
+		app.errorJson(w, errors.New("invalid email address"), http.StatusBadRequest)
+		return
+	}
+
+	if !app.ResendByIP.Allow(app.clientIP(r)) || !app.ResendByEmail.Allow(strings.ToLower(email)) {
+		app.errorJson(w, errRateLimited, http.StatusTooManyRequests)
+		return
+	}
+
+	// * like the password reset, the answer doesn't tell whether the email is registered
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		user, err := app.Models.User.GetByEmail(ctx, email)
+		if err != nil || user.Active != 1 || user.Verified() {
+			return
+		}
+
+		app.sendVerificationLink(*user)
+	}()
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "If the email belongs to an unverified account, a new link is on its way",
+	}
+
+	app.writeJson(w, http.StatusAccepted, payload)
+}
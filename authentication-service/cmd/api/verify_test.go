@@ -0,0 +1,136 @@
+package main
+
+import (
+	"authentication/data"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// addUnverifiedUser inserts a user the way registering does, without
+// verifying the email.
+func addUnverifiedUser(t *testing.T, app *Config, email string) int {
+	t.Helper()
+
+	id, err := app.Models.User.Insert(context.Background(), data.User{Email: email, Password: "correct horse battery", Active: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return id
+}
+
+func verificationToken(t *testing.T, app *Config, userID int, email string, ttl time.Duration) string {
+	t.Helper()
+
+	token, err := app.signToken(verifyEmailToken, verificationClaims{tokenClaims: expiresIn(ttl), UserID: userID, Email: email})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func TestVerifyEmail(t *testing.T) {
+	app := newTestApp(t)
+	id := addUnverifiedUser(t, app, "ann@example.com")
+
+	credentials := map[string]string{"email": "ann@example.com", "password": "correct horse battery"}
+	if status, response := call(t, app, http.MethodPost, "/authenticate", "", credentials); status != http.StatusForbidden || response.Code != "email_unverified" {
+		t.Fatalf("login before verifying answered %d %q, want %d email_unverified", status, response.Code, http.StatusForbidden)
+	}
+
+	other, err := app.signToken("password-reset", verificationClaims{tokenClaims: expiresIn(time.Hour), UserID: id, Email: "ann@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"no token", "", http.StatusBadRequest},
+		{"expired", verificationToken(t, app, id, "ann@example.com", -time.Second), http.StatusBadRequest},
+		{"token of another kind", other, http.StatusBadRequest},
+		{"other email", verificationToken(t, app, id, "bob@example.com", time.Hour), http.StatusBadRequest},
+		{"unknown user", verificationToken(t, app, id+1, "ann@example.com", time.Hour), http.StatusBadRequest},
+		{"good", verificationToken(t, app, id, "ann@example.com", time.Hour), http.StatusOK},
+		{"good again", verificationToken(t, app, id, "ann@example.com", time.Hour), http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, response := call(t, app, http.MethodGet, "/verify?token="+url.QueryEscape(tt.token), "", nil)
+			if status != tt.status {
+				t.Errorf("answered %d: %s, want %d", status, response.Message, tt.status)
+			}
+		})
+	}
+
+	if status, response := call(t, app, http.MethodPost, "/authenticate", "", credentials); status != http.StatusOK {
+		t.Errorf("login after verifying answered %d: %s", status, response.Message)
+	}
+}
+
+// TestVerifyAfterEmailChange follows a link mailed to an address the account
+// doesn't have anymore.
+func TestVerifyAfterEmailChange(t *testing.T) {
+	app := newTestApp(t)
+	id := addUnverifiedUser(t, app, "old@example.com")
+	stale := verificationToken(t, app, id, "old@example.com", time.Hour)
+
+	user, err := app.Models.User.GetOne(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.Email = "new@example.com"
+	if err := app.Models.User.Update(context.Background(), *user); err != nil {
+		t.Fatal(err)
+	}
+
+	if status, _ := call(t, app, http.MethodGet, "/verify?token="+url.QueryEscape(stale), "", nil); status != http.StatusBadRequest {
+		t.Errorf("link for the old email answered %d, want %d", status, http.StatusBadRequest)
+	}
+
+	user, err = app.Models.User.GetOne(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Verified() {
+		t.Error("the link for the old email verified the new one")
+	}
+}
+
+func TestResendVerificationIsRateLimited(t *testing.T) {
+	tests := []struct {
+		name    string
+		emails  func(i int) string
+		allowed int
+	}{
+		{"same email", func(i int) string { return "someone@example.com" }, resendsPerEmail},
+		{"same email in other cases", func(i int) string { return []string{"someone@example.com", "SomeOne@Example.COM"}[i%2] }, resendsPerEmail},
+		{"same address", func(i int) string { return fmt.Sprintf("user%d@example.com", i) }, resendsPerIP},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+
+			for i := 0; i < tt.allowed; i++ {
+				status, _ := call(t, app, http.MethodPost, "/verify/resend", "", ResendVerificationPayload{Email: tt.emails(i)})
+				if status != http.StatusAccepted {
+					t.Fatalf("request %d answered %d, want %d", i+1, status, http.StatusAccepted)
+				}
+			}
+
+			status, response := call(t, app, http.MethodPost, "/verify/resend", "", ResendVerificationPayload{Email: tt.emails(tt.allowed)})
+			if status != http.StatusTooManyRequests || response.Code != "rate_limited" {
+				t.Errorf("request over the limit answered %d %q, want %d rate_limited", status, response.Code, http.StatusTooManyRequests)
+			}
+		})
+	}
+}
@@ -0,0 +1,331 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"shared/envelope"
+	"sort"
+	"strings"
+	"time"
+)
+
+// APIKey is a key for clients that can't log in, like batch jobs. It belongs
+// to a user, and can't do more than they can, or to a service account, a
+// name for a client that isn't a person.
+type APIKey struct {
+	ID         int64      `json:"id"`
+	Prefix     string     `json:"prefix"` // * the start of the key, to tell keys apart
+	Name       string     `json:"name,omitempty"`
+	UserID     *int       `json:"user_id,omitempty"`
+	Service    string     `json:"service,omitempty"`
+	Scopes     []string   `json:"scopes"` // * permission names
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"` // * nil for a key that doesn't expire
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+func (k *APIKey) eventData() envelope.APIKeyData {
+	data := envelope.APIKeyData{
+		ID:      k.ID,
+		Prefix:  k.Prefix,
+		Name:    k.Name,
+		Service: k.Service,
+		Scopes:  k.Scopes,
+	}
+	if k.UserID != nil {
+		data.UserID = *k.UserID
+	}
+
+	return data
+}
+
+// APIKeyRepository stores API keys by their hash.
+type APIKeyRepository interface {
+	// Create stores the key and records an `apikey.created` event. It returns
+	// sql.ErrNoRows if the key's user doesn't exist.
+	Create(ctx context.Context, key APIKey, keyHash string) (int64, error)
+
+	// List returns the keys of the user, or every key for userID 0, revoked
+	// and expired ones included, the newest first.
+	List(ctx context.Context, userID int) ([]*APIKey, error)
+
+	// Use returns the key with the hash and records that it was used now. It
+	// returns ErrInvalidToken for an unknown, expired or revoked key.
+	Use(ctx context.Context, keyHash string) (*APIKey, error)
+
+	// Revoke ends the key and records an `apikey.revoked` event. It returns
+	// sql.ErrNoRows if there is no such key that isn't revoked already.
+	Revoke(ctx context.Context, id int64) error
+}
+
+type PostgresAPIKeyRepository struct {
+	db *sql.DB
+}
+
+func NewPostgresAPIKeyRepository(db *sql.DB) *PostgresAPIKeyRepository {
+	return &PostgresAPIKeyRepository{db: db}
+}
+
+const apiKeyColumns = `id, prefix, name, user_id, service, scopes, created_at, expires_at, last_used_at, revoked_at`
+
+func scanAPIKey(row interface{ Scan(...any) error }) (*APIKey, error) {
+	var key APIKey
+	var userID sql.NullInt64
+	var service sql.NullString
+	var scopes string
+
+	err := row.Scan(
+		&key.ID,
+		&key.Prefix,
+		&key.Name,
+		&userID,
+		&service,
+		&scopes,
+		&key.CreatedAt,
+		&key.ExpiresAt,
+		&key.LastUsedAt,
+		&key.RevokedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if userID.Valid {
+		id := int(userID.Int64)
+		key.UserID = &id
+	}
+	key.Service = service.String
+	key.Scopes = strings.Fields(scopes)
+
+	return &key, nil
+}
+
+func (r *PostgresAPIKeyRepository) Create(ctx context.Context, key APIKey, keyHash string) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var service sql.NullString
+	if key.UserID != nil {
+		var id int
+		if err := tx.QueryRowContext(ctx, `SELECT id FROM users WHERE id = $1 FOR SHARE`, *key.UserID).Scan(&id); err != nil {
+			return 0, err
+		}
+	} else {
+		service = sql.NullString{String: key.Service, Valid: true}
+	}
+
+	key.CreatedAt = time.Now()
+
+	stmt := `INSERT INTO api_keys (prefix, key_hash, name, user_id, service, scopes, created_at, expires_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`
+
+	err = tx.QueryRowContext(ctx, stmt,
+		key.Prefix,
+		keyHash,
+		key.Name,
+		key.UserID,
+		service,
+		strings.Join(key.Scopes, " "),
+		key.CreatedAt,
+		key.ExpiresAt,
+	).Scan(&key.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := insertEvent(ctx, tx, "apikey.created", key.eventData()); err != nil {
+		return 0, err
+	}
+
+	return key.ID, tx.Commit()
+}
+
+func (r *PostgresAPIKeyRepository) List(ctx context.Context, userID int) ([]*APIKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys
+	WHERE $1 = 0 OR user_id = $1
+	ORDER BY created_at DESC, id DESC`
+
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+func (r *PostgresAPIKeyRepository) Use(ctx context.Context, keyHash string) (*APIKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `UPDATE api_keys SET last_used_at = $1
+	WHERE key_hash = $2 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > $1)
+	RETURNING ` + apiKeyColumns
+
+	key, err := scanAPIKey(r.db.QueryRowContext(ctx, stmt, time.Now(), keyHash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidToken
+	}
+
+	return key, err
+}
+
+func (r *PostgresAPIKeyRepository) Revoke(ctx context.Context, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `UPDATE api_keys SET revoked_at = $1
+	WHERE id = $2 AND revoked_at IS NULL
+	RETURNING ` + apiKeyColumns
+
+	key, err := scanAPIKey(tx.QueryRowContext(ctx, stmt, time.Now(), id))
+	if err != nil {
+		return err
+	}
+
+	if err := insertEvent(ctx, tx, "apikey.revoked", key.eventData()); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// MemoryAPIKeyRepository keeps keys in a map by id, next to the memory user
+// repository, sharing its lock.
+type MemoryAPIKeyRepository struct {
+	users  *MemoryUserRepository
+	keys   map[int64]*APIKey
+	hashes map[string]int64 // * key id by key hash
+	nextID int64
+}
+
+func NewMemoryAPIKeyRepository(users *MemoryUserRepository) *MemoryAPIKeyRepository {
+	return &MemoryAPIKeyRepository{
+		users:  users,
+		keys:   make(map[int64]*APIKey),
+		hashes: make(map[string]int64),
+		nextID: 1,
+	}
+}
+
+// copyKey returns a copy the caller can't change the stored key through.
+func copyKey(key *APIKey) *APIKey {
+	c := *key
+	c.Scopes = append([]string{}, key.Scopes...)
+
+	return &c
+}
+
+func (r *MemoryAPIKeyRepository) Create(ctx context.Context, key APIKey, keyHash string) (int64, error) {
+	r.users.mu.Lock()
+	defer r.users.mu.Unlock()
+
+	if key.UserID != nil {
+		if _, ok := r.users.users[*key.UserID]; !ok {
+			return 0, sql.ErrNoRows
+		}
+	}
+
+	key.ID = r.nextID
+	key.CreatedAt = time.Now()
+
+	r.nextID++
+	r.keys[key.ID] = copyKey(&key)
+	r.hashes[keyHash] = key.ID
+	r.users.outbox.add("apikey.created", key.eventData())
+
+	return key.ID, nil
+}
+
+func (r *MemoryAPIKeyRepository) List(ctx context.Context, userID int) ([]*APIKey, error) {
+	r.users.mu.Lock()
+	defer r.users.mu.Unlock()
+
+	keys := []*APIKey{}
+	for _, key := range r.keys {
+		// * keys of a deleted user go with them, like ON DELETE CASCADE
+		if key.UserID != nil {
+			if _, ok := r.users.users[*key.UserID]; !ok {
+				continue
+			}
+		}
+
+		if userID == 0 || (key.UserID != nil && *key.UserID == userID) {
+			keys = append(keys, copyKey(key))
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].ID > keys[j].ID
+	})
+
+	return keys, nil
+}
+
+func (r *MemoryAPIKeyRepository) Use(ctx context.Context, keyHash string) (*APIKey, error) {
+	r.users.mu.Lock()
+	defer r.users.mu.Unlock()
+
+	key, ok := r.keys[r.hashes[keyHash]]
+	if !ok || key.RevokedAt != nil {
+		return nil, ErrInvalidToken
+	}
+
+	now := time.Now()
+	if key.ExpiresAt != nil && !now.Before(*key.ExpiresAt) {
+		return nil, ErrInvalidToken
+	}
+
+	if key.UserID != nil {
+		if _, ok := r.users.users[*key.UserID]; !ok {
+			return nil, ErrInvalidToken
+		}
+	}
+
+	key.LastUsedAt = &now
+
+	return copyKey(key), nil
+}
+
+func (r *MemoryAPIKeyRepository) Revoke(ctx context.Context, id int64) error {
+	r.users.mu.Lock()
+	defer r.users.mu.Unlock()
+
+	key, ok := r.keys[id]
+	if !ok || key.RevokedAt != nil {
+		return sql.ErrNoRows
+	}
+
+	now := time.Now()
+	key.RevokedAt = &now
+	r.users.outbox.add("apikey.revoked", key.eventData())
+
+	return nil
+}
@@ -0,0 +1,416 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"shared/envelope"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryUserRepository keeps users in a map. It behaves like the Postgres
+// repository, down to the errors, so handlers can be tested without a
+// database.
+type MemoryUserRepository struct {
+	mu     sync.Mutex
+	users  map[int]User
+	roles  map[int]map[string]bool // * role names by user id
+	nextID int
+	outbox *MemoryOutbox
+}
+
+func NewMemoryUserRepository(outbox *MemoryOutbox) *MemoryUserRepository {
+	return &MemoryUserRepository{
+		users:  make(map[int]User),
+		roles:  make(map[int]map[string]bool),
+		nextID: 1,
+		outbox: outbox,
+	}
+}
+
+func (r *MemoryUserRepository) GetAll(ctx context.Context) ([]*User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	users := r.all()
+	sort.SliceStable(users, func(i, j int) bool {
+		return users[i].LastName < users[j].LastName
+	})
+
+	return users, nil
+}
+
+func (r *MemoryUserRepository) List(ctx context.Context, filter UserFilter) ([]*User, int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if filter.Page < 1 {
+		filter.Page = 1
+	}
+
+	if filter.PerPage < 1 {
+		filter.PerPage = 20
+	}
+
+	search := strings.ToLower(filter.Search)
+
+	matching := []*User{}
+	for _, user := range r.all() {
+		if filter.Active != nil && user.Active != *filter.Active {
+			continue
+		}
+
+		if search != "" &&
+			!strings.Contains(strings.ToLower(user.Email), search) &&
+			!strings.Contains(strings.ToLower(user.FirstName), search) &&
+			!strings.Contains(strings.ToLower(user.LastName), search) {
+			continue
+		}
+
+		matching = append(matching, user)
+	}
+
+	less := func(a, b *User) bool {
+		switch filter.Sort {
+		case "email":
+			return a.Email < b.Email
+		case "first_name":
+			return a.FirstName < b.FirstName
+		case "last_name":
+			return a.LastName < b.LastName
+		case "created_at":
+			return a.CreatedAt.Before(b.CreatedAt)
+		default:
+			return a.ID < b.ID
+		}
+	}
+
+	// * all() is ordered by id, which breaks ties like in the SQL query
+	sort.SliceStable(matching, func(i, j int) bool {
+		if filter.Desc {
+			return less(matching[j], matching[i])
+		}
+		return less(matching[i], matching[j])
+	})
+
+	total := len(matching)
+	start := min((filter.Page-1)*filter.PerPage, total)
+	end := min(start+filter.PerPage, total)
+
+	return matching[start:end], total, nil
+}
+
+func (r *MemoryUserRepository) GetByEmail(ctx context.Context, email string) (*User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, user := range r.all() {
+		if strings.EqualFold(user.Email, email) {
+			return user, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+func (r *MemoryUserRepository) GetOne(ctx context.Context, id int) (*User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	return &user, nil
+}
+
+func (r *MemoryUserRepository) Insert(ctx context.Context, user User) (int, error) {
+	hashedPW, err := hashPassword(user.Password)
+	if err != nil {
+		return 0, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.emailTaken(user.Email, 0) {
+		return 0, ErrDuplicateEmail
+	}
+
+	user.ID = r.nextID
+	user.Password = string(hashedPW)
+	user.CreatedAt = time.Now()
+	user.UpdatedAt = user.CreatedAt
+
+	r.nextID++
+	r.users[user.ID] = user
+	r.assign(user.ID, DefaultRole)
+	r.outbox.add("user.created", user.eventData())
+
+	return user.ID, nil
+}
+
+func (r *MemoryUserRepository) Update(ctx context.Context, u User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current, ok := r.users[u.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	if r.emailTaken(u.Email, u.ID) {
+		return ErrDuplicateEmail
+	}
+
+	if !strings.EqualFold(current.Email, u.Email) {
+		current.VerifiedAt = nil
+	}
+
+	current.Email = u.Email
+	current.FirstName = u.FirstName
+	current.LastName = u.LastName
+	current.Active = u.Active
+	current.UpdatedAt = time.Now()
+
+	r.users[u.ID] = current
+	r.outbox.add("user.updated", current.eventData())
+
+	return nil
+}
+
+func (r *MemoryUserRepository) DeleteByID(ctx context.Context, id int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	deleted, ok := r.users[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	delete(r.users, id)
+	delete(r.roles, id)
+	r.outbox.add("user.deleted", deleted.eventData())
+
+	return nil
+}
+
+func (r *MemoryUserRepository) ResetPassword(ctx context.Context, id int, password string) error {
+	hashedPW, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	user.Password = string(hashedPW)
+	user.UpdatedAt = time.Now()
+	r.users[id] = user
+
+	return nil
+}
+
+func (r *MemoryUserRepository) Verify(ctx context.Context, id int, email string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[id]
+	if !ok || !strings.EqualFold(user.Email, email) {
+		return sql.ErrNoRows
+	}
+
+	if user.Verified() {
+		return nil
+	}
+
+	now := time.Now()
+	user.VerifiedAt = &now
+	user.UpdatedAt = now
+	r.users[id] = user
+	r.outbox.add("user.verified", user.eventData())
+
+	return nil
+}
+
+func (r *MemoryUserRepository) RecordLoginFailure(ctx context.Context, id int, ip string, threshold int, lockFor time.Duration) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[id]
+	if !ok {
+		return 0, sql.ErrNoRows
+	}
+
+	user.FailedLogins++
+	if user.FailedLogins >= threshold {
+		until := time.Now().Add(lockFor)
+		user.LockedUntil = &until
+
+		r.outbox.add("user.locked", envelope.LockoutData{
+			UserID:      user.ID,
+			Email:       user.Email,
+			IP:          ip,
+			Failures:    user.FailedLogins,
+			LockedUntil: &until,
+		})
+	}
+	r.users[id] = user
+
+	return user.FailedLogins, nil
+}
+
+func (r *MemoryUserRepository) ClearLoginFailures(ctx context.Context, id int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if user, ok := r.users[id]; ok {
+		user.FailedLogins = 0
+		user.LockedUntil = nil
+		r.users[id] = user
+	}
+
+	return nil
+}
+
+func (r *MemoryUserRepository) Unlock(ctx context.Context, id int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	user.FailedLogins = 0
+	user.LockedUntil = nil
+	user.UpdatedAt = time.Now()
+	r.users[id] = user
+	r.outbox.add("user.unlocked", envelope.LockoutData{UserID: user.ID, Email: user.Email})
+
+	return nil
+}
+
+// assign gives the user a role. The caller holds the lock.
+func (r *MemoryUserRepository) assign(userID int, role string) {
+	if r.roles[userID] == nil {
+		r.roles[userID] = make(map[string]bool)
+	}
+
+	r.roles[userID][role] = true
+}
+
+// all returns copies of every user, ordered by id.
+func (r *MemoryUserRepository) all() []*User {
+	users := make([]*User, 0, len(r.users))
+	for _, user := range r.users {
+		user := user
+		users = append(users, &user)
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].ID < users[j].ID
+	})
+
+	return users
+}
+
+func (r *MemoryUserRepository) emailTaken(email string, exceptID int) bool {
+	for id, user := range r.users {
+		if id != exceptID && strings.EqualFold(user.Email, email) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MemoryOutbox keeps events in a slice. Events are the ones recorded in
+// Postgres would have, so tests can check what a handler emitted.
+type MemoryOutbox struct {
+	mu     sync.Mutex
+	events []OutboxEvent
+	sent   int // * events before this index are published
+
+	publishedAt []time.Time // * one per published event
+}
+
+func NewMemoryOutbox() *MemoryOutbox {
+	return &MemoryOutbox{}
+}
+
+func (o *MemoryOutbox) Add(ctx context.Context, eventType string, data any) error {
+	event, err := newEvent(eventType, data)
+	if err != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.events = append(o.events, OutboxEvent{
+		ID:         int64(len(o.events) + 1),
+		RoutingKey: event.Type,
+		Envelope:   event,
+		CreatedAt:  time.Now(),
+	})
+
+	return nil
+}
+
+// add is Add for callers already holding their own lock, data is always
+// valid JSON there.
+func (o *MemoryOutbox) add(eventType string, data any) {
+	_ = o.Add(context.Background(), eventType, data)
+}
+
+func (o *MemoryOutbox) Relay(ctx context.Context, limit int, publish func(OutboxEvent) error) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	published := 0
+	for o.sent < len(o.events) && published < limit {
+		if err := publish(o.events[o.sent]); err != nil {
+			return published, err
+		}
+
+		o.sent++
+		o.publishedAt = append(o.publishedAt, time.Now())
+		published++
+	}
+
+	return published, nil
+}
+
+func (o *MemoryOutbox) Prune(ctx context.Context, before time.Time) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// * events are published in order, so the ones to prune come first
+	pruned := 0
+	for pruned < len(o.publishedAt) && o.publishedAt[pruned].Before(before) {
+		pruned++
+	}
+
+	o.events = o.events[pruned:]
+	o.publishedAt = o.publishedAt[pruned:]
+	o.sent -= pruned
+
+	return pruned, nil
+}
+
+// Events returns every event added so far, published or not.
+func (o *MemoryOutbox) Events() []OutboxEvent {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return append([]OutboxEvent(nil), o.events...)
+}
@@ -0,0 +1,202 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// eventTypes lists the routing keys of the events in the outbox, in order.
+func eventTypes(outbox *MemoryOutbox) []string {
+	var types []string
+	for _, event := range outbox.Events() {
+		types = append(types, event.RoutingKey)
+	}
+
+	return types
+}
+
+func TestMemoryUserRepository(t *testing.T) {
+	ctx := context.Background()
+	models := NewMemory()
+	users := models.User
+	outbox := models.Outbox.(*MemoryOutbox)
+
+	id, err := users.Insert(ctx, User{Email: "ann@example.com", Password: "correct horse battery", Active: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := users.Insert(ctx, User{Email: "ANN@example.com", Password: "correct horse battery"}); !errors.Is(err, ErrDuplicateEmail) {
+		t.Errorf("inserting a taken email in other case gave %v, want ErrDuplicateEmail", err)
+	}
+
+	user, err := users.GetByEmail(ctx, "Ann@Example.com")
+	if err != nil || user.ID != id {
+		t.Fatalf("looking up by email in other case gave %v, %v", user, err)
+	}
+	if ok, _ := user.PasswordMatches("correct horse battery"); !ok {
+		t.Error("the password wasn't stored hashed and matching")
+	}
+
+	access, err := models.Role.ForUser(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(access.Roles, DefaultRole) {
+		t.Errorf("new user has roles %v, want %s", access.Roles, DefaultRole)
+	}
+
+	t.Run("verify", func(t *testing.T) {
+		if err := users.Verify(ctx, id, "old@example.com"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("verifying another email gave %v, want sql.ErrNoRows", err)
+		}
+
+		if err := users.Verify(ctx, id, "ann@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if err := users.Verify(ctx, id, "ann@example.com"); err != nil {
+			t.Errorf("verifying twice gave %v", err)
+		}
+
+		user, _ := users.GetOne(ctx, id)
+		if !user.Verified() {
+			t.Error("user isn't verified")
+		}
+	})
+
+	t.Run("update", func(t *testing.T) {
+		other, err := users.Insert(ctx, User{Email: "bob@example.com", Password: "correct horse battery"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		user, _ := users.GetOne(ctx, id)
+		user.FirstName = "Ann"
+		if err := users.Update(ctx, *user); err != nil {
+			t.Fatal(err)
+		}
+		if user, _ := users.GetOne(ctx, id); user.FirstName != "Ann" || !user.Verified() {
+			t.Errorf("changing the name gave %q, verified %v", user.FirstName, user.Verified())
+		}
+
+		user.Email = "Bob@example.com"
+		if err := users.Update(ctx, *user); !errors.Is(err, ErrDuplicateEmail) {
+			t.Errorf("taking another user's email gave %v, want ErrDuplicateEmail", err)
+		}
+
+		user.Email = "anne@example.com"
+		if err := users.Update(ctx, *user); err != nil {
+			t.Fatal(err)
+		}
+		if user, _ := users.GetOne(ctx, id); user.Verified() {
+			t.Error("the new email address is verified")
+		}
+
+		if err := users.Update(ctx, User{ID: 99, Email: "nobody@example.com"}); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("updating an unknown user gave %v, want sql.ErrNoRows", err)
+		}
+
+		if err := users.DeleteByID(ctx, other); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("lockout", func(t *testing.T) {
+		for want := 1; want <= 3; want++ {
+			failures, err := users.RecordLoginFailure(ctx, id, "10.0.0.1", 3, time.Minute)
+			if err != nil || failures != want {
+				t.Fatalf("failure %d counted as %d, %v", want, failures, err)
+			}
+		}
+
+		user, _ := users.GetOne(ctx, id)
+		if !user.Locked(time.Now()) {
+			t.Error("user isn't locked after reaching the threshold")
+		}
+
+		if err := users.Unlock(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+		if user, _ := users.GetOne(ctx, id); user.Locked(time.Now()) || user.FailedLogins != 0 {
+			t.Errorf("unlocked user is locked %v with %d failures", user.Locked(time.Now()), user.FailedLogins)
+		}
+
+		if err := users.Unlock(ctx, 99); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("unlocking an unknown user gave %v, want sql.ErrNoRows", err)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if err := users.DeleteByID(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := users.GetOne(ctx, id); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("getting a deleted user gave %v, want sql.ErrNoRows", err)
+		}
+		if err := users.DeleteByID(ctx, id); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("deleting twice gave %v, want sql.ErrNoRows", err)
+		}
+	})
+
+	want := []string{
+		"user.created", "user.verified",
+		"user.created", "user.updated", "user.updated", "user.deleted",
+		"user.locked", "user.unlocked",
+		"user.deleted",
+	}
+	if got := eventTypes(outbox); !slices.Equal(got, want) {
+		t.Errorf("recorded events %v, want %v", got, want)
+	}
+}
+
+func TestMemoryOutboxRelay(t *testing.T) {
+	ctx := context.Background()
+	outbox := NewMemoryOutbox()
+	for _, eventType := range []string{"user.created", "user.updated", "user.deleted"} {
+		outbox.add(eventType, nil)
+	}
+
+	broken := errors.New("broker gone")
+	var sent []string
+	publish := func(event OutboxEvent) error {
+		if event.RoutingKey == "user.deleted" && len(sent) < 3 {
+			sent = append(sent, "failed")
+			return broken
+		}
+		sent = append(sent, event.RoutingKey)
+		return nil
+	}
+
+	if published, err := outbox.Relay(ctx, 10, publish); published != 2 || !errors.Is(err, broken) {
+		t.Fatalf("relay published %d with %v, want 2 and the publish error", published, err)
+	}
+	if published, err := outbox.Relay(ctx, 10, publish); published != 1 || err != nil {
+		t.Fatalf("second relay published %d with %v, want the event that failed", published, err)
+	}
+
+	want := []string{"user.created", "user.updated", "failed", "user.deleted"}
+	if !slices.Equal(sent, want) {
+		t.Errorf("published %v, want %v", sent, want)
+	}
+
+	outbox.add("user.locked", nil)
+
+	if pruned, _ := outbox.Prune(ctx, time.Now().Add(-time.Hour)); pruned != 0 {
+		t.Errorf("pruned %d events published within the hour, want none", pruned)
+	}
+	if pruned, _ := outbox.Prune(ctx, time.Now().Add(time.Second)); pruned != 3 {
+		t.Errorf("pruned %d events, want the 3 published", pruned)
+	}
+	if got := eventTypes(outbox); !slices.Equal(got, []string{"user.locked"}) {
+		t.Errorf("outbox kept %v, want the unpublished event", got)
+	}
+
+	if published, _ := outbox.Relay(ctx, 10, publish); published != 1 {
+		t.Errorf("relay after pruning published %d, want 1", published)
+	}
+}
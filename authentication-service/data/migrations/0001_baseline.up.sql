@@ -0,0 +1,53 @@
+-- Baseline: users and the outbox, matching the `User` and `OutboxEvent` structs.
+
+CREATE SEQUENCE IF NOT EXISTS public.user_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+CREATE TABLE IF NOT EXISTS public.users (
+    id integer DEFAULT nextval('public.user_id_seq'::regclass) NOT NULL,
+    email character varying(255) NOT NULL,
+    first_name character varying(255) NOT NULL DEFAULT '',
+    last_name character varying(255) NOT NULL DEFAULT '',
+    password character varying(60) NOT NULL,
+    active integer NOT NULL DEFAULT 1,
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    updated_at timestamp without time zone NOT NULL DEFAULT now(),
+    CONSTRAINT users_pkey PRIMARY KEY (id)
+);
+
+-- databases created from the old users.sql dump call the column user_active
+DO $$
+BEGIN
+    IF EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_schema = 'public' AND table_name = 'users' AND column_name = 'user_active'
+    ) THEN
+        ALTER TABLE public.users RENAME COLUMN user_active TO active;
+    END IF;
+END
+$$;
+
+ALTER SEQUENCE public.user_id_seq OWNED BY public.users.id;
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_lower_idx ON public.users (lower(email));
+
+CREATE TABLE IF NOT EXISTS public.outbox (
+    id bigserial PRIMARY KEY,
+    event_id character varying(36) NOT NULL,
+    event_type character varying(255) NOT NULL,
+    routing_key character varying(255) NOT NULL,
+    payload jsonb NOT NULL,
+    created_at timestamp without time zone NOT NULL,
+    published_at timestamp without time zone
+);
+
+CREATE INDEX IF NOT EXISTS outbox_unpublished_idx ON public.outbox (id) WHERE published_at IS NULL;
+
+-- admin@example.com / verysecret
+INSERT INTO public.users (email, first_name, last_name, password, active, created_at, updated_at)
+VALUES ('admin@example.com', 'Admin', 'User', '$2a$12$1zGLuYDDNvATh4RA4avbKuheAMpb1svexSzrQm7up.bnpwQHs0jNe', 1, '2022-03-14 00:00:00', '2022-03-14 00:00:00')
+ON CONFLICT DO NOTHING;
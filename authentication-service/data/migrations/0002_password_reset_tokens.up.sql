@@ -0,0 +1,12 @@
+-- Only the SHA-256 of a reset token is stored, the token itself is only ever in the mail.
+
+CREATE TABLE public.password_reset_tokens (
+    id bigserial PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES public.users (id) ON DELETE CASCADE,
+    token_hash character(64) NOT NULL UNIQUE,
+    expires_at timestamp without time zone NOT NULL,
+    used_at timestamp without time zone,
+    created_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX password_reset_tokens_user_idx ON public.password_reset_tokens (user_id);
@@ -0,0 +1,4 @@
+ALTER TABLE public.users ADD COLUMN verified_at timestamp without time zone;
+
+-- accounts from before verification existed count as verified
+UPDATE public.users SET verified_at = created_at;
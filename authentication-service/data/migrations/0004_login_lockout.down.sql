@@ -0,0 +1,3 @@
+ALTER TABLE public.users
+    DROP COLUMN failed_logins,
+    DROP COLUMN locked_until;
@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS public.recovery_codes;
+
+ALTER TABLE public.users
+    DROP COLUMN totp_secret,
+    DROP COLUMN totp_enabled,
+    DROP COLUMN totp_last_step;
@@ -0,0 +1,16 @@
+-- The TOTP secret is stored encrypted by the service, recovery codes as their SHA-256.
+
+ALTER TABLE public.users
+    ADD COLUMN totp_secret bytea,
+    ADD COLUMN totp_enabled boolean NOT NULL DEFAULT false,
+    ADD COLUMN totp_last_step bigint NOT NULL DEFAULT 0;
+
+CREATE TABLE public.recovery_codes (
+    id bigserial PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES public.users (id) ON DELETE CASCADE,
+    code_hash character(64) NOT NULL,
+    used_at timestamp without time zone,
+    created_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX recovery_codes_user_idx ON public.recovery_codes (user_id);
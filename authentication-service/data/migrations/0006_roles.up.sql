@@ -0,0 +1,49 @@
+CREATE TABLE public.roles (
+    id serial PRIMARY KEY,
+    name character varying(64) NOT NULL UNIQUE,
+    description text NOT NULL DEFAULT '',
+    created_at timestamp without time zone NOT NULL DEFAULT now()
+);
+
+CREATE TABLE public.permissions (
+    id serial PRIMARY KEY,
+    name character varying(128) NOT NULL UNIQUE,
+    description text NOT NULL DEFAULT ''
+);
+
+CREATE TABLE public.role_permissions (
+    role_id integer NOT NULL REFERENCES public.roles (id) ON DELETE CASCADE,
+    permission_id integer NOT NULL REFERENCES public.permissions (id) ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE public.user_roles (
+    user_id integer NOT NULL REFERENCES public.users (id) ON DELETE CASCADE,
+    role_id integer NOT NULL REFERENCES public.roles (id) ON DELETE CASCADE,
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, role_id)
+);
+
+CREATE INDEX user_roles_role_idx ON public.user_roles (role_id);
+
+INSERT INTO public.permissions (name, description) VALUES
+    ('users.read', 'List and view users'),
+    ('users.write', 'Change, delete and unlock users'),
+    ('roles.assign', 'Assign roles to users and revoke them'),
+    ('logs.write', 'Write log entries through the broker'),
+    ('mail.send', 'Send mail through the broker');
+
+INSERT INTO public.roles (name, description) VALUES
+    ('admin', 'Everything'),
+    ('user', 'What every registered user can do');
+
+INSERT INTO public.role_permissions (role_id, permission_id)
+SELECT r.id, p.id FROM public.roles r CROSS JOIN public.permissions p
+WHERE r.name = 'admin'
+   OR (r.name = 'user' AND p.name IN ('logs.write', 'mail.send'));
+
+-- every existing user is a user, the seeded admin an admin as well
+INSERT INTO public.user_roles (user_id, role_id)
+SELECT u.id, r.id FROM public.users u CROSS JOIN public.roles r
+WHERE r.name = 'user'
+   OR (r.name = 'admin' AND u.email = 'admin@example.com');
@@ -0,0 +1,15 @@
+-- Like reset tokens, only the SHA-256 of a session token is stored.
+
+CREATE TABLE public.sessions (
+    id bigserial PRIMARY KEY,
+    token_hash character(64) NOT NULL UNIQUE,
+    user_id integer NOT NULL REFERENCES public.users (id) ON DELETE CASCADE,
+    device character varying(255) NOT NULL DEFAULT '',
+    ip character varying(64) NOT NULL DEFAULT '',
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    last_seen_at timestamp without time zone NOT NULL DEFAULT now(),
+    expires_at timestamp without time zone NOT NULL,
+    revoked_at timestamp without time zone
+);
+
+CREATE INDEX sessions_user_idx ON public.sessions (user_id);
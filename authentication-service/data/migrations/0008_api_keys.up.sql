@@ -0,0 +1,20 @@
+-- A key belongs to a user or to a service account, a name for a client
+-- that isn't a person. Scopes are permission names, separated by spaces.
+-- Only the SHA-256 of a key is stored, the prefix is kept to tell keys apart.
+
+CREATE TABLE public.api_keys (
+    id bigserial PRIMARY KEY,
+    prefix character varying(16) NOT NULL UNIQUE,
+    key_hash character(64) NOT NULL UNIQUE,
+    name character varying(255) NOT NULL DEFAULT '',
+    user_id integer REFERENCES public.users (id) ON DELETE CASCADE,
+    service character varying(64),
+    scopes text NOT NULL DEFAULT '',
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    expires_at timestamp without time zone,
+    last_used_at timestamp without time zone,
+    revoked_at timestamp without time zone,
+    CHECK ((user_id IS NULL) <> (service IS NULL))
+);
+
+CREATE INDEX api_keys_user_idx ON public.api_keys (user_id);
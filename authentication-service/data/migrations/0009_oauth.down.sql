@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS public.oauth_revoked_tokens;
+DROP TABLE IF EXISTS public.oauth_refresh_tokens;
+DROP TABLE IF EXISTS public.oauth_clients;
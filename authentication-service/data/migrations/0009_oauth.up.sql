@@ -0,0 +1,37 @@
+-- Clients of the OAuth2 token endpoint. Secrets are random, so, like tokens,
+-- only their SHA-256 is stored. Grant types and scopes are separated by
+-- spaces.
+
+CREATE TABLE public.oauth_clients (
+    id serial PRIMARY KEY,
+    client_id character varying(64) NOT NULL UNIQUE,
+    secret_hash character(64) NOT NULL,
+    name character varying(255) NOT NULL DEFAULT '',
+    grant_types text NOT NULL DEFAULT '',
+    scopes text NOT NULL DEFAULT '',
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    revoked_at timestamp without time zone
+);
+
+-- A refresh token is used once, used_at is set when it's exchanged for the
+-- next one.
+CREATE TABLE public.oauth_refresh_tokens (
+    id bigserial PRIMARY KEY,
+    token_hash character(64) NOT NULL UNIQUE,
+    client_id integer NOT NULL REFERENCES public.oauth_clients (id) ON DELETE CASCADE,
+    user_id integer NOT NULL REFERENCES public.users (id) ON DELETE CASCADE,
+    scopes text NOT NULL DEFAULT '',
+    created_at timestamp without time zone NOT NULL DEFAULT now(),
+    expires_at timestamp without time zone NOT NULL,
+    used_at timestamp without time zone,
+    revoked_at timestamp without time zone
+);
+
+CREATE INDEX oauth_refresh_tokens_user_idx ON public.oauth_refresh_tokens (user_id, client_id);
+
+-- Access tokens are JWTs nobody has to look up, but revoked ones are kept
+-- here until they would have expired anyway.
+CREATE TABLE public.oauth_revoked_tokens (
+    jti character varying(64) PRIMARY KEY,
+    expires_at timestamp without time zone NOT NULL
+);
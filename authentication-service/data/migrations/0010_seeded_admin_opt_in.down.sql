@@ -0,0 +1,8 @@
+-- back to the published password, unless one was set since
+UPDATE public.users SET password = '$2a$12$1zGLuYDDNvATh4RA4avbKuheAMpb1svexSzrQm7up.bnpwQHs0jNe', updated_at = now()
+WHERE email = 'admin@example.com' AND password = '!';
+
+INSERT INTO public.user_roles (user_id, role_id)
+SELECT u.id, r.id FROM public.users u CROSS JOIN public.roles r
+WHERE u.email = 'admin@example.com' AND r.name = 'admin'
+ON CONFLICT DO NOTHING;
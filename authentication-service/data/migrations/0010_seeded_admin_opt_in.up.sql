@@ -0,0 +1,12 @@
+-- the seeded admin@example.com has a published password, so it's no admin
+-- unless someone gives it the role through the API
+DELETE FROM public.user_roles ur
+USING public.users u, public.roles r
+WHERE ur.user_id = u.id AND ur.role_id = r.id
+  AND u.email = 'admin@example.com' AND r.name = 'admin';
+
+-- nor can it log in with that password: `!` is no bcrypt hash, so no password
+-- matches it until one is set through the API
+UPDATE public.users SET password = '!', updated_at = now()
+WHERE email = 'admin@example.com'
+  AND password = '$2a$12$1zGLuYDDNvATh4RA4avbKuheAMpb1svexSzrQm7up.bnpwQHs0jNe';
@@ -0,0 +1,28 @@
+-- Databases created from the old users.sql dump kept its users table, where
+-- the baseline's CREATE TABLE IF NOT EXISTS did nothing: every column but id
+-- is nullable and there are no defaults, which the code doesn't expect.
+-- Fill in the gaps and give them the baseline's constraints. On a database
+-- the baseline created, none of this changes anything.
+
+-- * an account without an email or password couldn't log in anyway, this keeps it that way
+UPDATE public.users SET email = 'user-' || id || '@example.invalid' WHERE email IS NULL;
+UPDATE public.users SET password = '' WHERE password IS NULL;
+UPDATE public.users SET first_name = '' WHERE first_name IS NULL;
+UPDATE public.users SET last_name = '' WHERE last_name IS NULL;
+UPDATE public.users SET active = 0 WHERE active IS NULL;
+UPDATE public.users SET created_at = now() WHERE created_at IS NULL;
+UPDATE public.users SET updated_at = created_at WHERE updated_at IS NULL;
+
+ALTER TABLE public.users
+    ALTER COLUMN email SET NOT NULL,
+    ALTER COLUMN password SET NOT NULL,
+    ALTER COLUMN first_name SET DEFAULT '',
+    ALTER COLUMN first_name SET NOT NULL,
+    ALTER COLUMN last_name SET DEFAULT '',
+    ALTER COLUMN last_name SET NOT NULL,
+    ALTER COLUMN active SET DEFAULT 1,
+    ALTER COLUMN active SET NOT NULL,
+    ALTER COLUMN created_at SET DEFAULT now(),
+    ALTER COLUMN created_at SET NOT NULL,
+    ALTER COLUMN updated_at SET DEFAULT now(),
+    ALTER COLUMN updated_at SET NOT NULL;
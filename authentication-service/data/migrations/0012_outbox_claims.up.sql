@@ -0,0 +1,7 @@
+-- The relay claims a batch by setting claimed_until instead of keeping its
+-- rows locked while the broker confirms them. Other replicas skip claimed
+-- rows until the claim runs out, so a crashed relay's batch is picked up again.
+ALTER TABLE public.outbox ADD COLUMN IF NOT EXISTS claimed_until timestamp without time zone;
+
+-- * published rows are pruned by age
+CREATE INDEX IF NOT EXISTS outbox_published_idx ON public.outbox (published_at) WHERE published_at IS NOT NULL;
@@ -3,7 +3,8 @@ package data
 import (
 	"context"
 	"database/sql"
-	"log"
+	"errors"
+	"shared/envelope"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
@@ -11,205 +12,159 @@ import (
 
 const dbTimeout = 3 * time.Second
 
-var db *sql.DB
+// ErrDuplicateEmail is returned when another user has the email, compared
+// case-insensitively.
+var ErrDuplicateEmail = errors.New("email is already registered")
 
-func New(dbPool *sql.DB) Models {
-	db = dbPool
+// New returns the Postgres implementations, sharing the pool.
+func New(db *sql.DB) Models {
+	return Models{
+		User:          NewPostgresUserRepository(db),
+		PasswordReset: NewPostgresPasswordResetRepository(db),
+		TwoFactor:     NewPostgresTwoFactorRepository(db),
+		Role:          NewPostgresRoleRepository(db),
+		Session:       NewPostgresSessionRepository(db),
+		APIKey:        NewPostgresAPIKeyRepository(db),
+		OAuth:         NewPostgresOAuthRepository(db),
+		Outbox:        NewPostgresOutbox(db),
+	}
+}
+
+// NewMemory returns in-memory implementations, e.g. for handler tests. Every
+// call starts with an empty store.
+func NewMemory() Models {
+	outbox := NewMemoryOutbox()
+	users := NewMemoryUserRepository(outbox)
 
 	return Models{
-		User: User{},
+		User:          users,
+		PasswordReset: NewMemoryPasswordResetRepository(users),
+		TwoFactor:     NewMemoryTwoFactorRepository(users),
+		Role:          NewMemoryRoleRepository(users),
+		Session:       NewMemorySessionRepository(),
+		APIKey:        NewMemoryAPIKeyRepository(users),
+		OAuth:         NewMemoryOAuthRepository(users),
+		Outbox:        outbox,
 	}
 }
 
 type Models struct {
-	User User
+	User          UserRepository
+	PasswordReset PasswordResetRepository
+	TwoFactor     TwoFactorRepository
+	Role          RoleRepository
+	Session       SessionRepository
+	APIKey        APIKeyRepository
+	OAuth         OAuthRepository
+	Outbox        Outbox
 }
 
-type User struct {
-	ID        int       `json:"id"`
-	Email     string    `json:"email"`
-	FirstName string    `json:"first_name,omitempty"`
-	LastName  string    `json:"last_name,omitempty"`
-	Password  string    `json:"-"`
-	Active    int       `json:"active"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+// UserRepository stores users. Lookups of missing users return sql.ErrNoRows
+// and changes that would give two users the same email ErrDuplicateEmail,
+// whatever the implementation. Insert, Update, DeleteByID, Verify and Unlock
+// record the matching `user.*` event. Insert gives the user the DefaultRole.
+type UserRepository interface {
+	GetAll(ctx context.Context) ([]*User, error)
+	List(ctx context.Context, filter UserFilter) ([]*User, int, error)
+	GetByEmail(ctx context.Context, email string) (*User, error)
+	GetOne(ctx context.Context, id int) (*User, error)
+	Insert(ctx context.Context, user User) (int, error)
+
+	// Update changes the user's email, names and active flag. A new email
+	// address isn't verified, whatever the old one was.
+	Update(ctx context.Context, user User) error
+
+	DeleteByID(ctx context.Context, id int) error
+	ResetPassword(ctx context.Context, id int, password string) error
+
+	// Verify marks the user's email address as verified, if the user still
+	// has that address. Verifying a verified user changes nothing.
+	Verify(ctx context.Context, id int, email string) error
+
+	// RecordLoginFailure counts a failed login and returns the failures in a
+	// row. From the threshold-th on, every failure locks the account until
+	// lockFor from now and records a `user.locked` event.
+	RecordLoginFailure(ctx context.Context, id int, ip string, threshold int, lockFor time.Duration) (int, error)
+
+	// ClearLoginFailures forgets the failures after a successful login.
+	ClearLoginFailures(ctx context.Context, id int) error
+
+	// Unlock lifts a lock and forgets the failures.
+	Unlock(ctx context.Context, id int) error
 }
 
-func (u *User) GetAll() ([]*User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
-
-	query := `SELECT id, email, first_name, last_name, password, active , created_at, updated_at
-	FROM users ORDER BY last_name`
-
-	rows, err := db.QueryContext(ctx, query)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var users []*User
-	for rows.Next() {
-		var user User
-		err := rows.Scan(
-			&user.ID,
-			&user.Email,
-			&user.FirstName,
-			&user.LastName,
-			&user.Password,
-			&user.Active,
-			&user.CreatedAt,
-			&user.UpdatedAt,
-		)
-		if err != nil {
-			log.Println("Error scanning", err)
-			return nil, err
-		}
-
-		users = append(users, &user)
-	}
-
-	return users, nil
+type User struct {
+	ID         int        `json:"id"`
+	Email      string     `json:"email"`
+	FirstName  string     `json:"first_name,omitempty"`
+	LastName   string     `json:"last_name,omitempty"`
+	Password   string     `json:"-"`
+	Active     int        `json:"active"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	VerifiedAt *time.Time `json:"verified_at,omitempty"` // * nil until the email address is verified
+
+	FailedLogins int        `json:"failed_logins"`
+	LockedUntil  *time.Time `json:"locked_until,omitempty"`
+
+	// * only filled in where it's needed, e.g. when logging in
+	*Access `json:",omitempty"`
 }
 
-func (u *User) GetByEmail(email string) (*User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
-
-	query := `SELECT id, email, first_name, last_name, password, active , created_at, updated_at
-	FROM users WHERE email = $1`
-
-	var user User
-	row := db.QueryRowContext(ctx, query, email)
-
-	err := row.Scan(
-		&user.ID,
-		&user.Email,
-		&user.FirstName,
-		&user.LastName,
-		&user.Password,
-		&user.Active,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-	)
-	if err != nil {
-		return nil, err
-	}
-
-	return &user, nil
+func (u *User) Verified() bool {
+	return u.VerifiedAt != nil
 }
 
-func (u *User) GetOne(id int) (*User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
-
-	query := `SELECT id, email, first_name, last_name, password, active , created_at, updated_at
-	WHERE id = $1`
-
-	var user User
-	row := db.QueryRowContext(ctx, query, id)
-
-	err := row.Scan(
-		&user.ID,
-		&user.Email,
-		&user.FirstName,
-		&user.LastName,
-		&user.Password,
-		&user.Active,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-	)
-	if err != nil {
-		return nil, err
-	}
-
-	return &user, nil
+func (u *User) Locked(now time.Time) bool {
+	return u.LockedUntil != nil && now.Before(*u.LockedUntil)
 }
 
-func (u *User) Update() error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
-
-	stmt := `UPDATE user SET
-				email = $1,
-				first_name = $2,
-				last_name = $3,
-				active = $4,
-				updated_at = $5,
-				WHERE id = $6
-	`
-
-	_, err := db.ExecContext(ctx, stmt, u.Email, u.FirstName, u.LastName, u.Active, time.Now(), u.ID)
-
-	return err
+// UserFilter narrows and orders the users returned by List.
+type UserFilter struct {
+	Page    int // * 1-based
+	PerPage int
+	Sort    string // * id, email, first_name, last_name or created_at
+	Desc    bool
+	Active  *int   // * only users with this active flag
+	Search  string // * case-insensitive match on email, first or last name
 }
 
-func (u *User) Delete() error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
-
-	stmt := `DELETE FROM users WHERE id = $1`
-
-	_, err := db.ExecContext(ctx, stmt, u.ID)
-
-	return err
+var sortColumns = map[string]string{
+	"id":         "id",
+	"email":      "email",
+	"first_name": "first_name",
+	"last_name":  "last_name",
+	"created_at": "created_at",
 }
 
-func (u *User) DeleteByID(id int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
-
-	stmt := `DELETE FROM users WHERE id = $1`
-
-	_, err := db.ExecContext(ctx, stmt, id)
-
-	return err
+func SortableColumn(name string) bool {
+	_, ok := sortColumns[name]
+	return ok
 }
 
-func (u *User) Insert(user User) (id int, err error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
-
-	hashedPW, err := bcrypt.GenerateFromPassword([]byte(user.Password), 12)
-	if err != nil {
-		return 0, err
-	}
-
-	var newID int
-	stmt := `INSERT INTO users (email, first_name, last_name, password, active, created_at, updated_at)
-			VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id		
-	`
-
-	err = db.QueryRowContext(ctx, stmt,
-		user.Email,
-		user.FirstName,
-		user.LastName,
-		hashedPW,
-		user.Active,
-		time.Now(),
-		time.Now()).Scan(&newID)
-
-	if err != nil {
-		return 0, err
-	}
-
-	return newID, nil
+func hashPassword(password string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(password), 12)
 }
 
-func (u *User) ResetPassword(password string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
-
-	hashedPW, err := bcrypt.GenerateFromPassword([]byte(password), 12)
-	if err != nil {
-		return err
+// eventData is what user events carry, everything but the password.
+func (u *User) eventData() envelope.UserData {
+	return envelope.UserData{
+		ID:        u.ID,
+		Email:     u.Email,
+		FirstName: u.FirstName,
+		LastName:  u.LastName,
+		Active:    u.Active,
 	}
+}
 
-	stmt := `UPDATE user SET password = $1 WHERE id = $2`
-	_, err = db.ExecContext(ctx, stmt, hashedPW, u.ID)
+// dummyHash is a bcrypt hash, with the same cost as real ones, of a password
+// nobody has.
+const dummyHash = "$2a$12$L1G01/c/1K30KY9L./k1au2iTEdeqeDUy.qhDiPOTN03Sy0weeF.O"
 
-	return err
+// DummyPasswordCheck takes as long as PasswordMatches, so a login for an
+// unknown email can't be told apart by its response time.
+func DummyPasswordCheck(password string) {
+	bcrypt.CompareHashAndPassword([]byte(dummyHash), []byte(password))
 }
 
 func (u *User) PasswordMatches(password string) (bool, error) {
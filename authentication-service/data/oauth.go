@@ -0,0 +1,593 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// OAuthClient is a registered client of the OAuth2 token endpoint.
+type OAuthClient struct {
+	ID         int        `json:"-"`
+	ClientID   string     `json:"client_id"`
+	SecretHash string     `json:"-"`
+	Name       string     `json:"name,omitempty"`
+	GrantTypes []string   `json:"grant_types"`
+	Scopes     []string   `json:"scopes"` // * the most any of its tokens may have
+	CreatedAt  time.Time  `json:"created_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+func (c *OAuthClient) Allows(grantType string) bool {
+	return slices.Contains(c.GrantTypes, grantType)
+}
+
+// RefreshToken is what a refresh token stands for, a user's grant to a
+// client.
+type RefreshToken struct {
+	ClientID  int    // * the OAuthClient's ID
+	Client    string // * and its client id, only filled in by RefreshToken
+	UserID    int
+	Scopes    []string
+	ExpiresAt time.Time
+}
+
+// OAuthRepository stores OAuth2 clients and refresh tokens by the hash of
+// their secrets, and revoked access tokens by their id.
+type OAuthRepository interface {
+	CreateClient(ctx context.Context, client OAuthClient, secretHash string) (int, error)
+	ListClients(ctx context.Context) ([]*OAuthClient, error)
+
+	// Client returns the client with the client id, unless it was revoked,
+	// sql.ErrNoRows otherwise.
+	Client(ctx context.Context, clientID string) (*OAuthClient, error)
+
+	// RevokeClient revokes the client and its refresh tokens. It returns
+	// sql.ErrNoRows if there is no such client that isn't revoked already.
+	RevokeClient(ctx context.Context, clientID string) error
+
+	CreateRefreshToken(ctx context.Context, token RefreshToken, tokenHash string) error
+
+	// RefreshToken returns the refresh token with the hash, ErrInvalidToken
+	// for an unknown, used, expired or revoked token.
+	RefreshToken(ctx context.Context, tokenHash string) (*RefreshToken, error)
+
+	// RotateRefreshToken uses up the client's refresh token with oldHash and
+	// stores one with newHash, the same user and scopes, valid until
+	// expiresAt, in its place. It returns the old token. A token used before
+	// means it was stolen, by whoever used it first or now, so every refresh
+	// token of the user for the client is revoked. It returns
+	// ErrInvalidToken for any token that can't be rotated.
+	RotateRefreshToken(ctx context.Context, clientID int, oldHash, newHash string, expiresAt time.Time) (*RefreshToken, error)
+
+	// RevokeRefreshToken revokes the client's refresh token with the hash.
+	// Unknown tokens are ignored.
+	RevokeRefreshToken(ctx context.Context, clientID int, tokenHash string) error
+
+	// RevokeUserTokens revokes every refresh token of the user.
+	RevokeUserTokens(ctx context.Context, userID int) error
+
+	// RevokeAccessToken remembers the access token with the id as revoked
+	// until it expires.
+	RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error
+	AccessTokenRevoked(ctx context.Context, jti string) (bool, error)
+}
+
+type PostgresOAuthRepository struct {
+	db *sql.DB
+}
+
+func NewPostgresOAuthRepository(db *sql.DB) *PostgresOAuthRepository {
+	return &PostgresOAuthRepository{db: db}
+}
+
+const oauthClientColumns = `id, client_id, secret_hash, name, grant_types, scopes, created_at, revoked_at`
+
+func scanOAuthClient(row interface{ Scan(...any) error }) (*OAuthClient, error) {
+	var client OAuthClient
+	var grantTypes, scopes string
+
+	err := row.Scan(
+		&client.ID,
+		&client.ClientID,
+		&client.SecretHash,
+		&client.Name,
+		&grantTypes,
+		&scopes,
+		&client.CreatedAt,
+		&client.RevokedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	client.GrantTypes = strings.Fields(grantTypes)
+	client.Scopes = strings.Fields(scopes)
+
+	return &client, nil
+}
+
+func (r *PostgresOAuthRepository) CreateClient(ctx context.Context, client OAuthClient, secretHash string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	var id int
+	stmt := `INSERT INTO oauth_clients (client_id, secret_hash, name, grant_types, scopes, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`
+
+	err := r.db.QueryRowContext(ctx, stmt,
+		client.ClientID,
+		secretHash,
+		client.Name,
+		strings.Join(client.GrantTypes, " "),
+		strings.Join(client.Scopes, " "),
+		time.Now(),
+	).Scan(&id)
+
+	return id, err
+}
+
+func (r *PostgresOAuthRepository) ListClients(ctx context.Context) ([]*OAuthClient, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	rows, err := r.db.QueryContext(ctx, `SELECT `+oauthClientColumns+` FROM oauth_clients ORDER BY id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []*OAuthClient{}
+	for rows.Next() {
+		client, err := scanOAuthClient(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		clients = append(clients, client)
+	}
+
+	return clients, rows.Err()
+}
+
+func (r *PostgresOAuthRepository) Client(ctx context.Context, clientID string) (*OAuthClient, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `SELECT ` + oauthClientColumns + ` FROM oauth_clients WHERE client_id = $1 AND revoked_at IS NULL`
+
+	return scanOAuthClient(r.db.QueryRowContext(ctx, query, clientID))
+}
+
+func (r *PostgresOAuthRepository) RevokeClient(ctx context.Context, clientID string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	var id int
+	stmt := `UPDATE oauth_clients SET revoked_at = $1 WHERE client_id = $2 AND revoked_at IS NULL RETURNING id`
+	if err := tx.QueryRowContext(ctx, stmt, now, clientID).Scan(&id); err != nil {
+		return err
+	}
+
+	stmt = `UPDATE oauth_refresh_tokens SET revoked_at = $1 WHERE client_id = $2 AND revoked_at IS NULL`
+	if _, err := tx.ExecContext(ctx, stmt, now, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *PostgresOAuthRepository) CreateRefreshToken(ctx context.Context, token RefreshToken, tokenHash string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	return insertRefreshToken(ctx, r.db, token, tokenHash)
+}
+
+func insertRefreshToken(ctx context.Context, exec execer, token RefreshToken, tokenHash string) error {
+	stmt := `INSERT INTO oauth_refresh_tokens (token_hash, client_id, user_id, scopes, created_at, expires_at)
+			VALUES ($1, $2, $3, $4, $5, $6)`
+
+	_, err := exec.ExecContext(ctx, stmt,
+		tokenHash,
+		token.ClientID,
+		token.UserID,
+		strings.Join(token.Scopes, " "),
+		time.Now(),
+		token.ExpiresAt,
+	)
+
+	return err
+}
+
+func (r *PostgresOAuthRepository) RefreshToken(ctx context.Context, tokenHash string) (*RefreshToken, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	var token RefreshToken
+	var scopes string
+	query := `SELECT t.client_id, c.client_id, t.user_id, t.scopes, t.expires_at
+	FROM oauth_refresh_tokens t JOIN oauth_clients c ON c.id = t.client_id
+	WHERE t.token_hash = $1 AND t.used_at IS NULL AND t.revoked_at IS NULL AND t.expires_at > $2`
+
+	err := r.db.QueryRowContext(ctx, query, tokenHash, time.Now()).Scan(
+		&token.ClientID,
+		&token.Client,
+		&token.UserID,
+		&scopes,
+		&token.ExpiresAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	token.Scopes = strings.Fields(scopes)
+
+	return &token, nil
+}
+
+func (r *PostgresOAuthRepository) RotateRefreshToken(ctx context.Context, clientID int, oldHash, newHash string, expiresAt time.Time) (*RefreshToken, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	var old RefreshToken
+	var scopes string
+	var usedAt, revokedAt *time.Time
+	query := `SELECT client_id, user_id, scopes, expires_at, used_at, revoked_at FROM oauth_refresh_tokens
+	WHERE token_hash = $1 AND client_id = $2
+	FOR UPDATE`
+
+	err = tx.QueryRowContext(ctx, query, oldHash, clientID).Scan(
+		&old.ClientID,
+		&old.UserID,
+		&scopes,
+		&old.ExpiresAt,
+		&usedAt,
+		&revokedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	old.Scopes = strings.Fields(scopes)
+
+	if usedAt != nil && revokedAt == nil {
+		stmt := `UPDATE oauth_refresh_tokens SET revoked_at = $1
+		WHERE user_id = $2 AND client_id = $3 AND revoked_at IS NULL`
+		if _, err := tx.ExecContext(ctx, stmt, now, old.UserID, clientID); err != nil {
+			return nil, err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+
+		return nil, ErrInvalidToken
+	}
+
+	if usedAt != nil || revokedAt != nil || !now.Before(old.ExpiresAt) {
+		return nil, ErrInvalidToken
+	}
+
+	stmt := `UPDATE oauth_refresh_tokens SET used_at = $1 WHERE token_hash = $2`
+	if _, err := tx.ExecContext(ctx, stmt, now, oldHash); err != nil {
+		return nil, err
+	}
+
+	next := old
+	next.ExpiresAt = expiresAt
+	if err := insertRefreshToken(ctx, tx, next, newHash); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &old, nil
+}
+
+func (r *PostgresOAuthRepository) RevokeRefreshToken(ctx context.Context, clientID int, tokenHash string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `UPDATE oauth_refresh_tokens SET revoked_at = $1
+	WHERE token_hash = $2 AND client_id = $3 AND revoked_at IS NULL`
+
+	_, err := r.db.ExecContext(ctx, stmt, time.Now(), tokenHash, clientID)
+
+	return err
+}
+
+func (r *PostgresOAuthRepository) RevokeUserTokens(ctx context.Context, userID int) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `UPDATE oauth_refresh_tokens SET revoked_at = $1 WHERE user_id = $2 AND revoked_at IS NULL`
+
+	_, err := r.db.ExecContext(ctx, stmt, time.Now(), userID)
+
+	return err
+}
+
+func (r *PostgresOAuthRepository) RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	now := time.Now()
+
+	// * tokens that expired need no remembering, this keeps the table small
+	if _, err := r.db.ExecContext(ctx, `DELETE FROM oauth_revoked_tokens WHERE expires_at <= $1`, now); err != nil {
+		return err
+	}
+
+	stmt := `INSERT INTO oauth_revoked_tokens (jti, expires_at) VALUES ($1, $2) ON CONFLICT DO NOTHING`
+	_, err := r.db.ExecContext(ctx, stmt, jti, expiresAt)
+
+	return err
+}
+
+func (r *PostgresOAuthRepository) AccessTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	var revoked bool
+	err := r.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM oauth_revoked_tokens WHERE jti = $1)`, jti).Scan(&revoked)
+
+	return revoked, err
+}
+
+type memoryRefreshToken struct {
+	RefreshToken
+	used    bool
+	revoked bool
+}
+
+// MemoryOAuthRepository keeps clients and tokens in maps, next to the memory
+// user repository, sharing its lock.
+type MemoryOAuthRepository struct {
+	users         *MemoryUserRepository
+	clients       map[string]*OAuthClient // * by client id
+	refreshTokens map[string]*memoryRefreshToken
+	revoked       map[string]time.Time
+	nextID        int
+}
+
+func NewMemoryOAuthRepository(users *MemoryUserRepository) *MemoryOAuthRepository {
+	return &MemoryOAuthRepository{
+		users:         users,
+		clients:       make(map[string]*OAuthClient),
+		refreshTokens: make(map[string]*memoryRefreshToken),
+		revoked:       make(map[string]time.Time),
+		nextID:        1,
+	}
+}
+
+func copyClient(client *OAuthClient) *OAuthClient {
+	c := *client
+	c.GrantTypes = slices.Clone(client.GrantTypes)
+	c.Scopes = slices.Clone(client.Scopes)
+
+	return &c
+}
+
+func (r *MemoryOAuthRepository) CreateClient(ctx context.Context, client OAuthClient, secretHash string) (int, error) {
+	r.users.mu.Lock()
+	defer r.users.mu.Unlock()
+
+	if _, ok := r.clients[client.ClientID]; ok {
+		return 0, errors.New("client id is taken")
+	}
+
+	client.ID = r.nextID
+	client.SecretHash = secretHash
+	client.CreatedAt = time.Now()
+
+	r.nextID++
+	r.clients[client.ClientID] = copyClient(&client)
+
+	return client.ID, nil
+}
+
+func (r *MemoryOAuthRepository) ListClients(ctx context.Context) ([]*OAuthClient, error) {
+	r.users.mu.Lock()
+	defer r.users.mu.Unlock()
+
+	clients := []*OAuthClient{}
+	for _, client := range r.clients {
+		clients = append(clients, copyClient(client))
+	}
+
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ID > clients[j].ID
+	})
+
+	return clients, nil
+}
+
+func (r *MemoryOAuthRepository) Client(ctx context.Context, clientID string) (*OAuthClient, error) {
+	r.users.mu.Lock()
+	defer r.users.mu.Unlock()
+
+	client, ok := r.clients[clientID]
+	if !ok || client.RevokedAt != nil {
+		return nil, sql.ErrNoRows
+	}
+
+	return copyClient(client), nil
+}
+
+func (r *MemoryOAuthRepository) RevokeClient(ctx context.Context, clientID string) error {
+	r.users.mu.Lock()
+	defer r.users.mu.Unlock()
+
+	client, ok := r.clients[clientID]
+	if !ok || client.RevokedAt != nil {
+		return sql.ErrNoRows
+	}
+
+	now := time.Now()
+	client.RevokedAt = &now
+
+	for _, token := range r.refreshTokens {
+		if token.ClientID == client.ID {
+			token.revoked = true
+		}
+	}
+
+	return nil
+}
+
+func (r *MemoryOAuthRepository) CreateRefreshToken(ctx context.Context, token RefreshToken, tokenHash string) error {
+	r.users.mu.Lock()
+	defer r.users.mu.Unlock()
+
+	if _, ok := r.users.users[token.UserID]; !ok {
+		return sql.ErrNoRows
+	}
+
+	token.Scopes = slices.Clone(token.Scopes)
+	r.refreshTokens[tokenHash] = &memoryRefreshToken{RefreshToken: token}
+
+	return nil
+}
+
+// active reports whether the token can be used. The caller holds the lock.
+func (r *MemoryOAuthRepository) active(token *memoryRefreshToken, now time.Time) bool {
+	// * tokens of a deleted user go with them, like ON DELETE CASCADE
+	if _, ok := r.users.users[token.UserID]; !ok {
+		return false
+	}
+
+	return !token.used && !token.revoked && now.Before(token.ExpiresAt)
+}
+
+func (r *MemoryOAuthRepository) RefreshToken(ctx context.Context, tokenHash string) (*RefreshToken, error) {
+	r.users.mu.Lock()
+	defer r.users.mu.Unlock()
+
+	token, ok := r.refreshTokens[tokenHash]
+	if !ok || !r.active(token, time.Now()) {
+		return nil, ErrInvalidToken
+	}
+
+	t := token.RefreshToken
+	t.Scopes = slices.Clone(t.Scopes)
+	for _, client := range r.clients {
+		if client.ID == t.ClientID {
+			t.Client = client.ClientID
+		}
+	}
+
+	return &t, nil
+}
+
+func (r *MemoryOAuthRepository) RotateRefreshToken(ctx context.Context, clientID int, oldHash, newHash string, expiresAt time.Time) (*RefreshToken, error) {
+	r.users.mu.Lock()
+	defer r.users.mu.Unlock()
+
+	old, ok := r.refreshTokens[oldHash]
+	if !ok || old.ClientID != clientID {
+		return nil, ErrInvalidToken
+	}
+
+	if old.used && !old.revoked {
+		for _, token := range r.refreshTokens {
+			if token.UserID == old.UserID && token.ClientID == clientID {
+				token.revoked = true
+			}
+		}
+
+		return nil, ErrInvalidToken
+	}
+
+	if !r.active(old, time.Now()) {
+		return nil, ErrInvalidToken
+	}
+
+	old.used = true
+
+	next := old.RefreshToken
+	next.Scopes = slices.Clone(next.Scopes)
+	next.ExpiresAt = expiresAt
+	r.refreshTokens[newHash] = &memoryRefreshToken{RefreshToken: next}
+
+	t := old.RefreshToken
+	t.Scopes = slices.Clone(t.Scopes)
+
+	return &t, nil
+}
+
+func (r *MemoryOAuthRepository) RevokeRefreshToken(ctx context.Context, clientID int, tokenHash string) error {
+	r.users.mu.Lock()
+	defer r.users.mu.Unlock()
+
+	if token, ok := r.refreshTokens[tokenHash]; ok && token.ClientID == clientID {
+		token.revoked = true
+	}
+
+	return nil
+}
+
+func (r *MemoryOAuthRepository) RevokeUserTokens(ctx context.Context, userID int) error {
+	r.users.mu.Lock()
+	defer r.users.mu.Unlock()
+
+	for _, token := range r.refreshTokens {
+		if token.UserID == userID {
+			token.revoked = true
+		}
+	}
+
+	return nil
+}
+
+func (r *MemoryOAuthRepository) RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	r.users.mu.Lock()
+	defer r.users.mu.Unlock()
+
+	now := time.Now()
+	for id, until := range r.revoked {
+		if !now.Before(until) {
+			delete(r.revoked, id)
+		}
+	}
+
+	r.revoked[jti] = expiresAt
+
+	return nil
+}
+
+func (r *MemoryOAuthRepository) AccessTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	r.users.mu.Lock()
+	defer r.users.mu.Unlock()
+
+	_, ok := r.revoked[jti]
+
+	return ok, nil
+}
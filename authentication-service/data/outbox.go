@@ -0,0 +1,216 @@
+package data
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"shared/envelope"
+	"slices"
+	"time"
+)
+
+const (
+	eventSource  = "authentication-service"
+	eventVersion = "1"
+
+	// outboxClaim is how long a relay has to publish the batch it claimed
+	outboxClaim = 2 * time.Minute
+)
+
+// execer is satisfied by both *sql.DB and *sql.Tx, so events can be written
+// in the same transaction as the change they describe.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// Outbox holds domain events until the relay publishes them to RabbitMQ.
+type Outbox interface {
+	// Add stores an event on its own, for events that don't change any row,
+	// like logins.
+	Add(ctx context.Context, eventType string, data any) error
+
+	// Relay hands up to limit unpublished events, oldest first, to publish
+	// and marks the ones it succeeded for as published. It stops at the
+	// first event that can't be published and returns the number published.
+	Relay(ctx context.Context, limit int, publish func(OutboxEvent) error) (int, error)
+
+	// Prune deletes the events published before the given time and returns
+	// how many it deleted.
+	Prune(ctx context.Context, before time.Time) (int, error)
+}
+
+// PostgresOutbox keeps events in the `outbox` table, next to the rows they
+// describe.
+type PostgresOutbox struct {
+	db *sql.DB
+}
+
+func NewPostgresOutbox(db *sql.DB) *PostgresOutbox {
+	return &PostgresOutbox{db: db}
+}
+
+type OutboxEvent struct {
+	ID         int64
+	RoutingKey string
+	Envelope   envelope.Envelope
+	CreatedAt  time.Time
+}
+
+func (o *PostgresOutbox) Add(ctx context.Context, eventType string, data any) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	return insertEvent(ctx, o.db, eventType, data)
+}
+
+func newEvent(eventType string, data any) (envelope.Envelope, error) {
+	return envelope.Encode(eventType, eventVersion, eventSource, data)
+}
+
+func insertEvent(ctx context.Context, exec execer, eventType string, data any) error {
+	event, err := newEvent(eventType, data)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	// * the event type doubles as the routing key
+	stmt := `INSERT INTO outbox (event_id, event_type, routing_key, payload, created_at)
+			VALUES ($1, $2, $3, $4, $5)`
+
+	_, err = exec.ExecContext(ctx, stmt, event.ID, event.Type, event.Type, payload, time.Now())
+
+	return err
+}
+
+// Relay claims its batch in a single statement, so no rows stay locked while
+// the broker confirms the events. Other replicas skip claimed rows, and a
+// claim runs out after outboxClaim in case the relay dies holding it.
+func (o *PostgresOutbox) Relay(ctx context.Context, limit int, publish func(OutboxEvent) error) (int, error) {
+	events, err := o.claim(ctx, limit)
+	if err != nil || len(events) == 0 {
+		return 0, err
+	}
+
+	// * stop once the claim ran out, another replica may have the rest by now
+	claimCtx, cancel := context.WithTimeout(ctx, outboxClaim)
+	defer cancel()
+
+	published := 0
+	for _, event := range events {
+		// keep the order, stop at the first event that can't be published
+		err := claimCtx.Err()
+		if err == nil {
+			err = publish(event)
+		}
+		if err == nil {
+			err = o.markPublished(ctx, event.ID)
+		}
+
+		if err != nil {
+			// * hand the rest back now instead of when the claim runs out,
+			// unless it already did and the rows may be someone else's
+			if claimCtx.Err() == nil {
+				if releaseErr := o.release(ctx, event.ID, events[len(events)-1].ID); releaseErr != nil {
+					log.Println("Releasing outbox claim failed:", releaseErr)
+				}
+			}
+			return published, err
+		}
+
+		published++
+	}
+
+	return published, nil
+}
+
+func (o *PostgresOutbox) claim(ctx context.Context, limit int) ([]OutboxEvent, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	now := time.Now()
+
+	// * SKIP LOCKED only matters while the statement runs, claimed_until keeps the batch after
+	query := `UPDATE outbox SET claimed_until = $1
+	WHERE id IN (
+		SELECT id FROM outbox
+		WHERE published_at IS NULL AND (claimed_until IS NULL OR claimed_until < $2)
+		ORDER BY id LIMIT $3 FOR UPDATE SKIP LOCKED)
+	RETURNING id, routing_key, payload, created_at`
+
+	rows, err := o.db.QueryContext(ctx, query, now.Add(outboxClaim), now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []OutboxEvent
+	for rows.Next() {
+		var event OutboxEvent
+		var payload []byte
+
+		if err := rows.Scan(&event.ID, &event.RoutingKey, &payload, &event.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal(payload, &event.Envelope); err != nil {
+			return nil, err
+		}
+
+		events = append(events, event)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// * RETURNING has no order
+	slices.SortFunc(events, func(a, b OutboxEvent) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+
+	return events, nil
+}
+
+func (o *PostgresOutbox) markPublished(ctx context.Context, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `UPDATE outbox SET published_at = $1, claimed_until = NULL WHERE id = $2`
+	_, err := o.db.ExecContext(ctx, stmt, time.Now(), id)
+
+	return err
+}
+
+// release drops the claim on the unpublished events of a batch, from id first
+// to id last.
+func (o *PostgresOutbox) release(ctx context.Context, first, last int64) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `UPDATE outbox SET claimed_until = NULL
+	WHERE id BETWEEN $1 AND $2 AND published_at IS NULL`
+	_, err := o.db.ExecContext(ctx, stmt, first, last)
+
+	return err
+}
+
+func (o *PostgresOutbox) Prune(ctx context.Context, before time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	result, err := o.db.ExecContext(ctx, `DELETE FROM outbox WHERE published_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+
+	pruned, err := result.RowsAffected()
+
+	return int(pruned), err
+}
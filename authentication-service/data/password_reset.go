@@ -0,0 +1,163 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrInvalidToken is returned for reset tokens that don't exist, expired or
+// were already used. Callers can't and shouldn't tell these apart.
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// PasswordResetRepository stores password reset tokens by their hash.
+type PasswordResetRepository interface {
+	// Create stores a token for the user, valid until expiresAt.
+	Create(ctx context.Context, userID int, tokenHash string, expiresAt time.Time) error
+
+	// Consume sets the password of the token's user and uses up the token,
+	// and every other token of the user with it. It records a
+	// `user.password.reset` event.
+	Consume(ctx context.Context, tokenHash, password string) (int, error)
+}
+
+type PostgresPasswordResetRepository struct {
+	db *sql.DB
+}
+
+func NewPostgresPasswordResetRepository(db *sql.DB) *PostgresPasswordResetRepository {
+	return &PostgresPasswordResetRepository{db: db}
+}
+
+func (r *PostgresPasswordResetRepository) Create(ctx context.Context, userID int, tokenHash string, expiresAt time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `INSERT INTO password_reset_tokens (user_id, token_hash, expires_at, created_at)
+			VALUES ($1, $2, $3, $4)`
+
+	_, err := r.db.ExecContext(ctx, stmt, userID, tokenHash, expiresAt, time.Now())
+
+	return err
+}
+
+func (r *PostgresPasswordResetRepository) Consume(ctx context.Context, tokenHash, password string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	hashedPW, err := hashPassword(password)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	// * the row lock makes a second, concurrent use of the token wait and then fail
+	var userID int
+	query := `SELECT user_id FROM password_reset_tokens
+	WHERE token_hash = $1 AND used_at IS NULL AND expires_at > $2 FOR UPDATE`
+
+	err = tx.QueryRowContext(ctx, query, tokenHash, now).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrInvalidToken
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	stmt := `UPDATE password_reset_tokens SET used_at = $1 WHERE user_id = $2 AND used_at IS NULL`
+	if _, err := tx.ExecContext(ctx, stmt, now, userID); err != nil {
+		return 0, err
+	}
+
+	var user User
+	stmt = `UPDATE users SET password = $1, updated_at = $2 WHERE id = $3
+	RETURNING id, email, first_name, last_name, active`
+
+	err = tx.QueryRowContext(ctx, stmt, hashedPW, now, userID).Scan(
+		&user.ID,
+		&user.Email,
+		&user.FirstName,
+		&user.LastName,
+		&user.Active,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := insertEvent(ctx, tx, "user.password.reset", user.eventData()); err != nil {
+		return 0, err
+	}
+
+	return userID, tx.Commit()
+}
+
+type resetToken struct {
+	userID    int
+	expiresAt time.Time
+	used      bool
+}
+
+// MemoryPasswordResetRepository keeps tokens in a map and changes passwords
+// through the memory user repository.
+type MemoryPasswordResetRepository struct {
+	users  *MemoryUserRepository
+	tokens map[string]*resetToken
+}
+
+func NewMemoryPasswordResetRepository(users *MemoryUserRepository) *MemoryPasswordResetRepository {
+	return &MemoryPasswordResetRepository{
+		users:  users,
+		tokens: make(map[string]*resetToken),
+	}
+}
+
+func (r *MemoryPasswordResetRepository) Create(ctx context.Context, userID int, tokenHash string, expiresAt time.Time) error {
+	r.users.mu.Lock()
+	defer r.users.mu.Unlock()
+
+	r.tokens[tokenHash] = &resetToken{userID: userID, expiresAt: expiresAt}
+
+	return nil
+}
+
+func (r *MemoryPasswordResetRepository) Consume(ctx context.Context, tokenHash, password string) (int, error) {
+	hashedPW, err := hashPassword(password)
+	if err != nil {
+		return 0, err
+	}
+
+	// * shares the user repository's lock, so the token and the password change together
+	r.users.mu.Lock()
+	defer r.users.mu.Unlock()
+
+	token, ok := r.tokens[tokenHash]
+	if !ok || token.used || !time.Now().Before(token.expiresAt) {
+		return 0, ErrInvalidToken
+	}
+
+	user, ok := r.users.users[token.userID]
+	if !ok {
+		return 0, ErrInvalidToken
+	}
+
+	for _, t := range r.tokens {
+		if t.userID == token.userID {
+			t.used = true
+		}
+	}
+
+	user.Password = string(hashedPW)
+	user.UpdatedAt = time.Now()
+	r.users.users[user.ID] = user
+	r.users.outbox.add("user.password.reset", user.eventData())
+
+	return user.ID, nil
+}
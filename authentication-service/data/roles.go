@@ -0,0 +1,328 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"shared/envelope"
+	"sort"
+	"time"
+)
+
+// DefaultRole is given to every new user.
+const DefaultRole = "user"
+
+// ErrUnknownRole is returned for a role name that doesn't exist.
+var ErrUnknownRole = errors.New("unknown role")
+
+type Role struct {
+	ID          int      `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Permissions []string `json:"permissions"`
+}
+
+// Access is what a user may do: their roles and the permissions the roles
+// grant together, both sorted.
+type Access struct {
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions"`
+}
+
+// RoleRepository reads roles and assigns them. Methods taking a user id
+// return sql.ErrNoRows for a missing user.
+type RoleRepository interface {
+	List(ctx context.Context) ([]*Role, error)
+	ForUser(ctx context.Context, userID int) (*Access, error)
+
+	// Assign gives the user the role and records a `user.role.assigned`
+	// event, unless the user has the role already.
+	Assign(ctx context.Context, userID int, role string) error
+
+	// Revoke takes the role from the user and records a `user.role.revoked`
+	// event, unless the user doesn't have the role.
+	Revoke(ctx context.Context, userID int, role string) error
+}
+
+type PostgresRoleRepository struct {
+	db *sql.DB
+}
+
+func NewPostgresRoleRepository(db *sql.DB) *PostgresRoleRepository {
+	return &PostgresRoleRepository{db: db}
+}
+
+func (r *PostgresRoleRepository) List(ctx context.Context) ([]*Role, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `SELECT r.id, r.name, r.description, p.name
+	FROM roles r
+	LEFT JOIN role_permissions rp ON rp.role_id = r.id
+	LEFT JOIN permissions p ON p.id = rp.permission_id
+	ORDER BY r.name, p.name`
+
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []*Role
+	for rows.Next() {
+		var role Role
+		var permission sql.NullString
+		if err := rows.Scan(&role.ID, &role.Name, &role.Description, &permission); err != nil {
+			return nil, err
+		}
+
+		// * one row per permission, rows of a role are next to each other
+		if len(roles) == 0 || roles[len(roles)-1].ID != role.ID {
+			role.Permissions = []string{}
+			roles = append(roles, &role)
+		}
+
+		if permission.Valid {
+			last := roles[len(roles)-1]
+			last.Permissions = append(last.Permissions, permission.String)
+		}
+	}
+
+	return roles, rows.Err()
+}
+
+func (r *PostgresRoleRepository) ForUser(ctx context.Context, userID int) (*Access, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	var exists bool
+	if err := r.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)`, userID).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, sql.ErrNoRows
+	}
+
+	var access Access
+	var err error
+
+	query := `SELECT r.name FROM user_roles ur JOIN roles r ON r.id = ur.role_id
+	WHERE ur.user_id = $1 ORDER BY r.name`
+	if access.Roles, err = queryStrings(ctx, r.db, query, userID); err != nil {
+		return nil, err
+	}
+
+	query = `SELECT DISTINCT p.name FROM user_roles ur
+	JOIN role_permissions rp ON rp.role_id = ur.role_id
+	JOIN permissions p ON p.id = rp.permission_id
+	WHERE ur.user_id = $1 ORDER BY p.name`
+	if access.Permissions, err = queryStrings(ctx, r.db, query, userID); err != nil {
+		return nil, err
+	}
+
+	return &access, nil
+}
+
+func queryStrings(ctx context.Context, db *sql.DB, query string, args ...any) ([]string, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := []string{}
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+
+	return values, rows.Err()
+}
+
+// lookupRole makes sure the user exists and returns the id of the role.
+func lookupRole(ctx context.Context, tx *sql.Tx, userID int, role string) (int, error) {
+	var id int
+	if err := tx.QueryRowContext(ctx, `SELECT id FROM users WHERE id = $1`, userID).Scan(&id); err != nil {
+		return 0, err
+	}
+
+	err := tx.QueryRowContext(ctx, `SELECT id FROM roles WHERE name = $1`, role).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrUnknownRole
+	}
+
+	return id, err
+}
+
+func (r *PostgresRoleRepository) Assign(ctx context.Context, userID int, role string) error {
+	return r.change(ctx, userID, role, "user.role.assigned", func(tx *sql.Tx, roleID int) (sql.Result, error) {
+		stmt := `INSERT INTO user_roles (user_id, role_id, created_at) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`
+		return tx.ExecContext(ctx, stmt, userID, roleID, time.Now())
+	})
+}
+
+func (r *PostgresRoleRepository) Revoke(ctx context.Context, userID int, role string) error {
+	return r.change(ctx, userID, role, "user.role.revoked", func(tx *sql.Tx, roleID int) (sql.Result, error) {
+		stmt := `DELETE FROM user_roles WHERE user_id = $1 AND role_id = $2`
+		return tx.ExecContext(ctx, stmt, userID, roleID)
+	})
+}
+
+// change looks up the role and runs exec, recording the event if exec
+// changed a row.
+func (r *PostgresRoleRepository) change(ctx context.Context, userID int, role, eventType string, exec func(tx *sql.Tx, roleID int) (sql.Result, error)) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	roleID, err := lookupRole(ctx, tx, userID, role)
+	if err != nil {
+		return err
+	}
+
+	result, err := exec(tx, roleID)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+
+	if err := insertEvent(ctx, tx, eventType, envelope.RoleData{UserID: userID, Role: role}); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// MemoryRoleRepository has the roles the migrations seed. The roles of each
+// user are kept by the memory user repository, which gives new users the
+// default role.
+type MemoryRoleRepository struct {
+	users *MemoryUserRepository
+	roles []*Role
+}
+
+func NewMemoryRoleRepository(users *MemoryUserRepository) *MemoryRoleRepository {
+	return &MemoryRoleRepository{
+		users: users,
+		roles: []*Role{
+			{
+				ID:          1,
+				Name:        "admin",
+				Description: "Everything",
+				Permissions: []string{"logs.write", "mail.send", "roles.assign", "users.read", "users.write"},
+			},
+			{
+				ID:          2,
+				Name:        DefaultRole,
+				Description: "What every registered user can do",
+				Permissions: []string{"logs.write", "mail.send"},
+			},
+		},
+	}
+}
+
+func (r *MemoryRoleRepository) role(name string) *Role {
+	for _, role := range r.roles {
+		if role.Name == name {
+			return role
+		}
+	}
+
+	return nil
+}
+
+func (r *MemoryRoleRepository) List(ctx context.Context) ([]*Role, error) {
+	roles := make([]*Role, 0, len(r.roles))
+	for _, role := range r.roles {
+		role := *role
+		role.Permissions = append([]string{}, role.Permissions...)
+		roles = append(roles, &role)
+	}
+
+	return roles, nil
+}
+
+func (r *MemoryRoleRepository) ForUser(ctx context.Context, userID int) (*Access, error) {
+	r.users.mu.Lock()
+	defer r.users.mu.Unlock()
+
+	if _, ok := r.users.users[userID]; !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	access := Access{Roles: []string{}, Permissions: []string{}}
+	granted := make(map[string]bool)
+
+	for name := range r.users.roles[userID] {
+		access.Roles = append(access.Roles, name)
+
+		if role := r.role(name); role != nil {
+			for _, permission := range role.Permissions {
+				if !granted[permission] {
+					granted[permission] = true
+					access.Permissions = append(access.Permissions, permission)
+				}
+			}
+		}
+	}
+
+	sort.Strings(access.Roles)
+	sort.Strings(access.Permissions)
+
+	return &access, nil
+}
+
+func (r *MemoryRoleRepository) Assign(ctx context.Context, userID int, role string) error {
+	r.users.mu.Lock()
+	defer r.users.mu.Unlock()
+
+	if _, ok := r.users.users[userID]; !ok {
+		return sql.ErrNoRows
+	}
+
+	if r.role(role) == nil {
+		return ErrUnknownRole
+	}
+
+	if r.users.roles[userID][role] {
+		return nil
+	}
+
+	r.users.assign(userID, role)
+	r.users.outbox.add("user.role.assigned", envelope.RoleData{UserID: userID, Role: role})
+
+	return nil
+}
+
+func (r *MemoryRoleRepository) Revoke(ctx context.Context, userID int, role string) error {
+	r.users.mu.Lock()
+	defer r.users.mu.Unlock()
+
+	if _, ok := r.users.users[userID]; !ok {
+		return sql.ErrNoRows
+	}
+
+	if r.role(role) == nil {
+		return ErrUnknownRole
+	}
+
+	if !r.users.roles[userID][role] {
+		return nil
+	}
+
+	delete(r.users.roles[userID], role)
+	r.users.outbox.add("user.role.revoked", envelope.RoleData{UserID: userID, Role: role})
+
+	return nil
+}
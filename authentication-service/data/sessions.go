@@ -0,0 +1,283 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Session is a login, known to the client by a token only its hash is
+// kept of.
+type Session struct {
+	ID         int64     `json:"id"`
+	UserID     int       `json:"user_id"`
+	Device     string    `json:"device,omitempty"`
+	IP         string    `json:"ip,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// SessionRepository stores sessions. Only sessions that are neither expired
+// nor revoked are ever returned.
+type SessionRepository interface {
+	Create(ctx context.Context, session Session, tokenHash string) (int64, error)
+
+	// Touch returns the session with the token hash and marks it as seen
+	// now. It returns ErrInvalidToken for an unknown, expired or revoked
+	// session.
+	Touch(ctx context.Context, tokenHash string) (*Session, error)
+
+	// ListForUser returns the user's sessions, the most recently seen first.
+	ListForUser(ctx context.Context, userID int) ([]*Session, error)
+
+	// Revoke ends one of the user's sessions, sql.ErrNoRows if the user has
+	// no such session.
+	Revoke(ctx context.Context, userID int, id int64) error
+
+	// RevokeAll ends every session of the user and returns how many.
+	RevokeAll(ctx context.Context, userID int) (int, error)
+}
+
+type PostgresSessionRepository struct {
+	db *sql.DB
+}
+
+func NewPostgresSessionRepository(db *sql.DB) *PostgresSessionRepository {
+	return &PostgresSessionRepository{db: db}
+}
+
+func (r *PostgresSessionRepository) Create(ctx context.Context, session Session, tokenHash string) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	now := time.Now()
+
+	var id int64
+	stmt := `INSERT INTO sessions (token_hash, user_id, device, ip, created_at, last_seen_at, expires_at)
+			VALUES ($1, $2, $3, $4, $5, $5, $6) RETURNING id`
+
+	err := r.db.QueryRowContext(ctx, stmt,
+		tokenHash,
+		session.UserID,
+		session.Device,
+		session.IP,
+		now,
+		session.ExpiresAt,
+	).Scan(&id)
+
+	return id, err
+}
+
+func (r *PostgresSessionRepository) Touch(ctx context.Context, tokenHash string) (*Session, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	var session Session
+	stmt := `UPDATE sessions SET last_seen_at = $1
+	WHERE token_hash = $2 AND revoked_at IS NULL AND expires_at > $1
+	RETURNING id, user_id, device, ip, created_at, last_seen_at, expires_at`
+
+	err := r.db.QueryRowContext(ctx, stmt, time.Now(), tokenHash).Scan(
+		&session.ID,
+		&session.UserID,
+		&session.Device,
+		&session.IP,
+		&session.CreatedAt,
+		&session.LastSeenAt,
+		&session.ExpiresAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+func (r *PostgresSessionRepository) ListForUser(ctx context.Context, userID int) ([]*Session, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `SELECT id, user_id, device, ip, created_at, last_seen_at, expires_at
+	FROM sessions
+	WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > $2
+	ORDER BY last_seen_at DESC`
+
+	rows, err := r.db.QueryContext(ctx, query, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(
+			&session.ID,
+			&session.UserID,
+			&session.Device,
+			&session.IP,
+			&session.CreatedAt,
+			&session.LastSeenAt,
+			&session.ExpiresAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, &session)
+	}
+
+	return sessions, rows.Err()
+}
+
+func (r *PostgresSessionRepository) Revoke(ctx context.Context, userID int, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `UPDATE sessions SET revoked_at = $1
+	WHERE id = $2 AND user_id = $3 AND revoked_at IS NULL AND expires_at > $1`
+
+	result, err := r.db.ExecContext(ctx, stmt, time.Now(), id, userID)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func (r *PostgresSessionRepository) RevokeAll(ctx context.Context, userID int) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `UPDATE sessions SET revoked_at = $1
+	WHERE user_id = $2 AND revoked_at IS NULL AND expires_at > $1`
+
+	result, err := r.db.ExecContext(ctx, stmt, time.Now(), userID)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := result.RowsAffected()
+
+	return int(n), err
+}
+
+type memorySession struct {
+	Session
+	tokenHash string
+	revoked   bool
+}
+
+// MemorySessionRepository keeps sessions in a map by id.
+type MemorySessionRepository struct {
+	mu       sync.Mutex
+	sessions map[int64]*memorySession
+	nextID   int64
+}
+
+func NewMemorySessionRepository() *MemorySessionRepository {
+	return &MemorySessionRepository{
+		sessions: make(map[int64]*memorySession),
+		nextID:   1,
+	}
+}
+
+func (s *memorySession) active(now time.Time) bool {
+	return !s.revoked && now.Before(s.ExpiresAt)
+}
+
+func (r *MemorySessionRepository) Create(ctx context.Context, session Session, tokenHash string) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	session.ID = r.nextID
+	session.CreatedAt = time.Now()
+	session.LastSeenAt = session.CreatedAt
+
+	r.nextID++
+	r.sessions[session.ID] = &memorySession{Session: session, tokenHash: tokenHash}
+
+	return session.ID, nil
+}
+
+func (r *MemorySessionRepository) Touch(ctx context.Context, tokenHash string) (*Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for _, s := range r.sessions {
+		if s.tokenHash == tokenHash && s.active(now) {
+			s.LastSeenAt = now
+			session := s.Session
+			return &session, nil
+		}
+	}
+
+	return nil, ErrInvalidToken
+}
+
+func (r *MemorySessionRepository) ListForUser(ctx context.Context, userID int) ([]*Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	sessions := []*Session{}
+	for _, s := range r.sessions {
+		if s.UserID == userID && s.active(now) {
+			session := s.Session
+			sessions = append(sessions, &session)
+		}
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt)
+	})
+
+	return sessions, nil
+}
+
+func (r *MemorySessionRepository) Revoke(ctx context.Context, userID int, id int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.sessions[id]
+	if !ok || s.UserID != userID || !s.active(time.Now()) {
+		return sql.ErrNoRows
+	}
+
+	s.revoked = true
+
+	return nil
+}
+
+func (r *MemorySessionRepository) RevokeAll(ctx context.Context, userID int) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	n := 0
+	for _, s := range r.sessions {
+		if s.UserID == userID && s.active(now) {
+			s.revoked = true
+			n++
+		}
+	}
+
+	return n, nil
+}
@@ -0,0 +1,359 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrTwoFactorEnabled is returned when enrolling a user who already has
+// two-factor authentication.
+var ErrTwoFactorEnabled = errors.New("two-factor authentication is already enabled")
+
+// TwoFactor is a user's TOTP setup. The secret is encrypted by the caller,
+// repositories never see it in the clear.
+type TwoFactor struct {
+	Secret   []byte // * nil until the user enrolls
+	Enabled  bool
+	LastStep int64 // * the time step of the last code accepted
+}
+
+// TwoFactorRepository stores TOTP secrets and recovery codes, the latter by
+// their hash. Every method returns sql.ErrNoRows for a missing user.
+type TwoFactorRepository interface {
+	Get(ctx context.Context, userID int) (*TwoFactor, error)
+
+	// Enroll stores a secret that isn't enabled yet, replacing one that
+	// wasn't confirmed.
+	Enroll(ctx context.Context, userID int, secret []byte) error
+
+	// Enable turns two-factor authentication on, step being the time step of
+	// the code that confirmed it, and replaces the recovery codes. It
+	// records a `user.2fa.enabled` event.
+	Enable(ctx context.Context, userID int, step int64, codeHashes []string) error
+
+	// Disable removes the secret and the recovery codes and records a
+	// `user.2fa.disabled` event.
+	Disable(ctx context.Context, userID int) error
+
+	// UseStep records that a code of the time step was accepted. It reports
+	// false if a code of this or a later step was accepted before, so every
+	// code works once.
+	UseStep(ctx context.Context, userID int, step int64) (bool, error)
+
+	// UseRecoveryCode uses up the recovery code with the hash. It reports
+	// false if the user has no unused code with it.
+	UseRecoveryCode(ctx context.Context, userID int, codeHash string) (bool, error)
+}
+
+type PostgresTwoFactorRepository struct {
+	db *sql.DB
+}
+
+func NewPostgresTwoFactorRepository(db *sql.DB) *PostgresTwoFactorRepository {
+	return &PostgresTwoFactorRepository{db: db}
+}
+
+func (r *PostgresTwoFactorRepository) Get(ctx context.Context, userID int) (*TwoFactor, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	var tf TwoFactor
+	query := `SELECT totp_secret, totp_enabled, totp_last_step FROM users WHERE id = $1`
+
+	err := r.db.QueryRowContext(ctx, query, userID).Scan(&tf.Secret, &tf.Enabled, &tf.LastStep)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tf, nil
+}
+
+func (r *PostgresTwoFactorRepository) Enroll(ctx context.Context, userID int, secret []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	var enabled bool
+	stmt := `UPDATE users SET totp_secret = CASE WHEN totp_enabled THEN totp_secret ELSE $1 END
+	WHERE id = $2
+	RETURNING totp_enabled`
+
+	if err := r.db.QueryRowContext(ctx, stmt, secret, userID).Scan(&enabled); err != nil {
+		return err
+	}
+
+	if enabled {
+		return ErrTwoFactorEnabled
+	}
+
+	return nil
+}
+
+func (r *PostgresTwoFactorRepository) Enable(ctx context.Context, userID int, step int64, codeHashes []string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	var user User
+	stmt := `UPDATE users SET totp_enabled = true, totp_last_step = $1, updated_at = $2
+	WHERE id = $3 AND totp_secret IS NOT NULL
+	RETURNING id, email, first_name, last_name, active`
+
+	err = tx.QueryRowContext(ctx, stmt, step, now, userID).Scan(
+		&user.ID,
+		&user.Email,
+		&user.FirstName,
+		&user.LastName,
+		&user.Active,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := replaceRecoveryCodes(ctx, tx, userID, codeHashes, now); err != nil {
+		return err
+	}
+
+	if err := insertEvent(ctx, tx, "user.2fa.enabled", user.eventData()); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID int, codeHashes []string, now time.Time) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+
+	stmt := `INSERT INTO recovery_codes (user_id, code_hash, created_at) VALUES ($1, $2, $3)`
+	for _, hash := range codeHashes {
+		if _, err := tx.ExecContext(ctx, stmt, userID, hash, now); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *PostgresTwoFactorRepository) Disable(ctx context.Context, userID int) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	var user User
+	stmt := `UPDATE users SET totp_secret = NULL, totp_enabled = false, totp_last_step = 0, updated_at = $1
+	WHERE id = $2
+	RETURNING id, email, first_name, last_name, active`
+
+	err = tx.QueryRowContext(ctx, stmt, now, userID).Scan(
+		&user.ID,
+		&user.Email,
+		&user.FirstName,
+		&user.LastName,
+		&user.Active,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := replaceRecoveryCodes(ctx, tx, userID, nil, now); err != nil {
+		return err
+	}
+
+	if err := insertEvent(ctx, tx, "user.2fa.disabled", user.eventData()); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *PostgresTwoFactorRepository) UseStep(ctx context.Context, userID int, step int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	// * the condition makes two logins racing with the same code only let one through
+	stmt := `UPDATE users SET totp_last_step = $1 WHERE id = $2 AND totp_last_step < $1`
+
+	result, err := r.db.ExecContext(ctx, stmt, step, userID)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+
+	return n == 1, err
+}
+
+func (r *PostgresTwoFactorRepository) UseRecoveryCode(ctx context.Context, userID int, codeHash string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `UPDATE recovery_codes SET used_at = $1
+	WHERE user_id = $2 AND code_hash = $3 AND used_at IS NULL`
+
+	result, err := r.db.ExecContext(ctx, stmt, time.Now(), userID, codeHash)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+
+	return n > 0, err
+}
+
+type twoFactorState struct {
+	TwoFactor
+	codes map[string]bool // * code hash to whether it was used
+}
+
+// MemoryTwoFactorRepository keeps the setups in a map next to the memory user
+// repository, sharing its lock.
+type MemoryTwoFactorRepository struct {
+	users  *MemoryUserRepository
+	states map[int]*twoFactorState
+}
+
+func NewMemoryTwoFactorRepository(users *MemoryUserRepository) *MemoryTwoFactorRepository {
+	return &MemoryTwoFactorRepository{
+		users:  users,
+		states: make(map[int]*twoFactorState),
+	}
+}
+
+// state returns the user's setup, creating an empty one. The caller holds
+// the lock.
+func (r *MemoryTwoFactorRepository) state(userID int) (*twoFactorState, bool) {
+	if _, ok := r.users.users[userID]; !ok {
+		return nil, false
+	}
+
+	state, ok := r.states[userID]
+	if !ok {
+		state = &twoFactorState{}
+		r.states[userID] = state
+	}
+
+	return state, true
+}
+
+func (r *MemoryTwoFactorRepository) Get(ctx context.Context, userID int) (*TwoFactor, error) {
+	r.users.mu.Lock()
+	defer r.users.mu.Unlock()
+
+	state, ok := r.state(userID)
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	tf := state.TwoFactor
+	return &tf, nil
+}
+
+func (r *MemoryTwoFactorRepository) Enroll(ctx context.Context, userID int, secret []byte) error {
+	r.users.mu.Lock()
+	defer r.users.mu.Unlock()
+
+	state, ok := r.state(userID)
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	if state.Enabled {
+		return ErrTwoFactorEnabled
+	}
+
+	state.Secret = secret
+
+	return nil
+}
+
+func (r *MemoryTwoFactorRepository) Enable(ctx context.Context, userID int, step int64, codeHashes []string) error {
+	r.users.mu.Lock()
+	defer r.users.mu.Unlock()
+
+	state, ok := r.state(userID)
+	if !ok || state.Secret == nil {
+		return sql.ErrNoRows
+	}
+
+	state.Enabled = true
+	state.LastStep = step
+	state.codes = make(map[string]bool, len(codeHashes))
+	for _, hash := range codeHashes {
+		state.codes[hash] = false
+	}
+
+	user := r.users.users[userID]
+	r.users.outbox.add("user.2fa.enabled", user.eventData())
+
+	return nil
+}
+
+func (r *MemoryTwoFactorRepository) Disable(ctx context.Context, userID int) error {
+	r.users.mu.Lock()
+	defer r.users.mu.Unlock()
+
+	if _, ok := r.state(userID); !ok {
+		return sql.ErrNoRows
+	}
+
+	delete(r.states, userID)
+
+	user := r.users.users[userID]
+	r.users.outbox.add("user.2fa.disabled", user.eventData())
+
+	return nil
+}
+
+func (r *MemoryTwoFactorRepository) UseStep(ctx context.Context, userID int, step int64) (bool, error) {
+	r.users.mu.Lock()
+	defer r.users.mu.Unlock()
+
+	state, ok := r.state(userID)
+	if !ok {
+		return false, sql.ErrNoRows
+	}
+
+	if state.LastStep >= step {
+		return false, nil
+	}
+
+	state.LastStep = step
+
+	return true, nil
+}
+
+func (r *MemoryTwoFactorRepository) UseRecoveryCode(ctx context.Context, userID int, codeHash string) (bool, error) {
+	r.users.mu.Lock()
+	defer r.users.mu.Unlock()
+
+	state, ok := r.state(userID)
+	if !ok {
+		return false, sql.ErrNoRows
+	}
+
+	used, ok := state.codes[codeHash]
+	if !ok || used {
+		return false, nil
+	}
+
+	state.codes[codeHash] = true
+
+	return true, nil
+}
@@ -0,0 +1,474 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"shared/envelope"
+	"time"
+
+	"github.com/jackc/pgconn"
+)
+
+// PostgresUserRepository keeps users in the `users` table. Changes are
+// recorded in the outbox in the same transaction.
+type PostgresUserRepository struct {
+	db *sql.DB
+}
+
+func NewPostgresUserRepository(db *sql.DB) *PostgresUserRepository {
+	return &PostgresUserRepository{db: db}
+}
+
+func (r *PostgresUserRepository) GetAll(ctx context.Context) ([]*User, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `SELECT id, email, first_name, last_name, password, active , created_at, updated_at, verified_at,
+	failed_logins, locked_until
+	FROM users ORDER BY last_name`
+
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*User
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&user.ID,
+			&user.Email,
+			&user.FirstName,
+			&user.LastName,
+			&user.Password,
+			&user.Active,
+			&user.CreatedAt,
+			&user.UpdatedAt,
+			&user.VerifiedAt,
+			&user.FailedLogins,
+			&user.LockedUntil,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		users = append(users, &user)
+	}
+
+	return users, nil
+}
+
+// List returns a page of users matching the filter, and how many match it in
+// total.
+func (r *PostgresUserRepository) List(ctx context.Context, filter UserFilter) ([]*User, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	if filter.Page < 1 {
+		filter.Page = 1
+	}
+
+	if filter.PerPage < 1 {
+		filter.PerPage = 20
+	}
+
+	// * the column comes from a fixed list, never from the request itself
+	column, ok := sortColumns[filter.Sort]
+	if !ok {
+		column = "id"
+	}
+
+	direction := "ASC"
+	if filter.Desc {
+		direction = "DESC"
+	}
+
+	where := `WHERE ($1::int IS NULL OR active = $1)
+	AND ($2 = '' OR email ILIKE '%' || $2 || '%' OR first_name ILIKE '%' || $2 || '%' OR last_name ILIKE '%' || $2 || '%')`
+
+	var total int
+	err := r.db.QueryRowContext(ctx, `SELECT count(*) FROM users `+where, filter.Active, filter.Search).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query := `SELECT id, email, first_name, last_name, password, active , created_at, updated_at, verified_at,
+	failed_logins, locked_until
+	FROM users ` + where + `
+	ORDER BY ` + column + ` ` + direction + `, id LIMIT $3 OFFSET $4`
+
+	rows, err := r.db.QueryContext(ctx, query, filter.Active, filter.Search, filter.PerPage, (filter.Page-1)*filter.PerPage)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&user.ID,
+			&user.Email,
+			&user.FirstName,
+			&user.LastName,
+			&user.Password,
+			&user.Active,
+			&user.CreatedAt,
+			&user.UpdatedAt,
+			&user.VerifiedAt,
+			&user.FailedLogins,
+			&user.LockedUntil,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, 0, err
+		}
+
+		users = append(users, &user)
+	}
+
+	return users, total, rows.Err()
+}
+
+func (r *PostgresUserRepository) GetByEmail(ctx context.Context, email string) (*User, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `SELECT id, email, first_name, last_name, password, active , created_at, updated_at, verified_at,
+	failed_logins, locked_until
+	FROM users WHERE lower(email) = lower($1)`
+
+	var user User
+	row := r.db.QueryRowContext(ctx, query, email)
+
+	err := row.Scan(
+		&user.ID,
+		&user.Email,
+		&user.FirstName,
+		&user.LastName,
+		&user.Password,
+		&user.Active,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+		&user.VerifiedAt,
+		&user.FailedLogins,
+		&user.LockedUntil,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func (r *PostgresUserRepository) GetOne(ctx context.Context, id int) (*User, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `SELECT id, email, first_name, last_name, password, active , created_at, updated_at, verified_at,
+	failed_logins, locked_until
+	FROM users WHERE id = $1`
+
+	var user User
+	row := r.db.QueryRowContext(ctx, query, id)
+
+	err := row.Scan(
+		&user.ID,
+		&user.Email,
+		&user.FirstName,
+		&user.LastName,
+		&user.Password,
+		&user.Active,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+		&user.VerifiedAt,
+		&user.FailedLogins,
+		&user.LockedUntil,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func (r *PostgresUserRepository) Update(ctx context.Context, u User) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	// * the CASE sees the old email, so verified_at only survives if it stays the
+	// * same, up to case like every lookup by email
+	stmt := `UPDATE users SET
+				email = $1,
+				first_name = $2,
+				last_name = $3,
+				active = $4,
+				updated_at = $5,
+				verified_at = CASE WHEN lower(email) = lower($1) THEN verified_at END
+				WHERE id = $6
+	`
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, stmt, u.Email, u.FirstName, u.LastName, u.Active, time.Now(), u.ID)
+	if uniqueViolation(err) {
+		return ErrDuplicateEmail
+	}
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+
+	err = insertEvent(ctx, tx, "user.updated", u.eventData())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *PostgresUserRepository) DeleteByID(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var deleted User
+	stmt := `DELETE FROM users WHERE id = $1 RETURNING id, email, first_name, last_name, active`
+
+	err = tx.QueryRowContext(ctx, stmt, id).Scan(
+		&deleted.ID,
+		&deleted.Email,
+		&deleted.FirstName,
+		&deleted.LastName,
+		&deleted.Active,
+	)
+	if err != nil {
+		return err
+	}
+
+	err = insertEvent(ctx, tx, "user.deleted", deleted.eventData())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *PostgresUserRepository) Insert(ctx context.Context, user User) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	hashedPW, err := hashPassword(user.Password)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var newID int
+	stmt := `INSERT INTO users (email, first_name, last_name, password, active, created_at, updated_at, verified_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id		
+	`
+
+	err = tx.QueryRowContext(ctx, stmt,
+		user.Email,
+		user.FirstName,
+		user.LastName,
+		hashedPW,
+		user.Active,
+		time.Now(),
+		time.Now(),
+		user.VerifiedAt).Scan(&newID)
+
+	if uniqueViolation(err) {
+		return 0, ErrDuplicateEmail
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	stmt = `INSERT INTO user_roles (user_id, role_id, created_at)
+	SELECT $1, id, $2 FROM roles WHERE name = $3`
+	if _, err := tx.ExecContext(ctx, stmt, newID, time.Now(), DefaultRole); err != nil {
+		return 0, err
+	}
+
+	user.ID = newID
+	err = insertEvent(ctx, tx, "user.created", user.eventData())
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+func (r *PostgresUserRepository) ResetPassword(ctx context.Context, id int, password string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	hashedPW, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	stmt := `UPDATE users SET password = $1, updated_at = $2 WHERE id = $3`
+	result, err := r.db.ExecContext(ctx, stmt, hashedPW, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func (r *PostgresUserRepository) Verify(ctx context.Context, id int, email string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	var verifiedAt *time.Time
+	query := `SELECT verified_at FROM users WHERE id = $1 AND lower(email) = lower($2) FOR UPDATE`
+	if err := tx.QueryRowContext(ctx, query, id, email).Scan(&verifiedAt); err != nil {
+		return err
+	}
+
+	// * verifying twice, e.g. clicking the link again, changes nothing
+	if verifiedAt != nil {
+		return nil
+	}
+
+	var user User
+	stmt := `UPDATE users SET verified_at = $1, updated_at = $1 WHERE id = $2
+	RETURNING id, email, first_name, last_name, active`
+
+	err = tx.QueryRowContext(ctx, stmt, now, id).Scan(
+		&user.ID,
+		&user.Email,
+		&user.FirstName,
+		&user.LastName,
+		&user.Active,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := insertEvent(ctx, tx, "user.verified", user.eventData()); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *PostgresUserRepository) RecordLoginFailure(ctx context.Context, id int, ip string, threshold int, lockFor time.Duration) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	lockout := envelope.LockoutData{UserID: id}
+	stmt := `UPDATE users SET failed_logins = failed_logins + 1,
+		locked_until = CASE WHEN failed_logins + 1 >= $2 THEN $3 ELSE locked_until END
+	WHERE id = $1
+	RETURNING email, failed_logins, locked_until`
+
+	err = tx.QueryRowContext(ctx, stmt, id, threshold, time.Now().Add(lockFor)).Scan(
+		&lockout.Email,
+		&lockout.Failures,
+		&lockout.LockedUntil,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	if lockout.Failures >= threshold {
+		lockout.IP = ip
+		if err := insertEvent(ctx, tx, "user.locked", lockout); err != nil {
+			return 0, err
+		}
+	}
+
+	return lockout.Failures, tx.Commit()
+}
+
+func (r *PostgresUserRepository) ClearLoginFailures(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	// * the condition spares the write on most logins
+	stmt := `UPDATE users SET failed_logins = 0, locked_until = NULL
+	WHERE id = $1 AND (failed_logins > 0 OR locked_until IS NOT NULL)`
+
+	_, err := r.db.ExecContext(ctx, stmt, id)
+
+	return err
+}
+
+func (r *PostgresUserRepository) Unlock(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	lockout := envelope.LockoutData{UserID: id}
+	stmt := `UPDATE users SET failed_logins = 0, locked_until = NULL, updated_at = $1 WHERE id = $2
+	RETURNING email`
+
+	if err := tx.QueryRowContext(ctx, stmt, time.Now(), id).Scan(&lockout.Email); err != nil {
+		return err
+	}
+
+	if err := insertEvent(ctx, tx, "user.unlocked", lockout); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// uniqueViolation reports whether err is a unique_violation, which for users
+// can only come from users_email_lower_idx.
+func uniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
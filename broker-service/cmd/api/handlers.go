@@ -10,6 +10,8 @@ import (
 	"fmt"
 	"net/http"
 	"net/rpc"
+	"net/url"
+	"shared/envelope"
 	"time"
 
 	"google.golang.org/grpc"
@@ -17,15 +19,27 @@ import (
 )
 
 type RequestPayload struct {
-	Action string      `json:"action"`
-	Auth   AuthPayload `json:"auth,omitempty"`
-	Log    LogPayload  `json:"log,omitempty"`
-	Mail   MailPayload `json:"mail,omitempty"`
+	Action   string          `json:"action"`
+	Auth     AuthPayload     `json:"auth,omitempty"`
+	Register RegisterPayload `json:"register,omitempty"`
+	Log      LogPayload      `json:"log,omitempty"`
+	Mail     MailPayload     `json:"mail,omitempty"`
 }
 
+// AuthPayload is either the email and password, or, for users with
+// two-factor authentication, the challenge the password got and a code.
 type AuthPayload struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email     string `json:"email"`
+	Password  string `json:"password"`
+	Challenge string `json:"challenge,omitempty"`
+	Code      string `json:"code,omitempty"`
+}
+
+type RegisterPayload struct {
+	Email     string `json:"email"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Password  string `json:"password"`
 }
 
 type LogPayload struct {
@@ -65,19 +79,33 @@ func (app *Config) HandleSubmission(w http.ResponseWriter, r *http.Request) {
 
 	switch requestPayload.Action {
 	case "auth":
-		app.Authenticate(w, requestPayload.Auth)
+		app.Authenticate(w, r, requestPayload.Auth)
+	case "register":
+		app.Register(w, requestPayload.Register)
+	case "logout":
+		app.Logout(w, r)
 	case "log":
+		if !app.authorize(w, r, "logs.write") {
+			return
+		}
 		// app.LogItem(w, requestPayload.Log)
 		// app.logEventViaRabbit(w, requestPayload.Log)
 		app.logEventViaRPC(w, requestPayload.Log)
 	case "mail":
-		app.SendMail(w, requestPayload.Mail)
+		if !app.authorize(w, r, "mail.send") {
+			return
+		}
+		if app.MailTransport == "queue" {
+			app.sendMailViaRabbit(w, requestPayload.Mail)
+		} else {
+			app.SendMail(w, requestPayload.Mail)
+		}
 	default:
 		app.errorJson(w, errors.New("unknown action"))
 	}
 }
 
-func (app *Config) Authenticate(w http.ResponseWriter, a AuthPayload) {
+func (app *Config) Authenticate(w http.ResponseWriter, r *http.Request, a AuthPayload) {
 	// create some json we'll send to the auth microservice
 	jsonData, err := json.Marshal(a)
 	if err != nil {
@@ -85,13 +113,22 @@ func (app *Config) Authenticate(w http.ResponseWriter, a AuthPayload) {
 		return
 	}
 
+	authURL := "http://authentication-service/authenticate"
+	if a.Challenge != "" {
+		// the second step of a login with two-factor authentication
+		authURL += "/2fa"
+	}
+
 	// call the service
-	request, err := http.NewRequest(http.MethodPost, "http://authentication-service/authenticate", bytes.NewBuffer(jsonData))
+	request, err := http.NewRequest(http.MethodPost, authURL, bytes.NewBuffer(jsonData))
 	if err != nil {
 		app.errorJson(w, err)
 		return
 	}
 
+	// the auth service counts failed logins per client address
+	request.Header.Set("X-Forwarded-For", clientAddr(r))
+
 	client := &http.Client{}
 	response, err := client.Do(request)
 	if err != nil {
@@ -99,7 +136,28 @@ func (app *Config) Authenticate(w http.ResponseWriter, a AuthPayload) {
 		return
 	}
 	defer response.Body.Close()
-	fmt.Println(response.Status)
+
+	// wrong codes, unverified, disabled and locked accounts are told apart by the code the auth service sends
+	switch response.StatusCode {
+	case http.StatusBadRequest, http.StatusForbidden, http.StatusTooManyRequests:
+		var jsonFromService jsonResponse
+		if err := json.NewDecoder(response.Body).Decode(&jsonFromService); err != nil {
+			app.errorJson(w, errors.New("error calling auth service"))
+			return
+		}
+
+		if retry := response.Header.Get("Retry-After"); retry != "" {
+			w.Header().Set("Retry-After", retry)
+		}
+
+		payload := jsonResponse{
+			Error:   true,
+			Message: jsonFromService.Message,
+			Code:    jsonFromService.Code,
+		}
+		app.writeJson(w, response.StatusCode, payload)
+		return
+	}
 
 	// make sure we get back the correct status code
 	if response.StatusCode == http.StatusUnauthorized || response.StatusCode != http.StatusOK {
@@ -115,7 +173,6 @@ func (app *Config) Authenticate(w http.ResponseWriter, a AuthPayload) {
 
 	// decode the json from auth service
 	err = json.NewDecoder(response.Body).Decode(&jsonFromService)
-	fmt.Println(jsonFromService)
 	if err != nil {
 		app.errorJson(w, err)
 		return
@@ -126,6 +183,12 @@ func (app *Config) Authenticate(w http.ResponseWriter, a AuthPayload) {
 		return
 	}
 
+	// the client sends the challenge back with a code from the authenticator
+	if jsonFromService.Code == "two_factor_required" {
+		app.writeJson(w, http.StatusOK, jsonFromService)
+		return
+	}
+
 	payload := jsonResponse{
 		Error:   false,
 		Message: "Authenticated!",
@@ -135,6 +198,85 @@ func (app *Config) Authenticate(w http.ResponseWriter, a AuthPayload) {
 	app.writeJson(w, http.StatusOK, payload)
 }
 
+// Register passes the registration to the auth service and its answer, e.g. a
+// validation error or a conflict, back to the caller.
+func (app *Config) Register(w http.ResponseWriter, a RegisterPayload) {
+	jsonData, err := json.Marshal(a)
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	request, err := http.NewRequest(http.MethodPost, "http://authentication-service/users/register", bytes.NewBuffer(jsonData))
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+	defer response.Body.Close()
+
+	var jsonFromService jsonResponse
+	err = json.NewDecoder(response.Body).Decode(&jsonFromService)
+	if err != nil {
+		app.errorJson(w, errors.New("error calling auth service"))
+		return
+	}
+
+	if response.StatusCode != http.StatusCreated {
+		app.errorJson(w, errors.New(jsonFromService.Message), response.StatusCode)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Registered!",
+		Data:    jsonFromService.Data,
+	}
+
+	app.writeJson(w, http.StatusCreated, payload)
+}
+
+// VerifyEmail passes the token of a verification link on to the auth service,
+// which isn't reachable from outside, and its answer back to the caller.
+func (app *Config) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	verifyURL := "http://authentication-service/verify?" + url.Values{"token": {r.URL.Query().Get("token")}}.Encode()
+
+	request, err := http.NewRequestWithContext(r.Context(), http.MethodGet, verifyURL, nil)
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+	defer response.Body.Close()
+
+	var jsonFromService jsonResponse
+	err = json.NewDecoder(response.Body).Decode(&jsonFromService)
+	if err != nil {
+		app.errorJson(w, errors.New("error calling auth service"))
+		return
+	}
+
+	if response.StatusCode != http.StatusOK {
+		app.errorJson(w, errors.New(jsonFromService.Message), response.StatusCode)
+		return
+	}
+
+	app.writeJson(w, http.StatusOK, jsonFromService)
+}
+
 func (app *Config) LogItem(w http.ResponseWriter, entry LogPayload) {
 	jsonData, err := json.Marshal(entry)
 	if err != nil {
@@ -236,17 +378,18 @@ func (app *Config) pushToQueue(name, msg string) error {
 		return err
 	}
 
-	payload := LogPayload{
+	payload := envelope.LogData{
 		Name: name,
 		Data: msg,
 	}
 
-	j, err := json.Marshal(&payload)
+	// * the log name is the event type, so listeners can route on it
+	logEvent, err := envelope.Encode(name, "1", "broker-service", payload)
 	if err != nil {
 		return err
 	}
 
-	err = emitter.Push(string(j), "log.INFO")
+	err = emitter.Push(logEvent, "log.INFO")
 	if err != nil {
 		return err
 	}
@@ -254,6 +397,40 @@ func (app *Config) pushToQueue(name, msg string) error {
 	return nil
 }
 
+// sendMailViaRabbit queues the mail for mail-service instead of waiting on
+// SMTP. The outcome is published later as a `mail.sent` or `mail.failed` event.
+func (app *Config) sendMailViaRabbit(w http.ResponseWriter, msg MailPayload) {
+	emitter, err := event.NewEventEmitter(app.rabit)
+	if err != nil {
+		app.errorJson(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	mailEvent, err := envelope.Encode("mail.send", "1", "broker-service", envelope.MailData{
+		From:    msg.From,
+		To:      msg.To,
+		Subject: msg.Subject,
+		Message: msg.Message,
+	})
+	if err != nil {
+		app.errorJson(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = emitter.Push(mailEvent, "mail.send")
+	if err != nil {
+		app.errorJson(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Message to %s queued", msg.To),
+		Data:    map[string]string{"id": mailEvent.ID},
+	}
+	app.writeJson(w, http.StatusAccepted, payload)
+}
+
 type RPCPayload struct { // * Must be exactly the same as the server type
 	Name string
 	Data string
@@ -299,6 +476,10 @@ func (app *Config) LogViaGRPC(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !app.authorize(w, r, "logs.write") {
+		return
+	}
+
 	// conn, err := grpc.Dial("logger-service:50001", grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
 	conn, err := grpc.NewClient("logger-service:50001", grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
@@ -4,12 +4,14 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"net"
 	"net/http"
 )
 
 type jsonResponse struct {
 	Error   bool   `json:"error"`
 	Message string `json:"message" `
+	Code    string `json:"code,omitempty"`
 	Data    any    `json:"data,omitempty"`
 }
 
@@ -69,3 +71,14 @@ func (app *Config) errorJson(w http.ResponseWriter, err error, status ...int) er
 
 	return app.writeJson(w, statusCode, payload)
 }
+
+// clientAddr is the address the request came from. X-Forwarded-For sent by
+// the client is ignored, anyone could set it to dodge a per-address limit.
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
@@ -7,6 +7,7 @@ import (
 	"math"
 	"net"
 	"net/http"
+	"os"
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
@@ -27,7 +28,10 @@ import (
 const webPort = "80"
 
 type Config struct {
-	rabit *amqp.Connection
+	rabit         *amqp.Connection
+	MailTransport string // * `queue` sends mail actions through RabbitMQ instead of HTTP
+	AuthRequired  bool   // * actions other than auth and register need a session, unless AUTH_REQUIRED=false
+	Sessions      *sessionCache
 }
 
 func main() {
@@ -39,7 +43,14 @@ func main() {
 	defer rabbitConn.Close()
 
 	app := Config{
-		rabit: rabbitConn,
+		rabit:         rabbitConn,
+		MailTransport: os.Getenv("MAIL_TRANSPORT"),
+		AuthRequired:  os.Getenv("AUTH_REQUIRED") != "false",
+		Sessions:      newSessionCache(sessionCacheTTL()),
+	}
+
+	if !app.AuthRequired {
+		log.Println("WARNING: AUTH_REQUIRED=false, requests without a token skip permission checks; only use this for local development")
 	}
 
 	log.Printf("Starting broker service on port %s\r\n", webPort)
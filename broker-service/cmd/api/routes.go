@@ -23,11 +23,15 @@ func (app *Config) routes() http.Handler {
 
 	mux.Use(middleware.Heartbeat("/ping"))
 
+	mux.Use(app.session)
+
 	mux.Post("/", app.Broker)
 
 	mux.Post("/log-grpc", app.LogViaGRPC)
 
 	mux.Post("/handle", app.HandleSubmission)
 
+	mux.Get("/verify", app.VerifyEmail)
+
 	return mux
 }
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NOTE: Sessions
+/*
+	A login through the broker returns a session token. Requests carrying it
+	as `Authorization: Bearer <token>` are checked with the auth service's
+	introspection endpoint, and what it says is cached for SESSION_CACHE_TTL
+	(30s by default), so a session ended elsewhere can still be used here for
+	that long. A logout through the broker takes effect at once.
+
+	Scripts and other services send an API key instead, as
+	`Authorization: ApiKey <key>`. It's checked with the auth service the
+	same way, and what it may do are its scopes.
+
+	Actions need a permission: `log` needs logs.write, `mail` needs mail.send.
+	A token that's no good is refused with 401 and code `invalid_session`.
+	Requests without a token are refused with 401 and code `login_required`,
+	unless AUTH_REQUIRED=false lets them through, e.g. for the front-end
+	test page, which doesn't log in. Logging in again works with an ended
+	session's token still attached.
+*/
+
+const (
+	defaultSessionCacheTTL = 30 * time.Second
+	sessionCacheLimit      = 10000
+)
+
+var errNoSession = errors.New("not logged in or the session has ended")
+
+// Principal is who a session token or API key belongs to, as the auth
+// service sees it. A key belongs to a user or to a service account.
+type Principal struct {
+	Active      bool      `json:"active"`
+	SessionID   int64     `json:"session_id,omitempty"`
+	KeyID       int64     `json:"key_id,omitempty"`
+	UserID      int       `json:"user_id,omitempty"`
+	Email       string    `json:"email,omitempty"`
+	Service     string    `json:"service,omitempty"`
+	Permissions []string  `json:"permissions"`
+	ExpiresAt   time.Time `json:"expires_at"` // * zero for a key that doesn't expire
+}
+
+func (p *Principal) Can(permission string) bool {
+	return slices.Contains(p.Permissions, permission)
+}
+
+type principalKey struct{}
+
+// principal returns the principal the session middleware found, nil for a
+// request without a token. It isn't Active for a token that's no good.
+func principal(r *http.Request) *Principal {
+	p, _ := r.Context().Value(principalKey{}).(*Principal)
+	return p
+}
+
+func sessionCacheTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("SESSION_CACHE_TTL")); err == nil && d >= 0 {
+		return d
+	}
+
+	return defaultSessionCacheTTL
+}
+
+type cachedSession struct {
+	principal *Principal
+	until     time.Time
+}
+
+// sessionCache keeps what the auth service said about a credential by its
+// hash, so the credentials themselves aren't kept around. Session tokens and
+// API keys look nothing alike, so they share the cache.
+type sessionCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]cachedSession
+}
+
+func newSessionCache(ttl time.Duration) *sessionCache {
+	return &sessionCache{
+		ttl:     ttl,
+		entries: make(map[string]cachedSession),
+	}
+}
+
+func cacheKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *sessionCache) Get(token string) (*Principal, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[cacheKey(token)]
+	if !ok || time.Now().After(entry.until) {
+		return nil, false
+	}
+
+	return entry.principal, true
+}
+
+func (c *sessionCache) Put(token string, p *Principal) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+
+	// * a made-up token per request mustn't grow the cache without bound
+	if len(c.entries) >= sessionCacheLimit {
+		for key, entry := range c.entries {
+			if now.After(entry.until) {
+				delete(c.entries, key)
+			}
+		}
+		if len(c.entries) >= sessionCacheLimit {
+			clear(c.entries)
+		}
+	}
+
+	until := now.Add(c.ttl)
+	if p.Active && !p.ExpiresAt.IsZero() && p.ExpiresAt.Before(until) {
+		until = p.ExpiresAt
+	}
+
+	c.entries[cacheKey(token)] = cachedSession{principal: p, until: until}
+}
+
+func (c *sessionCache) Forget(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, cacheKey(token))
+}
+
+func bearerToken(r *http.Request) string {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token
+}
+
+// session looks up the bearer token or API key, if the request has one, and
+// puts its principal into the request context.
+func (app *Config) session(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p *Principal
+		var err error
+
+		if key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "ApiKey "); ok {
+			p, err = app.validateKey(r.Context(), key)
+		} else if token := bearerToken(r); token != "" {
+			p, err = app.introspect(r.Context(), token)
+		} else {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			app.errorJson(w, err, http.StatusBadGateway)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+}
+
+// introspect asks the auth service about the token, unless the answer is
+// cached.
+func (app *Config) introspect(ctx context.Context, token string) (*Principal, error) {
+	if p, ok := app.Sessions.Get(token); ok {
+		return p, nil
+	}
+
+	var p Principal
+	err := askAuthService(ctx, "/sessions/introspect", struct {
+		Token string `json:"token"`
+	}{token}, &p)
+	if err != nil {
+		return nil, err
+	}
+
+	app.Sessions.Put(token, &p)
+
+	return &p, nil
+}
+
+// validateKey asks the auth service about the API key, unless the answer is
+// cached.
+func (app *Config) validateKey(ctx context.Context, key string) (*Principal, error) {
+	if p, ok := app.Sessions.Get(key); ok {
+		return p, nil
+	}
+
+	var validation struct {
+		Active    bool       `json:"active"`
+		KeyID     int64      `json:"key_id"`
+		UserID    int        `json:"user_id"`
+		Email     string     `json:"email"`
+		Service   string     `json:"service"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	err := askAuthService(ctx, "/api-keys/validate", struct {
+		Key string `json:"key"`
+	}{key}, &validation)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Principal{
+		Active:      validation.Active,
+		KeyID:       validation.KeyID,
+		UserID:      validation.UserID,
+		Email:       validation.Email,
+		Service:     validation.Service,
+		Permissions: validation.Scopes,
+	}
+	if validation.ExpiresAt != nil {
+		p.ExpiresAt = *validation.ExpiresAt
+	}
+
+	app.Sessions.Put(key, p)
+
+	return p, nil
+}
+
+// askAuthService posts the payload to the auth service and decodes the data
+// of its answer into result.
+func askAuthService(ctx context.Context, path string, payload, result any) error {
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://authentication-service"+path, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("error calling auth service: %s", response.Status)
+	}
+
+	jsonFromService := struct {
+		Data any `json:"data"`
+	}{result}
+	if err := json.NewDecoder(response.Body).Decode(&jsonFromService); err != nil {
+		return errors.New("error calling auth service")
+	}
+
+	return nil
+}
+
+// authorize reports whether the request may do what needs the permission,
+// answering it when it may not.
+func (app *Config) authorize(w http.ResponseWriter, r *http.Request, permission string) bool {
+	p := principal(r)
+
+	if p == nil {
+		if !app.AuthRequired {
+			return true
+		}
+
+		app.writeJson(w, http.StatusUnauthorized, jsonResponse{
+			Error:   true,
+			Message: "log in first",
+			Code:    "login_required",
+		})
+		return false
+	}
+
+	if !p.Active {
+		app.writeJson(w, http.StatusUnauthorized, jsonResponse{
+			Error:   true,
+			Message: errNoSession.Error(),
+			Code:    "invalid_session",
+		})
+		return false
+	}
+
+	if !p.Can(permission) {
+		app.writeJson(w, http.StatusForbidden, jsonResponse{
+			Error:   true,
+			Message: fmt.Sprintf("%s isn't allowed", permission),
+			Code:    "forbidden",
+		})
+		return false
+	}
+
+	return true
+}
+
+// Logout ends the session of the request's bearer token at the auth service.
+func (app *Config) Logout(w http.ResponseWriter, r *http.Request) {
+	token := bearerToken(r)
+	// * API keys aren't logged out of, they're revoked
+	if p := principal(r); p == nil || !p.Active || p.SessionID == 0 {
+		app.errorJson(w, errNoSession, http.StatusUnauthorized)
+		return
+	}
+
+	request, err := http.NewRequestWithContext(r.Context(), http.MethodPost, "http://authentication-service/logout", nil)
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+	defer response.Body.Close()
+
+	// * the token is no good either way now, don't let the cache say otherwise
+	app.Sessions.Forget(token)
+
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusUnauthorized {
+		app.errorJson(w, errors.New("error calling auth service"), http.StatusBadGateway)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Logged out",
+	}
+
+	app.writeJson(w, http.StatusOK, payload)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionCache(t *testing.T) {
+	const ttl = time.Minute
+	soon := time.Now().Add(10 * time.Second)
+
+	tests := []struct {
+		name      string
+		ttl       time.Duration
+		principal *Principal
+		cached    bool
+		until     time.Time // * zero for now plus the ttl
+	}{
+		{"active session", ttl, &Principal{Active: true, SessionID: 1, ExpiresAt: time.Now().Add(time.Hour)}, true, time.Time{}},
+		{"session ending before the ttl", ttl, &Principal{Active: true, SessionID: 1, ExpiresAt: soon}, true, soon},
+		{"key that doesn't expire", ttl, &Principal{Active: true, KeyID: 1}, true, time.Time{}},
+		{"inactive token", ttl, &Principal{}, true, time.Time{}},
+		{"caching turned off", 0, &Principal{Active: true, SessionID: 1}, false, time.Time{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newSessionCache(tt.ttl)
+			before := time.Now()
+			c.Put("token", tt.principal)
+
+			p, ok := c.Get("token")
+			if ok != tt.cached || (ok && p != tt.principal) {
+				t.Fatalf("got %v, %v, want cached %v", p, ok, tt.cached)
+			}
+			if !ok {
+				return
+			}
+
+			until := c.entries[cacheKey("token")].until
+			switch {
+			case !tt.until.IsZero() && !until.Equal(tt.until):
+				t.Errorf("cached until %s, want %s", until, tt.until)
+			case tt.until.IsZero() && (until.Before(before.Add(tt.ttl)) || until.After(time.Now().Add(tt.ttl))):
+				t.Errorf("cached until %s, want the ttl from now", until)
+			}
+
+			if _, ok := c.Get("other token"); ok {
+				t.Error("another token hit the cache")
+			}
+		})
+	}
+}
+
+func TestSessionCacheExpiry(t *testing.T) {
+	c := newSessionCache(time.Minute)
+	c.Put("token", &Principal{Active: true, SessionID: 1})
+
+	for key := range c.entries {
+		if strings.Contains(key, "token") {
+			t.Errorf("cache key %q has the token in it", key)
+		}
+	}
+
+	entry := c.entries[cacheKey("token")]
+	entry.until = time.Now().Add(-time.Second)
+	c.entries[cacheKey("token")] = entry
+
+	if _, ok := c.Get("token"); ok {
+		t.Error("an expired entry hit the cache")
+	}
+
+	c.Put("token", &Principal{Active: true, SessionID: 1})
+	c.Forget("token")
+	if _, ok := c.Get("token"); ok {
+		t.Error("a forgotten token hit the cache")
+	}
+}
+
+// TestAuthorize sends requests through the session middleware with the
+// answers of the auth service cached, so it's never asked.
+func TestAuthorize(t *testing.T) {
+	tests := []struct {
+		name          string
+		authorization string
+		authRequired  bool
+		status        int
+		code          string
+	}{
+		{"no token", "", true, http.StatusUnauthorized, "login_required"},
+		{"no token without AUTH_REQUIRED", "", false, http.StatusOK, ""},
+		{"ended session", "Bearer ended", true, http.StatusUnauthorized, "invalid_session"},
+		{"ended session without AUTH_REQUIRED", "Bearer ended", false, http.StatusUnauthorized, "invalid_session"},
+		{"session without the permission", "Bearer reader", true, http.StatusForbidden, "forbidden"},
+		{"session with the permission", "Bearer writer", true, http.StatusOK, ""},
+		{"API key with the scope", "ApiKey gmk_writer", true, http.StatusOK, ""},
+		{"API key without the scope", "ApiKey gmk_reader", true, http.StatusForbidden, "forbidden"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &Config{AuthRequired: tt.authRequired, Sessions: newSessionCache(time.Minute)}
+			app.Sessions.Put("ended", &Principal{})
+			app.Sessions.Put("reader", &Principal{Active: true, SessionID: 1, Permissions: []string{"logs.read"}})
+			app.Sessions.Put("writer", &Principal{Active: true, SessionID: 2, Permissions: []string{"logs.write"}})
+			app.Sessions.Put("gmk_writer", &Principal{Active: true, KeyID: 1, Permissions: []string{"logs.write"}})
+			app.Sessions.Put("gmk_reader", &Principal{Active: true, KeyID: 2, Permissions: []string{"logs.read"}})
+
+			handler := app.session(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if app.authorize(w, r, "logs.write") {
+					app.writeJson(w, http.StatusOK, jsonResponse{Message: "ok"})
+				}
+			}))
+
+			r := httptest.NewRequest(http.MethodPost, "/handle", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			var response jsonResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != tt.status || response.Code != tt.code {
+				t.Errorf("answered %d %q, want %d %q", w.Code, response.Code, tt.status, tt.code)
+			}
+		})
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"shared/envelope"
+	"shared/topology"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
@@ -33,7 +35,9 @@ func (consumer *Consumer) setup() error {
 		return err
 	}
 
-	return declareExchange(channel)
+	_, err = topology.Declare(channel)
+
+	return err
 }
 
 type Payload struct {
@@ -48,7 +52,7 @@ func (consumer *Consumer) Listen(topics []string) error {
 	}
 	defer ch.Close()
 
-	q, err := declareRandomQueue(ch)
+	q, err := topology.DeclareTemporaryQueue(ch)
 	if err != nil {
 		return err
 	}
@@ -57,7 +61,7 @@ func (consumer *Consumer) Listen(topics []string) error {
 		err := ch.QueueBind(
 			q.Name,
 			topic,
-			"logs_topic",
+			topology.EventsExchange,
 			false,
 			nil,
 		)
@@ -76,14 +80,23 @@ func (consumer *Consumer) Listen(topics []string) error {
 	defer close(forever)
 	go func() {
 		for msg := range messages {
-			var payload Payload
-			json.Unmarshal(msg.Body, &payload)
+			env, err := envelope.FromDelivery(msg)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+
+			payload, err := envelope.Decode[Payload](env)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
 
 			go handlePayload(&payload)
 		}
 	}()
 
-	fmt.Printf("Waiting for message on [Exchange, Queue] [logs_topic, %s]\r\n", q.Name)
+	fmt.Printf("Waiting for message on [Exchange, Queue] [%s, %s]\r\n", topology.EventsExchange, q.Name)
 
 	<-forever
 
@@ -2,6 +2,8 @@ package event
 
 import (
 	"log"
+	"shared/envelope"
+	"shared/topology"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
@@ -30,10 +32,17 @@ func (e *Emitter) setup() error {
 	}
 	defer channel.Close()
 
-	return declareExchange(channel)
+	_, err = topology.Declare(channel)
+
+	return err
 }
 
-func (e *Emitter) Push(event string, severity string) error {
+func (e *Emitter) Push(event envelope.Envelope, severity string) error {
+	publishing, err := event.Publishing()
+	if err != nil {
+		return err
+	}
+
 	channel, err := e.connection.Channel()
 	if err != nil {
 		return err
@@ -43,14 +52,11 @@ func (e *Emitter) Push(event string, severity string) error {
 	log.Println("Pushing to channel...")
 
 	err = channel.Publish(
-		"logs_topic",
+		topology.EventsExchange,
 		severity,
 		false,
 		false,
-		amqp.Publishing{
-			ContentType: "text/plain",
-			Body:        []byte(event),
-		},
+		publishing,
 	)
 	if err != nil {
 		return err
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"listener/event"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// NOTE: Admin commands
+/*
+	listenerApp parked list [-limit 20]
+	listenerApp parked replay [-limit 20]
+*/
+
+func runAdmin(conn *amqp.Connection, args []string) error {
+	if len(args) < 2 || args[0] != "parked" {
+		return errors.New("usage: listenerApp parked list|replay [-limit n]")
+	}
+
+	flags := flag.NewFlagSet("parked "+args[1], flag.ContinueOnError)
+	limit := flags.Int("limit", 20, "max number of messages to handle")
+	if err := flags.Parse(args[2:]); err != nil {
+		return err
+	}
+
+	switch args[1] {
+	case "list":
+		parked, err := event.InspectParked(conn, *limit)
+		if err != nil {
+			return err
+		}
+
+		for _, msg := range parked {
+			fmt.Printf("%s\t%s\tqueue=%s\tattempts=%d\t%s\r\n", msg.Timestamp.Format("2006-01-02 15:04:05"), msg.RoutingKey, msg.Queue, msg.Attempts, msg.Body)
+		}
+		fmt.Printf("%d parked message(s)\r\n", len(parked))
+
+	case "replay":
+		replayed, err := event.ReplayParked(conn, *limit)
+		fmt.Printf("Replayed %d message(s)\r\n", replayed)
+		if err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("unknown parked command %q", args[1])
+	}
+
+	return nil
+}
@@ -1,63 +1,190 @@
 package event
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"log"
-	"net/http"
+	"shared/envelope"
+	"shared/topology"
+	"sort"
+	"sync"
+	"sync/atomic"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
+const (
+	DefaultPrefetch = 10
+	DefaultWorkers  = 5
+	DefaultGroup    = "listener"
+)
+
+var (
+	ErrChannelClosed     = errors.New("amqp channel closed")
+	ErrConsumerCancelled = errors.New("amqp consumer cancelled by the broker")
+)
+
+type QueueMode int
+
+const (
+	WorkQueue QueueMode = iota // * durable named queue, replicas of a group compete for messages
+	Broadcast                  // * exclusive server-named queue, every replica gets every message
+)
+
+type ConsumerConfig struct {
+	Prefetch int    // * max unacknowledged messages the broker pushes to us
+	Workers  int    // * number of goroutines handling messages
+	Group    string // * consumer group, names the shared work queue
+	Mode     QueueMode
+}
+
+// Channel is the part of *amqp.Channel the consumer uses, so it can be
+// replaced by a fake in tests.
+type Channel interface {
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	QueueUnbind(name, key, exchange string, args amqp.Table) error
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Cancel(consumer string, noWait bool) error
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	NotifyClose(c chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
 type Consumer struct {
-	conn      *amqp.Connection
+	open      func() (Channel, error)
 	queueName string
+	config    ConsumerConfig
+	topology  *topology.Topology
+	handlers  *Registry
+
+	mu       sync.Mutex
+	ch       Channel
+	tag      string
+	bindings map[string]bool
+	topics   map[string]*topicCounters
+	workers  sync.WaitGroup // * workers still draining deliveries
+	inFlight atomic.Int64   // * messages being handled right now
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+type topicCounters struct {
+	processed atomic.Int64
+	failed    atomic.Int64
+}
+
+type TopicStats struct {
+	Processed int64 `json:"processed"`
+	Failed    int64 `json:"failed"`
 }
 
-func NewConsumer(conn *amqp.Connection) (Consumer, error) {
-	consumer := Consumer{
-		conn: conn,
+type Status struct {
+	Queue    string                `json:"queue"`
+	Group    string                `json:"group"`
+	Mode     string                `json:"mode"`
+	Bindings []string              `json:"bindings"`
+	InFlight int64                 `json:"in_flight"`
+	Topics   map[string]TopicStats `json:"topics"`
+}
+
+func NewConsumer(conn *amqp.Connection, config ConsumerConfig, handlers *Registry) (*Consumer, error) {
+	open := func() (Channel, error) {
+		return conn.Channel()
+	}
+
+	return newConsumer(open, config, handlers)
+}
+
+func newConsumer(open func() (Channel, error), config ConsumerConfig, handlers *Registry) (*Consumer, error) {
+	if config.Prefetch <= 0 {
+		config.Prefetch = DefaultPrefetch
+	}
+
+	if config.Workers <= 0 {
+		config.Workers = DefaultWorkers
+	}
+
+	if config.Group == "" {
+		config.Group = DefaultGroup
+	}
+
+	consumer := &Consumer{
+		open:     open,
+		config:   config,
+		handlers: handlers,
+		bindings: make(map[string]bool),
+		topics:   make(map[string]*topicCounters),
+		stopped:  make(chan struct{}),
 	}
 
 	if err := consumer.setup(); err != nil {
-		return Consumer{}, err
+		return nil, err
 	}
 
 	return consumer, nil
 }
 
 func (consumer *Consumer) setup() error {
-	channel, err := consumer.conn.Channel()
+	channel, err := consumer.open()
 	if err != nil {
 		return err
 	}
+	defer channel.Close()
 
-	return declareExchange(channel)
-}
+	t, err := topology.Declare(channel)
+	if err != nil {
+		return err
+	}
+
+	if err := checkRetryTopology(t); err != nil {
+		return err
+	}
 
-type Payload struct {
-	Name string `json:"name"`
-	Data string `json:"data"`
+	consumer.topology = t
+
+	return nil
 }
 
-func (consumer *Consumer) Listen(topics []string) error {
-	ch, err := consumer.conn.Channel()
+// Listen consumes messages bound by topics until ctx is cancelled, Stop is
+// called, the AMQP channel closes or the broker stops delivering. It returns
+// the reason it stopped: the context's error, nil after Stop, the channel's
+// close error or ErrConsumerCancelled.
+func (consumer *Consumer) Listen(ctx context.Context, topics []string) error {
+	ch, err := consumer.open()
 	if err != nil {
 		return err
 	}
 	defer ch.Close()
 
-	q, err := declareRandomQueue(ch)
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	var q amqp.Queue
+	if consumer.config.Mode == Broadcast {
+		q, err = topology.DeclareTemporaryQueue(ch)
+	} else {
+		q, err = declareWorkQueue(ch, consumer.topology, workQueueName(consumer.config.Group))
+	}
 	if err != nil {
 		return err
 	}
 
+	consumer.mu.Lock()
+	consumer.queueName = q.Name
+	consumer.mu.Unlock()
+
+	if err := topology.BindRequeue(ch, q.Name); err != nil {
+		return err
+	}
+
 	for _, topic := range topics {
 		err := ch.QueueBind(
 			q.Name,
 			topic,
-			"logs_topic",
+			topology.EventsExchange,
 			false,
 			nil,
 		)
@@ -65,70 +192,253 @@ func (consumer *Consumer) Listen(topics []string) error {
 		if err != nil {
 			return err
 		}
+
+		consumer.mu.Lock()
+		consumer.bindings[topic] = true
+		consumer.mu.Unlock()
 	}
 
-	messages, err := ch.Consume(q.Name, "", true, false, false, false, nil)
+	// don't let the broker push more than we can handle
+	err = ch.Qos(consumer.config.Prefetch, 0, false)
 	if err != nil {
-		return nil
+		return err
 	}
 
-	forever := make(chan bool)
-	defer close(forever)
+	tag := fmt.Sprintf("%s-%s", consumer.config.Group, envelope.NewID())
+
+	// * autoAck is off, every message is acked or nacked by a worker
+	messages, err := ch.Consume(q.Name, tag, false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	consumer.mu.Lock()
+	consumer.ch = ch
+	consumer.tag = tag
+	consumer.mu.Unlock()
+
+	// fixed size worker pool, so a burst can't spawn unbounded goroutines
+	for i := 0; i < consumer.config.Workers; i++ {
+		consumer.workers.Add(1)
+		go func() {
+			defer consumer.workers.Done()
+
+			for msg := range messages {
+				consumer.handleDelivery(ch, q.Name, msg)
+			}
+		}()
+	}
+
+	// * closed once the deliveries run out, e.g. when the broker cancels the consumer
+	drained := make(chan struct{})
 	go func() {
-		for msg := range messages {
-			var payload Payload
-			json.Unmarshal(msg.Body, &payload)
+		consumer.workers.Wait()
+		close(drained)
+	}()
+
+	fmt.Printf("Waiting for message on [Exchange, Queue] [%s, %s] with %d workers\r\n", topology.EventsExchange, q.Name, consumer.config.Workers)
 
-			go handlePayload(&payload)
+	select {
+	case <-ctx.Done():
+		if err := consumer.Stop(); err != nil {
+			log.Println(err)
 		}
-	}()
+		return ctx.Err()
 
-	fmt.Printf("Waiting for message on [Exchange, Queue] [logs_topic, %s]\r\n", q.Name)
+	case <-consumer.stopped:
+		consumer.workers.Wait()
+		return nil
 
-	<-forever
+	case amqpErr, ok := <-closed:
+		// * the deliveries channel is closed too, let the workers drain it
+		consumer.workers.Wait()
+		if ok && amqpErr != nil {
+			return amqpErr
+		}
+		return ErrChannelClosed
 
-	return nil
+	case <-drained:
+		select {
+		case <-consumer.stopped:
+			return nil
+		case amqpErr := <-closed:
+			if amqpErr != nil {
+				return amqpErr
+			}
+		default:
+		}
+		return ErrConsumerCancelled
+	}
 }
 
-func handlePayload(payload *Payload) {
-	switch payload.Name {
-	case "log", "event":
-		// log whatever we get
-		if err := logEvent(payload); err != nil {
-			log.Println(err)
-		}
+// Stop cancels the consumer so the broker stops delivering, then waits for
+// the messages already being handled.
+func (consumer *Consumer) Stop() error {
+	consumer.mu.Lock()
+	ch, tag := consumer.ch, consumer.tag
+	consumer.mu.Unlock()
 
-	case "auth":
-		// authenticate
+	if ch == nil {
+		return nil
 	}
+
+	var err error
+	consumer.stopOnce.Do(func() {
+		// * stopped first, so Listen doesn't take the deliveries running out for a cancel by the broker
+		close(consumer.stopped)
+		err = ch.Cancel(tag, false)
+	})
+
+	consumer.workers.Wait()
+
+	return err
 }
 
-func logEvent(payload *Payload) error {
-	jsonData, err := json.Marshal(payload)
-	if err != nil {
+// Bind starts routing messages with the topic to the consumer's queue.
+func (consumer *Consumer) Bind(topic string) error {
+	consumer.mu.Lock()
+	defer consumer.mu.Unlock()
+
+	if consumer.ch == nil {
+		return errors.New("consumer is not listening")
+	}
+
+	if err := consumer.ch.QueueBind(consumer.queueName, topic, topology.EventsExchange, false, nil); err != nil {
 		return err
 	}
 
-	logServiceURL := "http://logger-service/log"
+	consumer.bindings[topic] = true
 
-	request, err := http.NewRequest(http.MethodPost, logServiceURL, bytes.NewBuffer(jsonData))
-	if err != nil {
+	return nil
+}
+
+// Unbind stops routing messages with the topic to the consumer's queue.
+func (consumer *Consumer) Unbind(topic string) error {
+	consumer.mu.Lock()
+	defer consumer.mu.Unlock()
+
+	if consumer.ch == nil {
+		return errors.New("consumer is not listening")
+	}
+
+	if !consumer.bindings[topic] {
+		return fmt.Errorf("queue %s is not bound to %q", consumer.queueName, topic)
+	}
+
+	if err := consumer.ch.QueueUnbind(consumer.queueName, topic, topology.EventsExchange, nil); err != nil {
 		return err
 	}
 
-	request.Header.Set("Content-Type", "Application/json")
+	delete(consumer.bindings, topic)
+
+	return nil
+}
 
-	client := &http.Client{}
+func (consumer *Consumer) Status() Status {
+	consumer.mu.Lock()
+	defer consumer.mu.Unlock()
 
-	response, err := client.Do(request)
+	status := Status{
+		Queue:    consumer.queueName,
+		Group:    consumer.config.Group,
+		Mode:     "work-queue",
+		Bindings: make([]string, 0, len(consumer.bindings)),
+		InFlight: consumer.inFlight.Load(),
+		Topics:   make(map[string]TopicStats, len(consumer.topics)),
+	}
+
+	if consumer.config.Mode == Broadcast {
+		status.Mode = "broadcast"
+	}
+
+	for topic := range consumer.bindings {
+		status.Bindings = append(status.Bindings, topic)
+	}
+	sort.Strings(status.Bindings)
+
+	for topic, counters := range consumer.topics {
+		status.Topics[topic] = TopicStats{
+			Processed: counters.processed.Load(),
+			Failed:    counters.failed.Load(),
+		}
+	}
+
+	return status
+}
+
+func (consumer *Consumer) counters(topic string) *topicCounters {
+	consumer.mu.Lock()
+	defer consumer.mu.Unlock()
+
+	counters, ok := consumer.topics[topic]
+	if !ok {
+		counters = &topicCounters{}
+		consumer.topics[topic] = counters
+	}
+
+	return counters
+}
+
+// handleDelivery dispatches a message from the queue and settles it.
+func (consumer *Consumer) handleDelivery(ch Channel, queue string, msg amqp.Delivery) {
+	consumer.inFlight.Add(1)
+	defer consumer.inFlight.Add(-1)
+
+	counters := consumer.counters(msg.RoutingKey)
+
+	message, err := decodeMessage(msg)
 	if err != nil {
-		return err
+		// a malformed body will never succeed, so don't requeue it
+		log.Println("Rejecting malformed message:", err)
+		counters.failed.Add(1)
+		if err := msg.Reject(false); err != nil {
+			log.Println(err)
+		}
+		return
 	}
-	defer response.Body.Close()
+	message.Queue = queue
 
-	if response.StatusCode != http.StatusOK {
-		return err
+	// * in-flight handlers finish even when the consumer is stopping
+	err = consumer.handlers.Dispatch(context.Background(), message)
+	if err != nil {
+		log.Println(err)
+		counters.failed.Add(1)
+		if IsPermanent(err) {
+			park(ch, queue, msg)
+		} else {
+			retry(ch, queue, msg)
+		}
+		return
 	}
 
-	return nil
+	counters.processed.Add(1)
+	if err := msg.Ack(false); err != nil {
+		log.Println(err)
+	}
+}
+
+// decodeMessage reads the envelope of a delivery. Bare payloads from older
+// publishers take the payload's name as their event type.
+func decodeMessage(msg amqp.Delivery) (*Message, error) {
+	env, err := envelope.FromDelivery(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if env.Type == "" {
+		payload, err := envelope.Decode[envelope.LogData](env)
+		if err != nil {
+			return nil, err
+		}
+		env.Type = payload.Name
+	}
+
+	if env.Type == "" {
+		return nil, envelope.ErrMissingType
+	}
+
+	return &Message{
+		RoutingKey: msg.RoutingKey,
+		Envelope:   env,
+	}, nil
 }
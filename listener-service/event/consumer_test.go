@@ -0,0 +1,491 @@
+package event
+
+import (
+	"context"
+	"errors"
+	"shared/envelope"
+	"shared/topology"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// fakeChannel is a Channel that records what the consumer does with it and
+// hands out deliveries the test pushes.
+type fakeChannel struct {
+	mu          sync.Mutex
+	deliveries  chan amqp.Delivery
+	closeOnce   sync.Once
+	notify      []chan *amqp.Error
+	bindings    []fakeBinding
+	published   []fakePublishing
+	cancelled   bool
+	bindErr     error
+	consumeErr  error
+	publishErr  error
+	consumerTag string
+}
+
+type fakeBinding struct {
+	queue, key, exchange string
+	args                 amqp.Table
+}
+
+type fakePublishing struct {
+	exchange, key string
+	msg           amqp.Publishing
+}
+
+func newFakeChannel() *fakeChannel {
+	return &fakeChannel{deliveries: make(chan amqp.Delivery, 16)}
+}
+
+func (f *fakeChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	return nil
+}
+
+func (f *fakeChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	if name == "" {
+		name = "amq.gen-test"
+	}
+
+	return amqp.Queue{Name: name}, nil
+}
+
+func (f *fakeChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.bindErr != nil {
+		return f.bindErr
+	}
+
+	f.bindings = append(f.bindings, fakeBinding{queue: name, key: key, exchange: exchange, args: args})
+
+	return nil
+}
+
+func (f *fakeChannel) QueueUnbind(name, key, exchange string, args amqp.Table) error {
+	return nil
+}
+
+func (f *fakeChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	return nil
+}
+
+func (f *fakeChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.consumeErr != nil {
+		return nil, f.consumeErr
+	}
+
+	f.consumerTag = consumer
+
+	return f.deliveries, nil
+}
+
+// Cancel closes the deliveries, like the client library does.
+func (f *fakeChannel) Cancel(consumer string, noWait bool) error {
+	f.mu.Lock()
+	f.cancelled = true
+	f.mu.Unlock()
+
+	f.closeDeliveries()
+
+	return nil
+}
+
+func (f *fakeChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.publishErr != nil {
+		return f.publishErr
+	}
+
+	f.published = append(f.published, fakePublishing{exchange: exchange, key: key, msg: msg})
+
+	return nil
+}
+
+func (f *fakeChannel) NotifyClose(c chan *amqp.Error) chan *amqp.Error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.notify = append(f.notify, c)
+
+	return c
+}
+
+// Close does nothing, the consumer opens the same fake more than once.
+func (f *fakeChannel) Close() error {
+	return nil
+}
+
+func (f *fakeChannel) closeDeliveries() {
+	f.closeOnce.Do(func() { close(f.deliveries) })
+}
+
+// closeWith closes the channel the way the broker does, e.g. on an error.
+func (f *fakeChannel) closeWith(err *amqp.Error) {
+	f.mu.Lock()
+	for _, c := range f.notify {
+		c <- err
+		close(c)
+	}
+	f.notify = nil
+	f.mu.Unlock()
+
+	f.closeDeliveries()
+}
+
+func (f *fakeChannel) publishings() []fakePublishing {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]fakePublishing{}, f.published...)
+}
+
+// fakeAcknowledger records how each delivery was settled.
+type fakeAcknowledger struct {
+	mu      sync.Mutex
+	settled map[uint64]string
+}
+
+func (a *fakeAcknowledger) settle(tag uint64, how string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.settled == nil {
+		a.settled = make(map[uint64]string)
+	}
+	a.settled[tag] = how
+
+	return nil
+}
+
+func (a *fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	return a.settle(tag, "ack")
+}
+
+func (a *fakeAcknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	if requeue {
+		return a.settle(tag, "nack-requeue")
+	}
+
+	return a.settle(tag, "nack")
+}
+
+func (a *fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	if requeue {
+		return a.settle(tag, "reject-requeue")
+	}
+
+	return a.settle(tag, "reject")
+}
+
+func (a *fakeAcknowledger) how(tag uint64) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.settled[tag]
+}
+
+func newTestConsumer(t *testing.T, registry *Registry) (*Consumer, *fakeChannel) {
+	t.Helper()
+
+	ch := newFakeChannel()
+	consumer, err := newConsumer(func() (Channel, error) { return ch, nil }, ConsumerConfig{Workers: 2}, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// * forget the bindings of the topology, only those of Listen matter
+	ch.bindings = nil
+
+	return consumer, ch
+}
+
+func logDelivery(t *testing.T, ack amqp.Acknowledger, tag uint64) amqp.Delivery {
+	t.Helper()
+
+	env, err := envelope.Encode("log", "1", "test", envelope.LogData{Name: "event", Data: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publishing, err := env.Publishing()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return amqp.Delivery{
+		Acknowledger: ack,
+		DeliveryTag:  tag,
+		RoutingKey:   "log.INFO",
+		MessageId:    publishing.MessageId,
+		ContentType:  publishing.ContentType,
+		Body:         publishing.Body,
+	}
+}
+
+// listen runs Listen in the background and waits until it consumes.
+func listen(t *testing.T, ctx context.Context, consumer *Consumer, ch *fakeChannel) <-chan error {
+	t.Helper()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- consumer.Listen(ctx, []string{"log.INFO"})
+	}()
+
+	waitFor(t, func() bool {
+		ch.mu.Lock()
+		defer ch.mu.Unlock()
+		return ch.consumerTag != ""
+	})
+
+	return done
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func result(t *testing.T, done <-chan error) error {
+	t.Helper()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(2 * time.Second):
+		t.Fatal("Listen didn't return")
+		return nil
+	}
+}
+
+func TestListenReturnsOnContextCancel(t *testing.T) {
+	consumer, ch := newTestConsumer(t, NewRegistry())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := listen(t, ctx, consumer, ch)
+
+	cancel()
+
+	if err := result(t, done); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Listen returned %v, want context.Canceled", err)
+	}
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if !ch.cancelled {
+		t.Error("the consumer wasn't cancelled")
+	}
+}
+
+func TestListenReturnsWhenDeliveriesClose(t *testing.T) {
+	consumer, ch := newTestConsumer(t, NewRegistry())
+	done := listen(t, context.Background(), consumer, ch)
+
+	// * the broker cancelled the consumer, the channel stays open
+	ch.closeDeliveries()
+
+	if err := result(t, done); !errors.Is(err, ErrConsumerCancelled) {
+		t.Fatalf("Listen returned %v, want ErrConsumerCancelled", err)
+	}
+}
+
+func TestListenReturnsTheCloseError(t *testing.T) {
+	consumer, ch := newTestConsumer(t, NewRegistry())
+	done := listen(t, context.Background(), consumer, ch)
+
+	closeErr := &amqp.Error{Code: amqp.ConnectionForced, Reason: "shutdown"}
+	ch.closeWith(closeErr)
+
+	if err := result(t, done); err != closeErr {
+		t.Fatalf("Listen returned %v, want %v", err, closeErr)
+	}
+}
+
+func TestListenReturnsSetupErrors(t *testing.T) {
+	bindErr := errors.New("bind failed")
+	consumeErr := errors.New("consume failed")
+
+	tests := []struct {
+		name  string
+		setup func(ch *fakeChannel)
+		want  error
+	}{
+		{"bind", func(ch *fakeChannel) { ch.bindErr = bindErr }, bindErr},
+		{"consume", func(ch *fakeChannel) { ch.consumeErr = consumeErr }, consumeErr},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			consumer, ch := newTestConsumer(t, NewRegistry())
+			tt.setup(ch)
+
+			err := consumer.Listen(context.Background(), []string{"log.INFO"})
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Listen returned %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestStopWaitsForInFlightHandlers(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	registry := NewRegistry()
+	registry.HandleEvent("log", func(ctx context.Context, msg *Message) error {
+		close(started)
+		<-release
+		return nil
+	})
+
+	consumer, ch := newTestConsumer(t, registry)
+	done := listen(t, context.Background(), consumer, ch)
+
+	ack := &fakeAcknowledger{}
+	ch.deliveries <- logDelivery(t, ack, 1)
+	<-started
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- consumer.Stop()
+	}()
+
+	select {
+	case <-stopped:
+		t.Fatal("Stop returned while a handler was running")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stop didn't return")
+	}
+
+	if how := ack.how(1); how != "ack" {
+		t.Errorf("in-flight message was settled with %q, want ack", how)
+	}
+
+	if err := result(t, done); err != nil {
+		t.Fatalf("Listen returned %v after Stop, want nil", err)
+	}
+}
+
+func TestHandleDelivery(t *testing.T) {
+	transient := errors.New("logger is down")
+
+	tests := []struct {
+		name       string
+		handler    Handler
+		body       string
+		headers    amqp.Table
+		publishErr error
+		settled    string
+		copied     string // * `retry` or `park` for where a copy was published, empty for none
+	}{
+		{
+			name:    "handled",
+			handler: func(ctx context.Context, msg *Message) error { return nil },
+			settled: "ack",
+		},
+		{
+			name:    "malformed",
+			handler: func(ctx context.Context, msg *Message) error { return nil },
+			body:    "{not json",
+			settled: "reject",
+		},
+		{
+			name:    "transient error",
+			handler: func(ctx context.Context, msg *Message) error { return transient },
+			settled: "ack",
+			copied:  "retry",
+		},
+		{
+			name:    "permanent error",
+			handler: func(ctx context.Context, msg *Message) error { return Permanent(transient) },
+			settled: "ack",
+			copied:  "park",
+		},
+		{
+			name:    "out of attempts",
+			handler: func(ctx context.Context, msg *Message) error { return transient },
+			headers: amqp.Table{"x-death": []any{
+				amqp.Table{"queue": topology.RetryQueuePrefix + "5m", "count": int64(len(topology.RetryTiers))},
+			}},
+			settled: "ack",
+			copied:  "park",
+		},
+		{
+			name:       "publishing the retry fails",
+			handler:    func(ctx context.Context, msg *Message) error { return transient },
+			publishErr: errors.New("channel closed"),
+			settled:    "nack-requeue",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := NewRegistry()
+			registry.HandleEvent("log", tt.handler)
+
+			consumer, ch := newTestConsumer(t, registry)
+			ch.publishErr = tt.publishErr
+
+			ack := &fakeAcknowledger{}
+			msg := logDelivery(t, ack, 1)
+			msg.Headers = tt.headers
+			if tt.body != "" {
+				msg.Body = []byte(tt.body)
+			}
+
+			consumer.handleDelivery(ch, "logs_topic.listener", msg)
+
+			if how := ack.how(1); how != tt.settled {
+				t.Errorf("message was settled with %q, want %q", how, tt.settled)
+			}
+
+			published := ch.publishings()
+			if tt.copied == "" {
+				if len(published) != 0 {
+					t.Errorf("published %d copies, want none", len(published))
+				}
+				return
+			}
+
+			if len(published) != 1 {
+				t.Fatalf("published %d copies, want one", len(published))
+			}
+
+			want := fakePublishing{exchange: retryExchange, key: msg.RoutingKey}
+			if tt.copied == "park" {
+				want = fakePublishing{exchange: "", key: parkingLotQueue}
+			}
+
+			if got := published[0]; got.exchange != want.exchange || got.key != want.key {
+				t.Errorf("copy went to exchange %q with key %q, want %q with %q", got.exchange, got.key, want.exchange, want.key)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package event
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	DefaultDedupWindow = 24 * time.Hour
+	DefaultDedupSize   = 100_000
+)
+
+// ProcessedStore remembers the IDs of messages that were handled successfully
+// within a time window, so redeliveries of them can be skipped. Idempotent
+// scopes the IDs to the queue, so a store can be shared by consumer groups.
+type ProcessedStore interface {
+	Seen(ctx context.Context, id string) (bool, error)
+	Mark(ctx context.Context, id string) error
+}
+
+// Idempotent skips messages whose ID was already processed and marks the ID
+// once the handler succeeds. Legacy payloads are passed through untouched
+// since they carry no stable ID.
+//
+// Every queue bound to a topic gets its own copy of an event, so the ID is
+// only a duplicate within the queue it was marked in.
+func Idempotent(store ProcessedStore) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg *Message) error {
+			if msg.Envelope.Legacy() {
+				return next(ctx, msg)
+			}
+
+			id := processedKey(msg)
+
+			seen, err := store.Seen(ctx, id)
+			if err != nil {
+				// better to risk a duplicate than to drop the message
+				log.Println("Checking processed messages failed:", err)
+			} else if seen {
+				log.Printf("Skipping duplicate message %s [%s]\r\n", msg.Envelope.ID, msg.RoutingKey)
+				return nil
+			}
+
+			if err := next(ctx, msg); err != nil {
+				return err
+			}
+
+			if err := store.Mark(ctx, id); err != nil {
+				log.Println("Marking message as processed failed:", err)
+			}
+
+			return nil
+		}
+	}
+}
+
+// processedKey is the message ID prefixed with the queue it came from.
+func processedKey(msg *Message) string {
+	return msg.Queue + "/" + msg.Envelope.ID
+}
+
+type processedID struct {
+	id string
+	at time.Time
+}
+
+// MemoryProcessedStore keeps at most size IDs for at most window, evicting
+// the oldest first. It only deduplicates within a single replica.
+type MemoryProcessedStore struct {
+	mu     sync.Mutex
+	window time.Duration
+	size   int
+	ids    map[string]*list.Element
+	order  *list.List // * oldest at the front
+}
+
+func NewMemoryProcessedStore(window time.Duration, size int) *MemoryProcessedStore {
+	if window <= 0 {
+		window = DefaultDedupWindow
+	}
+
+	if size <= 0 {
+		size = DefaultDedupSize
+	}
+
+	return &MemoryProcessedStore{
+		window: window,
+		size:   size,
+		ids:    make(map[string]*list.Element),
+		order:  list.New(),
+	}
+}
+
+func (s *MemoryProcessedStore) Seen(ctx context.Context, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire(time.Now())
+
+	_, ok := s.ids[id]
+	return ok, nil
+}
+
+func (s *MemoryProcessedStore) Mark(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.expire(now)
+
+	if el, ok := s.ids[id]; ok {
+		s.order.Remove(el)
+	}
+
+	s.ids[id] = s.order.PushBack(processedID{id: id, at: now})
+
+	for s.order.Len() > s.size {
+		s.remove(s.order.Front())
+	}
+
+	return nil
+}
+
+func (s *MemoryProcessedStore) expire(now time.Time) {
+	for el := s.order.Front(); el != nil; el = s.order.Front() {
+		if now.Sub(el.Value.(processedID).at) < s.window {
+			return
+		}
+		s.remove(el)
+	}
+}
+
+func (s *MemoryProcessedStore) remove(el *list.Element) {
+	s.order.Remove(el)
+	delete(s.ids, el.Value.(processedID).id)
+}
+
+// MongoProcessedStore shares processed IDs between replicas and consumer
+// groups, keyed by queue and message ID. A TTL index removes them once the
+// window has passed.
+type MongoProcessedStore struct {
+	collection *mongo.Collection
+	window     time.Duration
+}
+
+func NewMongoProcessedStore(ctx context.Context, client *mongo.Client, window time.Duration) (*MongoProcessedStore, error) {
+	if window <= 0 {
+		window = DefaultDedupWindow
+	}
+
+	collection := client.Database("listener").Collection("processed_messages")
+
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "processed_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(window.Seconds())),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &MongoProcessedStore{
+		collection: collection,
+		window:     window,
+	}, nil
+}
+
+func (s *MongoProcessedStore) Seen(ctx context.Context, id string) (bool, error) {
+	// * the TTL monitor only runs every minute, so check the window ourselves too
+	filter := bson.M{
+		"_id":          id,
+		"processed_at": bson.M{"$gt": time.Now().Add(-s.window)},
+	}
+
+	err := s.collection.FindOne(ctx, filter).Err()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (s *MongoProcessedStore) Mark(ctx context.Context, id string) error {
+	_, err := s.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{"processed_at": time.Now()}},
+		options.Update().SetUpsert(true),
+	)
+
+	return err
+}
@@ -0,0 +1,44 @@
+package event
+
+import (
+	"context"
+	"shared/envelope"
+	"testing"
+	"time"
+)
+
+func TestIdempotentScopesIDsToTheQueue(t *testing.T) {
+	env, err := envelope.Encode("log", "1", "test", envelope.LogData{Name: "event", Data: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// * one store shared by every group, like the Mongo collection
+	store := NewMemoryProcessedStore(time.Hour, 10)
+
+	handled := make(map[string]int)
+	handler := Idempotent(store)(func(ctx context.Context, msg *Message) error {
+		handled[msg.Queue]++
+		return nil
+	})
+
+	deliveries := []string{
+		"logs_topic.listener",
+		"logs_topic.audit",
+		"logs_topic.listener", // * redelivered to the first group
+		"logs_topic.audit",    // * redelivered to the second group
+	}
+
+	for _, queue := range deliveries {
+		msg := &Message{RoutingKey: "log.INFO", Queue: queue, Envelope: env}
+		if err := handler(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, queue := range []string{"logs_topic.listener", "logs_topic.audit"} {
+		if handled[queue] != 1 {
+			t.Errorf("%s handled the message %d times, want once", queue, handled[queue])
+		}
+	}
+}
@@ -1,28 +1,23 @@
 package event
 
 import (
+	"shared/topology"
+
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-func declareExchange(ch *amqp.Channel) error {
-	return ch.ExchangeDeclare(
-		"logs_topic", // * name of the exchange
-		"topic",      // * type
-		true,         // * durable?
-		false,        // * autoDelete?
-		false,        // * internal?
-		false,        // * no-wait?
-		nil,          // * arguments
-	)
+// workQueueName is the durable queue shared by every replica of a group
+func workQueueName(group string) string {
+	return topology.EventsExchange + "." + group
 }
 
-func declareRandomQueue(ch *amqp.Channel) (amqp.Queue, error) {
-	return ch.QueueDeclare(
-		"",    // * name
-		false, // * durable?
-		false, // * delete when unused?
-		true,  // * exclusive?
-		false, // * no-wait?
-		nil,   // * arguments
-	)
+// declareWorkQueue declares the queue as the topology file describes it, or as
+// a plain durable queue for groups the file doesn't know.
+func declareWorkQueue(ch Channel, t *topology.Topology, name string) (amqp.Queue, error) {
+	q, ok := t.Queue(name)
+	if !ok {
+		q = topology.Queue{Name: name, Durable: true}
+	}
+
+	return topology.DeclareQueue(ch, q)
 }
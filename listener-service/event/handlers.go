@@ -0,0 +1,81 @@
+package event
+
+import (
+	"context"
+	"fmt"
+	"shared/envelope"
+	"time"
+)
+
+// LogEvent writes the log entry carried by the event to the logger service.
+func LogEvent(writer LogWriter) Handler {
+	return func(ctx context.Context, msg *Message) error {
+		entry, err := envelope.Decode[envelope.LogData](msg.Envelope)
+		if err != nil {
+			return Permanent(err)
+		}
+
+		return writer.Write(ctx, &entry)
+	}
+}
+
+// AuthEvent records authentication activity, e.g. logins, in the logs.
+func AuthEvent(writer LogWriter) Handler {
+	return func(ctx context.Context, msg *Message) error {
+		entry, err := envelope.Decode[envelope.LogData](msg.Envelope)
+		if err != nil {
+			return Permanent(err)
+		}
+
+		if entry.Data == "" {
+			return Permanent(fmt.Errorf("auth event on %q has no data", msg.RoutingKey))
+		}
+
+		return writer.Write(ctx, &envelope.LogData{
+			Name: "authentication",
+			Data: entry.Data,
+		})
+	}
+}
+
+// LoginEvent records the logins published by authentication-service.
+func LoginEvent(writer LogWriter) Handler {
+	return func(ctx context.Context, msg *Message) error {
+		login, err := envelope.Decode[envelope.LoginData](msg.Envelope)
+		if err != nil {
+			return Permanent(err)
+		}
+
+		data := fmt.Sprintf("%s: %s from %s", msg.Envelope.Type, login.Email, login.IP)
+		if login.Reason != "" {
+			data = fmt.Sprintf("%s (%s)", data, login.Reason)
+		}
+
+		return writer.Write(ctx, &envelope.LogData{
+			Name: "authentication",
+			Data: data,
+		})
+	}
+}
+
+// LockoutEvent records accounts locked after too many failed logins, and
+// unlocked again by an admin.
+func LockoutEvent(writer LogWriter) Handler {
+	return func(ctx context.Context, msg *Message) error {
+		lockout, err := envelope.Decode[envelope.LockoutData](msg.Envelope)
+		if err != nil {
+			return Permanent(err)
+		}
+
+		data := fmt.Sprintf("%s: %s", msg.Envelope.Type, lockout.Email)
+		if lockout.LockedUntil != nil {
+			data = fmt.Sprintf("%s after %d failed logins from %s, until %s",
+				data, lockout.Failures, lockout.IP, lockout.LockedUntil.UTC().Format(time.RFC3339))
+		}
+
+		return writer.Write(ctx, &envelope.LogData{
+			Name: "authentication",
+			Data: data,
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package event
+
+import (
+	"log"
+	"shared/topology"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type ParkedMessage struct {
+	RoutingKey string
+	Queue      string // * the queue it failed in, empty for messages parked before it was recorded
+	Attempts   int
+	Timestamp  time.Time
+	Body       string
+}
+
+// InspectParked returns up to limit messages from the parking lot without
+// removing them from the queue.
+func InspectParked(conn *amqp.Connection, limit int) ([]ParkedMessage, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	defer ch.Close()
+
+	var parked []ParkedMessage
+	var last amqp.Delivery
+	for len(parked) < limit {
+		msg, ok, err := ch.Get(parkingLotQueue, false)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+
+		last = msg
+		routingKey, _ := msg.Headers[routingKeyHeader].(string)
+		queue, _ := msg.Headers[retryQueueHeader].(string)
+		parked = append(parked, ParkedMessage{
+			RoutingKey: routingKey,
+			Queue:      queue,
+			Attempts:   topology.Attempts(msg.Headers),
+			Timestamp:  msg.Timestamp,
+			Body:       string(msg.Body),
+		})
+	}
+
+	// put everything we peeked at back on the queue
+	if len(parked) > 0 {
+		if err := last.Nack(true, true); err != nil {
+			return nil, err
+		}
+	}
+
+	return parked, nil
+}
+
+// ReplayParked republishes up to limit parked messages to the queue each one
+// failed in, through logs_requeue like a retry, with a fresh retry budget.
+// The parking lot is shared by every queue, so going through logs_topic again
+// would hand a message to every group bound to its routing key, the ones that
+// handled it included. It returns the number of messages replayed.
+func ReplayParked(conn *amqp.Connection, limit int) (int, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return 0, err
+	}
+	defer ch.Close()
+
+	replayed := 0
+	for replayed < limit {
+		msg, ok, err := ch.Get(parkingLotQueue, false)
+		if err != nil {
+			return replayed, err
+		}
+		if !ok {
+			break
+		}
+
+		exchange, key, publishing := replayPublishing(msg)
+
+		err = ch.Publish(exchange, key, false, false, publishing)
+		if err != nil {
+			if err := msg.Nack(false, true); err != nil {
+				log.Println(err)
+			}
+			return replayed, err
+		}
+
+		if err := msg.Ack(false); err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+
+	return replayed, nil
+}
+
+// replayPublishing returns where to publish a parked message and the copy to
+// publish, without the headers of its earlier attempts.
+func replayPublishing(msg amqp.Delivery) (string, string, amqp.Publishing) {
+	routingKey, _ := msg.Headers[routingKeyHeader].(string)
+	queue, _ := msg.Headers[retryQueueHeader].(string)
+
+	headers := amqp.Table{}
+	for key, value := range msg.Headers {
+		switch key {
+		case "x-death", retryTierHeader, retryQueueHeader, routingKeyHeader:
+			// * dropped so the message starts over with every retry tier
+		default:
+			headers[key] = value
+		}
+	}
+
+	publishing := amqp.Publishing{
+		Headers:       headers,
+		ContentType:   msg.ContentType,
+		DeliveryMode:  amqp.Persistent,
+		CorrelationId: msg.CorrelationId,
+		MessageId:     msg.MessageId,
+		Timestamp:     msg.Timestamp,
+		Type:          msg.Type,
+		Body:          msg.Body,
+	}
+
+	// * parked before the queue was recorded, there's no telling which group failed it
+	if queue == "" {
+		log.Printf("Parked message %q has no queue, replaying it to every queue bound to its routing key\r\n", routingKey)
+		return topology.EventsExchange, routingKey, publishing
+	}
+
+	headers[retryQueueHeader] = queue
+
+	return requeueExchange, "", publishing
+}
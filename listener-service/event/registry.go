@@ -0,0 +1,198 @@
+package event
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"shared/envelope"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is what a handler receives: the event envelope together with the
+// routing key it was published with and the queue it was consumed from.
+type Message struct {
+	RoutingKey string
+	Queue      string
+	Envelope   envelope.Envelope
+}
+
+// Handler processes a single message. Returning an error sends the message to
+// the retry queues, unless the error is wrapped with Permanent.
+type Handler func(ctx context.Context, msg *Message) error
+
+// Middleware wraps a handler, e.g. to add logging or recovery.
+type Middleware func(Handler) Handler
+
+type route struct {
+	pattern string // * topic pattern like `log.*` or `user.#`, empty matches any routing key
+	event   string // * envelope type, empty matches any event
+	handler Handler
+}
+
+// Registry dispatches messages to the first handler whose topic pattern and
+// event name both match.
+type Registry struct {
+	mu         sync.RWMutex
+	routes     []route
+	middleware []Middleware
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Use adds middleware to every handler. The first one is the outermost.
+func (r *Registry) Use(middleware ...Middleware) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.middleware = append(r.middleware, middleware...)
+}
+
+// Handle registers a handler for a topic pattern and an event name, either of
+// which may be empty to match anything.
+func (r *Registry) Handle(pattern, event string, handler Handler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.routes = append(r.routes, route{pattern: pattern, event: event, handler: handler})
+}
+
+func (r *Registry) HandleTopic(pattern string, handler Handler) {
+	r.Handle(pattern, "", handler)
+}
+
+func (r *Registry) HandleEvent(event string, handler Handler) {
+	r.Handle("", event, handler)
+}
+
+func (r *Registry) Dispatch(ctx context.Context, msg *Message) error {
+	r.mu.RLock()
+	handler := r.match(msg)
+	middleware := r.middleware
+	r.mu.RUnlock()
+
+	if handler == nil {
+		log.Printf("No handler for [%s] %q, skipping\r\n", msg.RoutingKey, msg.Envelope.Type)
+		return nil
+	}
+
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+
+	return handler(ctx, msg)
+}
+
+func (r *Registry) match(msg *Message) Handler {
+	for _, rt := range r.routes {
+		if rt.event != "" && rt.event != msg.Envelope.Type {
+			continue
+		}
+
+		if rt.pattern != "" && !topicMatches(rt.pattern, msg.RoutingKey) {
+			continue
+		}
+
+		return rt.handler
+	}
+
+	return nil
+}
+
+// topicMatches follows AMQP topic exchange rules: words are separated by dots,
+// `*` matches exactly one word and `#` matches zero or more words.
+func topicMatches(pattern, key string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+func matchWords(pattern, key []string) bool {
+	if len(pattern) == 0 {
+		return len(key) == 0
+	}
+
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(key); i++ {
+			if matchWords(pattern[1:], key[i:]) {
+				return true
+			}
+		}
+		return false
+
+	case "*":
+		return len(key) > 0 && matchWords(pattern[1:], key[1:])
+
+	default:
+		return len(key) > 0 && pattern[0] == key[0] && matchWords(pattern[1:], key[1:])
+	}
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks an error as not worth retrying, the message goes straight to
+// the parking lot.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &permanentError{err: err}
+}
+
+func IsPermanent(err error) bool {
+	var perm *permanentError
+	return errors.As(err, &perm)
+}
+
+// Logging logs every handled message with its duration and outcome.
+func Logging(next Handler) Handler {
+	return func(ctx context.Context, msg *Message) error {
+		start := time.Now()
+		err := next(ctx, msg)
+
+		if err != nil {
+			log.Printf("[%s] %q failed after %s: %v\r\n", msg.RoutingKey, msg.Envelope.Type, time.Since(start), err)
+		} else {
+			log.Printf("[%s] %q handled in %s\r\n", msg.RoutingKey, msg.Envelope.Type, time.Since(start))
+		}
+
+		return err
+	}
+}
+
+// Recovery turns a panicking handler into a permanent error, so the message is
+// parked instead of crashing the worker.
+func Recovery(next Handler) Handler {
+	return func(ctx context.Context, msg *Message) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("panic handling [%s] %q: %v\r\n%s", msg.RoutingKey, msg.Envelope.Type, r, debug.Stack())
+				err = Permanent(fmt.Errorf("handler panicked: %v", r))
+			}
+		}()
+
+		return next(ctx, msg)
+	}
+}
+
+// Timeout cancels the handler's context after d.
+func Timeout(d time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg *Message) error {
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+
+			return next(ctx, msg)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package event
+
+import (
+	"fmt"
+	"log"
+	"shared/topology"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	retryExchange    = topology.RetryExchange   // * headers exchange routing failed messages to a retry queue
+	requeueExchange  = topology.RequeueExchange // * headers exchange routing retried messages back to their queue
+	parkingLotQueue  = "logs_parking_lot"       // * messages that ran out of attempts
+	routingKeyHeader = "x-original-routing-key"
+
+	retryTierHeader  = topology.RetryTierHeader
+	retryQueueHeader = topology.RetryQueueHeader
+)
+
+// checkRetryTopology makes sure the topology file has a retry queue for
+// every tier, see shared/topology/retry.go, and the parking lot.
+func checkRetryTopology(t *topology.Topology) error {
+	if err := t.CheckRetryQueues(); err != nil {
+		return err
+	}
+
+	if _, ok := t.Queue(parkingLotQueue); !ok {
+		return fmt.Errorf("topology has no parking lot queue %s", parkingLotQueue)
+	}
+
+	return nil
+}
+
+func republish(msg amqp.Delivery, headers amqp.Table) amqp.Publishing {
+	copied := amqp.Table{}
+	for key, value := range msg.Headers {
+		copied[key] = value
+	}
+
+	for key, value := range headers {
+		copied[key] = value
+	}
+
+	return amqp.Publishing{
+		Headers:       copied,
+		ContentType:   msg.ContentType,
+		DeliveryMode:  amqp.Persistent,
+		CorrelationId: msg.CorrelationId,
+		MessageId:     msg.MessageId,
+		Timestamp:     msg.Timestamp,
+		Type:          msg.Type,
+		Body:          msg.Body,
+	}
+}
+
+// retry moves a message that failed in the queue to the next retry tier, or
+// to the parking lot once every tier has been used. The original delivery is
+// acked only after the copy has been published.
+func retry(ch Channel, queue string, msg amqp.Delivery) {
+	attempt := topology.Attempts(msg.Headers)
+	if attempt >= len(topology.RetryTiers) {
+		park(ch, queue, msg)
+		return
+	}
+
+	tier := topology.TierName(topology.RetryTiers[attempt])
+	log.Printf("Retrying message %q in %s (attempt %d of %d)\r\n", msg.RoutingKey, tier, attempt+1, len(topology.RetryTiers))
+
+	publishing := republish(msg, amqp.Table{retryTierHeader: tier, retryQueueHeader: queue})
+	settle(msg, ch.Publish(retryExchange, msg.RoutingKey, false, false, publishing))
+}
+
+// park moves a message that failed in the queue straight to the parking lot,
+// keeping its routing key and the queue in headers so it can be replayed to
+// that queue later.
+func park(ch Channel, queue string, msg amqp.Delivery) {
+	log.Printf("Parking message %q after %d attempts\r\n", msg.RoutingKey, topology.Attempts(msg.Headers))
+
+	publishing := republish(msg, amqp.Table{routingKeyHeader: msg.RoutingKey, retryQueueHeader: queue})
+	settle(msg, ch.Publish("", parkingLotQueue, false, false, publishing))
+}
+
+// settle acks the original delivery once its copy is published, or hands it
+// back to the broker if publishing failed so it isn't lost.
+func settle(msg amqp.Delivery, publishErr error) {
+	if publishErr != nil {
+		log.Println(publishErr)
+		if err := msg.Nack(false, true); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	if err := msg.Ack(false); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,155 @@
+package event
+
+import (
+	"context"
+	"errors"
+	"shared/topology"
+	"strings"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestRetryCarriesTheQueue(t *testing.T) {
+	ch := newFakeChannel()
+	ack := &fakeAcknowledger{}
+	msg := logDelivery(t, ack, 1)
+
+	retry(ch, "logs_topic.listener", msg)
+
+	published := ch.publishings()
+	if len(published) != 1 {
+		t.Fatalf("published %d copies, want one", len(published))
+	}
+
+	headers := published[0].msg.Headers
+	if headers[retryQueueHeader] != "logs_topic.listener" {
+		t.Errorf("%s header is %v, want the queue the message failed in", retryQueueHeader, headers[retryQueueHeader])
+	}
+	if headers[retryTierHeader] != topology.TierName(topology.RetryTiers[0]) {
+		t.Errorf("%s header is %v, want %s", retryTierHeader, headers[retryTierHeader], topology.TierName(topology.RetryTiers[0]))
+	}
+}
+
+func TestListenBindsTheQueueForRetries(t *testing.T) {
+	registry := NewRegistry()
+	registry.HandleEvent("log", func(ctx context.Context, msg *Message) error { return errors.New("unavailable") })
+
+	consumer, ch := newTestConsumer(t, registry)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := listen(t, ctx, consumer, ch)
+	cancel()
+	result(t, done)
+
+	var requeue []fakeBinding
+	for _, b := range ch.bindings {
+		if b.exchange == requeueExchange {
+			requeue = append(requeue, b)
+		}
+	}
+
+	if len(requeue) != 1 {
+		t.Fatalf("queue is bound to %s %d times, want once", requeueExchange, len(requeue))
+	}
+
+	b := requeue[0]
+	if b.args["x-match"] != "all" || b.args[retryQueueHeader] != b.queue {
+		t.Errorf("binding to %s has arguments %v, want to match %s=%s", requeueExchange, b.args, retryQueueHeader, b.queue)
+	}
+}
+
+// TestRetryTopology follows a retried message through the shared topology:
+// its tier must pick one retry queue, and once it expires it must come back
+// to the queue it failed in only.
+func TestRetryTopology(t *testing.T) {
+	top, err := topology.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkRetryTopology(top); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ttl := range topology.RetryTiers {
+		name := topology.RetryQueuePrefix + topology.TierName(ttl)
+
+		var bound []topology.Binding
+		for _, b := range top.Bindings {
+			if b.Queue == name {
+				bound = append(bound, b)
+			}
+		}
+
+		if len(bound) != 1 || bound[0].Exchange != retryExchange {
+			t.Fatalf("retry queue %s has bindings %v, want one to %s", name, bound, retryExchange)
+		}
+
+		// * headers exchanges don't match on `x-` headers, such a binding takes every message
+		for key := range bound[0].Arguments {
+			if strings.HasPrefix(key, "x-") && key != "x-match" {
+				t.Errorf("retry queue %s is bound on %s, which is never matched", name, key)
+			}
+		}
+		if bound[0].Arguments[retryTierHeader] != topology.TierName(ttl) {
+			t.Errorf("retry queue %s is bound on %v, want %s=%s", name, bound[0].Arguments, retryTierHeader, topology.TierName(ttl))
+		}
+	}
+
+	for _, b := range top.Bindings {
+		if b.Exchange == requeueExchange {
+			t.Errorf("queue %s is bound to %s in the file, it would get every queue's retries", b.Queue, requeueExchange)
+		}
+	}
+
+	for _, e := range top.Exchanges {
+		if e.Name == requeueExchange && e.Type != amqp.ExchangeHeaders {
+			t.Errorf("exchange %s is a %s exchange, want headers", e.Name, e.Type)
+		}
+	}
+}
+
+// TestReplayGoesBackToTheQueue parks a message that ran out of attempts and
+// replays it: it must go to the queue it failed in only, with its attempts
+// forgotten.
+func TestReplayGoesBackToTheQueue(t *testing.T) {
+	ch := newFakeChannel()
+	msg := logDelivery(t, &fakeAcknowledger{}, 1)
+	msg.Headers = amqp.Table{
+		"x-death":       []any{amqp.Table{"queue": topology.RetryQueuePrefix + "5m", "count": int64(len(topology.RetryTiers))}},
+		retryTierHeader: "5m",
+		"trace-id":      "abc",
+	}
+
+	retry(ch, "logs_topic.audit", msg)
+
+	published := ch.publishings()
+	if len(published) != 1 || published[0].key != parkingLotQueue {
+		t.Fatalf("published %v, want one copy in the parking lot", published)
+	}
+
+	parked := amqp.Delivery{Headers: published[0].msg.Headers, Body: published[0].msg.Body}
+	exchange, key, replay := replayPublishing(parked)
+
+	if exchange != requeueExchange || key != "" {
+		t.Errorf("replayed to exchange %q with key %q, want %s", exchange, key, requeueExchange)
+	}
+	if replay.Headers[retryQueueHeader] != "logs_topic.audit" {
+		t.Errorf("%s header is %v, want the queue the message failed in", retryQueueHeader, replay.Headers[retryQueueHeader])
+	}
+	for _, header := range []string{"x-death", retryTierHeader, routingKeyHeader} {
+		if _, ok := replay.Headers[header]; ok {
+			t.Errorf("replay keeps the %s header", header)
+		}
+	}
+	if replay.Headers["trace-id"] != "abc" || topology.Attempts(replay.Headers) != 0 {
+		t.Errorf("replay has headers %v, want the others kept and no attempts", replay.Headers)
+	}
+
+	// * parked before the queue was recorded
+	delete(parked.Headers, retryQueueHeader)
+	if exchange, key, _ := replayPublishing(parked); exchange != topology.EventsExchange || key != msg.RoutingKey {
+		t.Errorf("replayed a message without a queue to %q with key %q, want %s with %q", exchange, key, topology.EventsExchange, msg.RoutingKey)
+	}
+}
@@ -0,0 +1,228 @@
+package event
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"listener/logs"
+	"log"
+	"net/http"
+	"shared/envelope"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	DefaultBatchSize   = DefaultWorkers // * one entry per worker, see GRPCLogWriter
+	DefaultBatchWindow = 200 * time.Millisecond
+)
+
+var errWriterClosed = errors.New("log writer is closed")
+
+// LogWriter stores a log entry in the logger service. Write returns only once
+// the entry is stored, so the caller can ack the message afterwards.
+type LogWriter interface {
+	Write(ctx context.Context, payload *envelope.LogData) error
+	Close() error
+}
+
+// HTTPLogWriter posts every entry on its own to the logger's `/log` endpoint.
+type HTTPLogWriter struct {
+	url    string
+	client *http.Client
+}
+
+func NewHTTPLogWriter(url string) *HTTPLogWriter {
+	return &HTTPLogWriter{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (w *HTTPLogWriter) Write(ctx context.Context, payload *envelope.LogData) error {
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return Permanent(err)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Content-Type", "Application/json")
+
+	response, err := w.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		err = fmt.Errorf("logger-service responded with %s", response.Status)
+
+		// the logger rejected the payload itself, sending it again won't help
+		if response.StatusCode >= 400 && response.StatusCode < 500 {
+			return Permanent(err)
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (w *HTTPLogWriter) Close() error {
+	w.client.CloseIdleConnections()
+	return nil
+}
+
+type pendingEntry struct {
+	entry *logs.Log
+	done  chan error
+}
+
+// GRPCLogWriter groups entries into batches and writes each batch with one
+// `WriteLogs` call over a persistent connection. A batch is flushed when it
+// reaches size entries or when window has passed since its first entry, and
+// every Write in it returns the outcome of the whole batch.
+//
+// Write blocks until the batch is written, so a batch only fills up with as
+// many concurrent writers. A size above the number of consumer workers is
+// never reached and every batch waits out the whole window. ctx only bounds
+// the wait for a place in a batch.
+type GRPCLogWriter struct {
+	conn    *grpc.ClientConn
+	client  logs.LogServiceClient
+	size    int
+	window  time.Duration
+	entries chan pendingEntry
+	quit    chan struct{}
+	wg      sync.WaitGroup
+	once    sync.Once
+}
+
+func NewGRPCLogWriter(addr string, size int, window time.Duration) (*GRPCLogWriter, error) {
+	if size <= 0 {
+		size = DefaultBatchSize
+	}
+
+	if window <= 0 {
+		window = DefaultBatchWindow
+	}
+
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+
+	w := &GRPCLogWriter{
+		conn:    conn,
+		client:  logs.NewLogServiceClient(conn),
+		size:    size,
+		window:  window,
+		entries: make(chan pendingEntry),
+		quit:    make(chan struct{}),
+	}
+
+	w.wg.Add(1)
+	go w.run()
+
+	return w, nil
+}
+
+func (w *GRPCLogWriter) Write(ctx context.Context, payload *envelope.LogData) error {
+	pending := pendingEntry{
+		entry: &logs.Log{Name: payload.Name, Data: payload.Data},
+		done:  make(chan error, 1),
+	}
+
+	select {
+	case w.entries <- pending:
+	case <-w.quit:
+		return errWriterClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	// * once queued the entry is written either way, so wait for the outcome
+	// instead of reporting ctx's error and having the message retried. The
+	// flush gives up after its own timeout.
+	return <-pending.done
+}
+
+// Close flushes the current batch and closes the connection.
+func (w *GRPCLogWriter) Close() error {
+	w.once.Do(func() { close(w.quit) })
+	w.wg.Wait()
+
+	return w.conn.Close()
+}
+
+func (w *GRPCLogWriter) run() {
+	defer w.wg.Done()
+
+	batch := make([]pendingEntry, 0, w.size)
+	timer := time.NewTimer(w.window)
+	timer.Stop()
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		timer.Stop()
+		w.flush(batch)
+		batch = make([]pendingEntry, 0, w.size)
+	}
+
+	for {
+		select {
+		case pending := <-w.entries:
+			if len(batch) == 0 {
+				timer.Reset(w.window)
+			}
+
+			batch = append(batch, pending)
+			if len(batch) >= w.size {
+				flush()
+			}
+
+		case <-timer.C:
+			flush()
+
+		case <-w.quit:
+			flush()
+			return
+		}
+	}
+}
+
+func (w *GRPCLogWriter) flush(batch []pendingEntry) {
+	entries := make([]*logs.Log, 0, len(batch))
+	for _, pending := range batch {
+		entries = append(entries, pending.entry)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := w.client.WriteLogs(ctx, &logs.LogBatchRequest{LogEntries: entries})
+	if err != nil {
+		log.Printf("Writing batch of %d logs failed: %v\r\n", len(batch), err)
+
+		if status.Code(err) == codes.InvalidArgument {
+			err = Permanent(err)
+		}
+	}
+
+	for _, pending := range batch {
+		pending.done <- err
+	}
+}
@@ -0,0 +1,76 @@
+package event
+
+import (
+	"context"
+	"listener/logs"
+	"shared/envelope"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// fakeLogClient holds every WriteLogs call until release is closed.
+type fakeLogClient struct {
+	logs.LogServiceClient
+	calls   chan *logs.LogBatchRequest
+	release chan struct{}
+}
+
+func (c *fakeLogClient) WriteLogs(ctx context.Context, in *logs.LogBatchRequest, opts ...grpc.CallOption) (*logs.LogBatchResponse, error) {
+	c.calls <- in
+	<-c.release
+	return &logs.LogBatchResponse{}, nil
+}
+
+func TestGRPCWriteWaitsForAQueuedEntry(t *testing.T) {
+	client := &fakeLogClient{
+		calls:   make(chan *logs.LogBatchRequest, 1),
+		release: make(chan struct{}),
+	}
+
+	w := &GRPCLogWriter{
+		client:  client,
+		size:    1,
+		window:  time.Second,
+		entries: make(chan pendingEntry),
+		quit:    make(chan struct{}),
+	}
+	w.wg.Add(1)
+	go w.run()
+	defer func() {
+		close(w.quit)
+		w.wg.Wait()
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- w.Write(ctx, &envelope.LogData{Name: "event", Data: "hello"})
+	}()
+
+	// * the batch is being written when the handler's context ends
+	<-client.calls
+	cancel()
+
+	select {
+	case err := <-done:
+		t.Fatalf("Write returned %v before the batch was written", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(client.release)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Write returned %v, want the batch's outcome", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Write didn't return after the batch was written")
+	}
+
+	if len(client.calls) != 0 {
+		t.Error("the entry was written more than once")
+	}
+}
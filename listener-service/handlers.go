@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+type bindingPayload struct {
+	Topic string `json:"topic"`
+}
+
+func (app *Config) Status(w http.ResponseWriter, r *http.Request) {
+	payload := jsonResponse{
+		Error:   false,
+		Message: "listener status",
+		Data:    app.Consumer.Status(),
+	}
+
+	app.writeJson(w, http.StatusOK, payload)
+}
+
+func (app *Config) Bindings(w http.ResponseWriter, r *http.Request) {
+	status := app.Consumer.Status()
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("bindings of %s", status.Queue),
+		Data:    status.Bindings,
+	}
+
+	app.writeJson(w, http.StatusOK, payload)
+}
+
+func (app *Config) AddBinding(w http.ResponseWriter, r *http.Request) {
+	var requestPayload bindingPayload
+
+	err := app.readJson(w, r, &requestPayload)
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	if requestPayload.Topic == "" {
+		app.errorJson(w, errors.New("topic is required"))
+		return
+	}
+
+	err = app.Consumer.Bind(requestPayload.Topic)
+	if err != nil {
+		app.errorJson(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("bound %s", requestPayload.Topic),
+		Data:    app.Consumer.Status().Bindings,
+	}
+
+	app.writeJson(w, http.StatusCreated, payload)
+}
+
+func (app *Config) RemoveBinding(w http.ResponseWriter, r *http.Request) {
+	var requestPayload bindingPayload
+
+	err := app.readJson(w, r, &requestPayload)
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	if requestPayload.Topic == "" {
+		app.errorJson(w, errors.New("topic is required"))
+		return
+	}
+
+	err = app.Consumer.Unbind(requestPayload.Topic)
+	if err != nil {
+		app.errorJson(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("unbound %s", requestPayload.Topic),
+		Data:    app.Consumer.Status().Bindings,
+	}
+
+	app.writeJson(w, http.StatusOK, payload)
+}
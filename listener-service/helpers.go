@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+)
+
+type jsonResponse struct {
+	Error   bool   `json:"error"`
+	Message string `json:"message" `
+	Data    any    `json:"data,omitempty"`
+}
+
+// data should be a variable pointed to
+func (app *Config) readJson(w http.ResponseWriter, r *http.Request, data any) error {
+	maxBytes := 1048576 // 1 MB
+
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(data); err != nil {
+		return err
+	}
+
+	if err := dec.Decode(&struct{}{}); err != io.EOF {
+		return errors.New("body must have only a single JSON value")
+	}
+
+	return nil
+}
+
+// NOTE: Using variadic parameters to make the `header` parameter optional
+func (app *Config) writeJson(w http.ResponseWriter, status int, data any, headers ...http.Header) error {
+	out, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	if len(headers) > 0 {
+		for key, value := range headers[0] {
+			w.Header()[key] = value
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(out)
+
+	return err
+}
+
+func (app *Config) errorJson(w http.ResponseWriter, err error, status ...int) error {
+	statusCode := http.StatusBadRequest
+
+	if len(status) > 0 {
+		statusCode = status[0]
+	}
+
+	// var payload jsonResponse
+	// payload.Error = true
+	// payload.Message = err.Error()
+
+	payload := jsonResponse{
+		Error:   true,
+		Message: err.Error(),
+	}
+
+	return app.writeJson(w, statusCode, payload)
+}
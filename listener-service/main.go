@@ -1,14 +1,24 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"listener/event"
 	"log"
 	"math"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // NOTE: Install third party libraries
@@ -16,6 +26,13 @@ import (
 	go get github.com/rabbitmq/amqp091-go
 */
 
+const webPort = "80"
+
+type Config struct {
+	Consumer   *event.Consumer
+	AdminToken string
+}
+
 func main() {
 	// try to connect to rabbitmq
 	rabbitConn, err := connectToRabbitMQ()
@@ -24,20 +41,177 @@ func main() {
 	}
 	defer rabbitConn.Close()
 
+	// run an admin command instead of the listener, if one was given
+	if len(os.Args) > 1 {
+		if err := runAdmin(rabbitConn, os.Args[1:]); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
 	// start listening for messages
 	log.Println("Listening for and consuming RabbitMQ messages...")
 
+	config := consumerConfig()
+
+	// connect to the logger service
+	writer, err := logWriter(config.Workers)
+	if err != nil {
+		log.Panicln(err)
+	}
+	defer writer.Close()
+
+	// remember processed messages, so redeliveries aren't logged twice
+	store, err := processedStore()
+	if err != nil {
+		log.Panicln(err)
+	}
+
 	// create consumer
-	consumer, err := event.NewConsumer(rabbitConn)
+	consumer, err := event.NewConsumer(rabbitConn, config, handlers(writer, store))
 	if err != nil {
 		log.Panicln(err)
 	}
 
+	// stop consuming on SIGINT or SIGTERM, letting in-flight handlers finish
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	app := Config{
+		Consumer:   consumer,
+		AdminToken: os.Getenv("ADMIN_API_TOKEN"),
+	}
+
+	// serve the admin API next to the consumer
+	srv := app.serveHttp()
+	defer srv.Shutdown(context.Background())
+
 	// watch the queue and consume events
-	err = consumer.Listen([]string{"log.INFO", "log.WARNING", "log.ERROR"})
-	if err != nil {
+	err = consumer.Listen(ctx, topics())
+	if err != nil && !errors.Is(err, context.Canceled) {
 		log.Fatalln(err)
 	}
+
+	log.Println("Listener stopped")
+}
+
+func (app *Config) serveHttp() *http.Server {
+	log.Println("Starting admin API on port", webPort)
+
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%s", webPort),
+		Handler: app.routes(),
+	}
+
+	go func() {
+		err := srv.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Panic(err)
+		}
+	}()
+
+	return srv
+}
+
+// topics are the initial bindings, more can be added through the admin API
+func topics() []string {
+	if t := os.Getenv("LISTENER_TOPICS"); t != "" {
+		return strings.Split(t, ",")
+	}
+
+	return []string{"log.INFO", "log.WARNING", "log.ERROR", "user.login.*", "user.locked", "user.unlocked"}
+}
+
+func handlers(writer event.LogWriter, store event.ProcessedStore) *event.Registry {
+	registry := event.NewRegistry()
+	registry.Use(event.Recovery, event.Logging, event.Idempotent(store), event.Timeout(10*time.Second))
+
+	registry.HandleEvent("log", event.LogEvent(writer))
+	registry.HandleEvent("event", event.LogEvent(writer))
+	registry.HandleEvent("auth", event.AuthEvent(writer))
+	registry.HandleEvent("user.login.succeeded", event.LoginEvent(writer))
+	registry.HandleEvent("user.login.failed", event.LoginEvent(writer))
+	registry.HandleEvent("user.login.blocked", event.LoginEvent(writer))
+	registry.HandleEvent("user.locked", event.LockoutEvent(writer))
+	registry.HandleEvent("user.unlocked", event.LockoutEvent(writer))
+
+	return registry
+}
+
+// logWriter uses batched gRPC by default, set LOG_TRANSPORT=http to post
+// every entry to the logger's HTTP endpoint instead.
+//
+// Every worker waits for its entry to be written before taking the next
+// message, so a batch never holds more entries than there are workers. The
+// batch size defaults to the number of workers and can't be more.
+func logWriter(workers int) (event.LogWriter, error) {
+	if os.Getenv("LOG_TRANSPORT") == "http" {
+		log.Println("Writing logs over HTTP")
+		return event.NewHTTPLogWriter("http://logger-service/log"), nil
+	}
+
+	size, _ := strconv.Atoi(os.Getenv("LOG_BATCH_SIZE"))
+	if size <= 0 {
+		size = workers
+	}
+	if size > workers {
+		return nil, fmt.Errorf("LOG_BATCH_SIZE is %d, but a batch can't hold more entries than the %d workers write at once", size, workers)
+	}
+
+	window, _ := time.ParseDuration(os.Getenv("LOG_BATCH_WINDOW"))
+
+	log.Println("Writing logs over gRPC")
+	return event.NewGRPCLogWriter("logger-service:50001", size, window)
+}
+
+// processedStore keeps processed message IDs in memory by default, set
+// DEDUP_STORE=mongo to share them between replicas.
+func processedStore() (event.ProcessedStore, error) {
+	window, _ := time.ParseDuration(os.Getenv("DEDUP_WINDOW"))
+
+	if os.Getenv("DEDUP_STORE") != "mongo" {
+		size, _ := strconv.Atoi(os.Getenv("DEDUP_SIZE"))
+		return event.NewMemoryProcessedStore(window, size), nil
+	}
+
+	clientOptions := options.Client().ApplyURI("mongodb://mongo:27017")
+	// ! This should be implemented using environment variables
+	clientOptions.SetAuth(options.Credential{
+		Username: "root",
+		Password: "123456",
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, clientOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	return event.NewMongoProcessedStore(ctx, client, window)
+}
+
+func consumerConfig() event.ConsumerConfig {
+	prefetch, _ := strconv.Atoi(os.Getenv("LISTENER_PREFETCH"))
+	workers, _ := strconv.Atoi(os.Getenv("LISTENER_WORKERS"))
+	if workers <= 0 {
+		workers = event.DefaultWorkers
+	}
+
+	config := event.ConsumerConfig{
+		Prefetch: prefetch,
+		Workers:  workers,
+		Group:    os.Getenv("LISTENER_GROUP"),
+		Mode:     event.WorkQueue,
+	}
+
+	// * broadcast consumers get their own copy of every event
+	if os.Getenv("LISTENER_MODE") == "broadcast" {
+		config.Mode = event.Broadcast
+	}
+
+	return config
 }
 
 func connectToRabbitMQ() (*amqp.Connection, error) {
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// NOTE: Admin API
+/*
+	Every route but `/ping` needs ADMIN_API_TOKEN as bearer token, and without
+	it set the admin API is off:
+
+	curl -H "Authorization: Bearer $ADMIN_API_TOKEN" http://listener-service/status
+
+	It's meant for operators and scripts, not browsers, so there is no CORS.
+*/
+
+var (
+	errAdminDisabled = errors.New("admin API is disabled, set ADMIN_API_TOKEN to enable it")
+	errAdminToken    = errors.New("invalid admin token")
+)
+
+func (app *Config) routes() http.Handler {
+	mux := chi.NewRouter()
+
+	mux.Use(middleware.Heartbeat("/ping"))
+
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.requireAdminToken)
+
+		mux.Get("/status", app.Status)
+
+		mux.Get("/bindings", app.Bindings)
+		mux.Post("/bindings", app.AddBinding)
+		mux.Delete("/bindings", app.RemoveBinding)
+	})
+
+	return mux
+}
+
+// requireAdminToken lets through requests with ADMIN_API_TOKEN as bearer token.
+func (app *Config) requireAdminToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.AdminToken == "" {
+			app.errorJson(w, errAdminDisabled, http.StatusForbidden)
+			return
+		}
+
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(app.AdminToken)) != 1 {
+			app.errorJson(w, errAdminToken, http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
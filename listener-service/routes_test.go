@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireAdminToken(t *testing.T) {
+	tests := []struct {
+		name       string
+		adminToken string
+		header     string
+		status     int
+	}{
+		{"disabled without a token", "", "Bearer ", http.StatusForbidden},
+		{"no token", "secret", "", http.StatusUnauthorized},
+		{"wrong token", "secret", "Bearer guess", http.StatusUnauthorized},
+		{"right token", "secret", "Bearer secret", http.StatusOK},
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := Config{AdminToken: tt.adminToken}
+
+			r := httptest.NewRequest(http.MethodPost, "/bindings", nil)
+			r.Header.Set("Authorization", tt.header)
+
+			w := httptest.NewRecorder()
+			app.requireAdminToken(ok).ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("answered %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestAdminRoutesHaveNoCORS(t *testing.T) {
+	app := Config{AdminToken: "secret"}
+
+	r := httptest.NewRequest(http.MethodOptions, "/bindings", nil)
+	r.Header.Set("Origin", "https://example.com")
+	r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+
+	w := httptest.NewRecorder()
+	app.routes().ServeHTTP(w, r)
+
+	if origin := w.Header().Get("Access-Control-Allow-Origin"); origin != "" {
+		t.Errorf("preflight allowed origin %q, want none", origin)
+	}
+}
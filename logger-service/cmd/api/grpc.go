@@ -42,6 +42,28 @@ func (l *LogServer) WriteLog(ctx context.Context, req *logs.LogRequest) (*logs.L
 	return res, nil
 }
 
+func (l *LogServer) WriteLogs(ctx context.Context, req *logs.LogBatchRequest) (*logs.LogBatchResponse, error) {
+	input := req.GetLogEntries()
+
+	entries := make([]data.LogEntry, 0, len(input))
+	for _, entry := range input {
+		entries = append(entries, data.LogEntry{
+			Name: entry.GetName(),
+			Data: entry.GetData(),
+		})
+	}
+
+	// a failed batch is retried as a whole by the caller
+	err := l.Models.LogEntry.InsertMany(entries)
+	if err != nil {
+		res := &logs.LogBatchResponse{Result: "failed"}
+		return res, err
+	}
+
+	res := &logs.LogBatchResponse{Result: "logged", Written: int32(len(entries))}
+	return res, nil
+}
+
 func (app *Config) gRPCListen() {
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%s", grpcPort))
 	if err != nil {
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestReplayIDIsStable(t *testing.T) {
+	id := primitive.NewObjectID()
+
+	if replayID(id) != replayID(id) {
+		t.Error("replaying the same entry twice gives different envelope IDs")
+	}
+
+	if replayID(id) == replayID(primitive.NewObjectID()) {
+		t.Error("two entries get the same envelope ID")
+	}
+}
+
+func TestCheckpointFollowsTheFlags(t *testing.T) {
+	parse := func(args ...string) string {
+		t.Helper()
+
+		opts, err := parseFlags(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return opts.checkpoint
+	}
+
+	base := parse("-from", "2025-04-01", "-name", "event")
+
+	if parse("-name", "event", "-from", "2025-04-01", "-rate", "5", "-dry-run") != base {
+		t.Error("flags that don't pick entries changed the checkpoint")
+	}
+
+	for _, args := range [][]string{
+		{"-from", "2025-04-02", "-name", "event"},
+		{"-from", "2025-04-01", "-name", "auth"},
+		{"-from", "2025-04-01", "-name", "event", "-match", "^user"},
+		{"-from", "2025-04-01", "-name", "event", "-key", "log.INFO"},
+	} {
+		if parse(args...) == base {
+			t.Errorf("%v resumes the checkpoint of another replay", args)
+		}
+	}
+
+	if got := parse("-checkpoint", "mine.checkpoint"); got != "mine.checkpoint" {
+		t.Errorf("-checkpoint was ignored, got %s", got)
+	}
+}
@@ -50,6 +50,33 @@ func (l *LogEntry) Insert(entry LogEntry) error {
 	return nil
 }
 
+// InsertMany writes a batch of entries with a single round trip to mongo
+func (l *LogEntry) InsertMany(entries []LogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	collection := client.Database("logs").Collection("logs")
+
+	docs := make([]any, 0, len(entries))
+	for _, entry := range entries {
+		docs = append(docs, LogEntry{
+			Name:      entry.Name,
+			Data:      entry.Data,
+			CreatedAt: time.Now(),
+			UpdatedAt: time.Now(),
+		})
+	}
+
+	_, err := collection.InsertMany(context.TODO(), docs)
+	if err != nil {
+		log.Println("Error inserting batch into logs", err)
+		return err
+	}
+
+	return nil
+}
+
 func (l *LogEntry) All() ([]*LogEntry, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 	defer cancel()
@@ -139,3 +166,66 @@ func (l *LogEntry) Update() (*mongo.UpdateResult, error) {
 
 	return result, nil
 }
+
+// ReplayFilter selects the entries to replay. Zero values don't filter.
+type ReplayFilter struct {
+	From  time.Time // * created at or after
+	To    time.Time // * created before
+	Name  string
+	Match string // * regular expression on data
+	After primitive.ObjectID
+}
+
+// Replay calls fn for every entry matching the filter in `_id` order, which
+// is also insertion order, so the ID of the last entry handled is enough to
+// resume from. It stops at the first error fn returns.
+func (l *LogEntry) Replay(ctx context.Context, filter ReplayFilter, fn func(entry LogEntry) error) error {
+	collection := client.Database("logs").Collection("logs")
+
+	query := bson.M{}
+
+	createdAt := bson.M{}
+	if !filter.From.IsZero() {
+		createdAt["$gte"] = filter.From
+	}
+	if !filter.To.IsZero() {
+		createdAt["$lt"] = filter.To
+	}
+	if len(createdAt) > 0 {
+		query["created_at"] = createdAt
+	}
+
+	if filter.Name != "" {
+		query["name"] = filter.Name
+	}
+
+	if filter.Match != "" {
+		query["data"] = primitive.Regex{Pattern: filter.Match}
+	}
+
+	if !filter.After.IsZero() {
+		query["_id"] = bson.M{"$gt": filter.After}
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+
+	cursor, err := collection.Find(ctx, query, opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var entry LogEntry
+
+		if err := cursor.Decode(&entry); err != nil {
+			return err
+		}
+
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+
+	return cursor.Err()
+}
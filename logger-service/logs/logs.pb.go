@@ -161,6 +161,102 @@ func (x *LogResponse) GetResult() string {
 	return ""
 }
 
+type LogBatchRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	LogEntries    []*Log                 `protobuf:"bytes,1,rep,name=logEntries,proto3" json:"logEntries,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LogBatchRequest) Reset() {
+	*x = LogBatchRequest{}
+	mi := &file_logs_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LogBatchRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LogBatchRequest) ProtoMessage() {}
+
+func (x *LogBatchRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_logs_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LogBatchRequest.ProtoReflect.Descriptor instead.
+func (*LogBatchRequest) Descriptor() ([]byte, []int) {
+	return file_logs_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *LogBatchRequest) GetLogEntries() []*Log {
+	if x != nil {
+		return x.LogEntries
+	}
+	return nil
+}
+
+type LogBatchResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Result        string                 `protobuf:"bytes,1,opt,name=result,proto3" json:"result,omitempty"`
+	Written       int32                  `protobuf:"varint,2,opt,name=written,proto3" json:"written,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LogBatchResponse) Reset() {
+	*x = LogBatchResponse{}
+	mi := &file_logs_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LogBatchResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LogBatchResponse) ProtoMessage() {}
+
+func (x *LogBatchResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_logs_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LogBatchResponse.ProtoReflect.Descriptor instead.
+func (*LogBatchResponse) Descriptor() ([]byte, []int) {
+	return file_logs_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *LogBatchResponse) GetResult() string {
+	if x != nil {
+		return x.Result
+	}
+	return ""
+}
+
+func (x *LogBatchResponse) GetWritten() int32 {
+	if x != nil {
+		return x.Written
+	}
+	return 0
+}
+
 var File_logs_proto protoreflect.FileDescriptor
 
 const file_logs_proto_rawDesc = "" +
@@ -174,10 +270,18 @@ const file_logs_proto_rawDesc = "" +
 	"LogRequest\x12%\n" +
 	"\blogEntry\x18\x01 \x01(\v2\t.logs.LogR\blogEntry\"%\n" +
 	"\vLogResponse\x12\x16\n" +
-	"\x06result\x18\x01 \x01(\tR\x06result2=\n" +
+	"\x06result\x18\x01 \x01(\tR\x06result\"<\n" +
+	"\x0fLogBatchRequest\x12)\n" +
+	"\n" +
+	"logEntries\x18\x01 \x03(\v2\t.logs.LogR\n" +
+	"logEntries\"D\n" +
+	"\x10LogBatchResponse\x12\x16\n" +
+	"\x06result\x18\x01 \x01(\tR\x06result\x12\x18\n" +
+	"\awritten\x18\x02 \x01(\x05R\awritten2y\n" +
 	"\n" +
 	"LogService\x12/\n" +
-	"\bWriteLog\x12\x10.logs.LogRequest\x1a\x11.logs.LogResponseB\bZ\x06/logs/b\x06proto3"
+	"\bWriteLog\x12\x10.logs.LogRequest\x1a\x11.logs.LogResponse\x12:\n" +
+	"\tWriteLogs\x12\x15.logs.LogBatchRequest\x1a\x16.logs.LogBatchResponseB\bZ\x06/logs/b\x06proto3"
 
 var (
 	file_logs_proto_rawDescOnce sync.Once
@@ -191,21 +295,26 @@ func file_logs_proto_rawDescGZIP() []byte {
 	return file_logs_proto_rawDescData
 }
 
-var file_logs_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
+var file_logs_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
 var file_logs_proto_goTypes = []any{
-	(*Log)(nil),         // 0: logs.Log
-	(*LogRequest)(nil),  // 1: logs.LogRequest
-	(*LogResponse)(nil), // 2: logs.LogResponse
+	(*Log)(nil),              // 0: logs.Log
+	(*LogRequest)(nil),       // 1: logs.LogRequest
+	(*LogResponse)(nil),      // 2: logs.LogResponse
+	(*LogBatchRequest)(nil),  // 3: logs.LogBatchRequest
+	(*LogBatchResponse)(nil), // 4: logs.LogBatchResponse
 }
 var file_logs_proto_depIdxs = []int32{
 	0, // 0: logs.LogRequest.logEntry:type_name -> logs.Log
-	1, // 1: logs.LogService.WriteLog:input_type -> logs.LogRequest
-	2, // 2: logs.LogService.WriteLog:output_type -> logs.LogResponse
-	2, // [2:3] is the sub-list for method output_type
-	1, // [1:2] is the sub-list for method input_type
-	1, // [1:1] is the sub-list for extension type_name
-	1, // [1:1] is the sub-list for extension extendee
-	0, // [0:1] is the sub-list for field type_name
+	0, // 1: logs.LogBatchRequest.logEntries:type_name -> logs.Log
+	1, // 2: logs.LogService.WriteLog:input_type -> logs.LogRequest
+	3, // 3: logs.LogService.WriteLogs:input_type -> logs.LogBatchRequest
+	2, // 4: logs.LogService.WriteLog:output_type -> logs.LogResponse
+	4, // 5: logs.LogService.WriteLogs:output_type -> logs.LogBatchResponse
+	4, // [4:6] is the sub-list for method output_type
+	2, // [2:4] is the sub-list for method input_type
+	2, // [2:2] is the sub-list for extension type_name
+	2, // [2:2] is the sub-list for extension extendee
+	0, // [0:2] is the sub-list for field type_name
 }
 
 func init() { file_logs_proto_init() }
@@ -219,7 +328,7 @@ func file_logs_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_logs_proto_rawDesc), len(file_logs_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   3,
+			NumMessages:   5,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
@@ -19,7 +19,8 @@ import (
 const _ = grpc.SupportPackageIsVersion9
 
 const (
-	LogService_WriteLog_FullMethodName = "/logs.LogService/WriteLog"
+	LogService_WriteLog_FullMethodName  = "/logs.LogService/WriteLog"
+	LogService_WriteLogs_FullMethodName = "/logs.LogService/WriteLogs"
 )
 
 // LogServiceClient is the client API for LogService service.
@@ -27,6 +28,7 @@ const (
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type LogServiceClient interface {
 	WriteLog(ctx context.Context, in *LogRequest, opts ...grpc.CallOption) (*LogResponse, error)
+	WriteLogs(ctx context.Context, in *LogBatchRequest, opts ...grpc.CallOption) (*LogBatchResponse, error)
 }
 
 type logServiceClient struct {
@@ -47,11 +49,22 @@ func (c *logServiceClient) WriteLog(ctx context.Context, in *LogRequest, opts ..
 	return out, nil
 }
 
+func (c *logServiceClient) WriteLogs(ctx context.Context, in *LogBatchRequest, opts ...grpc.CallOption) (*LogBatchResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(LogBatchResponse)
+	err := c.cc.Invoke(ctx, LogService_WriteLogs_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // LogServiceServer is the server API for LogService service.
 // All implementations must embed UnimplementedLogServiceServer
 // for forward compatibility.
 type LogServiceServer interface {
 	WriteLog(context.Context, *LogRequest) (*LogResponse, error)
+	WriteLogs(context.Context, *LogBatchRequest) (*LogBatchResponse, error)
 	mustEmbedUnimplementedLogServiceServer()
 }
 
@@ -65,6 +78,9 @@ type UnimplementedLogServiceServer struct{}
 func (UnimplementedLogServiceServer) WriteLog(context.Context, *LogRequest) (*LogResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method WriteLog not implemented")
 }
+func (UnimplementedLogServiceServer) WriteLogs(context.Context, *LogBatchRequest) (*LogBatchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method WriteLogs not implemented")
+}
 func (UnimplementedLogServiceServer) mustEmbedUnimplementedLogServiceServer() {}
 func (UnimplementedLogServiceServer) testEmbeddedByValue()                    {}
 
@@ -104,6 +120,24 @@ func _LogService_WriteLog_Handler(srv interface{}, ctx context.Context, dec func
 	return interceptor(ctx, in, info, handler)
 }
 
+func _LogService_WriteLogs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LogBatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServiceServer).WriteLogs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LogService_WriteLogs_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServiceServer).WriteLogs(ctx, req.(*LogBatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // LogService_ServiceDesc is the grpc.ServiceDesc for LogService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -115,6 +149,10 @@ var LogService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "WriteLog",
 			Handler:    _LogService_WriteLog_Handler,
 		},
+		{
+			MethodName: "WriteLogs",
+			Handler:    _LogService_WriteLogs_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "logs.proto",
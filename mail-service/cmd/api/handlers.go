@@ -5,10 +5,12 @@ import (
 )
 
 type mailMessage struct {
-	From    string `json:"from"`
-	To      string `json:"to"`
-	Subject string `json:"subject"`
-	Message string `json:"message"`
+	From     string            `json:"from"`
+	To       string            `json:"to"`
+	Subject  string            `json:"subject"`
+	Message  string            `json:"message"`
+	Template string            `json:"template,omitempty"`
+	Fields   map[string]string `json:"fields,omitempty"`
 }
 
 func (app *Config) SendMail(w http.ResponseWriter, r *http.Request) {
@@ -21,10 +23,12 @@ func (app *Config) SendMail(w http.ResponseWriter, r *http.Request) {
 	}
 
 	msg := Message{
-		From:    reqPayload.From,
-		To:      reqPayload.To,
-		Subject: reqPayload.Subject,
-		Data:    reqPayload.Message,
+		From:     reqPayload.From,
+		To:       reqPayload.To,
+		Subject:  reqPayload.Subject,
+		Data:     reqPayload.Message,
+		Template: reqPayload.Template,
+		Fields:   reqPayload.Fields,
 	}
 
 	err = app.Mailer.SendSMTPMessage(&msg)
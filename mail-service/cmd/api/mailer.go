@@ -2,7 +2,11 @@ package main
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"html/template"
+	"net/textproto"
+	"regexp"
 	"time"
 
 	"github.com/vanng822/go-premailer/premailer"
@@ -26,6 +30,36 @@ type Mail struct {
 	FromName    string
 }
 
+const defaultTemplate = "mail"
+
+// templateName keeps template names from reaching outside ./templates
+var templateName = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+// permanentError is a mail that won't go out however often it's tried, like
+// one with an unknown template or an address the mail server refuses.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+func permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// isPermanent reports whether trying again is pointless: the error was
+// marked permanent, or the mail server answered with a 5xx reply.
+func isPermanent(err error) bool {
+	var p *permanentError
+	if errors.As(err, &p) {
+		return true
+	}
+
+	var reply *textproto.Error
+	return errors.As(err, &reply) && reply.Code >= 500
+}
+
 type Message struct {
 	From        string
 	FromName    string
@@ -34,6 +68,8 @@ type Message struct {
 	Attachments []string
 	Data        any
 	DataMap     map[string]any
+	Template    string            // * renders ./templates/<Template>.html|plain.gohtml
+	Fields      map[string]string // * extra template data next to `message`
 }
 
 func (m *Mail) SendSMTPMessage(msg *Message) error {
@@ -45,20 +81,51 @@ func (m *Mail) SendSMTPMessage(msg *Message) error {
 		msg.FromName = m.FromName
 	}
 
+	if msg.Template == "" {
+		msg.Template = defaultTemplate
+	}
+
+	if !templateName.MatchString(msg.Template) {
+		return permanent(fmt.Errorf("invalid template name %q", msg.Template))
+	}
+
 	data := map[string]any{
 		"message": msg.Data,
 	}
 
+	for key, value := range msg.Fields {
+		data[key] = value
+	}
+
 	msg.DataMap = data
 
 	formattedMsg, err := m.buildHTMLMessage(msg)
 	if err != nil {
-		return err
+		return permanent(err)
 	}
 
 	plainMsg, err := m.buildPlainTextMessage(msg)
 	if err != nil {
-		return err
+		return permanent(err)
+	}
+
+	email := mail.NewMSG()
+	email.SetFrom(msg.From).
+		AddTo(msg.To).
+		SetSubject(msg.Subject)
+
+	email.SetBody(mail.TextPlain, plainMsg)
+	email.AddAlternative(mail.TextHTML, formattedMsg)
+
+	if len(msg.Attachments) > 0 {
+		for _, x := range msg.Attachments {
+			email.AddAttachment(x)
+		}
+	}
+
+	// * e.g. an address that doesn't parse
+	if email.Error != nil {
+		return permanent(email.Error)
 	}
 
 	server := mail.NewSMTPClient()
@@ -76,20 +143,6 @@ func (m *Mail) SendSMTPMessage(msg *Message) error {
 		return err
 	}
 
-	email := mail.NewMSG()
-	email.SetFrom(msg.From).
-		AddTo(msg.To).
-		SetSubject(msg.Subject)
-
-	email.SetBody(mail.TextPlain, plainMsg)
-	email.AddAlternative(mail.TextHTML, formattedMsg)
-
-	if len(msg.Attachments) > 0 {
-		for _, x := range msg.Attachments {
-			email.AddAttachment(x)
-		}
-	}
-
 	err = email.Send(smtpClient)
 	if err != nil {
 		return err
@@ -99,7 +152,7 @@ func (m *Mail) SendSMTPMessage(msg *Message) error {
 }
 
 func (m *Mail) buildHTMLMessage(msg *Message) (string, error) {
-	tplToRender := "./templates/mail.html.gohtml"
+	tplToRender := fmt.Sprintf("./templates/%s.html.gohtml", msg.Template)
 
 	t, err := template.New("email-html").ParseFiles(tplToRender)
 	if err != nil {
@@ -141,7 +194,7 @@ func (m *Mail) inlineCSS(s string) (string, error) {
 }
 
 func (m *Mail) buildPlainTextMessage(msg *Message) (string, error) {
-	tplToRender := "./templates/mail.plain.gohtml"
+	tplToRender := fmt.Sprintf("./templates/%s.plain.gohtml", msg.Template)
 
 	t, err := template.New("email-plain").ParseFiles(tplToRender)
 	if err != nil {
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"shared/envelope"
+	"shared/topology"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	mailExchange = topology.EventsExchange
+	mailQueue    = "mail.send" // * durable and bound in the topology file, so mail requests wait while the service is down
+	mailPrefetch = 5
+)
+
+// listenForMail consumes `mail.send` events and sends them the same way as
+// `POST /send`. Every request is answered with a `mail.sent` or `mail.failed`
+// event carrying the request's ID, the latter right away for a mail that
+// can never be sent and after the retry tiers for one the server didn't take.
+// Retries go through the shared retry queues, see shared/topology/retry.go.
+func (app *Config) listenForMail() error {
+	ch, err := app.Rabbit.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	t, err := topology.Declare(ch)
+	if err != nil {
+		return err
+	}
+
+	q, ok := t.Queue(mailQueue)
+	if !ok {
+		return fmt.Errorf("topology has no %s queue", mailQueue)
+	}
+
+	if err := t.CheckRetryQueues(); err != nil {
+		return err
+	}
+
+	// expired retries of mail requests come back to this queue only
+	if err := topology.BindRequeue(ch, q.Name); err != nil {
+		return err
+	}
+
+	// SMTP is slow, don't take more than a few requests at a time
+	err = ch.Qos(mailPrefetch, 0, false)
+	if err != nil {
+		return err
+	}
+
+	messages, err := ch.Consume(q.Name, "", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Waiting for mail on [Exchange, Queue] [%s, %s]\r\n", mailExchange, q.Name)
+
+	for msg := range messages {
+		app.handleMailRequest(ch, msg)
+	}
+
+	return fmt.Errorf("mail queue %s closed", q.Name)
+}
+
+func (app *Config) handleMailRequest(ch *amqp.Channel, msg amqp.Delivery) {
+	env, request, err := decodeMailRequest(msg)
+	if err != nil {
+		// a malformed request will never succeed, so don't requeue it
+		log.Println("Rejecting malformed mail request:", err)
+		if err := msg.Reject(false); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	app.sendQueuedMail(ch, msg, env.ID, request)
+}
+
+func decodeMailRequest(msg amqp.Delivery) (envelope.Envelope, envelope.MailData, error) {
+	env, err := envelope.FromDelivery(msg)
+	if err != nil {
+		return env, envelope.MailData{}, err
+	}
+
+	request, err := envelope.Decode[envelope.MailData](env)
+
+	return env, request, err
+}
+
+func (app *Config) sendQueuedMail(ch *amqp.Channel, msg amqp.Delivery, requestID string, request envelope.MailData) {
+	mail := Message{
+		From:     request.From,
+		To:       request.To,
+		Subject:  request.Subject,
+		Data:     request.Message,
+		Template: request.Template,
+		Fields:   request.Fields,
+	}
+
+	result := envelope.MailResultData{
+		RequestID: requestID,
+		To:        request.To,
+		Subject:   request.Subject,
+	}
+
+	err := app.Mailer.SendSMTPMessage(&mail)
+	if err != nil && !isPermanent(err) {
+		if attempt := topology.Attempts(msg.Headers); attempt < len(topology.RetryTiers) {
+			tier := topology.TierName(topology.RetryTiers[attempt])
+			log.Printf("Sending mail failed, retrying in %s (attempt %d of %d): %v\r\n", tier, attempt+1, len(topology.RetryTiers), err)
+			retryMail(ch, msg, tier)
+			return
+		}
+	}
+
+	topic := "mail.sent"
+	if err != nil {
+		log.Println("Sending mail failed:", err)
+		topic = "mail.failed"
+		result.Error = err.Error()
+	}
+
+	if err := publishMailResult(ch, topic, result); err != nil {
+		log.Println("Publishing mail result failed:", err)
+	}
+
+	// * a failed request was answered with mail.failed, don't requeue it
+	if err != nil {
+		err = msg.Reject(false)
+	} else {
+		err = msg.Ack(false)
+	}
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// retryMail moves the request to the retry queue of tier. The delivery is
+// acked only once the copy is published, or handed back to the broker.
+func retryMail(ch *amqp.Channel, msg amqp.Delivery, tier string) {
+	headers := amqp.Table{}
+	for key, value := range msg.Headers {
+		headers[key] = value
+	}
+	headers[topology.RetryTierHeader] = tier
+	headers[topology.RetryQueueHeader] = mailQueue
+
+	err := ch.Publish(topology.RetryExchange, msg.RoutingKey, false, false, amqp.Publishing{
+		Headers:      headers,
+		ContentType:  msg.ContentType,
+		DeliveryMode: amqp.Persistent,
+		MessageId:    msg.MessageId,
+		Timestamp:    msg.Timestamp,
+		Type:         msg.Type,
+		Body:         msg.Body,
+	})
+	if err != nil {
+		log.Println("Retrying mail request failed:", err)
+		if err := msg.Nack(false, true); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	if err := msg.Ack(false); err != nil {
+		log.Println(err)
+	}
+}
+
+func publishMailResult(ch *amqp.Channel, topic string, result envelope.MailResultData) error {
+	event, err := envelope.Encode(topic, "1", "mail-service", result)
+	if err != nil {
+		return err
+	}
+
+	publishing, err := event.Publishing()
+	if err != nil {
+		return err
+	}
+
+	return ch.Publish(mailExchange, topic, false, false, publishing)
+}
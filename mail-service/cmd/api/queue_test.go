@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"testing"
+)
+
+func TestIsPermanent(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"marked permanent", permanent(errors.New("invalid template name")), true},
+		{"wrapped permanent", fmt.Errorf("sending: %w", permanent(errors.New("bad address"))), true},
+		{"mailbox unavailable", fmt.Errorf("Mail Error: %w", &textproto.Error{Code: 550, Msg: "no such user"}), true},
+		{"mailbox busy", &textproto.Error{Code: 450, Msg: "try again later"}, false},
+		{"connection refused", errors.New("Mail Error on dialing: connection refused"), false},
+	}
+
+	for _, tt := range tests {
+		if got := isPermanent(tt.err); got != tt.want {
+			t.Errorf("%s: isPermanent = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -5,6 +5,7 @@ go 1.23.0
 require (
 	github.com/go-chi/chi/v5 v5.2.1
 	github.com/go-chi/cors v1.2.1
+	github.com/rabbitmq/amqp091-go v1.10.0
 	github.com/vanng822/go-premailer v1.24.0
 	github.com/xhit/go-simple-mail/v2 v2.16.0
 )
@@ -18,3 +19,7 @@ require (
 	github.com/vanng822/css v1.0.1 // indirect
 	golang.org/x/net v0.37.0 // indirect
 )
+
+require shared v0.0.0
+
+replace shared => ../shared
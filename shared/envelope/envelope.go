@@ -0,0 +1,160 @@
+package envelope
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// NOTE: Envelope format
+/*
+	Events are sent as CloudEvents 1.0 in structured JSON mode, with `version`
+	as an extension attribute for the schema version of `data`.
+
+	{
+		"specversion": "1.0",
+		"id": "1b4e28ba-2fa1-4d3b-a3f5-ef19b5a7633b",
+		"type": "log",
+		"version": "1",
+		"source": "broker-service",
+		"time": "2025-04-30T10:00:00Z",
+		"datacontenttype": "application/json",
+		"data": {"name": "event", "data": "hello"}
+	}
+*/
+
+const (
+	SpecVersion = "1.0"
+	ContentType = "application/cloudevents+json"
+
+	// LegacyVersion is the schema version given to bare payloads published
+	// before envelopes existed.
+	LegacyVersion = "0"
+)
+
+var ErrMissingType = errors.New("envelope has no type")
+
+type Envelope struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Type            string          `json:"type"`
+	Version         string          `json:"version"`
+	Source          string          `json:"source"`
+	Time            time.Time       `json:"time"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+}
+
+// Encode wraps data in a new envelope with a fresh ID and the current time.
+func Encode[T any](eventType, version, source string, data T) (Envelope, error) {
+	if eventType == "" {
+		return Envelope{}, ErrMissingType
+	}
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	return Envelope{
+		SpecVersion:     SpecVersion,
+		ID:              NewID(),
+		Type:            eventType,
+		Version:         version,
+		Source:          source,
+		Time:            time.Now().UTC(),
+		DataContentType: "application/json",
+		Data:            raw,
+	}, nil
+}
+
+// Decode unmarshals the envelope's data into T.
+func Decode[T any](e Envelope) (T, error) {
+	var data T
+
+	if len(e.Data) == 0 {
+		return data, fmt.Errorf("%s event %s has no data", e.Type, e.ID)
+	}
+
+	if err := json.Unmarshal(e.Data, &data); err != nil {
+		return data, fmt.Errorf("decoding %s event %s: %w", e.Type, e.ID, err)
+	}
+
+	return data, nil
+}
+
+// Legacy reports whether the envelope was built around a bare payload.
+func (e Envelope) Legacy() bool {
+	return e.SpecVersion == ""
+}
+
+// Publishing turns the envelope into an AMQP message, mirroring its metadata
+// in the `MessageId`, `Timestamp`, `Type` and `AppId` properties.
+func (e Envelope) Publishing() (amqp.Publishing, error) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return amqp.Publishing{}, err
+	}
+
+	return amqp.Publishing{
+		ContentType:  ContentType,
+		DeliveryMode: amqp.Persistent,
+		MessageId:    e.ID,
+		Timestamp:    e.Time,
+		Type:         e.Type,
+		AppId:        e.Source,
+		Body:         body,
+	}, nil
+}
+
+// FromDelivery reads the envelope of an AMQP message. Bodies without a
+// `specversion` are bare payloads from older publishers: they become the data
+// of a legacy envelope filled in from the message properties, with whatever
+// is missing (like the type) left for the caller to decide.
+func FromDelivery(d amqp.Delivery) (Envelope, error) {
+	body := bytes.TrimSpace(d.Body)
+	if !json.Valid(body) {
+		return Envelope{}, errors.New("message body is not valid JSON")
+	}
+
+	var e Envelope
+	if err := json.Unmarshal(body, &e); err != nil || e.SpecVersion == "" {
+		e = Envelope{
+			Type:    d.Type,
+			Version: LegacyVersion,
+			Source:  d.AppId,
+			Time:    d.Timestamp,
+			Data:    json.RawMessage(body),
+		}
+	}
+
+	if e.ID == "" {
+		e.ID = d.MessageId
+	}
+
+	if e.ID == "" {
+		e.ID = NewID()
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	return e, nil
+}
+
+// NewID returns a random (version 4) UUID.
+func NewID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
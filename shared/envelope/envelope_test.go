@@ -0,0 +1,188 @@
+package envelope
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var uuidV4 = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestNewID(t *testing.T) {
+	seen := make(map[string]bool)
+
+	for i := 0; i < 1000; i++ {
+		id := NewID()
+		if !uuidV4.MatchString(id) {
+			t.Fatalf("%q is not a version 4 UUID", id)
+		}
+		if seen[id] {
+			t.Fatalf("%s came up twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	e, err := Encode("log", "1", "test", LogData{Name: "event", Data: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e.SpecVersion != SpecVersion || e.Legacy() || !uuidV4.MatchString(e.ID) || e.Time.IsZero() {
+		t.Errorf("encoded %+v, want a full envelope", e)
+	}
+
+	data, err := Decode[LogData](e)
+	if err != nil || data != (LogData{Name: "event", Data: "hello"}) {
+		t.Errorf("decoded %+v, %v, want the data back", data, err)
+	}
+
+	if _, err := Encode("", "1", "test", LogData{}); err != ErrMissingType {
+		t.Errorf("encoding without a type returned %v, want %v", err, ErrMissingType)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"no data", ""},
+		{"data of another schema", `"just a string"`},
+		{"wrong field type", `{"name": 1}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := Envelope{ID: "1", Type: "log", Data: json.RawMessage(tt.data)}
+
+			_, err := Decode[LogData](e)
+			if err == nil {
+				t.Fatal("decoded without an error")
+			}
+			if !strings.Contains(err.Error(), "log event 1") {
+				t.Errorf("error %q doesn't name the event", err)
+			}
+		})
+	}
+}
+
+func TestFromDelivery(t *testing.T) {
+	sent := time.Date(2025, 4, 30, 10, 0, 0, 0, time.UTC)
+
+	enveloped, err := Encode("log", "1", "broker-service", LogData{Name: "event", Data: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishing, err := enveloped.Publishing()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		delivery amqp.Delivery
+		want     Envelope // * the ID is checked only when set
+		newID    bool
+	}{
+		{
+			name:     "envelope",
+			delivery: amqp.Delivery{Body: publishing.Body, MessageId: "ignored", Type: "ignored"},
+			want:     enveloped,
+		},
+		{
+			name: "bare payload",
+			delivery: amqp.Delivery{
+				Body:      []byte(` {"name": "event", "data": "hello"} `),
+				MessageId: "legacy-1",
+				Type:      "log",
+				AppId:     "old-broker",
+				Timestamp: sent,
+			},
+			want: Envelope{ID: "legacy-1", Type: "log", Version: LegacyVersion, Source: "old-broker", Time: sent, Data: json.RawMessage(`{"name": "event", "data": "hello"}`)},
+		},
+		{
+			name:     "bare payload without properties",
+			delivery: amqp.Delivery{Body: []byte(`{"name": "event"}`)},
+			want:     Envelope{Version: LegacyVersion, Data: json.RawMessage(`{"name": "event"}`)},
+			newID:    true,
+		},
+		{
+			name:     "bare array",
+			delivery: amqp.Delivery{Body: []byte(`[1, 2]`), Type: "log"},
+			want:     Envelope{Type: "log", Version: LegacyVersion, Data: json.RawMessage(`[1, 2]`)},
+			newID:    true,
+		},
+		{
+			name:     "envelope without an id",
+			delivery: amqp.Delivery{Body: []byte(`{"specversion": "1.0", "type": "log", "data": {}}`), MessageId: "from-properties"},
+			want:     Envelope{SpecVersion: "1.0", ID: "from-properties", Type: "log", Data: json.RawMessage(`{}`)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FromDelivery(tt.delivery)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.newID && !uuidV4.MatchString(got.ID) {
+				t.Errorf("id is %q, want a new one", got.ID)
+			}
+			if !tt.newID && got.ID != tt.want.ID {
+				t.Errorf("id is %q, want %q", got.ID, tt.want.ID)
+			}
+
+			if got.Legacy() != (tt.want.SpecVersion == "") {
+				t.Errorf("legacy is %v, want %v", got.Legacy(), tt.want.SpecVersion == "")
+			}
+			if got.Type != tt.want.Type || got.Version != tt.want.Version || got.Source != tt.want.Source {
+				t.Errorf("got %s %s from %s, want %s %s from %s", got.Type, got.Version, got.Source, tt.want.Type, tt.want.Version, tt.want.Source)
+			}
+			if string(got.Data) != string(tt.want.Data) {
+				t.Errorf("data is %s, want %s", got.Data, tt.want.Data)
+			}
+
+			// * a missing time becomes the time of reading
+			if !tt.want.Time.IsZero() && !got.Time.Equal(tt.want.Time) {
+				t.Errorf("time is %s, want %s", got.Time, tt.want.Time)
+			}
+			if got.Time.IsZero() {
+				t.Error("time is not set")
+			}
+		})
+	}
+}
+
+func TestFromDeliveryRejectsInvalidJSON(t *testing.T) {
+	for _, body := range []string{"", "hello", `{"name": `} {
+		if _, err := FromDelivery(amqp.Delivery{Body: []byte(body)}); err == nil {
+			t.Errorf("read %q without an error", body)
+		}
+	}
+}
+
+func TestPublishing(t *testing.T) {
+	e, err := Encode("log", "1", "broker-service", LogData{Name: "event"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := e.Publishing()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.MessageId != e.ID || p.Type != e.Type || p.AppId != e.Source || !p.Timestamp.Equal(e.Time) {
+		t.Errorf("properties %s %s %s %s don't mirror the envelope", p.MessageId, p.Type, p.AppId, p.Timestamp)
+	}
+	if p.ContentType != ContentType || p.DeliveryMode != amqp.Persistent {
+		t.Errorf("published as %s with delivery mode %d", p.ContentType, p.DeliveryMode)
+	}
+}
@@ -0,0 +1,83 @@
+package envelope
+
+import "time"
+
+// NOTE: Event schemas
+/*
+	The `data` of each event type, shared by whoever publishes and consumes it.
+	Bump the envelope's `version` when a schema changes incompatibly.
+*/
+
+// LogData is the schema of `log` events.
+type LogData struct {
+	Name string `json:"name"`
+	Data string `json:"data"`
+}
+
+// MailData is the schema of `mail.send` events. Template picks the mail's
+// templates in mail-service, `mail` when empty, and Fields fills them in next
+// to Message.
+type MailData struct {
+	From     string            `json:"from"`
+	To       string            `json:"to"`
+	Subject  string            `json:"subject"`
+	Message  string            `json:"message"`
+	Template string            `json:"template,omitempty"`
+	Fields   map[string]string `json:"fields,omitempty"`
+}
+
+// MailResultData is the schema of `mail.sent` and `mail.failed` events.
+// RequestID is the ID of the `mail.send` event it answers.
+type MailResultData struct {
+	RequestID string `json:"request_id"`
+	To        string `json:"to"`
+	Subject   string `json:"subject"`
+	Error     string `json:"error,omitempty"`
+}
+
+// UserData is the schema of `user.created`, `user.updated`, `user.deleted`,
+// `user.verified` and `user.password.reset` events.
+type UserData struct {
+	ID        int    `json:"id"`
+	Email     string `json:"email,omitempty"`
+	FirstName string `json:"first_name,omitempty"`
+	LastName  string `json:"last_name,omitempty"`
+	Active    int    `json:"active"`
+}
+
+// LockoutData is the schema of `user.locked` and `user.unlocked` events.
+// Unlocking leaves IP, Failures and LockedUntil empty.
+type LockoutData struct {
+	UserID      int        `json:"user_id"`
+	Email       string     `json:"email"`
+	IP          string     `json:"ip,omitempty"`
+	Failures    int        `json:"failures,omitempty"`
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+}
+
+// RoleData is the schema of `user.role.assigned` and `user.role.revoked`
+// events.
+type RoleData struct {
+	UserID int    `json:"user_id"`
+	Role   string `json:"role"`
+}
+
+// APIKeyData is the schema of `apikey.created` and `apikey.revoked` events.
+// A key has either UserID or Service.
+type APIKeyData struct {
+	ID      int64    `json:"id"`
+	Prefix  string   `json:"prefix"`
+	Name    string   `json:"name,omitempty"`
+	UserID  int      `json:"user_id,omitempty"`
+	Service string   `json:"service,omitempty"`
+	Scopes  []string `json:"scopes"`
+}
+
+// LoginData is the schema of `user.login.succeeded` and `user.login.failed`
+// events. UserID is empty when the email doesn't belong to any user.
+type LoginData struct {
+	UserID int    `json:"user_id,omitempty"`
+	Email  string `json:"email"`
+	IP     string `json:"ip,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
@@ -0,0 +1,195 @@
+package topology
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var errNotFound = errors.New("not found")
+
+// Management reads the live topology from the RabbitMQ management API. AMQP
+// can only tell whether something exists, not how it was declared.
+type Management struct {
+	URL      string // * e.g. http://rabbitmq:15672
+	Username string
+	Password string
+	VHost    string
+	client   *http.Client
+}
+
+func NewManagement(baseURL, username, password string) *Management {
+	return &Management{
+		URL:      baseURL,
+		Username: username,
+		Password: password,
+		VHost:    "/",
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type liveExchange struct {
+	Type       string     `json:"type"`
+	Durable    bool       `json:"durable"`
+	AutoDelete bool       `json:"auto_delete"`
+	Internal   bool       `json:"internal"`
+	Arguments  amqp.Table `json:"arguments"`
+}
+
+type liveQueue struct {
+	Durable    bool       `json:"durable"`
+	AutoDelete bool       `json:"auto_delete"`
+	Exclusive  bool       `json:"exclusive"`
+	Arguments  amqp.Table `json:"arguments"`
+}
+
+type liveBinding struct {
+	RoutingKey string     `json:"routing_key"`
+	Arguments  amqp.Table `json:"arguments"`
+}
+
+func (m *Management) get(ctx context.Context, path string, v any) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, m.URL+"/api/"+path, nil)
+	if err != nil {
+		return err
+	}
+	request.SetBasicAuth(m.Username, m.Password)
+
+	response, err := m.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		return errNotFound
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("management API responded to %s with %s", path, response.Status)
+	}
+
+	return json.NewDecoder(response.Body).Decode(v)
+}
+
+// Diff lists how the live broker differs from the topology: what is missing
+// and what was declared with other flags or arguments. Anything the file
+// doesn't mention, e.g. bindings added at runtime, is ignored. An empty
+// result means the broker matches.
+func (t *Topology) Diff(ctx context.Context, m *Management) ([]string, error) {
+	var diffs []string
+	vhost := url.PathEscape(m.VHost)
+
+	for _, e := range t.Exchanges {
+		var live liveExchange
+
+		err := m.get(ctx, fmt.Sprintf("exchanges/%s/%s", vhost, url.PathEscape(e.Name)), &live)
+		if errors.Is(err, errNotFound) {
+			diffs = append(diffs, fmt.Sprintf("exchange %s: missing", e.Name))
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		prefix := "exchange " + e.Name
+		diffs = compare(diffs, prefix, "type", e.Type, live.Type)
+		diffs = compare(diffs, prefix, "durable", e.Durable, live.Durable)
+		diffs = compare(diffs, prefix, "auto_delete", e.AutoDelete, live.AutoDelete)
+		diffs = compare(diffs, prefix, "internal", e.Internal, live.Internal)
+		diffs = compareArgs(diffs, prefix, e.Arguments, live.Arguments)
+	}
+
+	for _, q := range t.Queues {
+		var live liveQueue
+
+		err := m.get(ctx, fmt.Sprintf("queues/%s/%s", vhost, url.PathEscape(q.Name)), &live)
+		if errors.Is(err, errNotFound) {
+			diffs = append(diffs, fmt.Sprintf("queue %s: missing", q.Name))
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		prefix := "queue " + q.Name
+		diffs = compare(diffs, prefix, "durable", q.Durable, live.Durable)
+		diffs = compare(diffs, prefix, "auto_delete", q.AutoDelete, live.AutoDelete)
+		diffs = compare(diffs, prefix, "exclusive", q.Exclusive, live.Exclusive)
+		diffs = compareArgs(diffs, prefix, q.Args(), live.Arguments)
+	}
+
+	for _, b := range t.Bindings {
+		var live []liveBinding
+
+		path := fmt.Sprintf("bindings/%s/e/%s/q/%s", vhost, url.PathEscape(b.Exchange), url.PathEscape(b.Queue))
+		err := m.get(ctx, path, &live)
+		if err != nil && !errors.Is(err, errNotFound) {
+			return nil, err
+		}
+
+		found := false
+		for _, l := range live {
+			if l.RoutingKey == b.RoutingKey && len(compareArgs(nil, "", b.Arguments, l.Arguments)) == 0 {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			diffs = append(diffs, fmt.Sprintf("binding %s -> %s [%s] %v: missing", b.Exchange, b.Queue, b.RoutingKey, b.Arguments))
+		}
+	}
+
+	return diffs, nil
+}
+
+func compare[T comparable](diffs []string, prefix, field string, want, got T) []string {
+	if want == got {
+		return diffs
+	}
+
+	return append(diffs, fmt.Sprintf("%s: %s is %v, file says %v", prefix, field, got, want))
+}
+
+func compareArgs(diffs []string, prefix string, want, got amqp.Table) []string {
+	normalize(got)
+
+	keys := make(map[string]bool)
+	for key := range want {
+		keys[key] = true
+	}
+	for key := range got {
+		keys[key] = true
+	}
+
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	for _, key := range sorted {
+		// * compare the printed values, so int and int64 from the file match
+		w, inFile := want[key]
+		g, live := got[key]
+
+		switch {
+		case !live:
+			diffs = append(diffs, fmt.Sprintf("%s: argument %s is not set, file says %v", prefix, key, w))
+		case !inFile:
+			diffs = append(diffs, fmt.Sprintf("%s: argument %s is %v, file doesn't set it", prefix, key, g))
+		case fmt.Sprint(w) != fmt.Sprint(g):
+			diffs = append(diffs, fmt.Sprintf("%s: argument %s is %v, file says %v", prefix, key, g, w))
+		}
+	}
+
+	return diffs
+}
@@ -0,0 +1,117 @@
+package topology
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// managementAPI answers like the RabbitMQ management API, with the responses
+// by escaped path, and 404 for anything else.
+func managementAPI(t *testing.T, responses map[string]string) *Management {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "guest" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		body, ok := responses[strings.TrimPrefix(r.URL.EscapedPath(), "/api/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+
+	return NewManagement(server.URL, "guest", "secret")
+}
+
+func TestDiff(t *testing.T) {
+	topo, err := Parse([]byte(`{
+		"exchanges": [
+			{ "name": "events", "type": "topic", "durable": true },
+			{ "name": "retry", "type": "headers", "durable": true }
+		],
+		"queues": [
+			{ "name": "work", "durable": true, "max_length": 100 },
+			{ "name": "delayed", "durable": true, "message_ttl": "5s", "dead_letter_exchange": "events" },
+			{ "name": "gone", "durable": true }
+		],
+		"bindings": [
+			{ "queue": "work", "exchange": "events", "routing_key": "work" },
+			{ "queue": "work", "exchange": "events", "routing_key": "other" },
+			{ "queue": "delayed", "exchange": "retry", "arguments": { "x-match": "all", "tier": "5s" } }
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := managementAPI(t, map[string]string{
+		"exchanges/%2F/events": `{"name": "events", "type": "topic", "durable": true, "auto_delete": false, "internal": false, "arguments": {}}`,
+		"exchanges/%2F/retry":  `{"name": "retry", "type": "fanout", "durable": false, "auto_delete": false, "internal": false, "arguments": {}}`,
+		"queues/%2F/work":      `{"name": "work", "durable": true, "auto_delete": false, "exclusive": false, "arguments": {"x-max-length": 50}}`,
+		"queues/%2F/delayed": `{"name": "delayed", "durable": true, "auto_delete": false, "exclusive": false,
+			"arguments": {"x-message-ttl": 5000, "x-dead-letter-exchange": "events", "x-queue-type": "classic"}}`,
+		"bindings/%2F/e/events/q/work": `[
+			{"source": "events", "destination": "work", "routing_key": "work", "arguments": {}},
+			{"source": "events", "destination": "work", "routing_key": "added.at.runtime", "arguments": {}}
+		]`,
+		"bindings/%2F/e/retry/q/delayed": `[{"source": "retry", "destination": "delayed", "routing_key": "", "arguments": {"tier": "5s", "x-match": "all"}}]`,
+	})
+
+	diffs, err := topo.Diff(context.Background(), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"exchange retry: type is fanout, file says headers",
+		"exchange retry: durable is false, file says true",
+		"queue work: argument x-max-length is 50, file says 100",
+		"queue delayed: argument x-queue-type is classic, file doesn't set it",
+		"queue gone: missing",
+		"binding events -> work [other] map[]: missing",
+	}
+	if !slices.Equal(diffs, want) {
+		t.Errorf("diffs are\n%s\nwant\n%s", strings.Join(diffs, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestDiffMatches(t *testing.T) {
+	topo, err := Parse([]byte(`{"queues": [{ "name": "work", "durable": true, "message_ttl": "30s" }]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := managementAPI(t, map[string]string{
+		"queues/%2F/work": `{"durable": true, "auto_delete": false, "exclusive": false, "arguments": {"x-message-ttl": 30000}}`,
+	})
+
+	diffs, err := topo.Diff(context.Background(), m)
+	if err != nil || len(diffs) != 0 {
+		t.Errorf("diff is %v, %v, want nothing", diffs, err)
+	}
+}
+
+func TestDiffFails(t *testing.T) {
+	topo, err := Parse([]byte(`{"queues": [{ "name": "work" }]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := managementAPI(t, nil)
+	m.Password = "wrong"
+
+	if diffs, err := topo.Diff(context.Background(), m); err == nil {
+		t.Errorf("diff with wrong credentials is %v, want an error rather than everything missing", diffs)
+	}
+}
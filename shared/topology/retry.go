@@ -0,0 +1,102 @@
+package topology
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// NOTE: Retries
+/*
+	A message a service couldn't handle yet is published to logs_retry with
+	a `retry-tier` header, which routes it to the retry queue of that tier,
+	`logs_retry_<tier>`. Once the queue's TTL expires RabbitMQ dead-letters
+	it to logs_requeue, which routes it by its `retry-queue` header back to
+	the one queue it failed in. Every queue that retries binds itself to
+	logs_requeue with BindRequeue when it starts consuming.
+
+	Headers exchanges leave out headers starting with `x-` when matching, so
+	neither header has the prefix.
+*/
+
+const (
+	RetryQueuePrefix = "logs_retry_" // * retry queues are named `logs_retry_<tier>`
+	RetryTierHeader  = "retry-tier"  // * picks the retry queue
+	RetryQueueHeader = "retry-queue" // * the queue to come back to
+)
+
+// RetryTiers are the delays between attempts, the first retry waits for the
+// first one. A message that used every tier is given up on.
+var RetryTiers = []time.Duration{
+	5 * time.Second,
+	30 * time.Second,
+	5 * time.Minute,
+}
+
+// TierName is how a tier appears in the retry-tier header and in the name of
+// its queue, like `30s` or `5m`.
+func TierName(ttl time.Duration) string {
+	if ttl%time.Minute == 0 {
+		return fmt.Sprintf("%dm", int(ttl.Minutes()))
+	}
+
+	return fmt.Sprintf("%ds", int(ttl.Seconds()))
+}
+
+// CheckRetryQueues makes sure the topology has a retry queue for every tier,
+// otherwise retried messages would silently go nowhere.
+func (t *Topology) CheckRetryQueues() error {
+	for _, ttl := range RetryTiers {
+		name := RetryQueuePrefix + TierName(ttl)
+
+		q, ok := t.Queue(name)
+		if !ok {
+			return fmt.Errorf("topology has no retry queue %s", name)
+		}
+
+		if time.Duration(q.MessageTTL) != ttl || q.DeadLetterExchange != RequeueExchange {
+			return fmt.Errorf("retry queue %s must have a %s TTL and dead-letter to %s", name, TierName(ttl), RequeueExchange)
+		}
+	}
+
+	return nil
+}
+
+// BindRequeue routes retried messages that failed in the queue back to it.
+func BindRequeue(ch Declarer, queue string) error {
+	return ch.QueueBind(queue, "", RequeueExchange, false, amqp.Table{
+		"x-match":        "all",
+		RetryQueueHeader: queue,
+	})
+}
+
+// Attempts counts how many times a message already went through a retry
+// queue, using the `x-death` header RabbitMQ maintains when dead-lettering.
+// Unlike the redelivered flag, it isn't set by a restart of the broker or a
+// service.
+func Attempts(headers amqp.Table) int {
+	deaths, ok := headers["x-death"].([]any)
+	if !ok {
+		return 0
+	}
+
+	total := 0
+	for _, d := range deaths {
+		death, ok := d.(amqp.Table)
+		if !ok {
+			continue
+		}
+
+		queue, _ := death["queue"].(string)
+		if !strings.HasPrefix(queue, RetryQueuePrefix) {
+			continue
+		}
+
+		count, _ := death["count"].(int64)
+		total += int(count)
+	}
+
+	return total
+}
@@ -0,0 +1,98 @@
+package topology
+
+import (
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestTierName(t *testing.T) {
+	tests := []struct {
+		ttl  time.Duration
+		want string
+	}{
+		{5 * time.Second, "5s"},
+		{90 * time.Second, "90s"},
+		{5 * time.Minute, "5m"},
+		{time.Hour, "60m"},
+	}
+
+	for _, tt := range tests {
+		if got := TierName(tt.ttl); got != tt.want {
+			t.Errorf("TierName(%s) = %s, want %s", tt.ttl, got, tt.want)
+		}
+	}
+}
+
+func TestAttempts(t *testing.T) {
+	death := func(queue string, count int64) amqp.Table {
+		return amqp.Table{"queue": queue, "count": count}
+	}
+
+	tests := []struct {
+		name    string
+		headers amqp.Table
+		want    int
+	}{
+		{"first delivery", nil, 0},
+		{"redelivered after a restart", amqp.Table{}, 0},
+		{"one retry", amqp.Table{"x-death": []any{death("logs_retry_5s", 1)}}, 1},
+		{"every tier", amqp.Table{"x-death": []any{death("logs_retry_5s", 1), death("logs_retry_30s", 1), death("logs_retry_5m", 1)}}, 3},
+		{"same tier twice", amqp.Table{"x-death": []any{death("logs_retry_5s", 2)}}, 2},
+		{"other dead letters", amqp.Table{"x-death": []any{death("mail.send", 2), death("logs_retry_5s", 1)}}, 1},
+		{"not a list", amqp.Table{"x-death": "logs_retry_5s"}, 0},
+	}
+
+	for _, tt := range tests {
+		if got := Attempts(tt.headers); got != tt.want {
+			t.Errorf("%s: Attempts = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckRetryQueues(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		ok      bool
+	}{
+		{"embedded topology", string(defaultTopology), true},
+		{"missing tier", `{
+			"exchanges": [{"name": "logs_requeue", "type": "headers"}],
+			"queues": [
+				{"name": "logs_retry_5s", "message_ttl": "5s", "dead_letter_exchange": "logs_requeue"},
+				{"name": "logs_retry_30s", "message_ttl": "30s", "dead_letter_exchange": "logs_requeue"}
+			]
+		}`, false},
+		{"wrong TTL", `{
+			"exchanges": [{"name": "logs_requeue", "type": "headers"}],
+			"queues": [
+				{"name": "logs_retry_5s", "message_ttl": "10s", "dead_letter_exchange": "logs_requeue"},
+				{"name": "logs_retry_30s", "message_ttl": "30s", "dead_letter_exchange": "logs_requeue"},
+				{"name": "logs_retry_5m", "message_ttl": "5m", "dead_letter_exchange": "logs_requeue"}
+			]
+		}`, false},
+		{"dead-letters elsewhere", `{
+			"exchanges": [{"name": "logs_topic", "type": "topic"}],
+			"queues": [
+				{"name": "logs_retry_5s", "message_ttl": "5s", "dead_letter_exchange": "logs_topic"},
+				{"name": "logs_retry_30s", "message_ttl": "30s", "dead_letter_exchange": "logs_topic"},
+				{"name": "logs_retry_5m", "message_ttl": "5m", "dead_letter_exchange": "logs_topic"}
+			]
+		}`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			topo, err := Parse([]byte(tt.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := topo.CheckRetryQueues(); (err == nil) != tt.ok {
+				t.Errorf("CheckRetryQueues returned %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,286 @@
+package topology
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// NOTE: Topology file
+/*
+	Every exchange, queue and binding the services share is described in
+	`topology.json`, which is embedded in every binary. Set TOPOLOGY_FILE to
+	use another file, e.g. to try a change without rebuilding.
+
+	Services declare the whole topology when they connect, so it doesn't matter
+	which one starts first. Declaring something that already exists with
+	different flags or arguments fails with PRECONDITION_FAILED, use
+	`go run ./cmd/topology diff` to see what differs.
+*/
+
+// Names the services refer to in code.
+const (
+	EventsExchange  = "logs_topic"
+	RetryExchange   = "logs_retry"
+	RequeueExchange = "logs_requeue"
+)
+
+//go:embed topology.json
+var defaultTopology []byte
+
+type Topology struct {
+	Exchanges []Exchange `json:"exchanges"`
+	Queues    []Queue    `json:"queues"`
+	Bindings  []Binding  `json:"bindings"`
+}
+
+type Exchange struct {
+	Name       string     `json:"name"`
+	Type       string     `json:"type"`
+	Durable    bool       `json:"durable"`
+	AutoDelete bool       `json:"auto_delete"`
+	Internal   bool       `json:"internal"`
+	Arguments  amqp.Table `json:"arguments,omitempty"`
+}
+
+type Queue struct {
+	Name                 string     `json:"name"`
+	Durable              bool       `json:"durable"`
+	AutoDelete           bool       `json:"auto_delete"`
+	Exclusive            bool       `json:"exclusive"`
+	MessageTTL           Duration   `json:"message_ttl,omitempty"`
+	MaxLength            int        `json:"max_length,omitempty"`
+	Overflow             string     `json:"overflow,omitempty"` // * drop-head, reject-publish or reject-publish-dlx
+	DeadLetterExchange   string     `json:"dead_letter_exchange,omitempty"`
+	DeadLetterRoutingKey string     `json:"dead_letter_routing_key,omitempty"`
+	Arguments            amqp.Table `json:"arguments,omitempty"` // * any other `x-` argument
+}
+
+type Binding struct {
+	Queue      string     `json:"queue"`
+	Exchange   string     `json:"exchange"`
+	RoutingKey string     `json:"routing_key"`
+	Arguments  amqp.Table `json:"arguments,omitempty"`
+}
+
+// Duration reads durations like "30s" or "5m" from the file.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(parsed)
+
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Declarer is the part of *amqp.Channel needed to declare a topology.
+type Declarer interface {
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+}
+
+// Load reads the file named by TOPOLOGY_FILE, or the embedded default.
+func Load() (*Topology, error) {
+	content := defaultTopology
+
+	if path := os.Getenv("TOPOLOGY_FILE"); path != "" {
+		var err error
+		if content, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	return Parse(content)
+}
+
+func Parse(content []byte) (*Topology, error) {
+	var t Topology
+	if err := json.Unmarshal(content, &t); err != nil {
+		return nil, fmt.Errorf("reading topology: %w", err)
+	}
+
+	if err := t.validate(); err != nil {
+		return nil, err
+	}
+
+	// JSON numbers are float64, but RabbitMQ wants integers for things like TTLs
+	for _, e := range t.Exchanges {
+		normalize(e.Arguments)
+	}
+	for _, q := range t.Queues {
+		normalize(q.Arguments)
+	}
+	for _, b := range t.Bindings {
+		normalize(b.Arguments)
+	}
+
+	return &t, nil
+}
+
+func normalize(args amqp.Table) {
+	for key, value := range args {
+		if f, ok := value.(float64); ok && f == float64(int64(f)) {
+			args[key] = int64(f)
+		}
+	}
+}
+
+func (t *Topology) validate() error {
+	exchanges := make(map[string]bool)
+	for _, e := range t.Exchanges {
+		if e.Name == "" || e.Type == "" {
+			return errors.New("topology: exchanges need a name and a type")
+		}
+		if exchanges[e.Name] {
+			return fmt.Errorf("topology: exchange %s is declared twice", e.Name)
+		}
+		exchanges[e.Name] = true
+	}
+
+	queues := make(map[string]bool)
+	for _, q := range t.Queues {
+		if q.Name == "" {
+			return errors.New("topology: queues need a name")
+		}
+		if queues[q.Name] {
+			return fmt.Errorf("topology: queue %s is declared twice", q.Name)
+		}
+		queues[q.Name] = true
+
+		if q.DeadLetterExchange != "" && !exchanges[q.DeadLetterExchange] {
+			return fmt.Errorf("topology: queue %s dead-letters to unknown exchange %s", q.Name, q.DeadLetterExchange)
+		}
+	}
+
+	bindings := make(map[string]bool)
+	for _, b := range t.Bindings {
+		// * printed, so arguments in another order are the same binding
+		key := fmt.Sprint(b.Exchange, " ", b.Queue, " ", b.RoutingKey, " ", b.Arguments)
+		if bindings[key] {
+			return fmt.Errorf("topology: binding of %s to %s is declared twice", b.Queue, b.Exchange)
+		}
+		bindings[key] = true
+
+		if !exchanges[b.Exchange] {
+			return fmt.Errorf("topology: binding of %s to unknown exchange %s", b.Queue, b.Exchange)
+		}
+
+		if !queues[b.Queue] {
+			return fmt.Errorf("topology: binding of unknown queue %s", b.Queue)
+		}
+	}
+
+	return nil
+}
+
+// Declare loads the topology and applies it, for services that don't need
+// anything else from it.
+func Declare(ch Declarer) (*Topology, error) {
+	t, err := Load()
+	if err != nil {
+		return nil, err
+	}
+
+	return t, t.Apply(ch)
+}
+
+// Apply declares every exchange, then every queue, then every binding.
+func (t *Topology) Apply(ch Declarer) error {
+	for _, e := range t.Exchanges {
+		if err := DeclareExchange(ch, e); err != nil {
+			return fmt.Errorf("declaring exchange %s: %w", e.Name, err)
+		}
+	}
+
+	for _, q := range t.Queues {
+		if _, err := DeclareQueue(ch, q); err != nil {
+			return fmt.Errorf("declaring queue %s: %w", q.Name, err)
+		}
+	}
+
+	for _, b := range t.Bindings {
+		if err := ch.QueueBind(b.Queue, b.RoutingKey, b.Exchange, false, b.Arguments); err != nil {
+			return fmt.Errorf("binding %s to %s: %w", b.Queue, b.Exchange, err)
+		}
+	}
+
+	return nil
+}
+
+func DeclareExchange(ch Declarer, e Exchange) error {
+	return ch.ExchangeDeclare(e.Name, e.Type, e.Durable, e.AutoDelete, e.Internal, false, e.Arguments)
+}
+
+func DeclareQueue(ch Declarer, q Queue) (amqp.Queue, error) {
+	return ch.QueueDeclare(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, q.Args())
+}
+
+// DeclareTemporaryQueue declares an exclusive server-named queue, which is
+// deleted when the connection closes. Such queues are never in the file.
+func DeclareTemporaryQueue(ch Declarer) (amqp.Queue, error) {
+	return DeclareQueue(ch, Queue{Exclusive: true})
+}
+
+// Queue returns the queue with the name, if the file has it.
+func (t *Topology) Queue(name string) (Queue, bool) {
+	for _, q := range t.Queues {
+		if q.Name == name {
+			return q, true
+		}
+	}
+
+	return Queue{}, false
+}
+
+// Args merges the named settings into the queue's `x-` arguments.
+func (q Queue) Args() amqp.Table {
+	args := amqp.Table{}
+	for key, value := range q.Arguments {
+		args[key] = value
+	}
+
+	if q.MessageTTL > 0 {
+		args["x-message-ttl"] = time.Duration(q.MessageTTL).Milliseconds()
+	}
+
+	if q.MaxLength > 0 {
+		args["x-max-length"] = int64(q.MaxLength)
+	}
+
+	if q.Overflow != "" {
+		args["x-overflow"] = q.Overflow
+	}
+
+	if q.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = q.DeadLetterExchange
+	}
+
+	if q.DeadLetterRoutingKey != "" {
+		args["x-dead-letter-routing-key"] = q.DeadLetterRoutingKey
+	}
+
+	if len(args) == 0 {
+		return nil
+	}
+
+	return args
+}
@@ -0,0 +1,163 @@
+package topology
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	content := `{
+		"exchanges": [{ "name": "events", "type": "topic", "durable": true }],
+		"queues": [{
+			"name": "work", "durable": true, "message_ttl": "30s", "max_length": 100,
+			"dead_letter_exchange": "events", "arguments": { "x-max-priority": 10, "x-queue-mode": "lazy" }
+		}],
+		"bindings": [{ "queue": "work", "exchange": "events", "routing_key": "work.#", "arguments": { "x-weight": 2.5 } }]
+	}`
+
+	topo, err := Parse([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q, ok := topo.Queue("work")
+	if !ok {
+		t.Fatal("queue work is missing")
+	}
+	if time.Duration(q.MessageTTL) != 30*time.Second {
+		t.Errorf("message ttl is %s, want 30s", time.Duration(q.MessageTTL))
+	}
+
+	args := q.Args()
+	want := map[string]any{
+		"x-message-ttl":          int64(30000),
+		"x-max-length":           int64(100),
+		"x-dead-letter-exchange": "events",
+		"x-max-priority":         int64(10), // * a whole JSON number becomes an integer
+		"x-queue-mode":           "lazy",
+	}
+	if len(args) != len(want) {
+		t.Errorf("arguments are %v, want %v", args, want)
+	}
+	for key, value := range want {
+		if args[key] != value {
+			t.Errorf("argument %s is %v (%T), want %v (%T)", key, args[key], args[key], value, value)
+		}
+	}
+
+	if weight := topo.Bindings[0].Arguments["x-weight"]; weight != 2.5 {
+		t.Errorf("x-weight is %v (%T), want 2.5 left a float", weight, weight)
+	}
+
+	if _, ok := topo.Queue("other"); ok {
+		t.Error("found a queue the file doesn't have")
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"invalid JSON", `{"exchanges": [`, "reading topology"},
+		{"invalid duration", `{"queues": [{"name": "q", "message_ttl": "soon"}]}`, "reading topology"},
+		{"exchange without a type", `{"exchanges": [{"name": "e"}]}`, "need a name and a type"},
+		{"exchange without a name", `{"exchanges": [{"type": "topic"}]}`, "need a name and a type"},
+		{"queue without a name", `{"queues": [{"durable": true}]}`, "need a name"},
+		{
+			"dead-letters to an unknown exchange",
+			`{"queues": [{"name": "q", "dead_letter_exchange": "gone"}]}`,
+			"queue q dead-letters to unknown exchange gone",
+		},
+		{
+			"binding to an unknown exchange",
+			`{"queues": [{"name": "q"}], "bindings": [{"queue": "q", "exchange": "gone"}]}`,
+			"binding of q to unknown exchange gone",
+		},
+		{
+			"binding of an unknown queue",
+			`{"exchanges": [{"name": "e", "type": "topic"}], "bindings": [{"queue": "gone", "exchange": "e"}]}`,
+			"binding of unknown queue gone",
+		},
+		{
+			"exchange declared twice",
+			`{"exchanges": [{"name": "e", "type": "topic"}, {"name": "e", "type": "fanout"}]}`,
+			"exchange e is declared twice",
+		},
+		{
+			"queue declared twice",
+			`{"queues": [{"name": "q", "durable": true}, {"name": "q"}]}`,
+			"queue q is declared twice",
+		},
+		{
+			"binding declared twice",
+			`{"exchanges": [{"name": "e", "type": "headers"}], "queues": [{"name": "q"}], "bindings": [
+				{"queue": "q", "exchange": "e", "arguments": {"x-match": "all", "tier": "5s"}},
+				{"queue": "q", "exchange": "e", "arguments": {"tier": "5s", "x-match": "all"}}
+			]}`,
+			"binding of q to e is declared twice",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parsing returned %v, want an error with %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestParseAllowsBindingsThatDiffer(t *testing.T) {
+	content := `{"exchanges": [{"name": "e", "type": "headers"}], "queues": [{"name": "q"}], "bindings": [
+		{"queue": "q", "exchange": "e", "arguments": {"x-match": "all", "tier": "5s"}},
+		{"queue": "q", "exchange": "e", "arguments": {"x-match": "all", "tier": "30s"}},
+		{"queue": "q", "exchange": "e", "routing_key": "other"}
+	]}`
+
+	if _, err := Parse([]byte(content)); err != nil {
+		t.Errorf("parsing returned %v", err)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	t.Setenv("TOPOLOGY_FILE", "")
+
+	topo, err := Load()
+	if err != nil {
+		t.Fatalf("the embedded topology doesn't load: %v", err)
+	}
+	for _, name := range []string{EventsExchange, RetryExchange, RequeueExchange} {
+		found := false
+		for _, e := range topo.Exchanges {
+			found = found || e.Name == name
+		}
+		if !found {
+			t.Errorf("the embedded topology has no exchange %s", name)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "topology.json")
+	if err := os.WriteFile(path, []byte(`{"queues": [{"name": "only"}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TOPOLOGY_FILE", path)
+
+	topo, err = Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(topo.Queues) != 1 || topo.Queues[0].Name != "only" {
+		t.Errorf("loaded %+v, want the file TOPOLOGY_FILE names", topo)
+	}
+
+	t.Setenv("TOPOLOGY_FILE", filepath.Join(t.TempDir(), "missing.json"))
+	if _, err := Load(); err == nil {
+		t.Error("loaded a file that doesn't exist")
+	}
+}